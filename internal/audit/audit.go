@@ -0,0 +1,85 @@
+// Package audit describes the security events of accounts. The user service
+// keeps them, the other services send theirs over NATS.
+package audit
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+)
+
+// Subject carries the events recorded outside of the user service.
+const Subject = "audit.events"
+
+type Type string
+
+const (
+	LoginSucceeded   Type = "login.succeeded"
+	LoginFailed      Type = "login.failed"
+	AccountLocked    Type = "account.locked"
+	Logout           Type = "logout"
+	SessionRevoked   Type = "session.revoked"
+	PasswordChanged  Type = "password.changed"
+	PasswordReset    Type = "password.reset"
+	PasskeyAdded     Type = "passkey.registered"
+	PasskeyDeleted   Type = "passkey.deleted"
+	TOTPEnabled      Type = "totp.enabled"
+	TOTPDisabled     Type = "totp.disabled"
+	IdentityLinked   Type = "identity.linked"
+	IdentityUnlinked Type = "identity.unlinked"
+	RolesChanged     Type = "roles.changed"
+	AccountDeleted   Type = "account.deleted"
+	// TokenRejected is a revoked token or one issued for another purpose
+	// that was used to authenticate, expired tokens are not recorded.
+	TokenRejected Type = "token.rejected"
+	// AccessDenied is a request that lacked the required role.
+	AccessDenied Type = "access.denied"
+)
+
+// Event is a security relevant action on an account. UserID is uuid.Nil if the
+// account is not known, e.g. for a login with an unknown email. ActorID is set
+// if someone else acted on the account, like an admin changing roles.
+type Event struct {
+	ID        uuid.UUID         `bson:"_id"                 json:"id"`
+	Type      Type              `bson:"type"                json:"type"`
+	UserID    uuid.UUID         `bson:"userId"              json:"userId"`
+	ActorID   uuid.UUID         `bson:"actorId,omitempty"   json:"actorId,omitempty"`
+	IP        string            `bson:"ip,omitempty"        json:"ip,omitempty"`
+	UserAgent string            `bson:"userAgent,omitempty" json:"userAgent,omitempty"`
+	Service   string            `bson:"service"             json:"service"`
+	Details   map[string]string `bson:"details,omitempty"   json:"details,omitempty"`
+	CreatedAt time.Time         `bson:"createdAt"           json:"createdAt"`
+	ExpiresAt time.Time         `bson:"expiresAt"           json:"-"`
+}
+
+// Publisher sends events, it is implemented by *nats.Conn.
+type Publisher interface {
+	Publish(subject string, data []byte) error
+}
+
+// Publish sends an event to the user service to be recorded.
+func Publish(conn Publisher, event Event) error {
+	if event.CreatedAt.IsZero() {
+		event.CreatedAt = time.Now()
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return conn.Publish(Subject, data)
+}
+
+// Subscribe calls record for every event published by another service.
+func Subscribe(conn *nats.Conn, record func(Event)) (*nats.Subscription, error) {
+	return conn.Subscribe(Subject, func(msg *nats.Msg) {
+		var event Event
+		if err := json.Unmarshal(msg.Data, &event); err != nil || event.Type == "" {
+			log.Println("Failed to decode audit event:", err)
+			return
+		}
+		record(event)
+	})
+}
@@ -0,0 +1,220 @@
+// Package blocking shares the users blocked in the user service with the
+// services that have to keep blocked users apart.
+package blocking
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// ChangedSubject carries an Event whenever a user blocks or unblocks someone.
+	ChangedSubject = "user.blocked"
+	// ListSubject is requested for all blocks, it is answered with a Snapshot.
+	ListSubject = "user.blocks"
+)
+
+const (
+	// SyncRetryDelay is how long Follow waits before asking for the blocks
+	// again if the user service did not answer.
+	SyncRetryDelay = 30 * time.Second
+	// ResyncInterval is how often Follow asks for all blocks, so the list
+	// recovers from events that were lost.
+	ResyncInterval = 10 * time.Minute
+)
+
+type Block struct {
+	BlockerID uuid.UUID `json:"blockerId"`
+	BlockedID uuid.UUID `json:"blockedId"`
+}
+
+type Event struct {
+	Block
+	// Blocked is false if the block was lifted.
+	Blocked bool `json:"blocked"`
+}
+
+type Snapshot struct {
+	Blocks []Block `json:"blocks"`
+	Error  string  `json:"error,omitempty"`
+}
+
+// Publisher sends events, it is implemented by *nats.Conn.
+type Publisher interface {
+	Publish(subject string, data []byte) error
+}
+
+// Publish announces that a user blocked or unblocked someone.
+func Publish(conn Publisher, event Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return conn.Publish(ChangedSubject, data)
+}
+
+// Respond answers requests for all blocks with the ones returned by list.
+func Respond(conn *nats.Conn, list func() ([]Block, error)) (*nats.Subscription, error) {
+	return conn.Subscribe(ListSubject, func(msg *nats.Msg) {
+		var snapshot Snapshot
+		blocks, err := list()
+		if err != nil {
+			log.Println("Failed to list blocks:", err)
+			snapshot.Error = err.Error()
+		}
+		snapshot.Blocks = blocks
+
+		reply, err := json.Marshal(snapshot)
+		if err != nil {
+			log.Println("Failed to encode blocks:", err)
+			return
+		}
+		if err := msg.Respond(reply); err != nil {
+			log.Println("Failed to send blocks:", err)
+		}
+	})
+}
+
+// List is a cached copy of the blocks in the user service.
+type List struct {
+	mu      sync.RWMutex
+	blocked map[uuid.UUID]map[uuid.UUID]struct{}
+	// syncing is set while a snapshot is requested, the events applied in the
+	// meantime are kept in pending and applied again on top of it.
+	syncing bool
+	pending []Event
+}
+
+func NewList() *List {
+	return &List{blocked: make(map[uuid.UUID]map[uuid.UUID]struct{})}
+}
+
+// Set replaces all blocks. Events applied since BeginSync may be missing in
+// the blocks, they are applied again.
+func (l *List) Set(blocks []Block) {
+	blocked := make(map[uuid.UUID]map[uuid.UUID]struct{})
+	for _, block := range blocks {
+		if blocked[block.BlockerID] == nil {
+			blocked[block.BlockerID] = make(map[uuid.UUID]struct{})
+		}
+		blocked[block.BlockerID][block.BlockedID] = struct{}{}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.blocked = blocked
+	for _, event := range l.pending {
+		l.apply(event)
+	}
+	l.syncing, l.pending = false, nil
+}
+
+// BeginSync is called before the blocks for Set are requested, the events
+// applied until then are kept.
+func (l *List) BeginSync() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.syncing, l.pending = true, nil
+}
+
+// AbortSync stops keeping events if the blocks could not be requested.
+func (l *List) AbortSync() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.syncing, l.pending = false, nil
+}
+
+// Apply adds or removes the block of an event.
+func (l *List) Apply(event Event) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.syncing {
+		l.pending = append(l.pending, event)
+	}
+	l.apply(event)
+}
+
+func (l *List) apply(event Event) {
+	if !event.Blocked {
+		delete(l.blocked[event.BlockerID], event.BlockedID)
+		return
+	}
+	if l.blocked[event.BlockerID] == nil {
+		l.blocked[event.BlockerID] = make(map[uuid.UUID]struct{})
+	}
+	l.blocked[event.BlockerID][event.BlockedID] = struct{}{}
+}
+
+// HasBlocked reports whether the blocker blocked the other user.
+func (l *List) HasBlocked(blockerID, blockedID uuid.UUID) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	_, ok := l.blocked[blockerID][blockedID]
+	return ok
+}
+
+// Between reports whether one of the users blocked the other. Blocked users
+// are kept apart in both directions, the blocker can not contact them either.
+func (l *List) Between(a, b uuid.UUID) bool {
+	return l.HasBlocked(a, b) || l.HasBlocked(b, a)
+}
+
+// Follow keeps the list up to date with the blocks of the user service. It
+// subscribes to changes first, so none are missed while the current blocks
+// are requested, and asks again in the background until the user service
+// answered. Afterwards all blocks are requested every ResyncInterval.
+func Follow(conn *nats.Conn, list *List, timeout time.Duration) (*nats.Subscription, error) {
+	sub, err := conn.Subscribe(ChangedSubject, func(msg *nats.Msg) {
+		var event Event
+		if err := json.Unmarshal(msg.Data, &event); err != nil || event.BlockerID == uuid.Nil || event.BlockedID == uuid.Nil {
+			log.Println("Failed to decode block:", err)
+			return
+		}
+		list.Apply(event)
+	})
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for {
+			if err := load(conn, list, timeout); err != nil {
+				log.Printf("Failed to load blocked users, retrying in %s: %v", SyncRetryDelay, err)
+				time.Sleep(SyncRetryDelay)
+				continue
+			}
+			time.Sleep(ResyncInterval)
+		}
+	}()
+	return sub, nil
+}
+
+func load(conn *nats.Conn, list *List, timeout time.Duration) error {
+	list.BeginSync()
+	blocks, err := request(conn, timeout)
+	if err != nil {
+		list.AbortSync()
+		return err
+	}
+	list.Set(blocks)
+	return nil
+}
+
+func request(conn *nats.Conn, timeout time.Duration) ([]Block, error) {
+	msg, err := conn.Request(ListSubject, nil, timeout)
+	if err != nil {
+		return nil, err
+	}
+	var snapshot Snapshot
+	if err := json.Unmarshal(msg.Data, &snapshot); err != nil {
+		return nil, err
+	}
+	if snapshot.Error != "" {
+		return nil, errors.New(snapshot.Error)
+	}
+	return snapshot.Blocks, nil
+}
@@ -0,0 +1,44 @@
+package blocking
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestList_Sync(t *testing.T) {
+	a, b, c := uuid.New(), uuid.New(), uuid.New()
+	list := NewList()
+	list.Apply(Event{Block: Block{BlockerID: a, BlockedID: c}, Blocked: true})
+
+	// events while the snapshot is requested may be missing in it
+	list.BeginSync()
+	list.Apply(Event{Block: Block{BlockerID: a, BlockedID: b}, Blocked: true})
+	list.Apply(Event{Block: Block{BlockerID: b, BlockedID: c}, Blocked: true})
+	list.Apply(Event{Block: Block{BlockerID: b, BlockedID: c}, Blocked: false})
+	list.Set([]Block{{BlockerID: b, BlockedID: c}})
+
+	if !list.HasBlocked(a, b) {
+		t.Errorf("block applied during the sync should be kept")
+	}
+	if list.HasBlocked(b, c) {
+		t.Errorf("block lifted during the sync should stay lifted")
+	}
+	if list.HasBlocked(a, c) {
+		t.Errorf("block missing in the snapshot should be removed")
+	}
+
+	// events are only kept during a sync
+	list.Apply(Event{Block: Block{BlockerID: c, BlockedID: a}, Blocked: true})
+	list.Set(nil)
+	if list.Between(a, c) {
+		t.Errorf("block applied before the sync should be replaced")
+	}
+	list.BeginSync()
+	list.Apply(Event{Block: Block{BlockerID: c, BlockedID: b}, Blocked: true})
+	list.AbortSync()
+	list.Set(nil)
+	if list.Between(b, c) {
+		t.Errorf("events of an aborted sync should not be applied again")
+	}
+}
@@ -0,0 +1,138 @@
+// Package breached checks passwords against a local list of passwords known
+// from data breaches, like the SHA-1 list of Have I Been Pwned. The list is
+// grouped by the first five hex digits of the hash the same way the
+// k-anonymity range API is, so a range file downloaded from it can be used
+// as is.
+package breached
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// PrefixLength is the number of hex digits a range is selected by.
+const PrefixLength = 5
+
+const hashLength = 2 * sha1.Size
+
+// List holds the suffixes of the breached hashes by their prefix.
+type List struct {
+	ranges map[string][]string
+	size   int
+}
+
+// Load reads a file with one SHA-1 hash per line or a directory of range
+// files named after their prefix, e.g. 5BAA6.txt, with one suffix per line.
+// Lines may carry a count after a colon as in the range API, empty lines and
+// lines starting with # are ignored.
+func Load(path string) (*List, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	list := &List{ranges: map[string][]string{}}
+	if !info.IsDir() {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		if err := list.read(file, ""); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		list.sort()
+		return list, nil
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		prefix := strings.ToUpper(strings.TrimSuffix(entry.Name(), filepath.Ext(entry.Name())))
+		if entry.IsDir() || !isHex(prefix, PrefixLength) {
+			continue
+		}
+		file, err := os.Open(filepath.Join(path, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		err = list.read(file, prefix)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", entry.Name(), err)
+		}
+	}
+	list.sort()
+	return list, nil
+}
+
+// Read reads a list of full hashes in the format of Load.
+func Read(r io.Reader) (*List, error) {
+	list := &List{ranges: map[string][]string{}}
+	if err := list.read(r, ""); err != nil {
+		return nil, err
+	}
+	list.sort()
+	return list, nil
+}
+
+// read adds the lines of r, which are suffixes of the prefix or full hashes
+// if the prefix is empty.
+func (l *List) read(r io.Reader, prefix string) error {
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		hash := strings.TrimSpace(scanner.Text())
+		if hash == "" || strings.HasPrefix(hash, "#") {
+			continue
+		}
+		hash, _, _ = strings.Cut(hash, ":")
+		hash = strings.ToUpper(prefix + hash)
+		if !isHex(hash, hashLength) {
+			return fmt.Errorf("line %d: not a SHA-1 hash", line)
+		}
+		l.ranges[hash[:PrefixLength]] = append(l.ranges[hash[:PrefixLength]], hash[PrefixLength:])
+	}
+	return scanner.Err()
+}
+
+func (l *List) sort() {
+	l.size = 0
+	for prefix, suffixes := range l.ranges {
+		slices.Sort(suffixes)
+		l.ranges[prefix] = slices.Compact(suffixes)
+		l.size += len(l.ranges[prefix])
+	}
+}
+
+// Len returns the number of hashes in the list.
+func (l *List) Len() int {
+	return l.size
+}
+
+// Contains reports whether the password is in the list.
+func (l *List) Contains(password string) bool {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	_, found := slices.BinarySearch(l.Range(hash[:PrefixLength]), hash[PrefixLength:])
+	return found
+}
+
+// Range returns the sorted suffixes of the hashes starting with the prefix.
+func (l *List) Range(prefix string) []string {
+	return l.ranges[strings.ToUpper(prefix)]
+}
+
+func isHex(s string, length int) bool {
+	if len(s) != length {
+		return false
+	}
+	return strings.Trim(s, "0123456789ABCDEFabcdef") == ""
+}
@@ -0,0 +1,51 @@
+package breached
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRead(t *testing.T) {
+	list, err := Read(strings.NewReader("# top passwords\n5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8:9545824\n\n7c4a8d09ca3762af61e59520943dc26494f8941b\n7C4A8D09CA3762AF61E59520943DC26494F8941B\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if list.Len() != 2 {
+		t.Errorf("expected duplicates to be removed but got %d hashes", list.Len())
+	}
+	for _, password := range []string{"password", "123456"} {
+		if !list.Contains(password) {
+			t.Errorf("expected %q to be breached", password)
+		}
+	}
+	if list.Contains("correct horse battery staple") {
+		t.Errorf("expected password not to be breached")
+	}
+
+	if _, err := Read(strings.NewReader("5BAA61E4\n")); err == nil {
+		t.Errorf("expected truncated hash to be rejected")
+	}
+}
+
+func TestLoad_Ranges(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "5BAA6.txt"), []byte("1E4C9B93F3F0682250B6CF8331B7EE68FD8:9545824\r\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "README"), []byte("not a range"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := Load(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !list.Contains("password") || list.Contains("123456") {
+		t.Errorf("unexpected ranges: %v", list.ranges)
+	}
+	if got := list.Range("5baa6"); len(got) != 1 {
+		t.Errorf("expected one suffix in the range but got %v", got)
+	}
+}
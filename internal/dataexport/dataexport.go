@@ -0,0 +1,82 @@
+// Package dataexport lets the user service collect the data other services
+// keep about a user, so it can be handed out to the user.
+package dataexport
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+)
+
+// SubjectPrefix is followed by the name of the service that is asked for the
+// data of a user.
+const SubjectPrefix = "user.export."
+
+type Request struct {
+	UserID uuid.UUID `json:"userId"`
+}
+
+type Response struct {
+	Data  json.RawMessage `json:"data,omitempty"`
+	Error string          `json:"error,omitempty"`
+}
+
+// Respond answers export requests for the given service with the data
+// returned by collect, encoded as json.
+func Respond(conn *nats.Conn, service string, collect func(userID uuid.UUID) (any, error)) (*nats.Subscription, error) {
+	return conn.Subscribe(SubjectPrefix+service, func(msg *nats.Msg) {
+		var response Response
+		var request Request
+		if err := json.Unmarshal(msg.Data, &request); err != nil || request.UserID == uuid.Nil {
+			response.Error = "invalid request"
+		} else if data, err := collect(request.UserID); err != nil {
+			log.Printf("Failed to collect data of user %s: %v", request.UserID, err)
+			response.Error = err.Error()
+		} else if response.Data, err = json.Marshal(data); err != nil {
+			response.Error = err.Error()
+		}
+
+		reply, err := json.Marshal(response)
+		if err != nil {
+			log.Println("Failed to encode export response:", err)
+			return
+		}
+		if err := msg.Respond(reply); err != nil {
+			log.Println("Failed to send export response:", err)
+		}
+	})
+}
+
+// Collector asks the services for the data of a user.
+type Collector struct {
+	conn    *nats.Conn
+	timeout time.Duration
+}
+
+func NewCollector(conn *nats.Conn, timeout time.Duration) *Collector {
+	return &Collector{conn: conn, timeout: timeout}
+}
+
+// Collect returns the json data the service keeps about the user.
+func (c *Collector) Collect(service string, userID uuid.UUID) (json.RawMessage, error) {
+	data, err := json.Marshal(Request{UserID: userID})
+	if err != nil {
+		return nil, err
+	}
+	msg, err := c.conn.Request(SubjectPrefix+service, data, c.timeout)
+	if err != nil {
+		return nil, err
+	}
+	var response Response
+	if err := json.Unmarshal(msg.Data, &response); err != nil {
+		return nil, err
+	}
+	if response.Error != "" {
+		return nil, errors.New(response.Error)
+	}
+	return response.Data, nil
+}
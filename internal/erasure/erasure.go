@@ -0,0 +1,105 @@
+// Package erasure connects the deletion of an account in the user service
+// with the services that keep data of the user.
+package erasure
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// DeletedSubject carries a UserDeleted event once an account was deleted.
+	DeletedSubject = "user.deleted"
+	// ReportSubject carries the Report of a service that handled a UserDeleted event.
+	ReportSubject = "user.deleted.report"
+)
+
+// Names of the services that erase data of deleted users.
+const (
+	ServiceOffers   = "angebot"
+	ServiceChat     = "chat"
+	ServiceRatings  = "rating"
+	ServiceTracking = "tracking"
+	ServiceMedia    = "media"
+)
+
+// Services are the services a deletion waits for.
+var Services = []string{ServiceOffers, ServiceChat, ServiceRatings, ServiceTracking, ServiceMedia}
+
+type Status string
+
+const (
+	StatusPending Status = "pending"
+	StatusDone    Status = "done"
+	StatusFailed  Status = "failed"
+)
+
+type UserDeleted struct {
+	UserID    uuid.UUID `json:"userId"`
+	DeletedAt time.Time `json:"deletedAt"`
+}
+
+type Report struct {
+	UserID  uuid.UUID `json:"userId"`
+	Service string    `json:"service"`
+	Status  Status    `json:"status"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// Publisher sends events, it is implemented by *nats.Conn.
+type Publisher interface {
+	Publish(subject string, data []byte) error
+}
+
+// Publish announces the deletion of a user. The event may be published again
+// until every service reported, handlers have to be idempotent.
+func Publish(conn Publisher, event UserDeleted) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return conn.Publish(DeletedSubject, data)
+}
+
+// Subscribe calls erase for every deleted user and reports the outcome as the
+// given service.
+func Subscribe(conn *nats.Conn, service string, erase func(userID uuid.UUID) error) (*nats.Subscription, error) {
+	return conn.Subscribe(DeletedSubject, func(msg *nats.Msg) {
+		var event UserDeleted
+		if err := json.Unmarshal(msg.Data, &event); err != nil || event.UserID == uuid.Nil {
+			log.Println("Failed to decode deleted user:", err)
+			return
+		}
+
+		report := Report{UserID: event.UserID, Service: service, Status: StatusDone}
+		if err := erase(event.UserID); err != nil {
+			log.Printf("Failed to erase data of user %s: %v", event.UserID, err)
+			report.Status = StatusFailed
+			report.Error = err.Error()
+		}
+		data, err := json.Marshal(report)
+		if err != nil {
+			log.Println("Failed to encode erasure report:", err)
+			return
+		}
+		if err := conn.Publish(ReportSubject, data); err != nil {
+			log.Println("Failed to publish erasure report:", err)
+		}
+	})
+}
+
+// SubscribeReports calls handle for every report of a service.
+func SubscribeReports(conn *nats.Conn, handle func(Report)) (*nats.Subscription, error) {
+	return conn.Subscribe(ReportSubject, func(msg *nats.Msg) {
+		var report Report
+		if err := json.Unmarshal(msg.Data, &report); err != nil {
+			log.Println("Failed to decode erasure report:", err)
+			return
+		}
+		handle(report)
+	})
+}
@@ -1,15 +1,135 @@
 package hasher
 
-import "golang.org/x/crypto/bcrypt"
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	Bcrypt   = "bcrypt"
+	Argon2id = "argon2id"
+
+	argon2SaltBytes = 16
+	argon2KeyBytes  = 32
+)
+
+var (
+	ErrUnknownAlgorithm = errors.New("unknown password hash algorithm")
+	ErrMalformedHash    = errors.New("malformed password hash")
+)
+
+// Params selects how new passwords are hashed. Existing hashes are verified
+// with the parameters stored in them, so these can be raised at any time.
+type Params struct {
+	Algorithm  string
+	BcryptCost int
+	// Argon2Memory is given in KiB.
+	Argon2Memory  uint32
+	Argon2Time    uint32
+	Argon2Threads uint8
+}
+
+// DefaultParams use bcrypt, the argon2id values follow the recommendation of
+// RFC 9106 for memory constrained systems.
+var DefaultParams = Params{
+	Algorithm:     Bcrypt,
+	BcryptCost:    bcrypt.DefaultCost,
+	Argon2Memory:  64 * 1024,
+	Argon2Time:    3,
+	Argon2Threads: 4,
+}
 
 func HashPassword(password string) (string, error) {
-	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-	if err != nil {
-		return "", err
+	return DefaultParams.Hash(password)
+}
+
+// Hash hashes the password with the configured algorithm. Argon2id hashes are
+// encoded in the PHC string format, $argon2id$v=19$m=..,t=..,p=..$salt$key.
+func (p Params) Hash(password string) (string, error) {
+	switch p.Algorithm {
+	case Bcrypt, "":
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), p.BcryptCost)
+		if err != nil {
+			return "", err
+		}
+		return string(hash), nil
+	case Argon2id:
+		salt := make([]byte, argon2SaltBytes)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+		key := argon2.IDKey([]byte(password), salt, p.Argon2Time, p.Argon2Memory, p.Argon2Threads, argon2KeyBytes)
+		return fmt.Sprintf("$%s$v=%d$m=%d,t=%d,p=%d$%s$%s",
+			Argon2id, argon2.Version, p.Argon2Memory, p.Argon2Time, p.Argon2Threads,
+			base64.RawStdEncoding.EncodeToString(salt),
+			base64.RawStdEncoding.EncodeToString(key),
+		), nil
+	default:
+		return "", ErrUnknownAlgorithm
 	}
-	return string(hash), nil
 }
 
+// NeedsRehash reports whether the hash is weaker than the parameters, so it
+// should be replaced the next time the password is known. Bcrypt hashes are
+// migrated to argon2id if that is configured, argon2id hashes are never
+// downgraded to bcrypt.
+func (p Params) NeedsRehash(hash string) bool {
+	if stored, _, _, err := decodeArgon2id(hash); err == nil {
+		if p.Algorithm != Argon2id {
+			return false
+		}
+		return stored.Argon2Memory < p.Argon2Memory || stored.Argon2Time < p.Argon2Time || stored.Argon2Threads != p.Argon2Threads
+	}
+	if p.Algorithm == Argon2id {
+		return true
+	}
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err == nil && cost < p.BcryptCost
+}
+
+// VerifyPassword compares the password against a bcrypt or argon2id hash.
 func VerifyPassword(hashedPassword, password string) error {
-	return bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password))
+	if !strings.HasPrefix(hashedPassword, "$"+Argon2id+"$") {
+		return bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password))
+	}
+	params, salt, key, err := decodeArgon2id(hashedPassword)
+	if err != nil {
+		return err
+	}
+	other := argon2.IDKey([]byte(password), salt, params.Argon2Time, params.Argon2Memory, params.Argon2Threads, uint32(len(key)))
+	if subtle.ConstantTimeCompare(key, other) != 1 {
+		return bcrypt.ErrMismatchedHashAndPassword
+	}
+	return nil
+}
+
+func decodeArgon2id(hash string) (Params, []byte, []byte, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[0] != "" || parts[1] != Argon2id {
+		return Params{}, nil, nil, ErrMalformedHash
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return Params{}, nil, nil, ErrMalformedHash
+	}
+	params := Params{Algorithm: Argon2id}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Argon2Memory, &params.Argon2Time, &params.Argon2Threads); err != nil {
+		return Params{}, nil, nil, ErrMalformedHash
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return Params{}, nil, nil, ErrMalformedHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return Params{}, nil, nil, ErrMalformedHash
+	}
+	return params, salt, key, nil
 }
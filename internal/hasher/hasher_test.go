@@ -1,6 +1,11 @@
 package hasher
 
-import "testing"
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
 
 func TestHashPassword(t *testing.T) {
 	password := "password"
@@ -48,3 +53,86 @@ func TestHashAndVerifyPasswordWithDifferentPassword(t *testing.T) {
 		t.Errorf("Expected error when verifying wrong password")
 	}
 }
+
+func TestGenerateAndHashToken(t *testing.T) {
+	token, err := GenerateToken()
+	if err != nil {
+		t.Errorf("Failed to generate token: %v", err)
+	}
+	other, err := GenerateToken()
+	if err != nil {
+		t.Errorf("Failed to generate token: %v", err)
+	}
+	if token == other {
+		t.Errorf("Expected distinct tokens")
+	}
+	if HashToken(token) != HashToken(token) {
+		t.Errorf("Expected hashing to be deterministic")
+	}
+	if HashToken(token) == HashToken(other) {
+		t.Errorf("Expected distinct hashes for distinct tokens")
+	}
+}
+
+func TestArgon2id(t *testing.T) {
+	params := DefaultParams
+	params.Algorithm = Argon2id
+	params.Argon2Memory = 1024
+	params.Argon2Time = 1
+	hashedPassword, err := params.Hash("password")
+	if err != nil {
+		t.Fatalf("Failed to hash password: %v", err)
+	}
+	if !strings.HasPrefix(hashedPassword, "$argon2id$v=19$m=1024,t=1,p=4$") {
+		t.Errorf("Unexpected hash format: %s", hashedPassword)
+	}
+	if err := VerifyPassword(hashedPassword, "password"); err != nil {
+		t.Errorf("Failed to verify password: %v", err)
+	}
+	if err := VerifyPassword(hashedPassword, "wrong_password"); err == nil {
+		t.Errorf("Expected error when verifying wrong password")
+	}
+	if err := VerifyPassword("$argon2id$v=19$m=1024$salt$key", "password"); err != ErrMalformedHash {
+		t.Errorf("Expected malformed hash but got: %v", err)
+	}
+}
+
+func TestNeedsRehash(t *testing.T) {
+	cheap := DefaultParams
+	cheap.BcryptCost = bcrypt.MinCost
+	bcryptHash, err := cheap.Hash("password")
+	if err != nil {
+		t.Fatalf("Failed to hash password: %v", err)
+	}
+	argon2Params := DefaultParams
+	argon2Params.Algorithm = Argon2id
+	argon2Params.Argon2Memory = 1024
+	argon2Params.Argon2Time = 1
+	argon2Hash, err := argon2Params.Hash("password")
+	if err != nil {
+		t.Fatalf("Failed to hash password: %v", err)
+	}
+	stronger := argon2Params
+	stronger.Argon2Time = 2
+
+	tests := []struct {
+		name   string
+		params Params
+		hash   string
+		want   bool
+	}{
+		{"same bcrypt cost", cheap, bcryptHash, false},
+		{"higher bcrypt cost", DefaultParams, bcryptHash, true},
+		{"bcrypt to argon2id", argon2Params, bcryptHash, true},
+		{"same argon2id params", argon2Params, argon2Hash, false},
+		{"stronger argon2id params", stronger, argon2Hash, true},
+		{"no downgrade to bcrypt", DefaultParams, argon2Hash, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.params.NeedsRehash(tc.hash); got != tc.want {
+				t.Errorf("expected %v but got %v", tc.want, got)
+			}
+		})
+	}
+}
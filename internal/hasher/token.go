@@ -0,0 +1,27 @@
+package hasher
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+)
+
+const tokenBytes = 32
+
+// GenerateToken returns a random, url safe token for one-off secrets like
+// refresh or reset tokens.
+func GenerateToken() (string, error) {
+	buf := make([]byte, tokenBytes)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// HashToken hashes a random token so it can be stored and looked up.
+// Unlike passwords these tokens have enough entropy that a plain SHA-256 is sufficient.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -2,6 +2,7 @@ package angebotservice
 
 import (
 	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
 	"os"
@@ -9,6 +10,8 @@ import (
 	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/http/ratingservice"
 	"github.com/nats-io/nats.go"
 
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/dataexport"
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/erasure"
 	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/http/angebotservice/service"
 	repoangebot "github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/http/angebotservice/service/repo_angebot"
 	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/http/mediaservice/msclient"
@@ -48,35 +51,73 @@ func New(svc service.OfferService, secret []byte) *OfferController {
 	svr := &OfferController{
 		Server:         server.NewServer(),
 		service:        svc,
-		AuthMiddleware: auth.NewAuthMiddleware(secret),
+		AuthMiddleware: auth.NewAuthMiddleware(secret).WithAudit(conn, erasure.ServiceOffers),
 		Conn:           conn,
 	}
+	if err := svr.SubscribeRevocations(conn); err != nil {
+		panic(err)
+	}
+	if _, err := erasure.Subscribe(conn, erasure.ServiceOffers, svc.EraseUser); err != nil {
+		panic(err)
+	}
+	if _, err := dataexport.Respond(conn, erasure.ServiceOffers, svc.ExportUser); err != nil {
+		panic(err)
+	}
 	svr.setupRoutes()
 	return svr
 }
 
 func (c *OfferController) setupRoutes() {
-	c.WithHandlerFunc("/filter", c.handleGetOfferByFilter, http.MethodPost)
-	c.WithHandlerFunc("/", c.EnsureJWT(c.handleCreateOffer), http.MethodPost)
+	c.WithHandlerFunc("/filter", c.OptionalJWT(c.handleGetOfferByFilter), http.MethodPost)
+	c.WithHandlerFunc("/", c.EnsureVerified(c.handleCreateOffer), http.MethodPost)
 	c.WithHandlerFunc("/{id}", c.EnsureJWT(c.handleEditOffer), http.MethodPut)
 	c.WithHandlerFunc("/{id}", c.EnsureJWT(c.deleteOffer), http.MethodDelete)
 	c.WithHandlerFunc("/{id}", c.handleGetOffer, http.MethodGet)
-	c.WithHandlerFunc("/{id}/occupy", c.EnsureJWT(c.OccupyOffer), http.MethodPost)
+	c.WithHandlerFunc("/{id}/occupy", c.EnsureVerified(c.OccupyOffer), http.MethodPost)
+	c.WithHandlerFunc("/{id}/occupy", c.EnsureJWT(c.handleCancelBooking), http.MethodDelete)
+	c.WithHandlerFunc("/{id}/occupants/{userId}", c.EnsureJWT(c.handleRemoveOccupant), http.MethodDelete)
+	c.WithHandlerFunc("/{id}/bookings/{bookingId}/{action}", c.EnsureJWT(c.handleDecideBooking), http.MethodPost)
 	c.WithHandlerFunc("/{id}/pay", c.EnsureJWT(c.PayOffer), http.MethodPost)
 
 	c.WithHandlerFunc("/{id}/rating", c.EnsureJWT(c.handlePostRating), http.MethodPost)
 }
 
+// deleteOffer godoc
+// @Summary      Delete an offer
+// @Description  Deletes an offer. Only the creator of the offer or a moderator may delete it.
+// @Tags         offers
+// @Param        Authorization header string true "JWT token"
+// @Param        id path string true "Offer ID (UUID)"
+// @Success      200
+// @Failure      400  {object}  ErrorResponse
+// @Failure      403  {object}  ErrorResponse
+// @Failure      500  {object}  ErrorResponse
+// @Router       /angebot/{id} [delete]
 func (c *OfferController) deleteOffer(w http.ResponseWriter, r *http.Request) {
 	var (
 		err     error
 		offerId uuid.UUID
+		userId  uuid.UUID
 		vars    = mux.Vars(r)
 	)
 	if offerId, err = uuid.Parse(vars["id"]); err != nil {
 		c.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if userId, err = uuid.Parse(r.Header.Get(UserIdHeader)); err != nil {
+		c.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	offer, err := c.service.GetOffer(offerId)
+	if err != nil {
+		c.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if offer.Creator != userId && !auth.HasRole(r, auth.RoleModerator) {
+		c.Error(w, "only the creator or a moderator can delete this offer", http.StatusForbidden)
+		return
+	}
 
 	err = c.service.DeleteOffer(offerId)
 	if err != nil {
@@ -85,22 +126,52 @@ func (c *OfferController) deleteOffer(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// handleEditOffer godoc
+// @Summary      Edit an offer
+// @Description  The creator replaces the details of the offer, they are validated like a new offer. The route is computed again and the capacity has to leave room for the accepted bookings. The bookings, payments and refunds are kept.
+// @Tags         offers
+// @Accept       json
+// @Param        Authorization header string true "JWT token"
+// @Param        id path string true "Offer ID (UUID)"
+// @Param        body body repoangebot.Offer true "Offer data"
+// @Success      200
+// @Failure      400  {object}  ErrorResponse "Capacity exceeds the vehicle, invalid location or cancellation policy"
+// @Failure      403  {object}  ErrorResponse "Not the creator of the offer or vehicle of another user"
+// @Failure      404  {object}  ErrorResponse "Offer or vehicle not found"
+// @Failure      409  {object}  ErrorResponse "Capacity below the accepted bookings or the offer kept changing"
+// @Failure      500  {object}  ErrorResponse
+// @Router       /angebot/{id} [put]
 func (c *OfferController) handleEditOffer(w http.ResponseWriter, r *http.Request) {
-	var (
-		err     error
-		offerId uuid.UUID
-		offer   *repoangebot.Offer
-	)
-
-	if err = json.NewDecoder(r.Body).Decode(offer); err != nil {
+	offerId, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
 		c.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	err = c.service.EditOffer(offerId, uuid.New(), offer)
+	userId, err := uuid.Parse(r.Header.Get(UserIdHeader))
 	if err != nil {
-		c.Error(w, err.Error(), http.StatusInternalServerError)
+		c.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+
+	var offer repoangebot.Offer
+	if err = json.NewDecoder(r.Body).Decode(&offer); err != nil {
+		c.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = c.service.EditOffer(offerId, userId, &offer)
+	switch {
+	case errors.Is(err, service.ErrExceedsVehicle), errors.Is(err, service.ErrInvalidLocation),
+		errors.Is(err, repoangebot.ErrInvalidPolicy):
+		c.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, service.ErrNotCreator), errors.Is(err, service.ErrVehicleNotOwned):
+		c.Error(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, repoangebot.ErrOfferNotFound), errors.Is(err, service.ErrVehicleNotFound):
+		c.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, repoangebot.ErrNotEnoughSpace), errors.Is(err, repoangebot.ErrConflict):
+		c.Error(w, err.Error(), http.StatusConflict)
+	case err != nil:
+		c.Error(w, err.Error(), http.StatusInternalServerError)
+	}
 }
 
 // PayOffer godoc
@@ -113,6 +184,7 @@ func (c *OfferController) handleEditOffer(w http.ResponseWriter, r *http.Request
 // @Param        id path string true "Offer ID (UUID)"
 // @Success      200
 // @Failure      400  {object}  ErrorResponse
+// @Failure      409  {object}  ErrorResponse "The offer kept changing"
 // @Failure      500  {object}  ErrorResponse
 // @Router       /angebot/{id}/pay [post]
 func (c *OfferController) PayOffer(w http.ResponseWriter, r *http.Request) {
@@ -133,22 +205,26 @@ func (c *OfferController) PayOffer(w http.ResponseWriter, r *http.Request) {
 	}
 
 	err = c.service.PayOffer(offerId, userid)
-	if err != nil {
+	if errors.Is(err, repoangebot.ErrConflict) {
+		c.Error(w, err.Error(), http.StatusConflict)
+	} else if err != nil {
 		c.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
 
 // OccupyOffer godoc
 // @Summary      Occupy an offer
-// @Description  Marks an offer as occupied by the user, specifying the desired space parameters.
+// @Description  Requests a booking of the space in the offer. The creator of the offer accepts or rejects it, unless the offer accepts automatically. Both are notified with an offer.booking.<state> event on user.<id>.
 // @Tags         offers
 // @Accept       json
 // @Produce      json
 // @Param        Authorization header string true "JWT token"
 // @Param        id path string true "Offer ID (UUID)"
 // @Param        body body  repoangebot.Space true "Space details for the occupation"
-// @Success      200
+// @Success      200  {object}  repoangebot.Booking
 // @Failure      400  {object}  ErrorResponse
+// @Failure      403  {object}  ErrorResponse "Email address is not verified, the creator and the user blocked each other or the user created or drives the offer"
+// @Failure      409  {object}  ErrorResponse "Not enough free space, already booked, the trip already started or the offer kept changing"
 // @Failure      500  {object}  ErrorResponse
 // @Router       /angebot/{id}/occupy [post]
 func (c *OfferController) OccupyOffer(w http.ResponseWriter, r *http.Request) {
@@ -169,10 +245,164 @@ func (c *OfferController) OccupyOffer(w http.ResponseWriter, r *http.Request) {
 		c.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	if err := c.service.OccupieOffer(id, userId, space); err != nil {
+	booking, err := c.service.RequestBooking(id, userId, space)
+	if err != nil {
+		c.writeBookingError(w, err)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(booking); err != nil {
+		c.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// bookingActions are the decisions of the creator on a booking.
+var bookingActions = map[string]repoangebot.BookingState{
+	"accept":   repoangebot.BookingAccepted,
+	"reject":   repoangebot.BookingRejected,
+	"complete": repoangebot.BookingCompleted,
+	"no-show":  repoangebot.BookingNoShow,
+}
+
+// handleDecideBooking godoc
+// @Summary      Decide on a booking
+// @Description  The creator of the offer accepts or rejects a requested booking. Once the trip started an accepted booking is marked as completed or the passenger as a no-show. Both are notified with an offer.booking.<state> event on user.<id>.
+// @Tags         offers
+// @Produce      json
+// @Param        Authorization header string true "JWT token"
+// @Param        id path string true "Offer ID (UUID)"
+// @Param        bookingId path string true "Booking ID (UUID)"
+// @Param        action path string true "accept, reject, complete or no-show"
+// @Success      200  {object}  repoangebot.Booking
+// @Failure      400  {object}  ErrorResponse
+// @Failure      403  {object}  ErrorResponse "Not the creator of the offer"
+// @Failure      404  {object}  ErrorResponse "Booking not found"
+// @Failure      409  {object}  ErrorResponse "Not possible in the state of the booking or the offer kept changing"
+// @Failure      500  {object}  ErrorResponse
+// @Router       /angebot/{id}/bookings/{bookingId}/{action} [post]
+func (c *OfferController) handleDecideBooking(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	offerId, err := uuid.Parse(vars["id"])
+	if err != nil {
+		c.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	bookingId, err := uuid.Parse(vars["bookingId"])
+	if err != nil {
+		c.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	state, ok := bookingActions[vars["action"]]
+	if !ok {
+		c.Error(w, "unknown action "+vars["action"], http.StatusBadRequest)
+		return
+	}
+	userId, err := uuid.Parse(r.Header.Get(UserIdHeader))
+	if err != nil {
+		c.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	booking, err := c.service.DecideBooking(offerId, bookingId, userId, state)
+	if err != nil {
+		c.writeBookingError(w, err)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(booking); err != nil {
 		c.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// handleCancelBooking godoc
+// @Summary      Cancel a booking
+// @Description  Cancels the booking of the user before the trip starts and gives the space back to the offer. A paid booking is removed from the paid spaces and refunded in full until freeHours before the start, after that refundPercent of the price according to the cancellation policy of the offer.
+// @Tags         offers
+// @Produce      json
+// @Param        Authorization header string true "JWT token"
+// @Param        id path string true "Offer ID (UUID)"
+// @Success      200  {object}  repoangebot.Cancellation
+// @Failure      400  {object}  ErrorResponse
+// @Failure      404  {object}  ErrorResponse "No booking of the user"
+// @Failure      409  {object}  ErrorResponse "Trip has already started"
+// @Failure      500  {object}  ErrorResponse
+// @Router       /angebot/{id}/occupy [delete]
+func (c *OfferController) handleCancelBooking(w http.ResponseWriter, r *http.Request) {
+	offerId, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		c.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	userId, err := uuid.Parse(r.Header.Get(UserIdHeader))
+	if err != nil {
+		c.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	cancellation, err := c.service.CancelBooking(offerId, userId)
+	if err != nil {
+		c.writeBookingError(w, err)
 		return
 	}
+	if err := json.NewEncoder(w).Encode(cancellation); err != nil {
+		c.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// handleRemoveOccupant godoc
+// @Summary      Remove a passenger
+// @Description  The creator of the offer cancels the booking of a passenger before the trip starts, the space is given back to the offer and a paid booking is refunded in full.
+// @Tags         offers
+// @Produce      json
+// @Param        Authorization header string true "JWT token"
+// @Param        id path string true "Offer ID (UUID)"
+// @Param        userId path string true "User ID of the passenger (UUID)"
+// @Success      200  {object}  repoangebot.Cancellation
+// @Failure      400  {object}  ErrorResponse
+// @Failure      403  {object}  ErrorResponse "Not the creator of the offer"
+// @Failure      404  {object}  ErrorResponse "No booking of the passenger"
+// @Failure      409  {object}  ErrorResponse "Trip has already started"
+// @Failure      500  {object}  ErrorResponse
+// @Router       /angebot/{id}/occupants/{userId} [delete]
+func (c *OfferController) handleRemoveOccupant(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	offerId, err := uuid.Parse(vars["id"])
+	if err != nil {
+		c.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	occupantId, err := uuid.Parse(vars["userId"])
+	if err != nil {
+		c.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	userId, err := uuid.Parse(r.Header.Get(UserIdHeader))
+	if err != nil {
+		c.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	cancellation, err := c.service.RemoveOccupant(offerId, occupantId, userId)
+	if err != nil {
+		c.writeBookingError(w, err)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(cancellation); err != nil {
+		c.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (c *OfferController) writeBookingError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, service.ErrBlocked), errors.Is(err, service.ErrNotCreator), errors.Is(err, repoangebot.ErrOwnOffer):
+		c.Error(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, repoangebot.ErrOfferNotFound), errors.Is(err, repoangebot.ErrBookingNotFound):
+		c.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, repoangebot.ErrInvalidTransition), errors.Is(err, repoangebot.ErrTripNotStarted),
+		errors.Is(err, repoangebot.ErrTripStarted), errors.Is(err, repoangebot.ErrNotEnoughSpace),
+		errors.Is(err, repoangebot.ErrAlreadyBooked), errors.Is(err, repoangebot.ErrConflict):
+		c.Error(w, err.Error(), http.StatusConflict)
+	default:
+		c.Error(w, err.Error(), http.StatusInternalServerError)
+	}
 }
 
 // handlePostRating godoc
@@ -216,15 +446,17 @@ func (c *OfferController) handlePostRating(w http.ResponseWriter, r *http.Reques
 
 // handleCreateOffer godoc
 // @Summary      Create a new offer
-// @Description  Creates a new offer by the authenticated user, generates image URLs.
+// @Description  Creates a new offer by the authenticated user, generates image URLs. The route is computed from the start through the waypoints to the destination. With a vehicleId the car info is taken from the vehicle of the user service and canTransport defaults to its seats and trunk, a given canTransport has to fit into the vehicle.
 // @Tags         offers
 // @Accept       json
 // @Produce      json
 // @Param        Authorization header string true "JWT token"
 // @Param        body body repoangebot.Offer true "Offer data"
 // @Success      200  {object}  CreateOfferResponse
-// @Failure      400  {object}  ErrorResponse
+// @Failure      400  {object}  ErrorResponse "Capacity exceeds the vehicle, invalid location or cancellation policy"
 // @Failure      401  {object}  ErrorResponse
+// @Failure      403  {object}  ErrorResponse "Email address is not verified or vehicle of another user"
+// @Failure      404  {object}  ErrorResponse "Vehicle not found"
 // @Failure      500  {object}  ErrorResponse
 // @Router       /angebot [post]
 func (c *OfferController) handleCreateOffer(w http.ResponseWriter, r *http.Request) {
@@ -244,7 +476,18 @@ func (c *OfferController) handleCreateOffer(w http.ResponseWriter, r *http.Reque
 	offer.Creator = uid
 	imageURL := c.CreateMultiImageUrl()
 	offerId, err := c.service.CreateOffer(&offer, imageURL)
-	if err != nil {
+	switch {
+	case errors.Is(err, service.ErrExceedsVehicle), errors.Is(err, service.ErrInvalidLocation),
+		errors.Is(err, repoangebot.ErrInvalidPolicy):
+		c.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, service.ErrVehicleNotOwned):
+		c.Error(w, err.Error(), http.StatusForbidden)
+		return
+	case errors.Is(err, service.ErrVehicleNotFound):
+		c.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
 		c.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -296,7 +539,7 @@ func (c *OfferController) handleGetOffer(w http.ResponseWriter, r *http.Request)
 
 // handleGetOfferByFilter godoc
 // @Summary      Get offers by filter
-// @Description  Retrieves a list of offers filtered by the specified criteria.
+// @Description  Retrieves a list of offers filtered by the specified criteria. The radii around the locations are in kilometres, with a start location the nearest offers come first. With pickup and dropOff offers passing both in this order within the corridor (km, default 5) of their route are found. With a token, offers of users that blocked the caller or were blocked by the caller are left out.
 // @Tags         offers
 // @Accept       json
 // @Produce      json
@@ -313,7 +556,13 @@ func (c *OfferController) handleGetOfferByFilter(w http.ResponseWriter, r *http.
 		return
 	}
 
-	offers, err := c.service.GetOffersByFilter(filter)
+	// the caller is optional, other services list offers without a token
+	userId, _ := uuid.Parse(r.Header.Get(UserIdHeader))
+	offers, err := c.service.GetOffersByFilter(filter, userId)
+	if errors.Is(err, service.ErrInvalidLocation) {
+		c.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	if err != nil {
 		c.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -0,0 +1,46 @@
+package service
+
+import (
+	"errors"
+	"slices"
+
+	repoangebot "github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/http/angebotservice/service/repo_angebot"
+	"github.com/google/uuid"
+)
+
+// ErrBlocked is returned if the user and the creator or driver of an offer
+// blocked each other.
+var ErrBlocked = errors.New("user is blocked")
+
+// BlockList tells whether two users blocked each other, it is implemented by
+// *blocking.List.
+type BlockList interface {
+	Between(a, b uuid.UUID) bool
+}
+
+// WithBlocks sets the blocks that keep users away from each other's offers.
+func (s *Service) WithBlocks(blocks BlockList) *Service {
+	s.blocks = blocks
+	return s
+}
+
+// isBlocked reports whether the user and the creator or driver of the offer
+// blocked each other.
+func (s *Service) isBlocked(offer *repoangebot.Offer, userId uuid.UUID) bool {
+	if s.blocks == nil || userId == uuid.Nil {
+		return false
+	}
+	for _, other := range []uuid.UUID{offer.Creator, offer.Driver} {
+		if other != uuid.Nil && other != userId && s.blocks.Between(userId, other) {
+			return true
+		}
+	}
+	return false
+}
+
+// withoutBlocked removes the offers the user may not see because of a block.
+func (s *Service) withoutBlocked(offers []*repoangebot.Offer, userId uuid.UUID) []*repoangebot.Offer {
+	return slices.DeleteFunc(offers, func(offer *repoangebot.Offer) bool {
+		return s.isBlocked(offer, userId)
+	})
+}
@@ -0,0 +1,183 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	repoangebot "github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/http/angebotservice/service/repo_angebot"
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/notify"
+	"github.com/google/uuid"
+)
+
+// ErrNotCreator is returned if someone else than the creator of the offer
+// decides on a booking or removes a passenger.
+var ErrNotCreator = errors.New("only the creator of the offer can decide on bookings")
+
+// bookingAttempts is how often a change of the bookings or payments is tried
+// again if the offer was changed concurrently.
+const bookingAttempts = 3
+
+// PreferencesTimeout is how long the user service gets to answer for the
+// notification preferences of a user.
+const PreferencesTimeout = 2 * time.Second
+
+// Publisher sends events, it is implemented by *nats.Conn.
+type Publisher interface {
+	Publish(subject string, data []byte) error
+}
+
+// Preferences tells whether a user wants to be notified, it is implemented by
+// *notify.Lookup.
+type Preferences interface {
+	Allows(userID uuid.UUID, category notify.Category, channel notify.Channel) bool
+}
+
+// BookingEvent is sent on user.<id> to the passenger and the creator and
+// driver of the offer whenever a booking changes. Its type is
+// offer.booking.<state>, cancelled bookings that were paid carry the refund.
+type BookingEvent struct {
+	Type    string              `json:"type"`
+	OfferID uuid.UUID           `json:"offerId"`
+	Booking repoangebot.Booking `json:"booking"`
+	Refund  *repoangebot.Refund `json:"refund,omitempty"`
+}
+
+// BookingEventType returns the type of the events of bookings in the state.
+func BookingEventType(state repoangebot.BookingState) string {
+	return "offer.booking." + string(state)
+}
+
+// WithPublisher sets where booking events are sent, preferences may be nil to
+// notify everyone.
+func (s *Service) WithPublisher(publisher Publisher, preferences Preferences) *Service {
+	s.publisher = publisher
+	s.preferences = preferences
+	return s
+}
+
+// RequestBooking asks the creator of the offer for space, unless the user
+// and the creator or driver blocked each other. Offers that accept
+// automatically are booked right away.
+func (s *Service) RequestBooking(offerId uuid.UUID, userId uuid.UUID, space repoangebot.Space) (*repoangebot.Booking, error) {
+	var booking *repoangebot.Booking
+	offer, err := s.changeOffer(offerId, s.repo.SaveBookings, func(offer *repoangebot.Offer) (err error) {
+		if s.isBlocked(offer, userId) {
+			return ErrBlocked
+		}
+		booking, err = offer.RequestBooking(userId, space, time.Now())
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.publishBooking(offer, BookingEvent{Booking: *booking})
+	return booking, nil
+}
+
+// DecideBooking lets the creator of the offer accept or reject a booking and
+// tell whether the passenger showed up once the trip started.
+func (s *Service) DecideBooking(offerId uuid.UUID, bookingId uuid.UUID, userId uuid.UUID, state repoangebot.BookingState) (*repoangebot.Booking, error) {
+	switch state {
+	case repoangebot.BookingAccepted, repoangebot.BookingRejected, repoangebot.BookingCompleted, repoangebot.BookingNoShow:
+	default:
+		return nil, repoangebot.ErrInvalidTransition
+	}
+	var booking *repoangebot.Booking
+	offer, err := s.changeOffer(offerId, s.repo.SaveBookings, func(offer *repoangebot.Offer) (err error) {
+		if offer.Creator != userId {
+			return ErrNotCreator
+		}
+		booking, err = offer.SetBookingState(bookingId, state, time.Now())
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.publishBooking(offer, BookingEvent{Booking: *booking})
+	return booking, nil
+}
+
+// changeOffer applies the change to the offer and saves it. If the offer
+// was changed in the meantime it is read again and the change is checked
+// against the new state, after bookingAttempts repoangebot.ErrConflict is
+// returned.
+func (s *Service) changeOffer(offerId uuid.UUID, save func(offer *repoangebot.Offer) error, change func(offer *repoangebot.Offer) error) (*repoangebot.Offer, error) {
+	for attempt := 1; ; attempt++ {
+		offer, err := s.repo.GetOffer(offerId)
+		if err != nil {
+			return nil, err
+		}
+		if err := change(offer); err != nil {
+			return nil, err
+		}
+		err = save(offer)
+		if err == nil {
+			return offer, nil
+		}
+		if !errors.Is(err, repoangebot.ErrConflict) || attempt == bookingAttempts {
+			return nil, err
+		}
+	}
+}
+
+// CancelBooking cancels the booking of the user before the trip starts, the
+// space is given back to the offer and a paid booking is refunded according
+// to the cancellation policy of the offer.
+func (s *Service) CancelBooking(offerId uuid.UUID, userId uuid.UUID) (*repoangebot.Cancellation, error) {
+	return s.cancel(offerId, userId, uuid.Nil)
+}
+
+// RemoveOccupant lets the creator of the offer cancel the booking of a
+// passenger, a paid booking is refunded in full.
+func (s *Service) RemoveOccupant(offerId uuid.UUID, occupantId uuid.UUID, userId uuid.UUID) (*repoangebot.Cancellation, error) {
+	return s.cancel(offerId, occupantId, userId)
+}
+
+// cancel cancels the booking of the passenger, on behalf of the creator
+// unless creator is uuid.Nil.
+func (s *Service) cancel(offerId uuid.UUID, passenger uuid.UUID, creator uuid.UUID) (*repoangebot.Cancellation, error) {
+	var cancellation *repoangebot.Cancellation
+	offer, err := s.changeOffer(offerId, s.repo.ReleaseOffer, func(offer *repoangebot.Offer) (err error) {
+		if creator != uuid.Nil && offer.Creator != creator {
+			return ErrNotCreator
+		}
+		cancellation, err = offer.Cancel(passenger, creator != uuid.Nil, time.Now())
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.publishBooking(offer, BookingEvent{Booking: cancellation.Booking, Refund: cancellation.Refund})
+	return cancellation, nil
+}
+
+// publishBooking notifies the passenger and the creator and driver of the
+// offer about the booking of the event.
+func (s *Service) publishBooking(offer *repoangebot.Offer, event BookingEvent) {
+	if s.publisher == nil {
+		return
+	}
+	booking := event.Booking
+	event.Type = BookingEventType(booking.State)
+	event.OfferID = offer.ID
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Println("Failed to encode booking event:", err)
+		return
+	}
+	notified := map[uuid.UUID]bool{uuid.Nil: true}
+	for _, userId := range []uuid.UUID{booking.Passenger, offer.Creator, offer.Driver} {
+		if notified[userId] {
+			continue
+		}
+		notified[userId] = true
+		if s.preferences != nil && !s.preferences.Allows(userId, notify.Booking, notify.InApp) {
+			continue
+		}
+		if err := s.publisher.Publish(notify.Subject(userId), data); err != nil {
+			log.Printf("Failed to publish booking event to %s: %v", userId, err)
+		}
+	}
+}
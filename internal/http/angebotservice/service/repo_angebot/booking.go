@@ -0,0 +1,141 @@
+package repoangebot
+
+import (
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type BookingState string
+
+const (
+	// BookingRequested waits for the creator of the offer.
+	BookingRequested BookingState = "requested"
+	// BookingAccepted occupies its space in the offer.
+	BookingAccepted  BookingState = "accepted"
+	BookingRejected  BookingState = "rejected"
+	BookingCancelled BookingState = "cancelled"
+	BookingCompleted BookingState = "completed"
+	BookingNoShow    BookingState = "noShow"
+)
+
+// bookingTransitions are the states a booking can go to from a state, the
+// others are final.
+var bookingTransitions = map[BookingState][]BookingState{
+	BookingRequested: {BookingAccepted, BookingRejected, BookingCancelled},
+	BookingAccepted:  {BookingCancelled, BookingCompleted, BookingNoShow},
+}
+
+var (
+	ErrBookingNotFound   = errors.New("booking not found")
+	ErrInvalidTransition = errors.New("invalid booking transition")
+	ErrAlreadyBooked     = errors.New("user already booked the offer")
+	ErrNotEnoughSpace    = errors.New("not enough free space in the offer")
+	ErrTripNotStarted    = errors.New("trip has not started yet")
+	ErrOwnOffer          = errors.New("creator and driver can not book their own offer")
+)
+
+// CanTransition reports whether a booking in the state can go to the other.
+func (s BookingState) CanTransition(to BookingState) bool {
+	return slices.Contains(bookingTransitions[s], to)
+}
+
+// Open reports whether the booking still holds or may get space.
+func (s BookingState) Open() bool {
+	return s == BookingRequested || s == BookingAccepted
+}
+
+type Booking struct {
+	ID        uuid.UUID    `json:"id" bson:"id"`
+	Passenger uuid.UUID    `json:"passenger"`
+	Space     Space        `json:"space"`
+	State     BookingState `json:"state"`
+	CreatedAt time.Time    `json:"createdAt"`
+	UpdatedAt time.Time    `json:"updatedAt"`
+}
+
+// Booking returns the booking with the ID.
+func (o *Offer) Booking(id uuid.UUID) (*Booking, error) {
+	for i := range o.Bookings {
+		if o.Bookings[i].ID == id {
+			return &o.Bookings[i], nil
+		}
+	}
+	return nil, ErrBookingNotFound
+}
+
+// RequestBooking adds a booking of the space for the passenger before the
+// trip starts. Offers that accept automatically occupy the space right away.
+func (o *Offer) RequestBooking(passenger uuid.UUID, space Space, now time.Time) (*Booking, error) {
+	if passenger == o.Creator || passenger == o.Driver {
+		return nil, ErrOwnOffer
+	}
+	if !now.Before(o.StartDateTime) {
+		return nil, ErrTripStarted
+	}
+	for _, booking := range o.Bookings {
+		if booking.Passenger == passenger && booking.State.Open() {
+			return nil, ErrAlreadyBooked
+		}
+	}
+	if !o.HasEnoughFreeSpace(space) {
+		return nil, ErrNotEnoughSpace
+	}
+	space.Occupier = passenger
+	o.Bookings = append(o.Bookings, Booking{
+		ID:        uuid.New(),
+		Passenger: passenger,
+		Space:     space,
+		State:     BookingRequested,
+		CreatedAt: now,
+		UpdatedAt: now,
+	})
+	booking := &o.Bookings[len(o.Bookings)-1]
+	if o.AutoAccept {
+		return o.SetBookingState(booking.ID, BookingAccepted, now)
+	}
+	return booking, nil
+}
+
+// SetBookingState moves the booking to the state. Accepting occupies the
+// space of the booking, cancelling an accepted booking releases it. Whether a
+// passenger showed up is known once the trip started.
+func (o *Offer) SetBookingState(id uuid.UUID, to BookingState, now time.Time) (*Booking, error) {
+	booking, err := o.Booking(id)
+	if err != nil {
+		return nil, err
+	}
+	if !booking.State.CanTransition(to) {
+		return nil, ErrInvalidTransition
+	}
+
+	switch to {
+	case BookingAccepted:
+		if !o.HasEnoughFreeSpace(booking.Space) {
+			return nil, ErrNotEnoughSpace
+		}
+		o.OccupiedSpace = append(o.OccupiedSpace, booking.Space)
+	case BookingCancelled:
+		if booking.State == BookingAccepted {
+			o.releaseSpace(booking.Passenger)
+		}
+	case BookingCompleted, BookingNoShow:
+		if now.Before(o.StartDateTime) {
+			return nil, ErrTripNotStarted
+		}
+	}
+	booking.State = to
+	booking.UpdatedAt = now
+	return booking, nil
+}
+
+// releaseSpace removes the space the passenger occupies.
+func (o *Offer) releaseSpace(passenger uuid.UUID) {
+	if i := slices.IndexFunc(o.OccupiedSpace, func(space Space) bool {
+		return space.Occupier == passenger
+	}); i >= 0 {
+		o.OccupiedSpace = slices.Delete(o.OccupiedSpace, i, i+1)
+	}
+}
@@ -0,0 +1,142 @@
+package repoangebot
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestBookingState_CanTransition(t *testing.T) {
+	tests := []struct {
+		from, to BookingState
+		want     bool
+	}{
+		{BookingRequested, BookingAccepted, true},
+		{BookingRequested, BookingRejected, true},
+		{BookingRequested, BookingCancelled, true},
+		{BookingRequested, BookingCompleted, false},
+		{BookingAccepted, BookingCancelled, true},
+		{BookingAccepted, BookingNoShow, true},
+		{BookingAccepted, BookingRejected, false},
+		{BookingRejected, BookingAccepted, false},
+		{BookingCompleted, BookingCancelled, false},
+	}
+	for _, tt := range tests {
+		if got := tt.from.CanTransition(tt.to); got != tt.want {
+			t.Errorf("%s -> %s: expected %v", tt.from, tt.to, tt.want)
+		}
+	}
+}
+
+func TestOffer_Bookings(t *testing.T) {
+	now := time.Now()
+	passenger, other := uuid.New(), uuid.New()
+	offer := &Offer{StartDateTime: now.Add(time.Hour), CanTransport: Space{Seats: 2}}
+
+	booking, err := offer.RequestBooking(passenger, Space{Seats: 2}, now)
+	if err != nil || booking.State != BookingRequested || booking.Space.Occupier != passenger {
+		t.Fatalf("expected a requested booking but got %+v: %v", booking, err)
+	}
+	if len(offer.OccupiedSpace) != 0 {
+		t.Errorf("requested bookings should not occupy space")
+	}
+	if _, err := offer.RequestBooking(passenger, Space{Seats: 1}, now); !errors.Is(err, ErrAlreadyBooked) {
+		t.Errorf("expected already booked but got: %v", err)
+	}
+	if _, err := offer.RequestBooking(other, Space{Seats: 3}, now); !errors.Is(err, ErrNotEnoughSpace) {
+		t.Errorf("expected not enough space but got: %v", err)
+	}
+	requested, err := offer.RequestBooking(other, Space{Seats: 1}, now)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := offer.SetBookingState(booking.ID, BookingAccepted, now); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(offer.OccupiedSpace) != 1 || offer.OccupiedSpace[0].Occupier != passenger {
+		t.Errorf("accepted bookings should occupy their space: %+v", offer.OccupiedSpace)
+	}
+	// the space was taken while the other request waited
+	if _, err := offer.SetBookingState(requested.ID, BookingAccepted, now); !errors.Is(err, ErrNotEnoughSpace) {
+		t.Errorf("expected not enough space but got: %v", err)
+	}
+	if _, err := offer.SetBookingState(booking.ID, BookingCompleted, now); !errors.Is(err, ErrTripNotStarted) {
+		t.Errorf("expected trip not started but got: %v", err)
+	}
+	if _, err := offer.SetBookingState(booking.ID, BookingRejected, now); !errors.Is(err, ErrInvalidTransition) {
+		t.Errorf("expected invalid transition but got: %v", err)
+	}
+	if _, err := offer.SetBookingState(uuid.New(), BookingAccepted, now); !errors.Is(err, ErrBookingNotFound) {
+		t.Errorf("expected booking not found but got: %v", err)
+	}
+
+	if _, err := offer.SetBookingState(booking.ID, BookingCancelled, now); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(offer.OccupiedSpace) != 0 {
+		t.Errorf("cancelled bookings should release their space: %+v", offer.OccupiedSpace)
+	}
+	if _, err := offer.SetBookingState(requested.ID, BookingAccepted, now); err != nil {
+		t.Errorf("released space should be bookable: %v", err)
+	}
+	if _, err := offer.SetBookingState(requested.ID, BookingNoShow, now.Add(2*time.Hour)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestOffer_RequestBooking_AutoAccept(t *testing.T) {
+	now := time.Now()
+	offer := &Offer{AutoAccept: true, StartDateTime: now.Add(time.Hour), CanTransport: Space{Seats: 1}}
+	booking, err := offer.RequestBooking(uuid.New(), Space{Seats: 1}, now)
+	if err != nil || booking.State != BookingAccepted || len(offer.OccupiedSpace) != 1 {
+		t.Errorf("expected the booking to be accepted right away but got %+v: %v", booking, err)
+	}
+}
+
+func TestOffer_RequestBooking_Rejected(t *testing.T) {
+	now := time.Now()
+	creator, driver := uuid.New(), uuid.New()
+	offer := &Offer{Creator: creator, Driver: driver, AutoAccept: true, StartDateTime: now.Add(time.Hour), CanTransport: Space{Seats: 2}}
+
+	for _, own := range []uuid.UUID{creator, driver} {
+		if _, err := offer.RequestBooking(own, Space{Seats: 1}, now); !errors.Is(err, ErrOwnOffer) {
+			t.Errorf("expected the own offer to be rejected but got: %v", err)
+		}
+	}
+	for _, at := range []time.Time{offer.StartDateTime, now.Add(2 * time.Hour)} {
+		if _, err := offer.RequestBooking(uuid.New(), Space{Seats: 1}, at); !errors.Is(err, ErrTripStarted) {
+			t.Errorf("expected a started trip to be rejected but got: %v", err)
+		}
+	}
+	if len(offer.Bookings) != 0 || len(offer.OccupiedSpace) != 0 {
+		t.Errorf("rejected requests should not book: %+v", offer.Bookings)
+	}
+}
+
+func TestOffer_EraseUser_Bookings(t *testing.T) {
+	now := time.Now()
+	deleted, other := uuid.New(), uuid.New()
+	newOffer := func(start time.Time) *Offer {
+		return &Offer{StartDateTime: start, Bookings: []Booking{
+			{ID: uuid.New(), Passenger: deleted, Space: Space{Occupier: deleted}, State: BookingRequested},
+			{ID: uuid.New(), Passenger: other, Space: Space{Occupier: other}, State: BookingAccepted},
+		}}
+	}
+
+	upcoming := newOffer(now.Add(time.Hour))
+	if !upcoming.Involves(deleted) || !upcoming.EraseUser(deleted, now) {
+		t.Errorf("offer should have changed")
+	}
+	if len(upcoming.Bookings) != 1 || upcoming.Bookings[0].Passenger != other {
+		t.Errorf("bookings of upcoming trips should be removed: %+v", upcoming.Bookings)
+	}
+
+	passed := newOffer(now.Add(-time.Hour))
+	passed.EraseUser(deleted, now)
+	if len(passed.Bookings) != 2 || passed.Bookings[0].Passenger != uuid.Nil || passed.Bookings[0].Space.Occupier != uuid.Nil {
+		t.Errorf("bookings of past trips should be anonymized: %+v", passed.Bookings)
+	}
+}
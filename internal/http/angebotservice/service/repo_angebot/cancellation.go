@@ -0,0 +1,111 @@
+package repoangebot
+
+import (
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	ErrTripStarted   = errors.New("trip has already started")
+	ErrInvalidPolicy = errors.New("invalid cancellation policy")
+)
+
+// CancellationPolicy decides how much of the price passengers get back when
+// they cancel. Until FreeHours before the start everything is refunded,
+// after that RefundPercent. Without a policy passengers can cancel for free
+// until the start.
+type CancellationPolicy struct {
+	FreeHours     int `json:"freeHours"`
+	RefundPercent int `json:"refundPercent"`
+}
+
+// Validate checks that the hours are not negative and the percentage is
+// between 0 and 100.
+func (p CancellationPolicy) Validate() error {
+	if p.FreeHours < 0 || p.RefundPercent < 0 || p.RefundPercent > 100 {
+		return ErrInvalidPolicy
+	}
+	return nil
+}
+
+// RefundPercentAt returns the percentage of the price refunded for a
+// cancellation at the time.
+func (p CancellationPolicy) RefundPercentAt(start, now time.Time) int {
+	if now.Before(start.Add(-time.Duration(p.FreeHours) * time.Hour)) {
+		return 100
+	}
+	return p.RefundPercent
+}
+
+// Refund is owed to a passenger who paid for a cancelled booking.
+type Refund struct {
+	Passenger uuid.UUID `json:"passenger"`
+	BookingID uuid.UUID `json:"bookingId" bson:"bookingId"`
+	Percent   int       `json:"percent"`
+	Amount    float64   `json:"amount"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Cancellation is the result of cancelling a booking, the refund is nil if
+// the passenger did not pay.
+type Cancellation struct {
+	Booking Booking `json:"booking"`
+	Refund  *Refund `json:"refund,omitempty"`
+}
+
+// Cancel cancels the open booking of the passenger before the trip starts
+// and gives the space back to the offer. A paid booking is removed from the
+// paid spaces and refunded according to the policy, if the creator removes
+// the passenger the full price is refunded. Space occupied before bookings
+// existed is released as well.
+func (o *Offer) Cancel(passenger uuid.UUID, byCreator bool, now time.Time) (*Cancellation, error) {
+	if !now.Before(o.StartDateTime) {
+		return nil, ErrTripStarted
+	}
+
+	i := slices.IndexFunc(o.Bookings, func(booking Booking) bool {
+		return booking.Passenger == passenger && booking.State.Open()
+	})
+	if i < 0 {
+		// occupied without a booking, it is kept as a cancelled one
+		j := slices.IndexFunc(o.OccupiedSpace, func(space Space) bool { return space.Occupier == passenger })
+		if j < 0 {
+			return nil, ErrBookingNotFound
+		}
+		o.Bookings = append(o.Bookings, Booking{
+			ID:        uuid.New(),
+			Passenger: passenger,
+			Space:     o.OccupiedSpace[j],
+			State:     BookingAccepted,
+			CreatedAt: now,
+		})
+		i = len(o.Bookings) - 1
+	}
+	booking, err := o.SetBookingState(o.Bookings[i].ID, BookingCancelled, now)
+	if err != nil {
+		return nil, err
+	}
+
+	cancellation := &Cancellation{Booking: *booking}
+	paid := slices.IndexFunc(o.PaidSpaces, func(space Space) bool { return space.Occupier == passenger })
+	if paid >= 0 {
+		o.PaidSpaces = slices.Delete(o.PaidSpaces, paid, paid+1)
+		percent := 100
+		if !byCreator {
+			percent = o.CancellationPolicy.RefundPercentAt(o.StartDateTime, now)
+		}
+		refund := Refund{
+			Passenger: passenger,
+			BookingID: booking.ID,
+			Percent:   percent,
+			Amount:    o.Price * float64(percent) / 100,
+			CreatedAt: now,
+		}
+		o.Refunds = append(o.Refunds, refund)
+		cancellation.Refund = &refund
+	}
+	return cancellation, nil
+}
@@ -0,0 +1,109 @@
+package repoangebot
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestCancellationPolicy(t *testing.T) {
+	start := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	policy := CancellationPolicy{FreeHours: 24, RefundPercent: 50}
+	if got := policy.RefundPercentAt(start, start.Add(-25*time.Hour)); got != 100 {
+		t.Errorf("expected a full refund before the deadline but got %d", got)
+	}
+	if got := policy.RefundPercentAt(start, start.Add(-24*time.Hour)); got != 50 {
+		t.Errorf("expected a partial refund from the deadline on but got %d", got)
+	}
+	if got := (CancellationPolicy{}).RefundPercentAt(start, start.Add(-time.Minute)); got != 100 {
+		t.Errorf("expected free cancellation until the start without a policy but got %d", got)
+	}
+
+	for _, invalid := range []CancellationPolicy{{FreeHours: -1}, {RefundPercent: -1}, {RefundPercent: 101}} {
+		if err := invalid.Validate(); !errors.Is(err, ErrInvalidPolicy) {
+			t.Errorf("%+v: expected invalid policy but got: %v", invalid, err)
+		}
+	}
+}
+
+func TestOffer_Cancel(t *testing.T) {
+	now := time.Now()
+	passenger := uuid.New()
+	newOffer := func(start time.Time) *Offer {
+		offer := &Offer{
+			Price:              40,
+			StartDateTime:      start,
+			CanTransport:       Space{Seats: 2},
+			CancellationPolicy: CancellationPolicy{FreeHours: 24, RefundPercent: 25},
+		}
+		// the booking was made before the trip started
+		bookedAt := start.Add(-48 * time.Hour)
+		booking, err := offer.RequestBooking(passenger, Space{Seats: 2}, bookedAt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := offer.SetBookingState(booking.ID, BookingAccepted, bookedAt); err != nil {
+			t.Fatal(err)
+		}
+		offer.PaidSpaces = append(offer.PaidSpaces, offer.OccupiedSpace[0])
+		return offer
+	}
+
+	early := newOffer(now.Add(48 * time.Hour))
+	cancellation, err := early.Cancel(passenger, false, now)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cancellation.Booking.State != BookingCancelled || early.Bookings[0].State != BookingCancelled {
+		t.Errorf("expected the booking to be cancelled: %+v", cancellation.Booking)
+	}
+	if len(early.OccupiedSpace) != 0 || len(early.PaidSpaces) != 0 || !early.HasEnoughFreeSpace(Space{Seats: 2}) {
+		t.Errorf("expected the space to be released: %+v %+v", early.OccupiedSpace, early.PaidSpaces)
+	}
+	if cancellation.Refund == nil || cancellation.Refund.Amount != 40 || len(early.Refunds) != 1 {
+		t.Errorf("expected a full refund but got %+v", cancellation.Refund)
+	}
+	if _, err := early.Cancel(passenger, false, now); !errors.Is(err, ErrBookingNotFound) {
+		t.Errorf("expected no booking to be left but got: %v", err)
+	}
+
+	late := newOffer(now.Add(time.Hour))
+	if cancellation, err := late.Cancel(passenger, false, now); err != nil || cancellation.Refund.Percent != 25 || cancellation.Refund.Amount != 10 {
+		t.Errorf("expected a partial refund but got %+v: %v", cancellation, err)
+	}
+	removed := newOffer(now.Add(time.Hour))
+	if cancellation, err := removed.Cancel(passenger, true, now); err != nil || cancellation.Refund.Amount != 40 {
+		t.Errorf("expected a full refund if the creator removes the passenger but got %+v: %v", cancellation, err)
+	}
+	started := newOffer(now.Add(-time.Minute))
+	if _, err := started.Cancel(passenger, false, now); !errors.Is(err, ErrTripStarted) {
+		t.Errorf("expected trip started but got: %v", err)
+	}
+
+	// requested bookings are not paid for
+	requested := &Offer{StartDateTime: now.Add(time.Hour), CanTransport: Space{Seats: 1}}
+	if _, err := requested.RequestBooking(passenger, Space{Seats: 1}, now); err != nil {
+		t.Fatal(err)
+	}
+	if cancellation, err := requested.Cancel(passenger, false, now); err != nil || cancellation.Refund != nil {
+		t.Errorf("expected a cancellation without refund but got %+v: %v", cancellation, err)
+	}
+}
+
+func TestOffer_Cancel_WithoutBooking(t *testing.T) {
+	now := time.Now()
+	passenger := uuid.New()
+	offer := &Offer{
+		StartDateTime: now.Add(time.Hour),
+		OccupiedSpace: SpaceSlice{{Occupier: passenger, Seats: 1}},
+	}
+	cancellation, err := offer.Cancel(passenger, true, now)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(offer.OccupiedSpace) != 0 || len(offer.Bookings) != 1 || cancellation.Booking.State != BookingCancelled || cancellation.Booking.Space.Seats != 1 {
+		t.Errorf("expected the space to be released as a cancelled booking: %+v", offer)
+	}
+}
@@ -0,0 +1,336 @@
+package repoangebot
+
+import (
+	"cmp"
+	"context"
+	"log"
+	"math"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Fields of offers in mongo, the driver stores the Go names in lower case.
+const (
+	fieldPrice        = "price"
+	fieldTitleKey     = "titlekey"
+	fieldCreator      = "creator"
+	fieldDriver       = "driver"
+	fieldStart        = "startdatetime"
+	fieldEnd          = "enddatetime"
+	fieldOccupied     = "occupiedspace"
+	fieldOccupier     = fieldOccupied + ".occupier"
+	fieldSeats        = "cantransport.seats"
+	fieldLocationFrom = "locationfrom"
+	fieldLocationTo   = "locationto"
+	fieldRoute        = "route"
+	fieldBookings     = "bookings"
+	fieldPaid         = "paidspaces"
+	fieldPaidOccupier = fieldPaid + ".occupier"
+	fieldPassenger    = fieldBookings + ".passenger"
+	fieldRefunds      = "refunds"
+	fieldVersion      = "version"
+
+	// legacyOccupiedSpace is where OccupieOffer used to store bookings, the
+	// driver reads it into OccupiedSpace as well.
+	legacyOccupiedSpace = "occupiedSpace"
+)
+
+// titleKey is what NameStartsWith is compared to.
+func titleKey(title string) string {
+	return strings.ToLower(title)
+}
+
+// Query translates the filter into a mongo query. The offers it selects and
+// Matches accepts are exactly those the filter selects. Times are compared in
+// milliseconds like mongo stores them.
+func (f Filter) Query(now time.Time) bson.M {
+	var and bson.A
+	if !f.IncludePassed {
+		and = append(and, bson.M{fieldEnd: bson.M{"$gte": ceilMillis(now)}})
+	}
+	if f.Price != 0 {
+		and = append(and, bson.M{fieldPrice: bson.M{"$lt": f.Price}})
+	}
+	if !f.DateTime.IsZero() {
+		// offers starting on the same day of the month are left out, as the
+		// filter always did
+		and = append(and, bson.M{"$expr": bson.M{"$ne": bson.A{
+			bson.M{"$dayOfMonth": "$" + fieldStart},
+			f.DateTime.Day(),
+		}}})
+	}
+	if f.NameStartsWith != "" {
+		prefix := "^" + regexp.QuoteMeta(titleKey(f.NameStartsWith))
+		and = append(and, bson.M{fieldTitleKey: bson.M{"$regex": prefix}})
+	}
+	// Matches checks the rest, like offers without seats
+	if f.SpaceNeeded.Seats > 0 {
+		and = append(and, bson.M{fieldSeats: bson.M{"$gte": f.SpaceNeeded.Seats}})
+	}
+	if f.Creator != uuid.Nil {
+		and = append(and, bson.M{fieldCreator: f.Creator})
+	}
+	if f.ID != uuid.Nil {
+		and = append(and, bson.M{"_id": f.ID})
+	}
+	if f.User != uuid.Nil {
+		and = append(and, bson.M{"$or": bson.A{
+			bson.M{fieldCreator: f.User},
+			bson.M{fieldOccupier: f.User},
+		}})
+	}
+	if !f.CurrentTime.IsZero() {
+		and = append(and,
+			bson.M{fieldStart: bson.M{"$lte": f.CurrentTime.Truncate(time.Millisecond)}},
+			bson.M{fieldEnd: bson.M{"$gte": ceilMillis(f.CurrentTime)}},
+		)
+	}
+	if f.LocationFrom != emptyLocation {
+		and = append(and, withinRadius(fieldLocationFrom, f.LocationFrom, f.LocationFromDiff))
+	}
+	if f.LocationTo != emptyLocation {
+		and = append(and, withinRadius(fieldLocationTo, f.LocationTo, f.LocationToDiff))
+	}
+	// the index finds the routes passing pickup and drop-off, Matches checks
+	// their order
+	for _, location := range []Location{f.Pickup, f.DropOff} {
+		if location != emptyLocation && f.corridor() <= maxIndexedCorridor {
+			and = append(and, nearRoute(location, f.corridor()))
+		}
+	}
+
+	if len(and) == 0 {
+		return bson.M{}
+	}
+	return bson.M{"$and": and}
+}
+
+// Matches checks what the query can not express, it expects offers selected
+// by Query. The free space depends on the sum of all bookings and is checked
+// the same way as for a booking, the distances are checked exactly and the
+// route is followed from stop to stop.
+func (f Filter) Matches(offer *Offer) bool {
+	if !offer.HasEnoughFreeSpace(f.SpaceNeeded) {
+		return false
+	}
+	// the query only covers positive seats
+	if offer.CanTransport.Seats < f.SpaceNeeded.Seats {
+		return false
+	}
+	if f.LocationFrom != emptyLocation && !offer.LocationFrom.IsInRadius(f.LocationFromDiff, f.LocationFrom) {
+		return false
+	}
+	if f.LocationTo != emptyLocation && !offer.LocationTo.IsInRadius(f.LocationToDiff, f.LocationTo) {
+		return false
+	}
+	if f.Pickup != emptyLocation || f.DropOff != emptyLocation {
+		return offer.AlongRoute(f.Pickup, f.DropOff, f.corridor())
+	}
+	return true
+}
+
+func (f Filter) corridor() float64 {
+	if f.Corridor <= 0 {
+		return DefaultCorridor
+	}
+	return f.Corridor
+}
+
+// Sort orders the offers by the distance of their start from LocationFrom,
+// the order of offers at the same distance is kept.
+func (f Filter) Sort(offers []*Offer) {
+	if f.LocationFrom == emptyLocation {
+		return
+	}
+	slices.SortStableFunc(offers, func(a, b *Offer) int {
+		return cmp.Compare(a.LocationFrom.DistanceTo(f.LocationFrom), b.LocationFrom.DistanceTo(f.LocationFrom))
+	})
+}
+
+// withinRadius selects the locations around the center that may be within the
+// radius. It is slightly larger, so rounding never drops an offer the exact
+// check in Matches keeps.
+func withinRadius(field string, center Location, radius float64) bson.M {
+	radians := min((max(radius, 0)*(1+1e-9)+1e-6)/EarthRadius, math.Pi)
+	return bson.M{field: bson.M{"$geoWithin": bson.M{
+		"$centerSphere": bson.A{bson.A{center.Longitude, center.Latitude}, radians},
+	}}}
+}
+
+// maxIndexedCorridor is the widest corridor in kilometres the query narrows
+// down by the route, wider ones are only checked by Matches.
+const maxIndexedCorridor = 1000.0
+
+// corridorSides is how many sides the polygon around a pickup or drop-off has.
+const corridorSides = 32
+
+// nearRoute selects the routes that may pass the location within the
+// corridor. GeoJSON has no circles, so the routes crossing a polygon around
+// the circle are selected. Its edges touch a slightly larger circle, so
+// rounding never drops an offer the exact check in Matches keeps.
+func nearRoute(location Location, corridor float64) bson.M {
+	radius := (corridor*(1+1e-3) + 1e-3) / math.Cos(math.Pi/corridorSides)
+	ring := make(bson.A, 0, corridorSides+1)
+	for i := 0; i < corridorSides; i++ {
+		vertex := location.destination(2*math.Pi*float64(i)/corridorSides, radius)
+		ring = append(ring, bson.A{vertex.Longitude, vertex.Latitude})
+	}
+	ring = append(ring, ring[0])
+	return bson.M{fieldRoute: bson.M{"$geoIntersects": bson.M{
+		"$geometry": bson.M{"type": "Polygon", "coordinates": bson.A{ring}},
+	}}}
+}
+
+// destination returns the location the distance in kilometres away in the
+// direction of the bearing in radians.
+func (l Location) destination(bearing, distance float64) Location {
+	lat1, lon1 := l.Latitude*math.Pi/180, l.Longitude*math.Pi/180
+	angle := distance / EarthRadius
+	lat2 := math.Asin(math.Sin(lat1)*math.Cos(angle) + math.Cos(lat1)*math.Sin(angle)*math.Cos(bearing))
+	lon2 := lon1 + math.Atan2(math.Sin(bearing)*math.Sin(angle)*math.Cos(lat1), math.Cos(angle)-math.Sin(lat1)*math.Sin(lat2))
+	// back into ±180 degrees
+	lon2 = math.Mod(lon2+3*math.Pi, 2*math.Pi) - math.Pi
+	return Location{Longitude: lon2 * 180 / math.Pi, Latitude: lat2 * 180 / math.Pi}
+}
+
+// ceilMillis rounds up to the next millisecond, so a stored time is at or
+// after it exactly if it is at or after t.
+func ceilMillis(t time.Time) time.Time {
+	truncated := t.Truncate(time.Millisecond)
+	if truncated.Equal(t) {
+		return t
+	}
+	return truncated.Add(time.Millisecond)
+}
+
+// createFilterIndexes supports the filters the offer search uses most.
+func createFilterIndexes(collection *mongo.Collection) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: fieldEnd, Value: 1}, {Key: fieldStart, Value: 1}}},
+		{Keys: bson.D{{Key: fieldCreator, Value: 1}}},
+		{Keys: bson.D{{Key: fieldOccupier, Value: 1}}},
+		{Keys: bson.D{{Key: fieldDriver, Value: 1}}},
+		{Keys: bson.D{{Key: fieldPaidOccupier, Value: 1}}},
+		{Keys: bson.D{{Key: fieldPassenger, Value: 1}}},
+		{Keys: bson.D{{Key: fieldTitleKey, Value: 1}}},
+		{Keys: bson.D{{Key: fieldPrice, Value: 1}}},
+		{Keys: bson.D{{Key: fieldLocationFrom, Value: "2dsphere"}}},
+		{Keys: bson.D{{Key: fieldLocationTo, Value: "2dsphere"}}},
+		{Keys: bson.D{{Key: fieldRoute, Value: "2dsphere"}}},
+	})
+	return err
+}
+
+// migrateOccupiedSpace moves bookings OccupieOffer stored under the wrong
+// name to the field the queries use. The driver used to read the wrong one if
+// both existed, so it wins.
+func migrateOccupiedSpace(collection *mongo.Collection) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	_, err := collection.UpdateMany(ctx, bson.M{legacyOccupiedSpace: bson.M{"$exists": true}}, bson.A{
+		bson.M{"$set": bson.M{fieldOccupied: "$" + legacyOccupiedSpace}},
+		bson.M{"$unset": legacyOccupiedSpace},
+	})
+	return err
+}
+
+// backfillTitleKeys derives the title key of offers created before it existed.
+func backfillTitleKeys(collection *mongo.Collection) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	cursor, err := collection.Find(ctx, bson.M{fieldTitleKey: bson.M{"$exists": false}})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var offer Offer
+		if err := cursor.Decode(&offer); err != nil {
+			return err
+		}
+		_, err := collection.UpdateOne(ctx, bson.M{"_id": offer.ID}, bson.M{"$set": bson.M{
+			fieldTitleKey: titleKey(offer.Title),
+		}})
+		if err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+// migrateLocations stores the locations of offers created before they were
+// GeoJSON points as such. Invalid ones can not be indexed, they are removed.
+func migrateLocations(collection *mongo.Collection) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	cursor, err := collection.Find(ctx, bson.M{"$or": bson.A{
+		bson.M{fieldLocationFrom + ".longitude": bson.M{"$exists": true}},
+		bson.M{fieldLocationTo + ".longitude": bson.M{"$exists": true}},
+	}})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var offer struct {
+			ID           uuid.UUID `bson:"_id"`
+			LocationFrom Location  `bson:"locationfrom"`
+			LocationTo   Location  `bson:"locationto"`
+		}
+		if err := cursor.Decode(&offer); err != nil {
+			return err
+		}
+		update := bson.M{}
+		for field, location := range map[string]Location{fieldLocationFrom: offer.LocationFrom, fieldLocationTo: offer.LocationTo} {
+			if !location.Valid() {
+				log.Printf("Removing invalid location %s of offer %s: %v", field, offer.ID, location)
+				update[field] = nil
+				continue
+			}
+			update[field] = location
+		}
+		if _, err := collection.UpdateOne(ctx, bson.M{"_id": offer.ID}, bson.M{"$set": update}); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+// migrateRoutes stores the routes of offers created before they were GeoJSON
+// line strings as such, offers without a route get the straight one through
+// their stops.
+func migrateRoutes(collection *mongo.Collection) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	cursor, err := collection.Find(ctx, bson.M{"$or": bson.A{
+		bson.M{fieldRoute: bson.M{"$type": "array"}},
+		bson.M{fieldRoute: nil},
+	}})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var offer Offer
+		if err := cursor.Decode(&offer); err != nil {
+			return err
+		}
+		route := Line(offer.Path())
+		if _, _, err := route.MarshalBSONValue(); err != nil {
+			log.Printf("Removing invalid route of offer %s: %v", offer.ID, err)
+			route = nil
+		}
+		if _, err := collection.UpdateOne(ctx, bson.M{"_id": offer.ID}, bson.M{"$set": bson.M{fieldRoute: route}}); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
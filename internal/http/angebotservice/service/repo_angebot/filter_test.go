@@ -0,0 +1,414 @@
+package repoangebot
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// legacyMatches is the filter as GetOffersByFilter applied it to every offer
+// before the query was made in mongo.
+func legacyMatches(ft Filter, offer Offer, now time.Time) bool {
+	if !ft.IncludePassed {
+		if offer.EndDateTime.Before(now) {
+			return false
+		}
+	}
+	if ft.Price != 0 && offer.Price >= ft.Price {
+		return false
+	}
+	var nullTime = time.Time{}
+	if ft.DateTime != nullTime && offer.StartDateTime.Day() == ft.DateTime.Day() {
+		return false
+	}
+	if !strings.HasPrefix(strings.ToLower(offer.Title), strings.ToLower(ft.NameStartsWith)) {
+		return false
+	}
+	if !offer.HasEnoughFreeSpace(ft.SpaceNeeded) {
+		return false
+	}
+	if offer.CanTransport.Seats < ft.SpaceNeeded.Seats {
+		return false
+	}
+	if ft.Creator != uuid.Nil && offer.Creator != ft.Creator {
+		return false
+	}
+	if ft.ID != uuid.Nil && offer.ID != ft.ID {
+		return false
+	}
+	if ft.User != uuid.Nil {
+		if !slices.Contains(offer.OccupiedSpace.Users(), ft.User) && offer.Creator != ft.User {
+			return false
+		}
+	}
+	if !ft.CurrentTime.IsZero() {
+		if ft.CurrentTime.Before(offer.StartDateTime) || ft.CurrentTime.After(offer.EndDateTime) {
+			return false
+		}
+	}
+	if ft.LocationFrom != emptyLocation && !offer.LocationFrom.IsInRadius(ft.LocationFromDiff, ft.LocationFrom) {
+		return false
+	}
+	if ft.LocationTo != emptyLocation && !offer.LocationTo.IsInRadius(ft.LocationToDiff, ft.LocationTo) {
+		return false
+	}
+	return true
+}
+
+// stored returns the offer as mongo stores it and as the repo reads it back.
+func stored(t *testing.T, offer Offer) (bson.M, Offer) {
+	t.Helper()
+	offer.TitleKey = titleKey(offer.Title)
+	data, err := bson.Marshal(offer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc bson.M
+	var decoded Offer
+	if err := bson.Unmarshal(data, &doc); err != nil {
+		t.Fatal(err)
+	}
+	if err := bson.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	return doc, decoded
+}
+
+// encode returns the query as mongo receives it.
+func encode(t *testing.T, query bson.M) bson.M {
+	t.Helper()
+	data, err := bson.Marshal(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var encoded bson.M
+	if err := bson.Unmarshal(data, &encoded); err != nil {
+		t.Fatal(err)
+	}
+	return encoded
+}
+
+// matchDocument evaluates the query on the document like mongo would, as far
+// as Filter.Query uses its operators.
+func matchDocument(t *testing.T, query bson.M, doc bson.M) bool {
+	for key, condition := range query {
+		var ok bool
+		switch key {
+		case "$and", "$or":
+			ok = key == "$and"
+			for _, sub := range condition.(bson.A) {
+				if matchDocument(t, sub.(bson.M), doc) != ok {
+					ok = !ok
+					break
+				}
+			}
+		case "$expr":
+			ok = evalExpression(t, condition, doc).(bool)
+		default:
+			ok = matchField(t, lookup(doc, strings.Split(key, ".")), condition)
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// lookup returns the values at the path, arrays on the way are searched.
+func lookup(value any, path []string) []any {
+	if len(path) == 0 {
+		if array, ok := value.(bson.A); ok {
+			return append([]any{value}, array...)
+		}
+		return []any{value}
+	}
+	switch v := value.(type) {
+	case bson.M:
+		field, ok := v[path[0]]
+		if !ok {
+			return nil
+		}
+		return lookup(field, path[1:])
+	case bson.A:
+		var values []any
+		for _, element := range v {
+			values = append(values, lookup(element, path)...)
+		}
+		return values
+	}
+	return nil
+}
+
+func matchField(t *testing.T, values []any, condition any) bool {
+	operators, ok := condition.(bson.M)
+	if !ok {
+		return slices.ContainsFunc(values, func(value any) bool { return compare(value, condition) == 0 })
+	}
+	for operator, operand := range operators {
+		ok := slices.ContainsFunc(values, func(value any) bool {
+			switch operator {
+			case "$regex":
+				s, isString := value.(string)
+				return isString && regexp.MustCompile(operand.(string)).MatchString(s)
+			case "$lt":
+				return compare(value, operand) == -1
+			case "$lte":
+				c := compare(value, operand)
+				return c == -1 || c == 0
+			case "$gt":
+				return compare(value, operand) == 1
+			case "$gte":
+				c := compare(value, operand)
+				return c == 1 || c == 0
+			case "$geoWithin":
+				point, isPoint := value.(bson.M)
+				if !isPoint || point["type"] != "Point" {
+					return false
+				}
+				sphere := operand.(bson.M)["$centerSphere"].(bson.A)
+				center, radians := sphere[0].(bson.A), sphere[1].(float64)
+				coordinates := point["coordinates"].(bson.A)
+				location := Location{Longitude: coordinates[0].(float64), Latitude: coordinates[1].(float64)}
+				return location.DistanceTo(Location{Longitude: center[0].(float64), Latitude: center[1].(float64)}) <= radians*EarthRadius
+			}
+			t.Fatalf("unsupported operator %s", operator)
+			return false
+		})
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func evalExpression(t *testing.T, expression any, doc bson.M) any {
+	switch e := expression.(type) {
+	case string:
+		if strings.HasPrefix(e, "$") {
+			values := lookup(doc, strings.Split(e[1:], "."))
+			if len(values) == 0 {
+				return nil
+			}
+			return values[0]
+		}
+		return e
+	case bson.M:
+		for operator, operand := range e {
+			switch operator {
+			case "$ne":
+				args := operand.(bson.A)
+				return compare(evalExpression(t, args[0], doc), evalExpression(t, args[1], doc)) != 0
+			case "$dayOfMonth":
+				return int64(evalExpression(t, operand, doc).(primitive.DateTime).Time().UTC().Day())
+			}
+			t.Fatalf("unsupported expression %s", operator)
+		}
+	}
+	return expression
+}
+
+// compare returns -1, 0 or 1, or 2 if the values can not be compared.
+func compare(a, b any) int {
+	if x, ok := number(a); ok {
+		if y, ok := number(b); ok {
+			return cmpFloat(x, y)
+		}
+		return 2
+	}
+	switch x := a.(type) {
+	case primitive.DateTime:
+		if y, ok := b.(primitive.DateTime); ok {
+			return cmpFloat(float64(x), float64(y))
+		}
+	case string:
+		if y, ok := b.(string); ok {
+			return strings.Compare(x, y)
+		}
+	case primitive.Binary:
+		if y, ok := b.(primitive.Binary); ok && x.Subtype == y.Subtype && bytes.Equal(x.Data, y.Data) {
+			return 0
+		}
+	}
+	return 2
+}
+
+func number(value any) (float64, bool) {
+	switch v := value.(type) {
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+func cmpFloat(x, y float64) int {
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	case x == y:
+		return 0
+	}
+	return 2
+}
+
+func TestFilter_Equivalent(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	pick := func(n int) int { return rng.Intn(n) }
+
+	// now is between two milliseconds, times close to it are on both sides
+	now := time.Date(2026, 3, 31, 23, 30, 0, 500_400, time.UTC)
+	base := now.Truncate(time.Millisecond)
+	offsets := []time.Duration{-48 * time.Hour, -time.Hour, -time.Millisecond, 0, time.Millisecond, 30 * time.Minute, 2 * time.Hour, 40 * time.Hour}
+	moment := func() time.Time { return base.Add(offsets[pick(len(offsets))]) }
+
+	users := []uuid.UUID{uuid.New(), uuid.New(), uuid.New(), uuid.New()}
+	titles := []string{"Umzug nach Berlin", "umzug", "Über die Alpen", "über", "a.b", "axb", "Sofa*", "", "Fahrt"}
+	prefixes := []string{"", "um", "UMZUG ", "üb", "ÜBER", "a.", "sofa*", "x", "fahrt nach"}
+	coordinates := []float64{0, 0.5, 1, 1.5, 3, -1}
+	// half a degree is about 56 km
+	radii := []float64{-1, 0, 50, 56, 80, 112, 200, 400}
+	prices := []float64{0, 5, 10, 20}
+	location := func() Location {
+		return Location{Longitude: coordinates[pick(len(coordinates))], Latitude: coordinates[pick(len(coordinates))]}
+	}
+	space := func(seats int) Space {
+		return Space{Occupier: users[pick(len(users))], Seats: seats, Items: make([]Item, pick(3))}
+	}
+
+	var docs []bson.M
+	var offers []Offer
+	for range 300 {
+		start := moment()
+		offer := Offer{
+			ID:            uuid.New(),
+			Creator:       users[pick(len(users))],
+			Driver:        users[pick(len(users))],
+			Title:         titles[pick(len(titles))],
+			Price:         prices[pick(len(prices))],
+			LocationFrom:  location(),
+			LocationTo:    location(),
+			StartDateTime: start,
+			EndDateTime:   start.Add(offsets[pick(len(offsets))]),
+			CanTransport:  Space{Seats: pick(4), Items: make([]Item, pick(4))},
+		}
+		for range pick(3) {
+			offer.OccupiedSpace = append(offer.OccupiedSpace, space(pick(2)))
+		}
+		doc, decoded := stored(t, offer)
+		docs = append(docs, doc)
+		offers = append(offers, decoded)
+	}
+
+	zone := time.FixedZone("UTC+14", 14*60*60)
+	for i := range 3000 {
+		var ft Filter
+		ft.IncludePassed = pick(2) == 0
+		if pick(3) == 0 {
+			ft.Price = prices[pick(len(prices))]
+		}
+		if pick(4) == 0 {
+			ft.DateTime = moment().In(zone)
+		}
+		if pick(3) == 0 {
+			ft.NameStartsWith = prefixes[pick(len(prefixes))]
+		}
+		if pick(3) == 0 {
+			ft.SpaceNeeded = Space{Seats: pick(4) - 1, Items: make([]Item, pick(3))}
+		}
+		if pick(4) == 0 {
+			ft.Creator = users[pick(len(users))]
+		}
+		if pick(4) == 0 {
+			ft.User = users[pick(len(users))]
+		}
+		if pick(10) == 0 {
+			ft.ID = offers[pick(len(offers))].ID
+		}
+		if pick(4) == 0 {
+			ft.CurrentTime = moment().Add(time.Duration(pick(3)-1) * 300 * time.Microsecond)
+		}
+		if pick(3) == 0 {
+			ft.LocationFrom, ft.LocationFromDiff = location(), radii[pick(len(radii))]
+		}
+		if pick(3) == 0 {
+			ft.LocationTo, ft.LocationToDiff = location(), radii[pick(len(radii))]
+		}
+
+		query := encode(t, ft.Query(now))
+		for j, doc := range docs {
+			want := legacyMatches(ft, offers[j], now)
+			got := matchDocument(t, query, doc) && ft.Matches(&offers[j])
+			if got != want {
+				t.Fatalf("filter %d %+v on offer %+v: expected %v but got %v with query %v", i, ft, offers[j], want, got, query)
+			}
+		}
+	}
+}
+
+func TestFilter_Query(t *testing.T) {
+	if query := (Filter{IncludePassed: true}).Query(time.Now()); len(query) != 0 {
+		t.Errorf("expected an empty query but got %v", query)
+	}
+
+	// everything but the free space and the exact distance is left to mongo
+	ft := Filter{
+		Price:          10,
+		DateTime:       time.Now(),
+		NameStartsWith: "Um",
+		SpaceNeeded:    Space{Seats: 1},
+		User:           uuid.New(),
+		Creator:        uuid.New(),
+		CurrentTime:    time.Now(),
+		ID:             uuid.New(),
+		LocationFrom:   Location{Longitude: 8, Latitude: 50},
+		LocationTo:     Location{Longitude: 13, Latitude: 52},
+		Pickup:         Location{Longitude: 9, Latitude: 50},
+	}
+	query := fmt.Sprint(ft.Query(time.Now()))
+	for _, field := range []string{fieldEnd, fieldStart, fieldPrice, fieldTitleKey, fieldSeats, fieldCreator, fieldOccupier, "_id", fieldLocationFrom, fieldLocationTo, fieldRoute} {
+		if !strings.Contains(query, field) {
+			t.Errorf("expected %s in the query %s", field, query)
+		}
+	}
+}
+
+func TestFilter_Sort(t *testing.T) {
+	berlin := Location{Longitude: 13.405, Latitude: 52.52}
+	near := &Offer{Title: "near", LocationFrom: Location{Longitude: 13.5, Latitude: 52.5}}
+	far := &Offer{Title: "far", LocationFrom: Location{Longitude: 11.58, Latitude: 48.14}}
+	farToo := &Offer{Title: "far too", LocationFrom: far.LocationFrom}
+
+	offers := []*Offer{far, near, farToo}
+	(Filter{}).Sort(offers)
+	if offers[0] != far || offers[1] != near {
+		t.Errorf("expected the order to be kept without a location")
+	}
+	(Filter{LocationFrom: berlin}).Sort(offers)
+	if offers[0] != near || offers[1] != far || offers[2] != farToo {
+		t.Errorf("expected the nearest offer first and equal distances in order but got %s, %s, %s", offers[0].Title, offers[1].Title, offers[2].Title)
+	}
+}
+
+func TestCeilMillis(t *testing.T) {
+	exact := time.Date(2026, 1, 1, 0, 0, 0, 5_000_000, time.UTC)
+	if got := ceilMillis(exact); !got.Equal(exact) {
+		t.Errorf("expected %v but got %v", exact, got)
+	}
+	if got := ceilMillis(exact.Add(1)); !got.Equal(exact.Add(time.Millisecond)) {
+		t.Errorf("expected the next millisecond but got %v", got)
+	}
+}
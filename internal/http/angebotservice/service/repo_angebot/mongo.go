@@ -2,10 +2,8 @@ package repoangebot
 
 import (
 	"context"
-	"fmt"
-	"log"
+	"errors"
 	"slices"
-	"strings"
 	"time"
 
 	"github.com/google/uuid"
@@ -18,11 +16,6 @@ type MongoRepo struct {
 	offerCollection *mongo.Collection
 }
 
-func (r *MongoRepo) ReleaseOffer(offerId uuid.UUID) error {
-	//TODO implement me
-	panic("implement me")
-}
-
 const (
 	CollectionName = "offers"
 	DBName         = "MyCargonaut"
@@ -33,9 +26,26 @@ func NewMongoRepo(mongoUri string) (*MongoRepo, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &MongoRepo{
+	repo := &MongoRepo{
 		offerCollection: client.Database(DBName).Collection(CollectionName),
-	}, nil
+	}
+
+	if err := migrateLocations(repo.offerCollection); err != nil {
+		return nil, err
+	}
+	if err := migrateRoutes(repo.offerCollection); err != nil {
+		return nil, err
+	}
+	if err := migrateOccupiedSpace(repo.offerCollection); err != nil {
+		return nil, err
+	}
+	if err := backfillTitleKeys(repo.offerCollection); err != nil {
+		return nil, err
+	}
+	if err := createFilterIndexes(repo.offerCollection); err != nil {
+		return nil, err
+	}
+	return repo, nil
 }
 
 func (r *MongoRepo) DeleteOffer(offerId uuid.UUID) error {
@@ -43,9 +53,121 @@ func (r *MongoRepo) DeleteOffer(offerId uuid.UUID) error {
 	return err
 }
 
+// GetOffersOfUser returns all offers the user is involved in, including past ones.
+func (r *MongoRepo) GetOffersOfUser(userId uuid.UUID) ([]*Offer, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	cur, err := r.offerCollection.Find(ctx, involving(userId))
+	if err != nil {
+		return nil, err
+	}
+	var offers []*Offer
+	if err := cur.All(ctx, &offers); err != nil {
+		return nil, err
+	}
+	return offers, nil
+}
+
+// involving selects the offers Offer.Involves the user in, every field is
+// indexed.
+func involving(userId uuid.UUID) bson.M {
+	return bson.M{"$or": bson.A{
+		bson.M{fieldCreator: userId},
+		bson.M{fieldDriver: userId},
+		bson.M{fieldOccupier: userId},
+		bson.M{fieldPaidOccupier: userId},
+		bson.M{fieldPassenger: userId},
+	}}
+}
+
+// EraseUser deletes the offers of a deleted user and removes the user from
+// the offers of others.
+func (r *MongoRepo) EraseUser(userId uuid.UUID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	cur, err := r.offerCollection.Find(ctx, involving(userId))
+	if err != nil {
+		return err
+	}
+	var offers []*Offer
+	if err := cur.All(ctx, &offers); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, offer := range offers {
+		if offer.Creator == userId {
+			if _, err := r.offerCollection.DeleteOne(ctx, bson.M{"_id": offer.ID}); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := r.eraseFromOffer(ctx, offer, userId, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// eraseAttempts is how often removing a user from an offer is tried when the
+// offer is changed concurrently.
+const eraseAttempts = 3
+
+// eraseFromOffer removes the user from the offer of someone else. If the
+// offer was changed in the meantime it is read again, so concurrent bookings
+// are not overwritten.
+func (r *MongoRepo) eraseFromOffer(ctx context.Context, offer *Offer, userId uuid.UUID, now time.Time) error {
+	for attempt := 1; ; attempt++ {
+		if !offer.EraseUser(userId, now) {
+			return nil
+		}
+		err := r.updateVersioned(ctx, offer, withoutVersion(offer))
+		if !errors.Is(err, ErrConflict) || attempt == eraseAttempts {
+			return err
+		}
+		id := offer.ID
+		offer = &Offer{}
+		err = r.offerCollection.FindOne(ctx, bson.M{"_id": id}).Decode(offer)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// EditOffer stores what the creator can change of the offer, unless it was
+// changed since it was read.
 func (r *MongoRepo) EditOffer(offerId uuid.UUID, userId uuid.UUID, offer *Offer) error {
-	_, err := r.offerCollection.UpdateOne(context.Background(), bson.M{"_id": offerId}, bson.M{"$set": offer})
-	return err
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	offer.ID = offerId
+	offer.TitleKey = titleKey(offer.Title)
+	set, err := editable(offer)
+	if err != nil {
+		return err
+	}
+	return r.updateVersioned(ctx, offer, set)
+}
+
+// serverOwned are the fields of an offer only the service changes.
+var serverOwned = []string{"_id", fieldCreator, "createdat", "imageurl", fieldOccupied, fieldPaid, fieldBookings, fieldRefunds, fieldVersion}
+
+// editable returns the fields of the offer without the server owned ones.
+func editable(offer *Offer) (bson.M, error) {
+	data, err := bson.Marshal(offer)
+	if err != nil {
+		return nil, err
+	}
+	var set bson.M
+	if err := bson.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+	for _, field := range serverOwned {
+		delete(set, field)
+	}
+	return set, nil
 }
 
 func (r *MongoRepo) Close() error {
@@ -53,141 +175,109 @@ func (r *MongoRepo) Close() error {
 }
 
 func (r *MongoRepo) CreateOffer(offer *Offer) error {
+	offer.TitleKey = titleKey(offer.Title)
 	_, err := r.offerCollection.InsertOne(context.Background(), offer)
 	return err
 }
 
+// UpdateOffer stores the whole offer, unless it was changed since it was
+// read.
 func (r *MongoRepo) UpdateOffer(offerId uuid.UUID, offer *Offer) error {
-	_, err := r.offerCollection.UpdateOne(context.Background(), bson.M{"_id": offerId}, bson.M{"$set": offer})
-	return err
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	offer.ID = offerId
+	offer.TitleKey = titleKey(offer.Title)
+	return r.updateVersioned(ctx, offer, withoutVersion(offer))
 }
 
 func (r *MongoRepo) GetOffer(id uuid.UUID) (*Offer, error) {
 	var offer Offer
 	err := r.offerCollection.FindOne(context.Background(), bson.M{"_id": id}).Decode(&offer)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrOfferNotFound
+	}
 	return &offer, err
 }
 
+// GetOffersByFilter queries the offers matching the filter, only the checks
+// mongo can not do are made here. With a start location the nearest offers
+// come first.
 func (r *MongoRepo) GetOffersByFilter(ft Filter) ([]*Offer, error) {
-	var offers []*Offer
-
-	// Nur Angebote laden, die nicht belegt sind
-	cur, err := r.offerCollection.Find(context.Background(), bson.M{})
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	cur, err := r.offerCollection.Find(ctx, ft.Query(time.Now()))
 	if err != nil {
 		return []*Offer{}, err
 	}
-	defer func() {
-		if err := cur.Close(context.Background()); err != nil {
-			log.Printf("Fehler beim Schließen der Cursor: %v", err)
-		}
-	}()
-
-	for cur.Next(context.Background()) {
-		var offer Offer
-		if err := cur.Decode(&offer); err != nil {
-			return []*Offer{}, err
-		}
-
-		if !ft.IncludePassed {
-			if offer.EndDateTime.Before(time.Now()) {
-				continue
-			}
-		}
-
-		if ft.Price != 0 && offer.Price >= ft.Price {
-			continue
-		}
-		var nullTime = time.Time{}
-		if ft.DateTime != nullTime && offer.StartDateTime.Day() == ft.DateTime.Day() {
-			continue
-		}
-
-		// Titel-Filter
-		if !strings.HasPrefix(strings.ToLower(offer.Title), strings.ToLower(ft.NameStartsWith)) {
-			continue
-		}
-
-		// Transportgröße prüfen
-		if !offer.HasEnoughFreeSpace(ft.SpaceNeeded) {
-			continue
-		}
-
-		// Sitzanzahl prüfen
-		if offer.CanTransport.Seats < ft.SpaceNeeded.Seats {
-			continue
-		}
-
-		// Creator-Filter
-		if ft.Creator != uuid.Nil && offer.Creator != ft.Creator {
-			continue
-		}
-
-		// ID-Filter
-		if ft.ID != uuid.Nil && offer.ID != ft.ID {
-			continue
-		}
-
-		// Nutzerbezogene Filter (z. B. für eigene oder belegte Angebote)
-		if ft.User != uuid.Nil {
-			if !slices.Contains(offer.OccupiedSpace.Users(), ft.User) && offer.Creator != ft.User {
-				continue
-			}
-		}
-
-		// Zeitfilter: ft.CurrentTime muss innerhalb von Start–Ende liegen
-		if !ft.CurrentTime.IsZero() {
-			if ft.CurrentTime.Before(offer.StartDateTime) || ft.CurrentTime.After(offer.EndDateTime) {
-				continue
-			}
-		}
-
-		// Location-Filter
-		if ft.LocationFrom != emptyLocation && !offer.LocationFrom.IsInRadius(ft.LocationFromDiff, ft.LocationFrom) {
-			continue
-		}
-		if ft.LocationTo != emptyLocation && !offer.LocationTo.IsInRadius(ft.LocationToDiff, ft.LocationTo) {
-			continue
-		}
-
-		// Angebot passt zu allen Filtern
-		offers = append(offers, &offer)
-	}
-
-	// Cursor-Fehler nach Iteration prüfen
-	if err := cur.Err(); err != nil {
+	var offers []*Offer
+	if err := cur.All(ctx, &offers); err != nil {
 		return []*Offer{}, err
 	}
-
+	offers = slices.DeleteFunc(offers, func(offer *Offer) bool {
+		return !ft.Matches(offer)
+	})
+	ft.Sort(offers)
 	return offers, nil
 }
 
-func (r *MongoRepo) OccupieOffer(offerId, userId uuid.UUID, space Space) error {
-	var offer Offer
-	err := r.offerCollection.FindOne(context.Background(), bson.M{"_id": offerId}).Decode(&offer)
+// ReleaseOffer stores the offer after a booking was cancelled: the bookings,
+// the occupied and paid spaces and the refunds, unless the offer was changed
+// since it was read.
+func (r *MongoRepo) ReleaseOffer(offer *Offer) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return r.updateVersioned(ctx, offer, bson.M{
+		fieldBookings: offer.Bookings,
+		fieldOccupied: offer.OccupiedSpace,
+		fieldPaid:     offer.PaidSpaces,
+		fieldRefunds:  offer.Refunds,
+	})
+}
+
+// SaveBookings stores the bookings of the offer and the space they occupy,
+// unless the offer was changed since it was read.
+func (r *MongoRepo) SaveBookings(offer *Offer) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return r.updateVersioned(ctx, offer, bson.M{
+		fieldBookings: offer.Bookings,
+		fieldOccupied: offer.OccupiedSpace,
+	})
+}
+
+// updateVersioned sets the fields of the offer if it is still at the version
+// it was read at and counts the change, ErrConflict is returned otherwise.
+func (r *MongoRepo) updateVersioned(ctx context.Context, offer *Offer, set any) error {
+	result, err := r.offerCollection.UpdateOne(ctx, versioned(offer), changed(set))
 	if err != nil {
 		return err
 	}
-
-	// Prüfen, ob der Platz ausreicht
-	if !offer.HasEnoughFreeSpace(space) {
-		return fmt.Errorf("nicht genug freier Platz im Angebot")
+	if result.MatchedCount == 0 {
+		return ErrConflict
 	}
+	offer.Version++
+	return nil
+}
 
-	spc := Space{
-		Occupier: userId,
-		Items:    space.Items,
-		Seats:    space.Seats,
+// versioned matches the offer as long as it was not changed since it was
+// read, offers that were never changed have no version.
+func versioned(offer *Offer) bson.M {
+	if offer.Version == 0 {
+		return bson.M{"_id": offer.ID, fieldVersion: bson.M{"$exists": false}}
 	}
+	return bson.M{"_id": offer.ID, fieldVersion: offer.Version}
+}
 
-	// Space und User zu den belegten hinzufügen
-	offer.OccupiedSpace = append(offer.OccupiedSpace, spc)
-
-	update := bson.M{
-		"$set": bson.M{
-			"occupiedSpace": offer.OccupiedSpace,
-		},
-	}
+// changed sets the fields and counts the change, so writers holding an older
+// read of the offer get ErrConflict.
+func changed(set any) bson.M {
+	return bson.M{"$set": set, "$inc": bson.M{fieldVersion: 1}}
+}
 
-	_, err = r.offerCollection.UpdateOne(context.Background(), bson.M{"_id": offerId}, update)
-	return err
+// withoutVersion returns a copy of the offer to set as a whole, the version
+// is left out as it is only ever incremented.
+func withoutVersion(offer *Offer) *Offer {
+	copied := *offer
+	copied.Version = 0
+	return &copied
 }
@@ -1,19 +1,39 @@
 package repoangebot
 
 import (
+	"errors"
+	"fmt"
 	"math"
+	"slices"
 	"time"
 
 	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
 )
 
+// EarthRadius is the radius in kilometres distances are computed with, it is
+// the one mongo uses for spherical queries.
+const EarthRadius = 6378.1
+
+// ErrInvalidLocation is returned for coordinates outside of the valid range.
+var ErrInvalidLocation = errors.New("invalid location")
+
+// Location is a point in degrees, it is stored as a GeoJSON point.
 type Location struct {
-	Longitude float64 `json:"longitude" bson:"longitude"`
-	Latitude  float64 `json:"latitude" bson:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Latitude  float64 `json:"latitude"`
 }
 
 var emptyLocation = Location{}
 
+// Valid reports whether the longitude is within ±180 and the latitude within
+// ±90 degrees.
+func (l Location) Valid() bool {
+	return l.Longitude >= -180 && l.Longitude <= 180 && l.Latitude >= -90 && l.Latitude <= 90
+}
+
+// IsInRadius reports whether the location is at most radius kilometres away.
 func (l *Location) IsInRadius(radius float64, location Location) bool {
 	if location.Longitude == 0 && location.Latitude == 0 {
 		return true
@@ -24,10 +44,49 @@ func (l *Location) IsInRadius(radius float64, location Location) bool {
 	return l.DistanceTo(location) <= radius
 }
 
+// DistanceTo returns the great-circle distance in kilometres.
 func (l *Location) DistanceTo(location Location) float64 {
-	dx := l.Longitude - location.Longitude
-	dy := l.Latitude - location.Latitude
-	return math.Sqrt(dx*dx + dy*dy)
+	lat1, lat2 := l.Latitude*math.Pi/180, location.Latitude*math.Pi/180
+	dLat := lat2 - lat1
+	dLon := (location.Longitude - l.Longitude) * math.Pi / 180
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * EarthRadius * math.Asin(math.Sqrt(min(h, 1)))
+}
+
+// geoPoint is a GeoJSON point, offers stored before it was used have the
+// longitude and latitude as fields.
+type geoPoint struct {
+	Type        string    `bson:"type"`
+	Coordinates []float64 `bson:"coordinates"`
+	Longitude   float64   `bson:"longitude,omitempty"`
+	Latitude    float64   `bson:"latitude,omitempty"`
+}
+
+func (l Location) MarshalBSONValue() (bsontype.Type, []byte, error) {
+	if !l.Valid() {
+		return 0, nil, fmt.Errorf("%w: %v, %v", ErrInvalidLocation, l.Longitude, l.Latitude)
+	}
+	return bson.MarshalValue(geoPoint{Type: "Point", Coordinates: []float64{l.Longitude, l.Latitude}})
+}
+
+func (l *Location) UnmarshalBSONValue(t bsontype.Type, data []byte) error {
+	if t == bson.TypeNull {
+		*l = Location{}
+		return nil
+	}
+	var point geoPoint
+	if err := bson.UnmarshalValue(t, data, &point); err != nil {
+		return err
+	}
+	if point.Type == "" {
+		*l = Location{Longitude: point.Longitude, Latitude: point.Latitude}
+		return nil
+	}
+	if point.Type != "Point" || len(point.Coordinates) != 2 {
+		return fmt.Errorf("%w: %s", ErrInvalidLocation, point.Type)
+	}
+	*l = Location{Longitude: point.Coordinates[0], Latitude: point.Coordinates[1]}
+	return nil
 }
 
 type SpaceSlice []Space
@@ -76,6 +135,21 @@ type Size struct {
 	Depth  float64 `json:"depth"`
 }
 
+// FitsIn reports whether something of this size fits into the other size,
+// it may be turned in any direction.
+func (s Size) FitsIn(other Size) bool {
+	own := []float64{s.Width, s.Height, s.Depth}
+	available := []float64{other.Width, other.Height, other.Depth}
+	slices.Sort(own)
+	slices.Sort(available)
+	for i := range own {
+		if own[i] > available[i] {
+			return false
+		}
+	}
+	return true
+}
+
 type Offer struct {
 	ID            uuid.UUID  `json:"id" bson:"_id"`
 	Driver        uuid.UUID  `json:"driver"`
@@ -85,6 +159,8 @@ type Offer struct {
 	Price         float64    `json:"price"`
 	LocationFrom  Location   `json:"locationFrom"`
 	LocationTo    Location   `json:"locationTo"`
+	Waypoints     []Location `json:"waypoints"`
+	Route         Line       `json:"route"`
 	Creator       uuid.UUID  `json:"creator"`
 	CreatedAt     time.Time  `json:"createdAt"`
 	IsChat        bool       `json:"isChat"`
@@ -95,16 +171,77 @@ type Offer struct {
 	CanTransport  Space      `json:"canTransport"`
 	OccupiedSpace SpaceSlice `json:"occupiedSpace"`
 	PaidSpaces    SpaceSlice `json:"paidSpaces"`
-	Restrictions  []string   `json:"restrictions"`
-	Info          []string   `json:"info"`
-	InfoCar       []string   `json:"infoCar"`
-	ImageURL      string     `json:"imageURL"`
+	// AutoAccept accepts booking requests without asking the creator.
+	AutoAccept         bool               `json:"autoAccept"`
+	Bookings           []Booking          `json:"bookings"`
+	CancellationPolicy CancellationPolicy `json:"cancellationPolicy"`
+	Refunds            []Refund           `json:"refunds"`
+	Restrictions       []string           `json:"restrictions"`
+	Info               []string           `json:"info"`
+	InfoCar            []string           `json:"infoCar"`
+	VehicleID          uuid.UUID          `json:"vehicleId"`
+	ImageURL           string             `json:"imageURL"`
+	// TitleKey is the lower case title the title filter searches.
+	TitleKey string `json:"-"`
+	// Version counts the changes of the offer, offers that were never changed
+	// have none.
+	Version int `json:"-" bson:"version,omitempty"`
 }
 
 func (o *Offer) HasEnoughFreeSpace(space Space) bool {
 	return o.OccupiedSpace.Sum().Add(space).Fits(o.CanTransport)
 }
 
+// Involves reports whether the user created, drives or booked the offer.
+func (o *Offer) Involves(userID uuid.UUID) bool {
+	return o.Creator == userID || o.Driver == userID ||
+		slices.Contains(o.OccupiedSpace.Users(), userID) || slices.Contains(o.PaidSpaces.Users(), userID) ||
+		slices.ContainsFunc(o.Bookings, func(booking Booking) bool { return booking.Passenger == userID })
+}
+
+// EraseUser removes a deleted user from an offer the user did not create.
+// Spaces of upcoming trips are released, on past trips the user is only
+// anonymized so the trip stays complete for the others. It reports whether
+// the offer changed.
+func (o *Offer) EraseUser(userID uuid.UUID, now time.Time) bool {
+	changed := false
+	if o.Driver == userID {
+		o.Driver = uuid.Nil
+		changed = true
+	}
+	upcoming := o.StartDateTime.After(now)
+	for _, spaces := range []*SpaceSlice{&o.OccupiedSpace, &o.PaidSpaces} {
+		kept := (*spaces)[:0]
+		for _, space := range *spaces {
+			if space.Occupier == userID {
+				changed = true
+				if upcoming {
+					continue
+				}
+				space.Occupier = uuid.Nil
+			}
+			kept = append(kept, space)
+		}
+		*spaces = kept
+	}
+	bookings := o.Bookings[:0]
+	for _, booking := range o.Bookings {
+		if booking.Passenger == userID {
+			changed = true
+			if upcoming {
+				continue
+			}
+			booking.Passenger, booking.Space.Occupier = uuid.Nil, uuid.Nil
+		}
+		bookings = append(bookings, booking)
+	}
+	o.Bookings = bookings
+	return changed
+}
+
+// Filter selects offers. The radii around the locations are in kilometres,
+// with LocationFrom the offers are sorted by the distance from it. Pickup and
+// DropOff select offers passing them in this order within the corridor.
 type Filter struct {
 	Price            float64   `json:"price"`
 	IncludePassed    bool      `json:"includePassed"`
@@ -113,21 +250,35 @@ type Filter struct {
 	SpaceNeeded      Space     `json:"spaceNeeded"`
 	LocationFrom     Location  `json:"locationFrom"`
 	LocationTo       Location  `json:"locationTo"`
-	LocationFromDiff float64   `json:"locationFromDiff"`
-	LocationToDiff   float64   `json:"locationToDiff"`
+	LocationFromDiff float64   `json:"locationFromDiff"` // km
+	LocationToDiff   float64   `json:"locationToDiff"`   // km
+	Pickup           Location  `json:"pickup"`
+	DropOff          Location  `json:"dropOff"`
+	Corridor         float64   `json:"corridor"` // km, DefaultCorridor if not set
 	User             uuid.UUID `json:"user"`
 	Creator          uuid.UUID `json:"creator"`
 	CurrentTime      time.Time `json:"currentTime"`
 	ID               uuid.UUID `json:"id"`
 }
 
+var (
+	ErrOfferNotFound = errors.New("offer not found")
+	// ErrConflict is returned if the offer was changed since it was read.
+	ErrConflict = errors.New("offer was changed concurrently")
+)
+
 type Repo interface {
 	GetOffer(id uuid.UUID) (*Offer, error)
 	GetOffersByFilter(filter Filter) ([]*Offer, error)
 	CreateOffer(offer *Offer) error
-	OccupieOffer(offerId uuid.UUID, userId uuid.UUID, space Space) error
-	ReleaseOffer(offerId uuid.UUID) error
+	// SaveBookings, ReleaseOffer, UpdateOffer and EditOffer return
+	// ErrConflict if the offer was changed since it was read.
+	SaveBookings(offer *Offer) error
+	ReleaseOffer(offer *Offer) error
 	UpdateOffer(offerId uuid.UUID, offer *Offer) error
+	// EditOffer keeps the creator, the bookings, payments and refunds.
 	EditOffer(offerId uuid.UUID, userId uuid.UUID, offer *Offer) error
 	DeleteOffer(offerId uuid.UUID) error
+	GetOffersOfUser(userId uuid.UUID) ([]*Offer, error)
+	EraseUser(userId uuid.UUID) error
 }
@@ -0,0 +1,187 @@
+package repoangebot
+
+import (
+	"errors"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestOffer_EraseUser(t *testing.T) {
+	now := time.Now()
+	deleted, other := uuid.New(), uuid.New()
+	newOffer := func(start time.Time) *Offer {
+		return &Offer{
+			Driver:        deleted,
+			StartDateTime: start,
+			OccupiedSpace: SpaceSlice{{Occupier: deleted, Seats: 1}, {Occupier: other, Seats: 2}},
+			PaidSpaces:    SpaceSlice{{Occupier: deleted, Seats: 1}},
+		}
+	}
+
+	upcoming := newOffer(now.Add(time.Hour))
+	if !upcoming.EraseUser(deleted, now) {
+		t.Errorf("offer should have changed")
+	}
+	if upcoming.Driver != uuid.Nil {
+		t.Errorf("driver should be removed but got %v", upcoming.Driver)
+	}
+	if len(upcoming.OccupiedSpace) != 1 || upcoming.OccupiedSpace[0].Occupier != other || len(upcoming.PaidSpaces) != 0 {
+		t.Errorf("spaces of upcoming trips should be released: %+v %+v", upcoming.OccupiedSpace, upcoming.PaidSpaces)
+	}
+
+	passed := newOffer(now.Add(-time.Hour))
+	passed.EraseUser(deleted, now)
+	if len(passed.OccupiedSpace) != 2 || passed.OccupiedSpace[0].Occupier != uuid.Nil || passed.PaidSpaces[0].Occupier != uuid.Nil {
+		t.Errorf("spaces of past trips should be anonymized: %+v %+v", passed.OccupiedSpace, passed.PaidSpaces)
+	}
+
+	if passed.EraseUser(deleted, now) {
+		t.Errorf("erasing twice should not change the offer")
+	}
+}
+
+func TestSize_FitsIn(t *testing.T) {
+	trunk := Size{Width: 100, Height: 50, Depth: 80}
+	tests := []struct {
+		name string
+		size Size
+		want bool
+	}{
+		{"smaller", Size{Width: 40, Height: 40, Depth: 40}, true},
+		{"turned", Size{Width: 50, Height: 100, Depth: 80}, true},
+		{"too long", Size{Width: 110, Height: 10, Depth: 10}, false},
+		{"too high in every direction", Size{Width: 60, Height: 60, Depth: 90}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.size.FitsIn(trunk); got != tt.want {
+			t.Errorf("%s: FitsIn() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLocation_DistanceTo(t *testing.T) {
+	berlin := Location{Longitude: 13.405, Latitude: 52.52}
+	munich := Location{Longitude: 11.582, Latitude: 48.135}
+	if got := berlin.DistanceTo(munich); math.Abs(got-505) > 5 {
+		t.Errorf("expected about 505 km from Berlin to Munich but got %.1f", got)
+	}
+	// a degree of longitude gets shorter towards the poles
+	north := Location{Longitude: 0, Latitude: 60}
+	if got := north.DistanceTo(Location{Longitude: 1, Latitude: 60}); math.Abs(got-55.6) > 0.5 {
+		t.Errorf("expected about 55.6 km but got %.1f", got)
+	}
+	east := Location{Longitude: 179.5, Latitude: 0}
+	if got := east.DistanceTo(Location{Longitude: -179.5, Latitude: 0}); math.Abs(got-111.3) > 0.5 {
+		t.Errorf("expected about 111.3 km across the antimeridian but got %.1f", got)
+	}
+	if !berlin.IsInRadius(510, munich) || berlin.IsInRadius(500, munich) {
+		t.Errorf("expected the radius in kilometres")
+	}
+}
+
+func TestLocation_BSON(t *testing.T) {
+	type document struct {
+		Location Location `bson:"location"`
+	}
+	berlin := Location{Longitude: 13.405, Latitude: 52.52}
+
+	data, err := bson.Marshal(document{Location: berlin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var raw bson.M
+	if err := bson.Unmarshal(data, &raw); err != nil {
+		t.Fatal(err)
+	}
+	point := raw["location"].(bson.M)
+	if point["type"] != "Point" || point["coordinates"].(bson.A)[0] != berlin.Longitude {
+		t.Errorf("expected a GeoJSON point but got %v", point)
+	}
+	var decoded document
+	if err := bson.Unmarshal(data, &decoded); err != nil || decoded.Location != berlin {
+		t.Errorf("expected %v but got %v: %v", berlin, decoded.Location, err)
+	}
+
+	// offers stored before the GeoJSON points
+	legacy, _ := bson.Marshal(bson.M{"location": bson.M{"longitude": berlin.Longitude, "latitude": berlin.Latitude}})
+	decoded = document{}
+	if err := bson.Unmarshal(legacy, &decoded); err != nil || decoded.Location != berlin {
+		t.Errorf("expected %v but got %v: %v", berlin, decoded.Location, err)
+	}
+	null, _ := bson.Marshal(bson.M{"location": nil})
+	decoded = document{Location: berlin}
+	if err := bson.Unmarshal(null, &decoded); err != nil || decoded.Location != emptyLocation {
+		t.Errorf("expected no location but got %v: %v", decoded.Location, err)
+	}
+
+	if _, err := bson.Marshal(document{Location: Location{Longitude: 200}}); !errors.Is(err, ErrInvalidLocation) {
+		t.Errorf("expected invalid location but got: %v", err)
+	}
+}
+
+func TestEditable(t *testing.T) {
+	offer := &Offer{
+		ID:         uuid.New(),
+		Creator:    uuid.New(),
+		Title:      "Leipzig - Berlin",
+		Bookings:   []Booking{{ID: uuid.New()}},
+		PaidSpaces: SpaceSlice{{Occupier: uuid.New()}},
+		Version:    3,
+	}
+	set, err := editable(offer)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, field := range serverOwned {
+		if _, ok := set[field]; ok {
+			t.Errorf("expected %s to be left out", field)
+		}
+	}
+	if set["title"] != offer.Title {
+		t.Errorf("expected the title to be set: %v", set)
+	}
+}
+
+func TestInvolving(t *testing.T) {
+	user := uuid.New()
+	roles := map[string]*Offer{
+		fieldCreator:      {Creator: user},
+		fieldDriver:       {Driver: user},
+		fieldOccupier:     {OccupiedSpace: SpaceSlice{{Occupier: user}}},
+		fieldPaidOccupier: {PaidSpaces: SpaceSlice{{Occupier: user}}},
+		fieldPassenger:    {Bookings: []Booking{{Passenger: user}}},
+	}
+	or := involving(user)["$or"].(bson.A)
+	if len(or) != len(roles) {
+		t.Fatalf("expected a condition per role: %v", or)
+	}
+	for _, condition := range or {
+		for field := range condition.(bson.M) {
+			offer, ok := roles[field]
+			if !ok {
+				t.Fatalf("unexpected field %s", field)
+			}
+			if !offer.Involves(user) {
+				t.Errorf("offer selected by %s should involve the user", field)
+			}
+			data, err := bson.Marshal(offer)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			// arrays are matched by their first element here
+			path := strings.Split(field, ".")
+			if len(path) == 2 {
+				path = []string{path[0], "0", path[1]}
+			}
+			var stored uuid.UUID
+			if err := bson.Raw(data).Lookup(path...).Unmarshal(&stored); err != nil || stored != user {
+				t.Errorf("expected the user stored under %s but got %v: %v", field, stored, err)
+			}
+		}
+	}
+}
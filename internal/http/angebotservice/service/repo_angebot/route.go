@@ -0,0 +1,184 @@
+package repoangebot
+
+import (
+	"fmt"
+	"math"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+)
+
+// DefaultCorridor is how far in kilometres pickup and drop-off may be from the
+// route if the filter does not say.
+const DefaultCorridor = 5.0
+
+// Line is the route of an offer. It is stored as a GeoJSON line string, so
+// the offers passing a location can be found by an index, a line through a
+// single location as a point.
+type Line []Location
+
+// geoLine is a GeoJSON line string, routes stored before it was used are
+// arrays of points.
+type geoLine struct {
+	Type        string      `bson:"type"`
+	Coordinates [][]float64 `bson:"coordinates"`
+}
+
+func (l Line) MarshalBSONValue() (bsontype.Type, []byte, error) {
+	// a line string can not repeat a location right away
+	var coordinates [][]float64
+	for i, location := range l {
+		if !location.Valid() {
+			return 0, nil, fmt.Errorf("%w: %v, %v", ErrInvalidLocation, location.Longitude, location.Latitude)
+		}
+		if i > 0 && location == l[i-1] {
+			continue
+		}
+		coordinates = append(coordinates, []float64{location.Longitude, location.Latitude})
+	}
+	switch len(coordinates) {
+	case 0:
+		return bson.TypeNull, nil, nil
+	case 1:
+		return bson.MarshalValue(geoPoint{Type: "Point", Coordinates: coordinates[0]})
+	}
+	return bson.MarshalValue(geoLine{Type: "LineString", Coordinates: coordinates})
+}
+
+func (l *Line) UnmarshalBSONValue(t bsontype.Type, data []byte) error {
+	switch t {
+	case bson.TypeNull:
+		*l = nil
+		return nil
+	case bson.TypeArray:
+		var locations []Location
+		if err := bson.UnmarshalValue(t, data, &locations); err != nil {
+			return err
+		}
+		*l = locations
+		return nil
+	}
+	var raw bson.RawValue
+	raw.Type, raw.Value = t, data
+	var kind struct {
+		Type string `bson:"type"`
+	}
+	if err := raw.Unmarshal(&kind); err != nil {
+		return err
+	}
+	if kind.Type == "Point" {
+		var location Location
+		if err := location.UnmarshalBSONValue(t, data); err != nil {
+			return err
+		}
+		*l = Line{location}
+		return nil
+	}
+	var line geoLine
+	if err := raw.Unmarshal(&line); err != nil {
+		return err
+	}
+	if line.Type != "LineString" {
+		return fmt.Errorf("%w: %s", ErrInvalidLocation, line.Type)
+	}
+	locations := make(Line, 0, len(line.Coordinates))
+	for _, coordinates := range line.Coordinates {
+		if len(coordinates) != 2 {
+			return fmt.Errorf("%w: %v", ErrInvalidLocation, coordinates)
+		}
+		locations = append(locations, Location{Longitude: coordinates[0], Latitude: coordinates[1]})
+	}
+	*l = locations
+	return nil
+}
+
+// Stops returns the start, the waypoints and the destination of the offer.
+func (o *Offer) Stops() []Location {
+	stops := make([]Location, 0, len(o.Waypoints)+2)
+	stops = append(stops, o.LocationFrom)
+	stops = append(stops, o.Waypoints...)
+	return append(stops, o.LocationTo)
+}
+
+// Path returns the route of the offer, offers without one go straight from
+// stop to stop.
+func (o *Offer) Path() []Location {
+	if len(o.Route) >= 2 {
+		return o.Route
+	}
+	return o.Stops()
+}
+
+// alongRoute returns the positions along the path, in kilometres from its
+// start, where the path passes the location within the corridor. A path
+// passing more than once has a position per segment.
+func alongRoute(path []Location, location Location, corridor float64) []float64 {
+	var positions []float64
+	start := 0.0
+	for i := 1; i < len(path); i++ {
+		distance, along := toSegment(path[i-1], path[i], location)
+		if distance <= corridor {
+			positions = append(positions, start+along)
+		}
+		start += path[i-1].DistanceTo(path[i])
+	}
+	if len(path) == 1 && path[0].DistanceTo(location) <= corridor {
+		positions = append(positions, 0)
+	}
+	return positions
+}
+
+// toSegment returns the distance of the location from the great-circle
+// segment between a and b and how far along the segment the nearest point is,
+// both in kilometres.
+func toSegment(a, b, location Location) (float64, float64) {
+	length := a.DistanceTo(b)
+	fromA := a.DistanceTo(location)
+	if length == 0 || fromA == 0 {
+		return fromA, 0
+	}
+	angle := fromA / EarthRadius
+	offset := a.bearingTo(location) - a.bearingTo(b)
+	crossTrack := math.Asin(math.Max(-1, math.Min(1, math.Sin(angle)*math.Sin(offset))))
+	alongTrack := math.Acos(math.Max(-1, math.Min(1, math.Cos(angle)/math.Cos(crossTrack)))) * EarthRadius
+	switch {
+	case math.Cos(offset) < 0:
+		// behind the start of the segment
+		return fromA, 0
+	case alongTrack > length:
+		return b.DistanceTo(location), length
+	}
+	return math.Abs(crossTrack) * EarthRadius, alongTrack
+}
+
+// bearingTo returns the initial bearing of the great circle to the location
+// in radians.
+func (l *Location) bearingTo(location Location) float64 {
+	lat1, lat2 := l.Latitude*math.Pi/180, location.Latitude*math.Pi/180
+	dLon := (location.Longitude - l.Longitude) * math.Pi / 180
+	y := math.Sin(dLon) * math.Cos(lat2)
+	x := math.Cos(lat1)*math.Sin(lat2) - math.Sin(lat1)*math.Cos(lat2)*math.Cos(dLon)
+	return math.Atan2(y, x)
+}
+
+// AlongRoute reports whether the route of the offer passes the pickup and then
+// the drop-off within the corridor in kilometres. An empty location is not
+// checked.
+func (o *Offer) AlongRoute(pickup, dropOff Location, corridor float64) bool {
+	path := o.Path()
+	first := math.Inf(-1)
+	if pickup != emptyLocation {
+		positions := alongRoute(path, pickup, corridor)
+		if len(positions) == 0 {
+			return false
+		}
+		first = positions[0]
+	}
+	if dropOff != emptyLocation {
+		positions := alongRoute(path, dropOff, corridor)
+		if len(positions) == 0 || positions[len(positions)-1] < first {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,150 @@
+package repoangebot
+
+import (
+	"math"
+	"slices"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+var (
+	frankfurt = Location{Longitude: 8.682, Latitude: 50.111}
+	berlin    = Location{Longitude: 13.405, Latitude: 52.520}
+	eisenach  = Location{Longitude: 10.319, Latitude: 50.975}
+	leipzig   = Location{Longitude: 12.374, Latitude: 51.340}
+	potsdam   = Location{Longitude: 13.064, Latitude: 52.391}
+	mainz     = Location{Longitude: 8.247, Latitude: 49.993}
+)
+
+func TestToSegment(t *testing.T) {
+	distance, along := toSegment(frankfurt, berlin, eisenach)
+	if distance > 3 || along < 140 || along > 160 {
+		t.Errorf("expected Eisenach about 150 km along the way next to it but got %.1f km away at %.1f km", distance, along)
+	}
+	// before the start the start is the nearest point
+	distance, along = toSegment(frankfurt, berlin, mainz)
+	if along != 0 || math.Abs(distance-frankfurt.DistanceTo(mainz)) > 1e-9 {
+		t.Errorf("expected the distance to Frankfurt but got %.1f km at %.1f km", distance, along)
+	}
+	distance, along = toSegment(frankfurt, frankfurt, berlin)
+	if along != 0 || distance != frankfurt.DistanceTo(berlin) {
+		t.Errorf("expected the distance to the point but got %.1f km at %.1f km", distance, along)
+	}
+}
+
+func TestOffer_AlongRoute(t *testing.T) {
+	// without a route the offer goes straight to the destination
+	direct := &Offer{LocationFrom: frankfurt, LocationTo: berlin}
+	via := &Offer{LocationFrom: frankfurt, LocationTo: berlin, Waypoints: []Location{leipzig}}
+	via.Route = via.Stops()
+
+	tests := []struct {
+		name     string
+		offer    *Offer
+		pickup   Location
+		dropOff  Location
+		corridor float64
+		want     bool
+	}{
+		{"on the way", direct, eisenach, potsdam, DefaultCorridor, true},
+		{"wrong direction", direct, potsdam, eisenach, DefaultCorridor, false},
+		{"pickup only", direct, eisenach, emptyLocation, DefaultCorridor, true},
+		{"drop-off only", direct, emptyLocation, potsdam, DefaultCorridor, true},
+		{"off the route", direct, leipzig, potsdam, DefaultCorridor, false},
+		{"wide corridor", direct, leipzig, potsdam, 70, true},
+		{"before the start", direct, mainz, potsdam, DefaultCorridor, false},
+		{"via waypoint", via, leipzig, berlin, DefaultCorridor, true},
+		{"back to the waypoint", via, berlin, leipzig, DefaultCorridor, false},
+	}
+	for _, tt := range tests {
+		if got := tt.offer.AlongRoute(tt.pickup, tt.dropOff, tt.corridor); got != tt.want {
+			t.Errorf("%s: AlongRoute() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFilter_MatchesRoute(t *testing.T) {
+	offer := &Offer{LocationFrom: frankfurt, LocationTo: berlin}
+	if !(Filter{Pickup: eisenach, DropOff: potsdam}).Matches(offer) {
+		t.Errorf("expected the default corridor to be used")
+	}
+	if (Filter{Pickup: leipzig, DropOff: potsdam}).Matches(offer) {
+		t.Errorf("expected Leipzig to be off the route")
+	}
+	if !(Filter{Pickup: leipzig, DropOff: potsdam, Corridor: 70}).Matches(offer) {
+		t.Errorf("expected the corridor in kilometres")
+	}
+}
+
+func TestNearRoute(t *testing.T) {
+	for _, center := range []Location{leipzig, {Longitude: 179.99, Latitude: -10}, {Longitude: 0, Latitude: 89.9}} {
+		for _, corridor := range []float64{0.1, DefaultCorridor, maxIndexedCorridor} {
+			query := nearRoute(center, corridor)[fieldRoute].(bson.M)["$geoIntersects"].(bson.M)["$geometry"].(bson.M)
+			ring := query["coordinates"].(bson.A)[0].(bson.A)
+			if len(ring) != corridorSides+1 || !slices.Equal(ring[0].(bson.A), ring[corridorSides].(bson.A)) {
+				t.Fatalf("expected a closed ring with %d sides: %v", corridorSides, ring)
+			}
+			// every route passing within the corridor crosses the polygon
+			for i := 1; i < len(ring); i++ {
+				a, b := ring[i-1].(bson.A), ring[i].(bson.A)
+				from := Location{Longitude: a[0].(float64), Latitude: a[1].(float64)}
+				to := Location{Longitude: b[0].(float64), Latitude: b[1].(float64)}
+				if !from.Valid() {
+					t.Fatalf("invalid vertex %v", from)
+				}
+				if distance, _ := toSegment(from, to, center); distance < corridor {
+					t.Errorf("edge %d of the polygon around %v is %.4f km away, within the corridor of %.1f km", i, center, distance, corridor)
+				}
+			}
+		}
+	}
+}
+
+func TestLine_BSON(t *testing.T) {
+	type doc struct {
+		Route Line `bson:"route"`
+	}
+	roundTrip := func(route Line) (bson.M, Line) {
+		data, err := bson.Marshal(doc{route})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		var raw bson.M
+		var decoded doc
+		if err := bson.Unmarshal(data, &raw); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := bson.Unmarshal(data, &decoded); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return raw, decoded.Route
+	}
+
+	raw, route := roundTrip(Line{frankfurt, eisenach, eisenach, berlin})
+	if raw["route"].(bson.M)["type"] != "LineString" || !slices.Equal(route, Line{frankfurt, eisenach, berlin}) {
+		t.Errorf("expected a line string without the repeated stop but got %v", raw)
+	}
+	raw, route = roundTrip(Line{leipzig, leipzig})
+	if raw["route"].(bson.M)["type"] != "Point" || !slices.Equal(route, Line{leipzig}) {
+		t.Errorf("expected a point but got %v", raw)
+	}
+	if raw, route = roundTrip(nil); raw["route"] != nil || route != nil {
+		t.Errorf("expected no route but got %v", raw)
+	}
+	if _, err := bson.Marshal(doc{Line{{Latitude: 91}, leipzig}}); err == nil {
+		t.Errorf("expected invalid locations to be rejected")
+	}
+
+	// routes stored before were arrays of points
+	data, err := bson.Marshal(struct {
+		Route []Location `bson:"route"`
+	}{[]Location{frankfurt, berlin}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var legacy doc
+	if err := bson.Unmarshal(data, &legacy); err != nil || !slices.Equal(legacy.Route, Line{frankfurt, berlin}) {
+		t.Errorf("expected the legacy route to be read but got %v: %v", legacy.Route, err)
+	}
+}
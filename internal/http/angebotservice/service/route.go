@@ -0,0 +1,48 @@
+package service
+
+import (
+	"errors"
+
+	repoangebot "github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/http/angebotservice/service/repo_angebot"
+)
+
+// ErrTooFewStops is returned if a route is requested for less than a start
+// and a destination.
+var ErrTooFewStops = errors.New("a route needs a start and a destination")
+
+// Router computes the route of an offer, the polyline a pickup or drop-off is
+// matched against. It passes the stops in their order.
+type Router interface {
+	Route(stops []repoangebot.Location) ([]repoangebot.Location, error)
+}
+
+// StraightLine goes straight from stop to stop, it is used without a routing
+// service.
+type StraightLine struct{}
+
+func (StraightLine) Route(stops []repoangebot.Location) ([]repoangebot.Location, error) {
+	if len(stops) < 2 {
+		return nil, ErrTooFewStops
+	}
+	return append([]repoangebot.Location(nil), stops...), nil
+}
+
+// WithRouter sets how the routes of offers are computed.
+func (s *Service) WithRouter(router Router) *Service {
+	s.router = router
+	return s
+}
+
+// applyRoute computes the route of the offer through its waypoints.
+func (s *Service) applyRoute(offer *repoangebot.Offer) error {
+	router := s.router
+	if router == nil {
+		router = StraightLine{}
+	}
+	route, err := router.Route(offer.Stops())
+	if err != nil {
+		return err
+	}
+	offer.Route = route
+	return nil
+}
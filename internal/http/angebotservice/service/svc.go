@@ -2,60 +2,205 @@ package service
 
 import (
 	"errors"
+	"fmt"
+	"os"
 	"slices"
+	"strings"
 	"time"
 
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/blocking"
 	repoangebot "github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/http/angebotservice/service/repo_angebot"
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/notify"
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/userclient"
 	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
 )
 
+// ErrInvalidLocation is returned for coordinates outside of ±180 degrees
+// longitude and ±90 degrees latitude.
+var ErrInvalidLocation = repoangebot.ErrInvalidLocation
+
 type OfferService interface {
 	GetOffer(id uuid.UUID) (*repoangebot.Offer, error)
 	CreateOffer(offer *repoangebot.Offer, url string) (uuid.UUID, error)
-	OccupieOffer(offerId uuid.UUID, userId uuid.UUID, space repoangebot.Space) error
+	RequestBooking(offerId uuid.UUID, userId uuid.UUID, space repoangebot.Space) (*repoangebot.Booking, error)
+	DecideBooking(offerId uuid.UUID, bookingId uuid.UUID, userId uuid.UUID, state repoangebot.BookingState) (*repoangebot.Booking, error)
+	CancelBooking(offerId uuid.UUID, userId uuid.UUID) (*repoangebot.Cancellation, error)
+	RemoveOccupant(offerId uuid.UUID, occupantId uuid.UUID, userId uuid.UUID) (*repoangebot.Cancellation, error)
 	PayOffer(offerId uuid.UUID, userId uuid.UUID) error
-	GetOffersByFilter(filter repoangebot.Filter) ([]*repoangebot.Offer, error)
+	GetOffersByFilter(filter repoangebot.Filter, userId uuid.UUID) ([]*repoangebot.Offer, error)
 	EditOffer(offerId uuid.UUID, userId uuid.UUID, offer *repoangebot.Offer) error
 	DeleteOffer(offerId uuid.UUID) error
+	EraseUser(userId uuid.UUID) error
+	ExportUser(userId uuid.UUID) (any, error)
 }
 
 type Service struct {
-	repo repoangebot.Repo
+	repo     repoangebot.Repo
+	vehicles VehicleSource
+	blocks   BlockList
+	router   Router
+
+	publisher   Publisher
+	preferences Preferences
 }
 
+// blocksLoadTimeout is how long the user service gets to send the blocks.
+const blocksLoadTimeout = 5 * time.Second
+
+// New creates the offer service, vehicles are looked up in the user service
+// at USER_SERVICE, its blocks are followed and booking events sent over NATS
+// at NATS_URL.
 func New(repo repoangebot.Repo) OfferService {
-	return &Service{
-		repo: repo,
+	svc := &Service{
+		repo:   repo,
+		router: StraightLine{},
+	}
+	if url := strings.TrimSpace(os.Getenv("USER_SERVICE")); url != "" {
+		svc.vehicles = userclient.NewUserClient(url)
+	}
+	if url := strings.TrimSpace(os.Getenv("NATS_URL")); url != "" {
+		conn, err := nats.Connect(url)
+		if err != nil {
+			panic(err)
+		}
+		blocks := blocking.NewList()
+		if _, err := blocking.Follow(conn, blocks, blocksLoadTimeout); err != nil {
+			panic(err)
+		}
+		svc.blocks = blocks
+
+		preferences, err := notify.NewLookup(conn, PreferencesTimeout)
+		if err != nil {
+			panic(err)
+		}
+		svc.WithPublisher(conn, preferences)
 	}
+	return svc
+}
+
+func validateLocations(locations ...repoangebot.Location) error {
+	for _, location := range locations {
+		if !location.Valid() {
+			return fmt.Errorf("%w: %v, %v", ErrInvalidLocation, location.Longitude, location.Latitude)
+		}
+	}
+	return nil
 }
 
 func (s *Service) DeleteOffer(offerId uuid.UUID) error {
 	return s.repo.DeleteOffer(offerId)
 }
 
+// UserOffers are the offers a user is involved in, by role.
+type UserOffers struct {
+	Created []*repoangebot.Offer `json:"created"`
+	Driving []*repoangebot.Offer `json:"driving"`
+	Booked  []*repoangebot.Offer `json:"booked"`
+}
+
+// ExportUser collects the offers of a user for a data export.
+func (s *Service) ExportUser(userId uuid.UUID) (any, error) {
+	offers, err := s.repo.GetOffersOfUser(userId)
+	if err != nil {
+		return nil, err
+	}
+	result := UserOffers{
+		Created: []*repoangebot.Offer{},
+		Driving: []*repoangebot.Offer{},
+		Booked:  []*repoangebot.Offer{},
+	}
+	for _, offer := range offers {
+		if offer.Creator == userId {
+			result.Created = append(result.Created, offer)
+		}
+		if offer.Driver == userId {
+			result.Driving = append(result.Driving, offer)
+		}
+		if slices.Contains(offer.OccupiedSpace.Users(), userId) {
+			result.Booked = append(result.Booked, offer)
+		}
+	}
+	return result, nil
+}
+
+// EraseUser removes the data of a deleted user from all offers.
+func (s *Service) EraseUser(userId uuid.UUID) error {
+	return s.repo.EraseUser(userId)
+}
+
 func (s *Service) GetOffer(id uuid.UUID) (*repoangebot.Offer, error) {
 	return s.repo.GetOffer(id)
 }
 
+// EditOffer replaces what the creator can change of the offer, it is
+// validated like a new offer and has to leave room for the accepted
+// bookings. The bookings, payments and refunds are kept.
 func (s *Service) EditOffer(offerId uuid.UUID, userId uuid.UUID, offer *repoangebot.Offer) error {
-	err := s.repo.EditOffer(offerId, userId, offer)
+	if err := validateLocations(offer.Stops()...); err != nil {
+		return err
+	}
+	if err := offer.CancellationPolicy.Validate(); err != nil {
+		return err
+	}
+	save := func(offer *repoangebot.Offer) error {
+		return s.repo.EditOffer(offer.ID, userId, offer)
+	}
+	_, err := s.changeOffer(offerId, save, func(existing *repoangebot.Offer) error {
+		if existing.Creator != userId {
+			return ErrNotCreator
+		}
+		edited := *offer
+		edited.ID, edited.Creator, edited.CreatedAt, edited.ImageURL = existing.ID, existing.Creator, existing.CreatedAt, existing.ImageURL
+		edited.Bookings, edited.OccupiedSpace = existing.Bookings, existing.OccupiedSpace
+		edited.PaidSpaces, edited.Refunds = existing.PaidSpaces, existing.Refunds
+		edited.Version = existing.Version
+		if err := s.applyVehicle(&edited); err != nil {
+			return err
+		}
+		if !edited.OccupiedSpace.Sum().Fits(edited.CanTransport) {
+			return repoangebot.ErrNotEnoughSpace
+		}
+		if err := s.applyRoute(&edited); err != nil {
+			return err
+		}
+		*existing = edited
+		return nil
+	})
 	return err
 }
 
 func (s *Service) CreateOffer(offer *repoangebot.Offer, url string) (uuid.UUID, error) {
+	if err := validateLocations(offer.Stops()...); err != nil {
+		return uuid.Nil, err
+	}
+	if err := offer.CancellationPolicy.Validate(); err != nil {
+		return uuid.Nil, err
+	}
+	if err := s.applyVehicle(offer); err != nil {
+		return uuid.Nil, err
+	}
+	if err := s.applyRoute(offer); err != nil {
+		return uuid.Nil, err
+	}
+	// bookings and payments only come from the booking flow
+	offer.OccupiedSpace, offer.PaidSpaces = nil, nil
+	offer.Bookings, offer.Refunds = nil, nil
+	offer.Version = 0
 	offer.CreatedAt = time.Now()
 	offer.ImageURL = url
 	offer.ID = uuid.New()
 	return offer.ID, s.repo.CreateOffer(offer)
 }
 
-func (s *Service) OccupieOffer(offerId uuid.UUID, userId uuid.UUID, space repoangebot.Space) error {
-
-	space.Occupier = userId
-	return s.repo.OccupieOffer(offerId, userId, space)
-}
-
-func (s *Service) GetOffersByFilter(filter repoangebot.Filter) ([]*repoangebot.Offer, error) {
+// GetOffersByFilter returns the offers matching the filter, the nearest to
+// its start location first. A pickup and drop-off select the offers passing
+// them on their route. Offers of users that blocked the caller or were
+// blocked by the caller are left out, uuid.Nil returns all of them.
+func (s *Service) GetOffersByFilter(filter repoangebot.Filter, userId uuid.UUID) ([]*repoangebot.Offer, error) {
+	if err := validateLocations(filter.LocationFrom, filter.LocationTo, filter.Pickup, filter.DropOff); err != nil {
+		return []*repoangebot.Offer{}, err
+	}
 	offers, err := s.repo.GetOffersByFilter(filter)
 	if err != nil {
 		return []*repoangebot.Offer{}, err
@@ -63,28 +208,26 @@ func (s *Service) GetOffersByFilter(filter repoangebot.Filter) ([]*repoangebot.O
 	if offers == nil {
 		return []*repoangebot.Offer{}, nil
 	}
-	return offers, nil
+	return s.withoutBlocked(offers, userId), nil
 }
 
 func (s *Service) PayOffer(offerId uuid.UUID, userId uuid.UUID) error {
-	offers, err := s.GetOffersByFilter(repoangebot.Filter{ID: offerId})
-	if err != nil {
-		return err
-	}
-	if !slices.Contains(offers[0].OccupiedSpace.Users(), userId) {
-		return errors.New("user is not occupied")
-	}
-	var idx int
-	for idx = 0; idx < len(offers[0].OccupiedSpace); idx++ {
-		if offers[0].OccupiedSpace[idx].Occupier == userId {
-			break
+	_, err := s.changeOffer(offerId, s.updateOffer, func(offer *repoangebot.Offer) error {
+		idx := slices.IndexFunc(offer.OccupiedSpace, func(space repoangebot.Space) bool {
+			return space.Occupier == userId
+		})
+		if idx < 0 {
+			return errors.New("user is not occupied")
 		}
-	}
-
-	if slices.Contains(offers[0].PaidSpaces.Users(), userId) {
-		return errors.New("user is already paid")
-	}
+		if slices.Contains(offer.PaidSpaces.Users(), userId) {
+			return errors.New("user is already paid")
+		}
+		offer.PaidSpaces = append(offer.PaidSpaces, offer.OccupiedSpace[idx])
+		return nil
+	})
+	return err
+}
 
-	offers[0].PaidSpaces = append(offers[0].PaidSpaces, offers[0].OccupiedSpace[idx])
-	return s.repo.UpdateOffer(offers[0].ID, offers[0])
+func (s *Service) updateOffer(offer *repoangebot.Offer) error {
+	return s.repo.UpdateOffer(offer.ID, offer)
 }
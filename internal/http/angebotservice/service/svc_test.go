@@ -0,0 +1,498 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/blocking"
+	repoangebot "github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/http/angebotservice/service/repo_angebot"
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/notify"
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/userclient"
+	"github.com/google/uuid"
+)
+
+func TestApplyVehicle(t *testing.T) {
+	driver := uuid.New()
+	vehicle := &userclient.Vehicle{
+		ID:         uuid.New(),
+		OwnerID:    driver,
+		Make:       "VW",
+		Model:      "Golf",
+		Seats:      4,
+		Trunk:      userclient.Dimensions{Width: 100, Height: 50, Depth: 80},
+		MaxPayload: 400,
+		Features:   []string{"Klimaanlage"},
+	}
+
+	offer := &repoangebot.Offer{Creator: driver, VehicleID: vehicle.ID, InfoCar: []string{"typed by hand"}}
+	if err := ApplyVehicle(offer, vehicle); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(offer.InfoCar) != 2 || offer.InfoCar[0] != "VW Golf" || offer.InfoCar[1] != "Klimaanlage" {
+		t.Errorf("car info should be taken from the vehicle: %v", offer.InfoCar)
+	}
+	if offer.CanTransport.Seats != 4 || len(offer.CanTransport.Items) != 1 || offer.CanTransport.Items[0].Weight != 400 {
+		t.Errorf("capacity should be derived from the vehicle: %+v", offer.CanTransport)
+	}
+
+	tests := []struct {
+		name  string
+		space repoangebot.Space
+		want  error
+	}{
+		{"fits", repoangebot.Space{Seats: 2, Items: []repoangebot.Item{{Size: repoangebot.Size{Width: 50, Height: 90, Depth: 40}, Weight: 100}}}, nil},
+		{"too many seats", repoangebot.Space{Seats: 5}, ErrExceedsVehicle},
+		{"item too large", repoangebot.Space{Items: []repoangebot.Item{{Size: repoangebot.Size{Width: 120, Height: 10, Depth: 10}}}}, ErrExceedsVehicle},
+		{"too heavy", repoangebot.Space{Items: []repoangebot.Item{{Weight: 300}, {Weight: 200}}}, ErrExceedsVehicle},
+	}
+	for _, tt := range tests {
+		offer := &repoangebot.Offer{Creator: driver, VehicleID: vehicle.ID, CanTransport: tt.space}
+		if err := ApplyVehicle(offer, vehicle); !errors.Is(err, tt.want) {
+			t.Errorf("%s: expected %v but got %v", tt.name, tt.want, err)
+		}
+	}
+
+	offer = &repoangebot.Offer{Creator: uuid.New(), VehicleID: vehicle.ID}
+	if err := ApplyVehicle(offer, vehicle); err != ErrVehicleNotOwned {
+		t.Errorf("expected vehicle not owned but got: %v", err)
+	}
+	// the driver is sent by the client, naming the owner gives no access
+	offer = &repoangebot.Offer{Creator: uuid.New(), Driver: driver, VehicleID: vehicle.ID}
+	if err := ApplyVehicle(offer, vehicle); err != ErrVehicleNotOwned || len(offer.InfoCar) != 0 {
+		t.Errorf("expected vehicle not owned for a forged driver but got %v with %v", err, offer.InfoCar)
+	}
+}
+
+func TestWithoutBlocked(t *testing.T) {
+	caller, blocker, blockedDriver, other := uuid.New(), uuid.New(), uuid.New(), uuid.New()
+	blocks := blocking.NewList()
+	blocks.Apply(blocking.Event{Block: blocking.Block{BlockerID: blocker, BlockedID: caller}, Blocked: true})
+	blocks.Apply(blocking.Event{Block: blocking.Block{BlockerID: caller, BlockedID: blockedDriver}, Blocked: true})
+	svc := (&Service{}).WithBlocks(blocks)
+
+	byBlocker := &repoangebot.Offer{Creator: blocker}
+	withBlockedDriver := &repoangebot.Offer{Creator: other, Driver: blockedDriver}
+	visible := &repoangebot.Offer{Creator: other}
+	own := &repoangebot.Offer{Creator: caller}
+
+	offers := svc.withoutBlocked([]*repoangebot.Offer{byBlocker, withBlockedDriver, visible, own}, caller)
+	if len(offers) != 2 || offers[0] != visible || offers[1] != own {
+		t.Errorf("offers of blocked users should be left out: %+v", offers)
+	}
+	if !svc.isBlocked(byBlocker, caller) {
+		t.Errorf("blocked user should not be able to book the offer of the blocker")
+	}
+	if svc.isBlocked(byBlocker, uuid.Nil) {
+		t.Errorf("requests without a user should not be filtered")
+	}
+
+	blocks.Apply(blocking.Event{Block: blocking.Block{BlockerID: blocker, BlockedID: caller}, Blocked: false})
+	if svc.isBlocked(byBlocker, caller) {
+		t.Errorf("lifted block should no longer apply")
+	}
+}
+
+func TestInvalidLocation(t *testing.T) {
+	svc := &Service{}
+	offer := &repoangebot.Offer{LocationFrom: repoangebot.Location{Longitude: 13.4, Latitude: 95}}
+	if _, err := svc.CreateOffer(offer, ""); !errors.Is(err, ErrInvalidLocation) {
+		t.Errorf("expected invalid location but got: %v", err)
+	}
+	filter := repoangebot.Filter{LocationTo: repoangebot.Location{Longitude: -181}}
+	if _, err := svc.GetOffersByFilter(filter, uuid.Nil); !errors.Is(err, ErrInvalidLocation) {
+		t.Errorf("expected invalid location but got: %v", err)
+	}
+}
+
+type routerFunc func([]repoangebot.Location) ([]repoangebot.Location, error)
+
+func (f routerFunc) Route(stops []repoangebot.Location) ([]repoangebot.Location, error) {
+	return f(stops)
+}
+
+func TestApplyRoute(t *testing.T) {
+	from := repoangebot.Location{Longitude: 8.682, Latitude: 50.111}
+	via := repoangebot.Location{Longitude: 12.374, Latitude: 51.340}
+	to := repoangebot.Location{Longitude: 13.405, Latitude: 52.520}
+	offer := &repoangebot.Offer{LocationFrom: from, LocationTo: to, Waypoints: []repoangebot.Location{via}}
+
+	// without a router the stops are connected directly
+	if err := (&Service{}).applyRoute(offer); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(offer.Route) != 3 || offer.Route[0] != from || offer.Route[1] != via || offer.Route[2] != to {
+		t.Errorf("expected the route through the stops but got %v", offer.Route)
+	}
+
+	detour := repoangebot.Location{Longitude: 10, Latitude: 51}
+	svc := (&Service{}).WithRouter(routerFunc(func(stops []repoangebot.Location) ([]repoangebot.Location, error) {
+		return []repoangebot.Location{stops[0], detour, stops[len(stops)-1]}, nil
+	}))
+	if err := svc.applyRoute(offer); err != nil || offer.Route[1] != detour {
+		t.Errorf("expected the route of the router but got %v: %v", offer.Route, err)
+	}
+
+	if _, err := (StraightLine{}).Route([]repoangebot.Location{from}); !errors.Is(err, ErrTooFewStops) {
+		t.Errorf("expected too few stops but got: %v", err)
+	}
+}
+
+// memoryRepo keeps offers in memory, only what the booking tests need works.
+// beforeSave runs once before the next save, as if a concurrent request
+// changed the offer.
+type memoryRepo struct {
+	repoangebot.Repo
+	offers     map[uuid.UUID]*repoangebot.Offer
+	beforeSave func()
+}
+
+// save checks the version of the offer like MongoRepo does.
+func (m *memoryRepo) save(offer *repoangebot.Offer) (*repoangebot.Offer, error) {
+	if before := m.beforeSave; before != nil {
+		m.beforeSave = nil
+		before()
+	}
+	stored := m.offers[offer.ID]
+	if stored.Version != offer.Version {
+		return nil, repoangebot.ErrConflict
+	}
+	stored.Version++
+	offer.Version++
+	return stored, nil
+}
+
+func (m *memoryRepo) CreateOffer(offer *repoangebot.Offer) error {
+	m.offers[offer.ID] = offer
+	return nil
+}
+
+func (m *memoryRepo) GetOffer(id uuid.UUID) (*repoangebot.Offer, error) {
+	offer, ok := m.offers[id]
+	if !ok {
+		return nil, repoangebot.ErrOfferNotFound
+	}
+	copied := *offer
+	copied.Bookings = slices.Clone(offer.Bookings)
+	copied.OccupiedSpace = slices.Clone(offer.OccupiedSpace)
+	copied.PaidSpaces = slices.Clone(offer.PaidSpaces)
+	return &copied, nil
+}
+
+func (m *memoryRepo) SaveBookings(offer *repoangebot.Offer) error {
+	stored, err := m.save(offer)
+	if err != nil {
+		return err
+	}
+	stored.Bookings, stored.OccupiedSpace = offer.Bookings, offer.OccupiedSpace
+	return nil
+}
+
+func (m *memoryRepo) ReleaseOffer(offer *repoangebot.Offer) error {
+	stored, err := m.save(offer)
+	if err != nil {
+		return err
+	}
+	stored.Bookings, stored.OccupiedSpace = offer.Bookings, offer.OccupiedSpace
+	stored.PaidSpaces, stored.Refunds = offer.PaidSpaces, offer.Refunds
+	return nil
+}
+
+func (m *memoryRepo) EditOffer(offerId uuid.UUID, userId uuid.UUID, offer *repoangebot.Offer) error {
+	stored, err := m.save(offer)
+	if err != nil {
+		return err
+	}
+	// like MongoRepo only what the creator can change is stored
+	edited := *offer
+	edited.Creator, edited.CreatedAt, edited.ImageURL = stored.Creator, stored.CreatedAt, stored.ImageURL
+	edited.Bookings, edited.OccupiedSpace = stored.Bookings, stored.OccupiedSpace
+	edited.PaidSpaces, edited.Refunds = stored.PaidSpaces, stored.Refunds
+	*stored = edited
+	return nil
+}
+
+type vehicles map[uuid.UUID]*userclient.Vehicle
+
+func (v vehicles) GetVehicle(vehicleID uuid.UUID) (*userclient.Vehicle, error) {
+	if vehicle, ok := v[vehicleID]; ok {
+		return vehicle, nil
+	}
+	return nil, ErrVehicleNotFound
+}
+
+type published struct {
+	subjects []string
+	events   []BookingEvent
+}
+
+func (p *published) Publish(subject string, data []byte) error {
+	var event BookingEvent
+	if err := json.Unmarshal(data, &event); err != nil {
+		return err
+	}
+	p.subjects = append(p.subjects, subject)
+	p.events = append(p.events, event)
+	return nil
+}
+
+type muted map[uuid.UUID]bool
+
+func (m muted) Allows(userID uuid.UUID, category notify.Category, channel notify.Channel) bool {
+	return !m[userID]
+}
+
+func TestBookingLifecycle(t *testing.T) {
+	creator, passenger := uuid.New(), uuid.New()
+	offer := &repoangebot.Offer{ID: uuid.New(), Creator: creator, Driver: creator, StartDateTime: time.Now().Add(time.Hour), CanTransport: repoangebot.Space{Seats: 2}}
+	repo := &memoryRepo{offers: map[uuid.UUID]*repoangebot.Offer{offer.ID: offer}}
+	events := &published{}
+	svc := &Service{repo: repo}
+	svc.WithPublisher(events, muted{})
+
+	booking, err := svc.RequestBooking(offer.ID, passenger, repoangebot.Space{Seats: 1})
+	if err != nil || booking.State != repoangebot.BookingRequested {
+		t.Fatalf("expected a requested booking but got %+v: %v", booking, err)
+	}
+	if len(events.subjects) != 2 || events.subjects[0] != notify.Subject(passenger) || events.subjects[1] != notify.Subject(creator) {
+		t.Errorf("expected the passenger and the creator to be notified once but got %v", events.subjects)
+	}
+	if events.events[0].Type != "offer.booking.requested" || events.events[0].OfferID != offer.ID || events.events[0].Booking.ID != booking.ID {
+		t.Errorf("unexpected event: %+v", events.events[0])
+	}
+
+	if _, err := svc.DecideBooking(offer.ID, booking.ID, passenger, repoangebot.BookingAccepted); !errors.Is(err, ErrNotCreator) {
+		t.Errorf("expected only the creator to decide but got: %v", err)
+	}
+	if _, err := svc.DecideBooking(offer.ID, booking.ID, creator, repoangebot.BookingCancelled); !errors.Is(err, repoangebot.ErrInvalidTransition) {
+		t.Errorf("expected the creator not to cancel but got: %v", err)
+	}
+	accepted, err := svc.DecideBooking(offer.ID, booking.ID, creator, repoangebot.BookingAccepted)
+	if err != nil || accepted.State != repoangebot.BookingAccepted {
+		t.Fatalf("expected the booking to be accepted but got %+v: %v", accepted, err)
+	}
+	if len(offer.OccupiedSpace) != 1 || offer.Bookings[0].State != repoangebot.BookingAccepted {
+		t.Errorf("expected the accepted booking to be saved: %+v", offer)
+	}
+	if last := events.events[len(events.events)-1]; last.Type != "offer.booking.accepted" {
+		t.Errorf("expected an accepted event but got %s", last.Type)
+	}
+
+	// users who turned off booking notifications are left out
+	events.subjects = nil
+	svc.WithPublisher(events, muted{creator: true})
+	if _, err := svc.RequestBooking(offer.ID, uuid.New(), repoangebot.Space{Seats: 1}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(events.subjects) != 1 {
+		t.Errorf("expected only the passenger to be notified but got %v", events.subjects)
+	}
+}
+
+func TestRequestBooking_Concurrent(t *testing.T) {
+	offer := &repoangebot.Offer{ID: uuid.New(), Creator: uuid.New(), AutoAccept: true, StartDateTime: time.Now().Add(time.Hour), CanTransport: repoangebot.Space{Seats: 1}}
+	repo := &memoryRepo{offers: map[uuid.UUID]*repoangebot.Offer{offer.ID: offer}}
+	svc := &Service{repo: repo}
+
+	first, second := uuid.New(), uuid.New()
+	repo.beforeSave = func() {
+		if _, err := svc.RequestBooking(offer.ID, second, repoangebot.Space{Seats: 1}); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+	if _, err := svc.RequestBooking(offer.ID, first, repoangebot.Space{Seats: 1}); !errors.Is(err, repoangebot.ErrNotEnoughSpace) {
+		t.Errorf("expected the retry to find the offer full but got: %v", err)
+	}
+	if len(offer.Bookings) != 1 || len(offer.OccupiedSpace) != 1 || offer.Bookings[0].Passenger != second {
+		t.Errorf("expected only the booking saved first: %+v", offer.Bookings)
+	}
+
+	// a request that keeps losing gives up
+	offer = &repoangebot.Offer{ID: uuid.New(), Creator: uuid.New(), StartDateTime: time.Now().Add(time.Hour), CanTransport: repoangebot.Space{Seats: 1}}
+	repo.offers[offer.ID] = offer
+	conflicting := &conflictingRepo{memoryRepo: repo}
+	svc.repo = conflicting
+	if _, err := svc.RequestBooking(offer.ID, first, repoangebot.Space{Seats: 1}); !errors.Is(err, repoangebot.ErrConflict) {
+		t.Errorf("expected a conflict but got: %v", err)
+	}
+	if conflicting.saves != bookingAttempts || len(offer.Bookings) != 0 {
+		t.Errorf("expected %d attempts without a booking but got %d: %+v", bookingAttempts, conflicting.saves, offer.Bookings)
+	}
+}
+
+// conflictingRepo changes the offer before every save.
+type conflictingRepo struct {
+	*memoryRepo
+	saves int
+}
+
+func (c *conflictingRepo) SaveBookings(offer *repoangebot.Offer) error {
+	c.saves++
+	c.offers[offer.ID].Version++
+	return c.memoryRepo.SaveBookings(offer)
+}
+
+func TestCancelBooking(t *testing.T) {
+	creator, passenger, other := uuid.New(), uuid.New(), uuid.New()
+	offer := &repoangebot.Offer{
+		ID:            uuid.New(),
+		Creator:       creator,
+		Price:         20,
+		AutoAccept:    true,
+		StartDateTime: time.Now().Add(time.Hour),
+		CanTransport:  repoangebot.Space{Seats: 2},
+	}
+	repo := &memoryRepo{offers: map[uuid.UUID]*repoangebot.Offer{offer.ID: offer}}
+	events := &published{}
+	svc := (&Service{repo: repo}).WithPublisher(events, nil)
+
+	for _, user := range []uuid.UUID{passenger, other} {
+		if _, err := svc.RequestBooking(offer.ID, user, repoangebot.Space{Seats: 1}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	offer.PaidSpaces = slices.Clone(offer.OccupiedSpace)
+
+	cancellation, err := svc.CancelBooking(offer.ID, passenger)
+	if err != nil || cancellation.Refund == nil || cancellation.Refund.Amount != 20 {
+		t.Fatalf("expected a refunded cancellation but got %+v: %v", cancellation, err)
+	}
+	if len(offer.OccupiedSpace) != 1 || len(offer.PaidSpaces) != 1 || len(offer.Refunds) != 1 {
+		t.Errorf("expected the released space to be saved: %+v", offer)
+	}
+	if last := events.events[len(events.events)-1]; last.Type != "offer.booking.cancelled" || last.Refund == nil {
+		t.Errorf("expected a cancelled event with the refund but got %+v", last)
+	}
+
+	if _, err := svc.RemoveOccupant(offer.ID, other, passenger); !errors.Is(err, ErrNotCreator) {
+		t.Errorf("expected only the creator to remove passengers but got: %v", err)
+	}
+	if _, err := svc.RemoveOccupant(offer.ID, other, creator); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(offer.OccupiedSpace) != 0 || len(offer.PaidSpaces) != 0 {
+		t.Errorf("expected all space to be released: %+v", offer)
+	}
+}
+
+func TestCancelBooking_Concurrent(t *testing.T) {
+	creator, passenger := uuid.New(), uuid.New()
+	offer := &repoangebot.Offer{
+		ID:            uuid.New(),
+		Creator:       creator,
+		Price:         20,
+		AutoAccept:    true,
+		StartDateTime: time.Now().Add(time.Hour),
+		CanTransport:  repoangebot.Space{Seats: 2},
+	}
+	repo := &memoryRepo{offers: map[uuid.UUID]*repoangebot.Offer{offer.ID: offer}}
+	svc := &Service{repo: repo}
+	if _, err := svc.RequestBooking(offer.ID, passenger, repoangebot.Space{Seats: 1}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	offer.PaidSpaces = slices.Clone(offer.OccupiedSpace)
+
+	// the creator removes the passenger while they cancel themselves
+	repo.beforeSave = func() {
+		if _, err := svc.RemoveOccupant(offer.ID, passenger, creator); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+	if _, err := svc.CancelBooking(offer.ID, passenger); !errors.Is(err, repoangebot.ErrBookingNotFound) {
+		t.Errorf("expected the booking to be cancelled already but got: %v", err)
+	}
+	if len(offer.Refunds) != 1 || offer.Refunds[0].Percent != 100 || len(offer.PaidSpaces) != 0 {
+		t.Errorf("expected exactly the refund of the removal: %+v", offer.Refunds)
+	}
+}
+
+func TestEditOffer(t *testing.T) {
+	creator, passenger := uuid.New(), uuid.New()
+	vehicle := &userclient.Vehicle{ID: uuid.New(), OwnerID: creator, Seats: 3}
+	offer := &repoangebot.Offer{
+		ID:            uuid.New(),
+		Creator:       creator,
+		Title:         "Leipzig - Berlin",
+		AutoAccept:    true,
+		ImageURL:      "https://example.com/image",
+		LocationFrom:  repoangebot.Location{Longitude: 12.37, Latitude: 51.34},
+		LocationTo:    repoangebot.Location{Longitude: 13.40, Latitude: 52.52},
+		CanTransport:  repoangebot.Space{Seats: 3},
+		StartDateTime: time.Now().Add(time.Hour),
+	}
+	offers := &memoryRepo{offers: map[uuid.UUID]*repoangebot.Offer{offer.ID: offer}}
+	svc := (&Service{repo: offers}).WithVehicles(vehicles{vehicle.ID: vehicle})
+	if _, err := svc.RequestBooking(offer.ID, passenger, repoangebot.Space{Seats: 2}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	edit := func(edited repoangebot.Offer) *repoangebot.Offer {
+		edited.LocationFrom, edited.LocationTo = offer.LocationFrom, offer.LocationTo
+		return &edited
+	}
+	tests := []struct {
+		name   string
+		userId uuid.UUID
+		offer  *repoangebot.Offer
+		want   error
+	}{
+		{"not the creator", passenger, edit(repoangebot.Offer{CanTransport: repoangebot.Space{Seats: 3}}), ErrNotCreator},
+		{"exceeds the vehicle", creator, edit(repoangebot.Offer{VehicleID: vehicle.ID, CanTransport: repoangebot.Space{Seats: 4}}), ErrExceedsVehicle},
+		{"below the bookings", creator, edit(repoangebot.Offer{CanTransport: repoangebot.Space{Seats: 1}}), repoangebot.ErrNotEnoughSpace},
+		{"invalid policy", creator, edit(repoangebot.Offer{CanTransport: repoangebot.Space{Seats: 3}, CancellationPolicy: repoangebot.CancellationPolicy{RefundPercent: 120}}), repoangebot.ErrInvalidPolicy},
+		{"invalid location", creator, &repoangebot.Offer{LocationTo: repoangebot.Location{Latitude: 91}}, ErrInvalidLocation},
+	}
+	for _, tt := range tests {
+		if err := svc.EditOffer(offer.ID, tt.userId, tt.offer); !errors.Is(err, tt.want) {
+			t.Errorf("%s: expected %v but got %v", tt.name, tt.want, err)
+		}
+	}
+	if err := svc.EditOffer(uuid.New(), creator, edit(repoangebot.Offer{})); !errors.Is(err, repoangebot.ErrOfferNotFound) {
+		t.Errorf("expected offer not found but got: %v", err)
+	}
+
+	// bookings sent along are ignored
+	forged := edit(repoangebot.Offer{
+		Title:     "Leipzig - Berlin, flexible",
+		Creator:   passenger,
+		VehicleID: vehicle.ID,
+		Bookings:  []repoangebot.Booking{{ID: uuid.New(), Passenger: uuid.New(), State: repoangebot.BookingAccepted}},
+	})
+	if err := svc.EditOffer(offer.ID, creator, forged); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	stored := offers.offers[offer.ID]
+	if stored.Title != forged.Title || stored.CanTransport.Seats != 3 || len(stored.InfoCar) == 0 || len(stored.Route) != 2 {
+		t.Errorf("expected the edit to be validated and stored: %+v", stored)
+	}
+	if stored.Creator != creator || len(stored.Bookings) != 1 || stored.Bookings[0].Passenger != passenger || len(stored.OccupiedSpace) != 1 || stored.ImageURL != offer.ImageURL {
+		t.Errorf("expected the creator and bookings to be kept: %+v", stored)
+	}
+}
+
+func TestCreateOffer(t *testing.T) {
+	offers := &memoryRepo{offers: map[uuid.UUID]*repoangebot.Offer{}}
+	svc := &Service{repo: offers}
+	passenger := uuid.New()
+	forged := &repoangebot.Offer{
+		Creator:       uuid.New(),
+		LocationFrom:  repoangebot.Location{Longitude: 12.37, Latitude: 51.34},
+		LocationTo:    repoangebot.Location{Longitude: 13.40, Latitude: 52.52},
+		CanTransport:  repoangebot.Space{Seats: 3},
+		OccupiedSpace: repoangebot.SpaceSlice{{Occupier: passenger, Seats: 1}},
+		PaidSpaces:    repoangebot.SpaceSlice{{Occupier: passenger, Seats: 1}},
+		Bookings:      []repoangebot.Booking{{ID: uuid.New(), Passenger: passenger, State: repoangebot.BookingAccepted}},
+		Refunds:       []repoangebot.Refund{{Passenger: passenger, Amount: 10}},
+		Version:       5,
+	}
+	id, err := svc.CreateOffer(forged, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	stored := offers.offers[id]
+	if len(stored.OccupiedSpace) != 0 || len(stored.PaidSpaces) != 0 || len(stored.Bookings) != 0 || len(stored.Refunds) != 0 || stored.Version != 0 {
+		t.Errorf("expected bookings and payments of the request to be ignored: %+v", stored)
+	}
+}
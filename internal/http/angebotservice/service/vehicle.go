@@ -0,0 +1,83 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	repoangebot "github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/http/angebotservice/service/repo_angebot"
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/userclient"
+	"github.com/google/uuid"
+)
+
+var (
+	ErrVehicleNotFound    = userclient.ErrVehicleNotFound
+	ErrVehicleNotOwned    = errors.New("vehicle does not belong to the creator")
+	ErrExceedsVehicle     = errors.New("capacity exceeds the vehicle")
+	errVehiclesNotEnabled = errors.New("vehicles are not available")
+)
+
+// VehicleSource looks up the vehicles registered in the user service, it is
+// implemented by *userclient.UserClient.
+type VehicleSource interface {
+	GetVehicle(vehicleID uuid.UUID) (*userclient.Vehicle, error)
+}
+
+// WithVehicles sets where the vehicles referenced by offers are looked up.
+func (s *Service) WithVehicles(vehicles VehicleSource) *Service {
+	s.vehicles = vehicles
+	return s
+}
+
+// applyVehicle fills in the car info of an offer from its vehicle. Without a
+// given capacity the offer can transport what fits into the vehicle,
+// otherwise the capacity has to fit into it.
+func (s *Service) applyVehicle(offer *repoangebot.Offer) error {
+	if offer.VehicleID == uuid.Nil {
+		return nil
+	}
+	if s.vehicles == nil {
+		return errVehiclesNotEnabled
+	}
+	vehicle, err := s.vehicles.GetVehicle(offer.VehicleID)
+	if err != nil {
+		return err
+	}
+	return ApplyVehicle(offer, vehicle)
+}
+
+// ApplyVehicle derives the car info and capacity of an offer from a vehicle
+// and validates a capacity that was given by the creator against it. Only
+// vehicles of the creator can be used, the driver is taken from the request
+// and never confirmed it.
+func ApplyVehicle(offer *repoangebot.Offer, vehicle *userclient.Vehicle) error {
+	if vehicle.OwnerID != offer.Creator {
+		return ErrVehicleNotOwned
+	}
+
+	offer.InfoCar = append([]string{strings.TrimSpace(vehicle.Make + " " + vehicle.Model)}, vehicle.Features...)
+
+	trunk := repoangebot.Size{Width: vehicle.Trunk.Width, Height: vehicle.Trunk.Height, Depth: vehicle.Trunk.Depth}
+	if offer.CanTransport.Seats == 0 && len(offer.CanTransport.Items) == 0 {
+		offer.CanTransport = repoangebot.Space{Seats: vehicle.Seats}
+		if trunk != (repoangebot.Size{}) || vehicle.MaxPayload > 0 {
+			offer.CanTransport.Items = []repoangebot.Item{{Size: trunk, Weight: vehicle.MaxPayload}}
+		}
+		return nil
+	}
+
+	if offer.CanTransport.Seats > vehicle.Seats {
+		return fmt.Errorf("%w: %d seats, the vehicle has %d", ErrExceedsVehicle, offer.CanTransport.Seats, vehicle.Seats)
+	}
+	weight := 0
+	for _, item := range offer.CanTransport.Items {
+		if !item.Size.FitsIn(trunk) {
+			return fmt.Errorf("%w: item does not fit into the trunk", ErrExceedsVehicle)
+		}
+		weight += item.Weight
+	}
+	if weight > vehicle.MaxPayload {
+		return fmt.Errorf("%w: %d kg, the vehicle carries %d kg", ErrExceedsVehicle, weight, vehicle.MaxPayload)
+	}
+	return nil
+}
@@ -2,16 +2,20 @@ package chatservice
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 
 	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/http/chatservice/service/mocks"
 
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/dataexport"
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/erasure"
 	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/http/chatservice/service"
 	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/http/chatservice/service/repo"
 	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/middleware/auth"
 	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/server"
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
+	"github.com/nats-io/nats.go"
 )
 
 const (
@@ -35,11 +39,26 @@ type SendMessageRequest struct {
 }
 
 func New(secret []byte, repo repo.Repository, natsUrl string) *ChatController {
+	chatService := service.New(repo, natsUrl)
 	svc := &ChatController{
 		Server:         server.NewServer(),
-		service:        service.New(repo, natsUrl),
+		service:        chatService,
 		AuthMiddleware: auth.NewAuthMiddleware(secret),
 	}
+	conn, err := nats.Connect(natsUrl)
+	if err != nil {
+		panic(err)
+	}
+	svc.WithAudit(conn, erasure.ServiceChat)
+	if err := svc.SubscribeRevocations(conn); err != nil {
+		panic(err)
+	}
+	if _, err := erasure.Subscribe(conn, erasure.ServiceChat, chatService.EraseUser); err != nil {
+		panic(err)
+	}
+	if _, err := dataexport.Respond(conn, erasure.ServiceChat, chatService.ExportUser); err != nil {
+		panic(err)
+	}
 	svc.setupRoutes()
 	return svc
 }
@@ -52,6 +71,14 @@ func (c *ChatController) setupRoutes() {
 	c.WithHandlerFunc("/{chatId}/add", c.EnsureJWT(c.HandleAddUserToChat), http.MethodPost)
 }
 
+// statusOf maps an error of the service to the status code of the response.
+func statusOf(err error) int {
+	if errors.Is(err, service.ErrBlocked) {
+		return http.StatusForbidden
+	}
+	return http.StatusInternalServerError
+}
+
 func (c *ChatController) HandleAddUserToChat(w http.ResponseWriter, r *http.Request) {
 	var (
 		vars   = mux.Vars(r)
@@ -72,7 +99,7 @@ func (c *ChatController) HandleAddUserToChat(w http.ResponseWriter, r *http.Requ
 
 	for _, userID := range userRequest.UserIDs {
 		if err = c.service.AddUserToChat(chatID, userID); err != nil {
-			c.Error(w, err.Error(), http.StatusInternalServerError)
+			c.Error(w, err.Error(), statusOf(err))
 			return
 		}
 	}
@@ -126,6 +153,7 @@ func (c *ChatController) HandleGetChats(w http.ResponseWriter, r *http.Request)
 // @Param        body body CreateChatRequest true "List of user IDs to start chat with"
 // @Success      200  {string}  string  "ID of the newly created chat"
 // @Failure      400  {object}  ErrorResponse
+// @Failure      403  {object}  ErrorResponse "One of the users blocked another one"
 // @Failure      500  {object}  ErrorResponse
 // @Router       /chat [post]
 func (c *ChatController) CreateChat(w http.ResponseWriter, r *http.Request) {
@@ -152,7 +180,7 @@ func (c *ChatController) CreateChat(w http.ResponseWriter, r *http.Request) {
 
 	chatId, err := c.service.CreateChat(append(usersRequest.UserIds, userId)...)
 	if err != nil {
-		c.Error(w, err.Error(), http.StatusInternalServerError)
+		c.Error(w, err.Error(), statusOf(err))
 		return
 	}
 
@@ -215,6 +243,7 @@ func (c *ChatController) HandleGetChat(w http.ResponseWriter, r *http.Request) {
 // @Param        body body SendMessageRequest true "Message content"
 // @Success      201
 // @Failure      400  {object}  ErrorResponse
+// @Failure      403  {object}  ErrorResponse "The sender and someone in the chat blocked each other"
 // @Failure      500  {object}  ErrorResponse
 // @Router       /chat/{chatId}/messages [post]
 func (c *ChatController) HandleSendMessage(w http.ResponseWriter, r *http.Request) {
@@ -242,7 +271,7 @@ func (c *ChatController) HandleSendMessage(w http.ResponseWriter, r *http.Reques
 
 	err = c.service.SendMessage(userId, chatId, content["content"])
 	if err != nil {
-		c.Error(w, err.Error(), http.StatusInternalServerError)
+		c.Error(w, err.Error(), statusOf(err))
 		return
 	}
 	w.WriteHeader(http.StatusCreated)
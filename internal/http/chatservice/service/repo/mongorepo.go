@@ -75,6 +75,12 @@ func (r *MongoRepo) GetChats(userId uuid.UUID) ([]Chat, error) {
 	return chats, nil
 }
 
+func (r *MongoRepo) GetChat(chatId uuid.UUID) (Chat, error) {
+	var chat Chat
+	err := r.chatCollection.FindOne(context.Background(), bson.M{"_id": chatId}).Decode(&chat)
+	return chat, err
+}
+
 func (r *MongoRepo) GetHistory(id uuid.UUID) ([]Message, error) {
 	filter := bson.M{"chat_id": id}
 	cursor, err := r.messageCollection.Find(context.Background(), filter)
@@ -113,3 +119,49 @@ func (r *MongoRepo) SendMessage(message Message, chatId uuid.UUID) error {
 	_, err := r.messageCollection.InsertOne(context.Background(), message)
 	return err
 }
+
+func (r *MongoRepo) GetMessagesBySender(userId uuid.UUID) ([]Message, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}})
+	cursor, err := r.messageCollection.Find(context.Background(), bson.M{"sender_id": userId}, opts)
+	if err != nil {
+		return []Message{}, err
+	}
+	var messages []Message
+	if err := cursor.All(context.Background(), &messages); err != nil {
+		return []Message{}, err
+	}
+	return messages, nil
+}
+
+// EraseUser deletes the messages of a deleted user and removes the user from
+// all chats. Chats nobody is left in are deleted with their history.
+func (r *MongoRepo) EraseUser(userId uuid.UUID) error {
+	ctx := context.Background()
+	if _, err := r.messageCollection.DeleteMany(ctx, bson.M{"sender_id": userId}); err != nil {
+		return err
+	}
+	if _, err := r.chatCollection.UpdateMany(ctx,
+		bson.M{"user_ids": userId},
+		bson.M{"$pull": bson.M{"user_ids": userId}},
+	); err != nil {
+		return err
+	}
+
+	cursor, err := r.chatCollection.Find(ctx, bson.M{"user_ids": bson.M{"$size": 0}})
+	if err != nil {
+		return err
+	}
+	var empty []Chat
+	if err := cursor.All(ctx, &empty); err != nil {
+		return err
+	}
+	for _, chat := range empty {
+		if _, err := r.messageCollection.DeleteMany(ctx, bson.M{"chat_id": chat.ID}); err != nil {
+			return err
+		}
+		if _, err := r.chatCollection.DeleteOne(ctx, bson.M{"_id": chat.ID}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
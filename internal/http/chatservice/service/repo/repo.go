@@ -25,5 +25,8 @@ type Repository interface {
 	SendMessage(message Message, chatId uuid.UUID) error
 	CreateChat(user ...uuid.UUID) (uuid.UUID, error)
 	GetChats(userId uuid.UUID) ([]Chat, error)
+	GetChat(chatId uuid.UUID) (Chat, error)
 	AddUserToChat(userId uuid.UUID, chatId uuid.UUID) error
+	GetMessagesBySender(userId uuid.UUID) ([]Message, error)
+	EraseUser(userId uuid.UUID) error
 }
@@ -2,29 +2,78 @@ package service
 
 import (
 	"encoding/json"
+	"errors"
+	"log"
 	"time"
 
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/blocking"
 	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/http/chatservice/service/repo"
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/notify"
 	"github.com/google/uuid"
 	"github.com/nats-io/nats.go"
 )
 
+// ErrBlocked is returned if one of the users of a chat blocked another one.
+var ErrBlocked = errors.New("user is blocked")
+
+// blocksLoadTimeout is how long the user service gets to send the blocks.
+const blocksLoadTimeout = 5 * time.Second
+
+// PreferencesTimeout is how long the user service gets to answer for the
+// notification preferences of a user.
+const PreferencesTimeout = 2 * time.Second
+
+// MessageEventType is the type of the events sent on user.<id> to the other
+// users of a chat when a message is sent.
+const MessageEventType = "chat.message"
+
+// MessageEvent notifies a user of a message in one of the chats of the user.
+type MessageEvent struct {
+	Type    string       `json:"type"`
+	Message repo.Message `json:"message"`
+}
+
 type Service struct {
-	repo     repo.Repository
-	producer *nats.Conn
+	repo        repo.Repository
+	producer    *nats.Conn
+	blocks      *blocking.List
+	preferences *notify.Lookup
 }
 
+// New creates the chat service, the blocks of the user service are followed
+// over NATS.
 func New(repo repo.Repository, natsUrl string) *Service {
 	producer, err := nats.Connect(natsUrl)
 	if err != nil {
 		panic(err)
 	}
+	blocks := blocking.NewList()
+	if _, err := blocking.Follow(producer, blocks, blocksLoadTimeout); err != nil {
+		panic(err)
+	}
+	preferences, err := notify.NewLookup(producer, PreferencesTimeout)
+	if err != nil {
+		panic(err)
+	}
 	return &Service{
-		producer: producer,
-		repo:     repo,
+		producer:    producer,
+		repo:        repo,
+		blocks:      blocks,
+		preferences: preferences,
 	}
 }
 
+// checkBlocked returns ErrBlocked if the user blocked one of the others or
+// was blocked by them.
+func (s *Service) checkBlocked(userId uuid.UUID, others []uuid.UUID) error {
+	for _, other := range others {
+		if other != userId && s.blocks.Between(userId, other) {
+			return ErrBlocked
+		}
+	}
+	return nil
+}
+
 func (s *Service) GetChat(chatId, userId uuid.UUID) ([]repo.Message, error) {
 	messages, err := s.repo.GetHistory(chatId)
 	if err != nil {
@@ -36,7 +85,16 @@ func (s *Service) GetChat(chatId, userId uuid.UUID) ([]repo.Message, error) {
 	return messages, nil
 }
 
-func (s *Service) AddUserToChat(userId uuid.UUID, chatId uuid.UUID) error {
+// AddUserToChat adds a user to a chat, unless someone in it blocked the user
+// or was blocked by the user.
+func (s *Service) AddUserToChat(chatId uuid.UUID, userId uuid.UUID) error {
+	chat, err := s.repo.GetChat(chatId)
+	if err != nil {
+		return err
+	}
+	if err := s.checkBlocked(userId, chat.UserIds); err != nil {
+		return err
+	}
 	return s.repo.AddUserToChat(userId, chatId)
 }
 
@@ -51,11 +109,56 @@ func (s *Service) GetChats(userId uuid.UUID) ([]repo.Chat, error) {
 	return chats, nil
 }
 
+// CreateChat starts a chat between the users, none of them may have blocked
+// another one.
 func (s *Service) CreateChat(users ...uuid.UUID) (uuid.UUID, error) {
+	for _, user := range users {
+		if err := s.checkBlocked(user, users); err != nil {
+			return uuid.Nil, err
+		}
+	}
 	return s.repo.CreateChat(users...)
 }
 
+// UserChats are the chats of a user with the messages the user wrote.
+type UserChats struct {
+	Chats    []repo.Chat    `json:"chats"`
+	Messages []repo.Message `json:"messages"`
+}
+
+// ExportUser collects the chats of a user for a data export. Messages of the
+// other participants are not part of it.
+func (s *Service) ExportUser(userId uuid.UUID) (any, error) {
+	chats, err := s.GetChats(userId)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := s.repo.GetMessagesBySender(userId)
+	if err != nil {
+		return nil, err
+	}
+	if messages == nil {
+		messages = []repo.Message{}
+	}
+	return UserChats{Chats: chats, Messages: messages}, nil
+}
+
+// EraseUser removes the messages and chat memberships of a deleted user.
+func (s *Service) EraseUser(userId uuid.UUID) error {
+	return s.repo.EraseUser(userId)
+}
+
+// SendMessage sends a message to a chat. Messages are refused once the sender
+// and someone else in the chat blocked each other.
 func (s *Service) SendMessage(senderID, chatId uuid.UUID, content string) error {
+	chat, err := s.repo.GetChat(chatId)
+	if err != nil {
+		return err
+	}
+	if err := s.checkBlocked(senderID, chat.UserIds); err != nil {
+		return err
+	}
+
 	message := repo.Message{
 		ID:        uuid.New(),
 		SenderID:  senderID,
@@ -72,5 +175,27 @@ func (s *Service) SendMessage(senderID, chatId uuid.UUID, content string) error
 	if err != nil {
 		return err
 	}
-	return s.repo.SendMessage(message, chatId)
+	if err := s.repo.SendMessage(message, chatId); err != nil {
+		return err
+	}
+	s.notifyUsers(chat.UserIds, message)
+	return nil
+}
+
+// notifyUsers tells the users of the chat but the sender about the message,
+// unless they turned chat notifications off.
+func (s *Service) notifyUsers(users []uuid.UUID, message repo.Message) {
+	data, err := json.Marshal(MessageEvent{Type: MessageEventType, Message: message})
+	if err != nil {
+		log.Println("Failed to encode message event:", err)
+		return
+	}
+	for _, userId := range users {
+		if userId == message.SenderID || !s.preferences.Allows(userId, notify.Chat, notify.InApp) {
+			continue
+		}
+		if err := s.producer.Publish(notify.Subject(userId), data); err != nil {
+			log.Printf("Failed to publish message event to %s: %v", userId, err)
+		}
+	}
 }
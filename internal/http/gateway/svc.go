@@ -23,11 +23,15 @@ func New(natsurl string, jwtSecret []byte, proxyEndpoints map[string]url.URL) *S
 	if err != nil {
 		panic(err)
 	}
+	authMiddleware := auth.NewAuthMiddleware(jwtSecret).WithAudit(reciver.Conn, "gateway")
 	svr := &Service{
 		server.NewServer(),
 		reciver,
-		auth.NewAuthMiddleware(jwtSecret),
-		jwt.NewDecoder(jwtSecret),
+		authMiddleware,
+		jwt.NewDecoder(jwtSecret).WithDenylist(authMiddleware.Denylist()),
+	}
+	if err := svr.SubscribeRevocations(reciver.Conn); err != nil {
+		panic(err)
 	}
 	setupRoutes(svr)
 	setupProxy(svr, proxyEndpoints)
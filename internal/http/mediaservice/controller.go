@@ -8,11 +8,14 @@ import (
 	"net/http"
 	"os"
 
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/dataexport"
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/erasure"
 	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/http/mediaservice/service"
 	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/middleware/auth"
 	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/server"
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
+	"github.com/nats-io/nats.go"
 )
 
 const (
@@ -35,11 +38,29 @@ type UploadResponse struct {
 
 func New(svc *service.MediaService) *MediaController {
 	secret := os.Getenv("JWT_SECRET")
+	conn, err := nats.Connect(os.Getenv("NATS_URL"))
+	if err != nil {
+		panic(err)
+	}
 	svr := &MediaController{
 		mediaservice:   svc,
 		Server:         server.NewServer(),
 		AuthMiddleware: auth.NewAuthMiddleware([]byte(secret)),
 	}
+	if err := svr.SubscribeRevocations(conn); err != nil {
+		panic(err)
+	}
+	// pictures of deleted users are removed
+	if _, err := erasure.Subscribe(conn, erasure.ServiceMedia, func(userID uuid.UUID) error {
+		return svc.DeletePicturesOf(context.Background(), userID.String())
+	}); err != nil {
+		panic(err)
+	}
+	if _, err := dataexport.Respond(conn, erasure.ServiceMedia, func(userID uuid.UUID) (any, error) {
+		return svc.ListPicturesOf(context.Background(), userID.String())
+	}); err != nil {
+		panic(err)
+	}
 	svr.setupRoutes()
 	return svr
 }
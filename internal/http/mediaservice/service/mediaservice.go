@@ -6,6 +6,8 @@ import (
 	"embed"
 	"fmt"
 	"log"
+	"strings"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/minio/minio-go/v7"
@@ -14,6 +16,9 @@ import (
 
 const (
 	PICTURE_BUCKET_NAME = "images"
+	// OWNER_BUCKET_NAME indexes the pictures by uploader, it holds an empty
+	// object <uploader>/<picture> for every picture.
+	OWNER_BUCKET_NAME = "image-owners"
 )
 
 type MediaService struct {
@@ -43,7 +48,62 @@ func New(endpoint, accessKeyID, secretAccessKey string) (*MediaService, error) {
 		}
 	}
 
-	return &MediaService{client: client}, nil
+	m := &MediaService{client: client}
+	exists, err = client.BucketExists(ctx, OWNER_BUCKET_NAME)
+	if err != nil {
+		return nil, fmt.Errorf("bucket check failed: %v", err)
+	}
+	if !exists {
+		err = client.MakeBucket(ctx, OWNER_BUCKET_NAME, minio.MakeBucketOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("bucket creation failed: %v", err)
+		}
+	}
+	if err := m.indexOwners(ctx); err != nil {
+		return nil, fmt.Errorf("indexing pictures failed: %v", err)
+	}
+
+	return m, nil
+}
+
+// ownersIndexed marks that the pictures uploaded before the index existed
+// were added to it.
+const ownersIndexed = ".indexed"
+
+// indexOwners adds the pictures uploaded before the index existed, once.
+func (m *MediaService) indexOwners(ctx context.Context) error {
+	_, err := m.client.StatObject(ctx, OWNER_BUCKET_NAME, ownersIndexed, minio.StatObjectOptions{})
+	if err == nil {
+		return nil
+	}
+	if minio.ToErrorResponse(err).Code != "NoSuchKey" {
+		return err
+	}
+	for obj := range m.client.ListObjects(ctx, PICTURE_BUCKET_NAME, minio.ListObjectsOptions{Recursive: true}) {
+		if obj.Err != nil {
+			return obj.Err
+		}
+		info, err := m.client.StatObject(ctx, PICTURE_BUCKET_NAME, obj.Key, minio.StatObjectOptions{})
+		if err != nil {
+			return err
+		}
+		if uploader := info.UserMetadata["Id"]; uploader != "" {
+			if err := m.indexOwner(ctx, uploader, obj.Key); err != nil {
+				return err
+			}
+		}
+	}
+	_, err = m.client.PutObject(ctx, OWNER_BUCKET_NAME, ownersIndexed, bytes.NewReader(nil), 0, minio.PutObjectOptions{})
+	return err
+}
+
+func ownerKey(uploader, name string) string {
+	return uploader + "/" + name
+}
+
+func (m *MediaService) indexOwner(ctx context.Context, uploader, name string) error {
+	_, err := m.client.PutObject(ctx, OWNER_BUCKET_NAME, ownerKey(uploader, name), bytes.NewReader(nil), 0, minio.PutObjectOptions{})
+	return err
 }
 
 // UploadPicture mit Content-Type-Handling
@@ -80,7 +140,10 @@ func (m *MediaService) UploadPicture(ctx context.Context, uploader string, conte
 			},
 		},
 	)
-	return name, err
+	if err != nil {
+		return "", err
+	}
+	return name, m.indexOwner(ctx, uploader, name)
 }
 
 //go:embed impala.jpg
@@ -146,7 +209,10 @@ func (m *MediaService) UploadPictureToMulti(ctx context.Context, uploader, compo
 			},
 		},
 	)
-	return err
+	if err != nil {
+		return err
+	}
+	return m.indexOwner(ctx, uploader, name)
 }
 
 func (m *MediaService) GetMultiPicture(ctx context.Context, id uuid.UUID) ([]string, error) {
@@ -175,3 +241,75 @@ func (m *MediaService) GetMultiPicture(ctx context.Context, id uuid.UUID) ([]str
 	}
 	return pictureNames, nil
 }
+
+// PictureInfo describes an uploaded picture in a data export.
+type PictureInfo struct {
+	Name         string    `json:"name"`
+	ContentType  string    `json:"contentType"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"lastModified"`
+	CompoundID   string    `json:"compoundId,omitempty"`
+}
+
+// ListPicturesOf returns the pictures the user uploaded.
+func (m *MediaService) ListPicturesOf(ctx context.Context, uploader string) ([]PictureInfo, error) {
+	names, err := m.picturesOf(ctx, uploader)
+	if err != nil {
+		return nil, err
+	}
+	pictures := make([]PictureInfo, 0, len(names))
+	for _, name := range names {
+		info, err := m.client.StatObject(ctx, PICTURE_BUCKET_NAME, name, minio.StatObjectOptions{})
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			// removed by an erasure that did not finish
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		pictures = append(pictures, PictureInfo{
+			Name:         info.Key,
+			ContentType:  info.ContentType,
+			Size:         info.Size,
+			LastModified: info.LastModified,
+			CompoundID:   info.UserMetadata["Compound-Id"],
+		})
+	}
+	return pictures, nil
+}
+
+// DeletePicturesOf removes every picture the user uploaded. A picture is
+// removed from the index last, so a retry finds what is left.
+func (m *MediaService) DeletePicturesOf(ctx context.Context, uploader string) error {
+	names, err := m.picturesOf(ctx, uploader)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := m.client.RemoveObject(ctx, PICTURE_BUCKET_NAME, name, minio.RemoveObjectOptions{}); err != nil {
+			return err
+		}
+		if err := m.client.RemoveObject(ctx, OWNER_BUCKET_NAME, ownerKey(uploader, name), minio.RemoveObjectOptions{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// picturesOf returns the names of the pictures the uploader owns according
+// to the index.
+func (m *MediaService) picturesOf(ctx context.Context, uploader string) ([]string, error) {
+	prefix := ownerKey(uploader, "")
+	objectCh := m.client.ListObjects(ctx, OWNER_BUCKET_NAME, minio.ListObjectsOptions{
+		Prefix:    prefix,
+		Recursive: true,
+	})
+	var names []string
+	for obj := range objectCh {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		names = append(names, strings.TrimPrefix(obj.Key, prefix))
+	}
+	return names, nil
+}
@@ -23,6 +23,14 @@ func (m *MockRepository) GetRatings(userID uuid.UUID) ([]Rating, error) {
 	return m.GetRatingsFunc(userID)
 }
 
+func (m *MockRepository) GetRatingsBy(userID uuid.UUID) ([]Rating, error) {
+	return []Rating{}, nil
+}
+
+func (m *MockRepository) EraseUser(userID uuid.UUID) error {
+	return nil
+}
+
 func newTestService(repo Repository) *Service {
 	svc := &Service{
 		Server:     *server.NewServer(),
@@ -47,3 +47,29 @@ func (mr *MongoRepo) GetRatings(userID uuid.UUID) ([]Rating, error) {
 	}
 	return ratings, nil
 }
+
+// GetRatingsBy returns the ratings the user gave.
+func (mr *MongoRepo) GetRatingsBy(userID uuid.UUID) ([]Rating, error) {
+	var ratings []Rating
+	cursor, err := mr.ratingCollection.Find(context.Background(), bson.M{"user_id_from": userID})
+	if err != nil {
+		return []Rating{}, err
+	}
+	if err := cursor.All(context.Background(), &ratings); err != nil {
+		return []Rating{}, err
+	}
+	return ratings, nil
+}
+
+// EraseUser deletes the ratings a deleted user received. Ratings the user
+// gave stay for the rated users but no longer name the author.
+func (mr *MongoRepo) EraseUser(userID uuid.UUID) error {
+	if _, err := mr.ratingCollection.DeleteMany(context.Background(), bson.M{"user_id_to": userID}); err != nil {
+		return err
+	}
+	_, err := mr.ratingCollection.UpdateMany(context.Background(),
+		bson.M{"user_id_from": userID},
+		bson.M{"$set": bson.M{"user_id_from": uuid.Nil}},
+	)
+	return err
+}
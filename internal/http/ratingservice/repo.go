@@ -5,4 +5,6 @@ import "github.com/google/uuid"
 type Repository interface {
 	CreateRating(rating *Rating) error
 	GetRatings(userID uuid.UUID) ([]Rating, error)
+	GetRatingsBy(userID uuid.UUID) ([]Rating, error)
+	EraseUser(userID uuid.UUID) error
 }
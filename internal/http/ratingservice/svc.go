@@ -3,6 +3,8 @@ package ratingservice
 import (
 	"encoding/json"
 
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/dataexport"
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/erasure"
 	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/server"
 	"github.com/google/uuid"
 	"github.com/nats-io/nats.go"
@@ -45,6 +47,31 @@ type Rating struct {
 	Content    string        `json:"content" bson:"content"`
 }
 
+// UserRatings are the ratings a user gave and received.
+type UserRatings struct {
+	Given    []Rating `json:"given"`
+	Received []Rating `json:"received"`
+}
+
+// ExportUser collects the ratings of a user for a data export.
+func (svc *Service) ExportUser(userID uuid.UUID) (any, error) {
+	given, err := svc.GetRatingsBy(userID)
+	if err != nil {
+		return nil, err
+	}
+	received, err := svc.GetRatings(userID)
+	if err != nil {
+		return nil, err
+	}
+	if given == nil {
+		given = []Rating{}
+	}
+	if received == nil {
+		received = []Rating{}
+	}
+	return UserRatings{Given: given, Received: received}, nil
+}
+
 func (svc *Service) StartNats(done <-chan struct{}) {
 	subject := "ratings."
 
@@ -72,12 +99,29 @@ func (svc *Service) StartNats(done <-chan struct{}) {
 		}
 	})
 
+	erasureSub, err := erasure.Subscribe(svc.Conn, erasure.ServiceRatings, svc.EraseUser)
+	if err != nil {
+		svc.GetLogger().Err(err).Msg("Error subscribing to deleted users")
+	}
+	exportSub, err := dataexport.Respond(svc.Conn, erasure.ServiceRatings, svc.ExportUser)
+	if err != nil {
+		svc.GetLogger().Err(err).Msg("Error subscribing to data exports")
+	}
+
 	<-done
 	svc.GetLogger().Info().Msg("Shutting down NATS service")
-	err := sub.Unsubscribe()
+	err = sub.Unsubscribe()
 	if err != nil {
 		svc.GetLogger().Err(err).Msg("Error shutting down NATS service")
 	}
+	for _, s := range []*nats.Subscription{erasureSub, exportSub} {
+		if s == nil {
+			continue
+		}
+		if err := s.Unsubscribe(); err != nil {
+			svc.GetLogger().Err(err).Msg("Error shutting down NATS service")
+		}
+	}
 	svc.Conn.Close()
 
 }
@@ -3,6 +3,8 @@ package repo
 import (
 	"context"
 
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
@@ -25,3 +27,20 @@ func (m *mongoTrackingRepo) SaveTracking(tracking Tracking) error {
 	_, err := m.trackingCollection.InsertOne(context.Background(), tracking)
 	return err
 }
+
+func (m *mongoTrackingRepo) GetTrackingOfUser(userID uuid.UUID) ([]Tracking, error) {
+	cursor, err := m.trackingCollection.Find(context.Background(), bson.M{"user_id": userID})
+	if err != nil {
+		return nil, err
+	}
+	tracking := []Tracking{}
+	if err := cursor.All(context.Background(), &tracking); err != nil {
+		return nil, err
+	}
+	return tracking, nil
+}
+
+func (m *mongoTrackingRepo) DeleteTrackingOfUser(userID uuid.UUID) error {
+	_, err := m.trackingCollection.DeleteMany(context.Background(), bson.M{"user_id": userID})
+	return err
+}
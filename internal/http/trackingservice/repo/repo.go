@@ -12,4 +12,6 @@ type Tracking struct {
 
 type TrackingRepo interface {
 	SaveTracking(Tracking) error
+	GetTrackingOfUser(userID uuid.UUID) ([]Tracking, error)
+	DeleteTrackingOfUser(userID uuid.UUID) error
 }
@@ -5,9 +5,12 @@ import (
 	"os"
 	"time"
 
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/dataexport"
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/erasure"
 	repoangebot "github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/http/angebotservice/service/repo_angebot"
 	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/http/gateway"
 	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/http/trackingservice/repo"
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/notify"
 	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/offerclient"
 	"github.com/google/uuid"
 	"github.com/nats-io/nats.go"
@@ -19,18 +22,28 @@ type TrackingService struct {
 	logger      zerolog.Logger
 	offerClient *offerclient.OfferClient
 	mongoClient repo.TrackingRepo
+	preferences *notify.Lookup
 }
 
+// PreferencesTimeout is how long the user service gets to answer for the
+// notification preferences of a user.
+const PreferencesTimeout = 2 * time.Second
+
 func NewTrackingService(natsURL string, offerURL string, mongoURL string) *TrackingService {
 	queue, err := nats.Connect(natsURL)
 	if err != nil {
 		panic(err)
 	}
+	preferences, err := notify.NewLookup(queue, PreferencesTimeout)
+	if err != nil {
+		panic(err)
+	}
 	svc := &TrackingService{
 		queue:       queue,
 		logger:      zerolog.New(os.Stdout),
 		offerClient: offerclient.NewOfferClient(offerURL),
 		mongoClient: repo.NewMongoTrackingRepo(mongoURL),
+		preferences: preferences,
 	}
 	return svc
 }
@@ -84,7 +97,10 @@ func (s *TrackingService) Start() {
 			return
 		}
 		for _, occupied := range offer.OccupiedSpace.Users() {
-			if err := s.queue.Publish("user."+occupied.String(), msg.Data); err != nil {
+			if !s.preferences.Allows(occupied, notify.Tracking, notify.InApp) {
+				continue
+			}
+			if err := s.queue.Publish(notify.Subject(occupied), msg.Data); err != nil {
 				s.logger.Error().Err(err).Msg("Failed to publish tracking request")
 				return
 			}
@@ -96,5 +112,18 @@ func (s *TrackingService) Start() {
 		s.logger.Error().Err(err).Msg("Failed to subscribe to tracking requests")
 		return
 	}
+	// the locations of deleted users are removed
+	_, err = erasure.Subscribe(s.queue, erasure.ServiceTracking, s.mongoClient.DeleteTrackingOfUser)
+	if err != nil {
+		s.logger.Error().Err(err).Msg("Failed to subscribe to deleted users")
+		return
+	}
+	_, err = dataexport.Respond(s.queue, erasure.ServiceTracking, func(userID uuid.UUID) (any, error) {
+		return s.mongoClient.GetTrackingOfUser(userID)
+	})
+	if err != nil {
+		s.logger.Error().Err(err).Msg("Failed to subscribe to data exports")
+		return
+	}
 	select {} // Block forever
 }
@@ -0,0 +1,62 @@
+package userservice
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/audit"
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/http/userservice/repo"
+	"github.com/google/uuid"
+)
+
+const (
+	// AuditRetention is how long security events are kept.
+	AuditRetention = 180 * 24 * time.Hour
+	// auditServiceName marks the events recorded by the user service itself.
+	auditServiceName = "user"
+
+	defaultAuditLimit = 50
+	maxAuditLimit     = 200
+)
+
+var ERR_INVALID_AUDIT_QUERY = errors.New("invalid audit query")
+
+// RecordAudit appends a security event to the audit log. Failing to record
+// it does not fail the action, the event is logged instead.
+func (s *UserService) RecordAudit(event audit.Event) {
+	if event.ID == uuid.Nil {
+		event.ID = uuid.New()
+	}
+	if event.CreatedAt.IsZero() {
+		event.CreatedAt = time.Now()
+	}
+	if event.Service == "" {
+		event.Service = auditServiceName
+	}
+	event.ExpiresAt = event.CreatedAt.Add(AuditRetention)
+	if err := s.repo.CreateAuditEvent(event); err != nil {
+		log.Printf("Failed to record audit event %s of user %s from %s: %v", event.Type, event.UserID, event.IP, err)
+	}
+}
+
+// SecurityEvents returns the events of the user, newest first. The next page
+// starts before the oldest event of the previous one.
+func (s *UserService) SecurityEvents(userID uuid.UUID, before time.Time, limit int) ([]audit.Event, error) {
+	return s.QueryAudit(repo.AuditQuery{UserID: userID, Until: before, Limit: limit})
+}
+
+// QueryAudit searches the audit log. At least one of user, address or type
+// has to be given, the limit defaults to 50 events.
+func (s *UserService) QueryAudit(query repo.AuditQuery) ([]audit.Event, error) {
+	if query.UserID == uuid.Nil && query.IP == "" && query.Type == "" {
+		return nil, ERR_INVALID_AUDIT_QUERY
+	}
+	if query.Limit < 0 || query.Limit > maxAuditLimit {
+		return nil, ERR_INVALID_AUDIT_QUERY
+	}
+	if query.Limit == 0 {
+		query.Limit = defaultAuditLimit
+	}
+	return s.repo.FindAuditEvents(query)
+}
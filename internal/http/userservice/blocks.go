@@ -0,0 +1,74 @@
+package userservice
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/blocking"
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/http/userservice/repo"
+	"github.com/google/uuid"
+)
+
+var (
+	ERR_BLOCK_SELF     = errors.New("users can not block themselves")
+	ERR_USER_NOT_FOUND = errors.New("user not found")
+)
+
+// BlockUser keeps the other user away from the blocker: they can no longer
+// chat with each other or book each other's offers, and their offers are
+// hidden from one another. Blocking a user again has no effect.
+func (s *UserService) BlockUser(blockerID uuid.UUID, blockedID uuid.UUID) error {
+	if blockerID == blockedID {
+		return ERR_BLOCK_SELF
+	}
+	if _, err := s.repo.GetUserByID(blockedID); err != nil {
+		return ERR_USER_NOT_FOUND
+	}
+	block := repo.Block{BlockerID: blockerID, BlockedID: blockedID, CreatedAt: time.Now()}
+	if err := s.repo.CreateBlock(block); err != nil {
+		return err
+	}
+	s.publishBlock(blockerID, blockedID, true)
+	return nil
+}
+
+// UnblockUser lifts a block, unblocking a user that is not blocked has no
+// effect.
+func (s *UserService) UnblockUser(blockerID uuid.UUID, blockedID uuid.UUID) error {
+	if err := s.repo.DeleteBlock(blockerID, blockedID); err != nil {
+		return err
+	}
+	s.publishBlock(blockerID, blockedID, false)
+	return nil
+}
+
+// ListBlocks returns the users the blocker blocked, oldest first.
+func (s *UserService) ListBlocks(blockerID uuid.UUID) ([]repo.Block, error) {
+	return s.repo.GetBlocksOfUser(blockerID)
+}
+
+// AllBlocks returns every block, the other services load them on startup.
+func (s *UserService) AllBlocks() ([]blocking.Block, error) {
+	blocks, err := s.repo.GetBlocks()
+	if err != nil {
+		return nil, err
+	}
+	result := make([]blocking.Block, 0, len(blocks))
+	for _, block := range blocks {
+		result = append(result, blocking.Block{BlockerID: block.BlockerID, BlockedID: block.BlockedID})
+	}
+	return result, nil
+}
+
+// publishBlock announces the change on blocking.ChangedSubject. A lost event
+// is corrected when the services load all blocks again on their next start.
+func (s *UserService) publishBlock(blockerID uuid.UUID, blockedID uuid.UUID, blocked bool) {
+	if s.publisher == nil {
+		return
+	}
+	event := blocking.Event{Block: blocking.Block{BlockerID: blockerID, BlockedID: blockedID}, Blocked: blocked}
+	if err := blocking.Publish(s.publisher, event); err != nil {
+		log.Printf("Failed to announce block of %s by %s: %v", blockedID, blockerID, err)
+	}
+}
@@ -2,36 +2,54 @@ package userservice
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math"
+	"mime"
 	"net/http"
 	"net/mail"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/audit"
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/blocking"
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/dataexport"
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/erasure"
 	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/http/ratingservice"
 	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/ratingclient"
 	"github.com/joho/godotenv"
 
-	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/hasher"
 	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/http/userservice/repo"
 	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/jwt"
 	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/middleware/auth"
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/notify"
 	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/server"
+	"github.com/go-webauthn/webauthn/protocol"
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
+	"github.com/nats-io/nats.go"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
 const (
 	UserIdHeader = "UserId"
+
+	// ExportCollectTimeout is how long a service gets to answer with the data of a user.
+	ExportCollectTimeout = 10 * time.Second
 )
 
 type UserController struct {
 	*server.Server
 	*auth.AuthMiddleware
 	*jwt.Encoder
+	decoder      *jwt.Decoder
 	service      *UserService
 	ratingClient *ratingclient.RatingClient
+	nats         *nats.Conn
 }
 
 type ErrorResponse struct {
@@ -41,6 +59,63 @@ type UserCredentials struct {
 	Email    string
 	Password string
 }
+type TokenResponse struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refreshToken"`
+}
+type RefreshTokenRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+type SetRolesRequest struct {
+	Roles []string `json:"roles"`
+}
+type ForgotPasswordRequest struct {
+	Email string `json:"email"`
+}
+type ResetPasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"currentPassword"`
+	NewPassword     string `json:"newPassword"`
+}
+type OIDCLoginResponse struct {
+	AuthURL string `json:"authUrl"`
+}
+type OIDCCallbackRequest struct {
+	State string `json:"state"`
+	Code  string `json:"code"`
+}
+type MFARequiredResponse struct {
+	MFARequired bool   `json:"mfaRequired"`
+	MFAToken    string `json:"mfaToken"`
+}
+type MFALoginRequest struct {
+	MFAToken string `json:"mfaToken"`
+	Code     string `json:"code"`
+}
+type TOTPCodeRequest struct {
+	Code string `json:"code"`
+}
+type TOTPEnrollmentResponse struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recoveryCodes"`
+}
+type RenamePasskeyRequest struct {
+	Name string `json:"name"`
+}
+type ErasureStatusResponse struct {
+	repo.Erasure
+	Completed bool `json:"completed"`
+}
+type UserDirectoryResponse struct {
+	Users      []any  `json:"users"`
+	NextCursor string `json:"nextCursor,omitempty"`
+}
 
 func New(svc *UserService, secret []byte) *UserController {
 	err := godotenv.Load()
@@ -48,14 +123,45 @@ func New(svc *UserService, secret []byte) *UserController {
 		log.Println("Failed to load .env file:", err)
 	}
 	RATING_URL := os.Getenv("RATING_SERVICE_URL")
+	NATS_URL := os.Getenv("NATS_URL")
+	conn, err := nats.Connect(NATS_URL)
+	if err != nil {
+		panic(err)
+	}
 
+	authMiddleware := auth.NewAuthMiddleware(secret).WithAudit(conn, auditServiceName)
 	svr := &UserController{
 		Server:         server.NewServer(),
-		AuthMiddleware: auth.NewAuthMiddleware(secret),
+		AuthMiddleware: authMiddleware,
 		Encoder:        jwt.NewEncoder(secret),
+		decoder:        jwt.NewDecoder(secret).WithDenylist(authMiddleware.Denylist()),
 		service:        svc,
 		ratingClient:   ratingclient.NewRatingClient(RATING_URL),
+		nats:           conn,
+	}
+	if err := svr.SubscribeRevocations(conn); err != nil {
+		panic(err)
+	}
+	svc.WithPublisher(conn)
+	if _, err := erasure.SubscribeReports(conn, func(report erasure.Report) {
+		if err := svc.RecordErasureReport(report); err != nil {
+			svr.GetLogger().Err(err).Msg("Fehler beim Speichern des Löschstatus")
+		}
+	}); err != nil {
+		panic(err)
+	}
+	go svr.retryErasures()
+	go svr.cleanupExports()
+	if _, err := blocking.Respond(conn, svc.AllBlocks); err != nil {
+		panic(err)
+	}
+	if _, err := audit.Subscribe(conn, svc.RecordAudit); err != nil {
+		panic(err)
 	}
+	if _, err := notify.Respond(conn, svc.GetPreferences); err != nil {
+		panic(err)
+	}
+	svc.WithCollector(dataexport.NewCollector(conn, ExportCollectTimeout))
 
 	svr.setupRoutes()
 
@@ -70,7 +176,7 @@ func (c *UserController) setupRoutes() {
 				// Set CORS headers
 				w.Header().Set("Access-Control-Allow-Origin", origin)
 				w.Header().Set("Access-Control-Allow-Credentials", "true")
-				w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+				w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
 				w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
 
 				// Handle preflight requests
@@ -83,23 +189,72 @@ func (c *UserController) setupRoutes() {
 			})
 		})
 
+	// verification
+	c.WithHandlerFunc("/verify", c.VerifyEmail, http.MethodGet)
+	c.WithHandlerFunc("/verify/resend", c.EnsureJWT(c.ResendVerification), http.MethodPost)
+
 	// user
 	c.WithHandlerFunc("/self", c.EnsureJWT(c.GetSelfId), http.MethodGet)
-	c.WithHandlerFunc("/", c.GetUsers, http.MethodGet)
+	c.WithHandlerFunc("/self/profile", c.EnsureJWT(c.GetSelf), http.MethodGet)
+	c.WithHandlerFunc("/self/privacy", c.EnsureJWT(c.SetPrivacy), http.MethodPut)
+	c.WithHandlerFunc("/self/linked-accounts/{provider}", c.EnsureJWT(c.UnlinkIdentity), http.MethodDelete)
+	c.WithHandlerFunc("/self/sessions", c.EnsureJWT(c.ListSessions), http.MethodGet)
+	c.WithHandlerFunc("/self/sessions", c.EnsureJWT(c.RevokeOtherSessions), http.MethodDelete)
+	c.WithHandlerFunc("/self/sessions/{sessionId}", c.EnsureJWT(c.RevokeSession), http.MethodDelete)
+	c.WithHandlerFunc("/self/security-events", c.EnsureJWT(c.ListSecurityEvents), http.MethodGet)
+	c.WithHandlerFunc("/audit", c.RequireRole(auth.RoleAdmin)(c.QueryAudit), http.MethodGet)
+	c.WithHandlerFunc("/self/notification-preferences", c.EnsureJWT(c.GetPreferences), http.MethodGet)
+	c.WithHandlerFunc("/self/notification-preferences", c.EnsureJWT(c.UpdatePreferences), http.MethodPut)
+	c.WithHandlerFunc("/self/blocks", c.EnsureJWT(c.ListBlocks), http.MethodGet)
+	c.WithHandlerFunc("/self/blocks/{userId}", c.EnsureJWT(c.BlockUser), http.MethodPut)
+	c.WithHandlerFunc("/self/blocks/{userId}", c.EnsureJWT(c.UnblockUser), http.MethodDelete)
+	c.WithHandlerFunc("/self/export", c.EnsureJWT(c.StartExport), http.MethodPost)
+	c.WithHandlerFunc("/self/export/{exportId}", c.EnsureJWT(c.GetExport), http.MethodGet)
+	c.WithHandlerFunc("/self/export/{exportId}/download", c.EnsureJWT(c.DownloadExport), http.MethodGet)
+	c.WithHandlerFunc("/vehicles", c.EnsureJWT(c.ListVehicles), http.MethodGet)
+	c.WithHandlerFunc("/vehicles", c.EnsureJWT(c.CreateVehicle), http.MethodPost)
+	c.WithHandlerFunc("/vehicles/{vehicleId}", c.OptionalJWT(c.GetVehicle), http.MethodGet)
+	c.WithHandlerFunc("/vehicles/{vehicleId}", c.EnsureJWT(c.UpdateVehicle), http.MethodPut)
+	c.WithHandlerFunc("/vehicles/{vehicleId}", c.EnsureJWT(c.DeleteVehicle), http.MethodDelete)
+	c.WithHandlerFunc("/", c.OptionalJWT(c.GetUsers), http.MethodGet)
 	c.WithHandlerFunc("/", c.CreateUser, http.MethodPost)
 	c.WithHandlerFunc("/{id}", c.EnsureJWT(c.UpdateUser), http.MethodPut)
+	c.WithHandlerFunc("/{id}", c.EnsureJWT(c.PatchUser), http.MethodPatch)
 	c.WithHandlerFunc("/{id}", c.EnsureJWT(c.DeleteUser), http.MethodDelete)
-	c.WithHandlerFunc("/email", c.GetUserByEmail, http.MethodGet)
-	c.WithHandlerFunc("/{id}", c.GetUser, http.MethodGet)
+	c.WithHandlerFunc("/{id}/roles", c.RequireRole(auth.RoleAdmin)(c.SetRoles), http.MethodPut)
+	c.WithHandlerFunc("/{id}/erasure", c.EnsureJWT(c.GetErasureStatus), http.MethodGet)
+	c.WithHandlerFunc("/email", c.OptionalJWT(c.GetUserByEmail), http.MethodGet)
+	c.WithHandlerFunc("/{id}", c.OptionalJWT(c.GetUser), http.MethodGet)
 
 	// login
 	c.WithHandlerFunc("/login", c.GetLoginToken, http.MethodPost)
+	c.WithHandlerFunc("/refresh", c.RefreshToken, http.MethodPost)
+	c.WithHandlerFunc("/login/mfa", c.FinishMFALogin, http.MethodPost)
+	c.WithHandlerFunc("/logout", c.EnsureJWT(c.Logout), http.MethodPost)
+
+	// login with identity providers
+	c.WithHandlerFunc("/oidc/providers", c.ListOIDCProviders, http.MethodGet)
+	c.WithHandlerFunc("/oidc/{provider}/login", c.BeginOIDCLogin, http.MethodGet)
+	c.WithHandlerFunc("/oidc/{provider}/callback", c.FinishOIDCLogin, http.MethodPost)
+
+	// two-factor authentication
+	c.WithHandlerFunc("/2fa/totp", c.EnsureJWT(c.EnrollTOTP), http.MethodPost)
+	c.WithHandlerFunc("/2fa/totp/confirm", c.EnsureJWT(c.ConfirmTOTP), http.MethodPost)
+	c.WithHandlerFunc("/2fa/totp", c.EnsureJWT(c.DisableTOTP), http.MethodDelete)
+
+	// password reset
+	c.WithHandlerFunc("/password/forgot", c.ForgotPassword, http.MethodPost)
+	c.WithHandlerFunc("/password/reset", c.ResetPassword, http.MethodPost)
+	c.WithHandlerFunc("/password/change", c.EnsureJWT(c.ChangePassword), http.MethodPost)
 
 	// passkey
 	c.WithHandlerFunc("/webauthn/register/options", c.EnsureJWT(c.beginRegistration), http.MethodGet)
 	c.WithHandlerFunc("/webauthn/register", c.EnsureJWT(c.finishRegistration), http.MethodPost)
 	c.WithHandlerFunc("/webauthn/login/options", c.beginLogin, http.MethodGet)
 	c.WithHandlerFunc("/webauthn/login", c.finishLogin, http.MethodPost)
+	c.WithHandlerFunc("/webauthn/credentials", c.EnsureJWT(c.ListPasskeys), http.MethodGet)
+	c.WithHandlerFunc("/webauthn/credentials/{credentialId}", c.EnsureJWT(c.RenamePasskey), http.MethodPut)
+	c.WithHandlerFunc("/webauthn/credentials/{credentialId}", c.EnsureJWT(c.DeletePasskey), http.MethodDelete)
 
 	// rating
 	c.WithHandlerFunc("/{id}/rating", c.HandleGetRating, http.MethodGet)
@@ -148,18 +303,32 @@ func (c *UserController) HandleGetRating(w http.ResponseWriter, r *http.Request)
 	}
 }
 
+// PasskeyCreationResponse are the options for navigator.credentials.create
+// together with the session the answer belongs to.
+type PasskeyCreationResponse struct {
+	*protocol.CredentialCreation
+	SessionID string `json:"sessionId"`
+}
+
+// PasskeyAssertionResponse are the options for navigator.credentials.get
+// together with the session the answer belongs to.
+type PasskeyAssertionResponse struct {
+	*protocol.CredentialAssertion
+	SessionID string `json:"sessionId"`
+}
+
 // beginRegistration godoc
 // @Summary      Begin WebAuthn registration
-// @Description  Starts the WebAuthn registration process for the authenticated user.
+// @Description  Starts the WebAuthn registration process for the authenticated user. The returned session id has to be sent back with the registration.
 // @Tags         users
 // @Accept       json
 // @Produce      json
 // @Param        Authorization header string true "User JWT token"
-// @Success      200  {object}  protocol.CredentialCreation "Registration options"
-// @Failure      400  {object}  ErrorResponse "Invalid user ID"
-// @Failure      404  {object}  ErrorResponse "User not found"
-// @Failure      500  {object}  ErrorResponse "Internal server error"
-// @Router       /users/webauthn/register/options [post]
+// @Success      200  {object}  PasskeyCreationResponse "Registration options"
+// @Failure      400  {object}  ErrorResponse "Ungültige ID"
+// @Failure      404  {object}  ErrorResponse "Benutzer nicht gefunden"
+// @Failure      500  {object}  ErrorResponse "Interner Serverfehler"
+// @Router       /users/webauthn/register/options [get]
 func (c *UserController) beginRegistration(w http.ResponseWriter, r *http.Request) {
 	id := r.Header.Get(UserIdHeader)
 	uid, err := uuid.Parse(id)
@@ -167,23 +336,18 @@ func (c *UserController) beginRegistration(w http.ResponseWriter, r *http.Reques
 		c.Error(w, "ungültige ID", http.StatusBadRequest)
 		return
 	}
-	user, err := c.service.GetUserByID(uid)
-	if err != nil {
-		c.Error(w, "Benutzer nicht gefunden", http.StatusNotFound)
-		return
-	}
 
-	options, sessionData, err := c.service.webauth.BeginRegistration(user)
+	options, sessionID, err := c.service.BeginPasskeyRegistration(uid)
 	if err != nil {
-		c.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	user.SessionData = *sessionData
-	if err = c.service.repo.UpdateUser(user); err != nil {
-		c.Error(w, "Fehler beim Speichern der Session-Daten", http.StatusInternalServerError)
+		if err == mongo.ErrNoDocuments {
+			c.Error(w, "Benutzer nicht gefunden", http.StatusNotFound)
+		} else {
+			c.Error(w, "Fehler beim Starten der Registrierung", http.StatusInternalServerError)
+		}
 		return
 	}
-	if err := json.NewEncoder(w).Encode(options); err != nil {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(PasskeyCreationResponse{CredentialCreation: options, SessionID: sessionID}); err != nil {
 		c.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -196,9 +360,10 @@ func (c *UserController) beginRegistration(w http.ResponseWriter, r *http.Reques
 // @Accept       json
 // @Produce      plain
 // @Param        Authorization header string true "User JWT token"
+// @Param        session query string true "Session id from the registration options"
+// @Param        name query string false "Name of the passkey"
 // @Success      200  {string}  string  "Registrierung erfolgreich"
 // @Failure      400  {object}  ErrorResponse "Ungültige Anfrage oder Registrierung fehlgeschlagen"
-// @Failure      404  {object}  ErrorResponse "Benutzer nicht gefunden"
 // @Failure      500  {object}  ErrorResponse "Interner Serverfehler"
 // @Router       /users/webauthn/register [post]
 func (c *UserController) finishRegistration(w http.ResponseWriter, r *http.Request) {
@@ -209,24 +374,18 @@ func (c *UserController) finishRegistration(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	user, err := c.service.GetUserByID(uid)
-	if err != nil {
-		c.Error(w, "Benutzer nicht gefunden", http.StatusNotFound)
-		return
-	}
-	sessionData := user.SessionData
-
-	cred, err := c.service.webauth.FinishRegistration(user, sessionData, r)
+	query := r.URL.Query()
+	err = c.service.FinishPasskeyRegistration(uid, query.Get("session"), query.Get("name"), r)
 	if err != nil {
-		c.Error(w, fmt.Sprintf("Registrierung fehlgeschlagen [%v]", err), http.StatusBadRequest)
-		return
-	}
-	user.AddCredential(cred)
-	if err := c.service.repo.UpdateUser(user); err != nil {
-		c.Error(w, "Fehler beim Aktualisieren des Benutzers", http.StatusInternalServerError)
+		if err == ERR_INVALID_WEBAUTHN_SESSION {
+			c.Error(w, "Ungültige oder abgelaufene Sitzung", http.StatusBadRequest)
+		} else {
+			c.Error(w, fmt.Sprintf("Registrierung fehlgeschlagen [%v]", err), http.StatusBadRequest)
+		}
 		return
 	}
 
+	c.recordAudit(r, audit.Event{Type: audit.PasskeyAdded, UserID: uid, Details: map[string]string{"name": query.Get("name")}})
 	if _, err := w.Write([]byte("Registrierung erfolgreich")); err != nil {
 		c.GetLogger().Error().Str("Fehler beim schreiben der Antwort", err.Error())
 		return
@@ -235,39 +394,35 @@ func (c *UserController) finishRegistration(w http.ResponseWriter, r *http.Reque
 
 // beginLogin godoc
 // @Summary      Begin WebAuthn login
-// @Description  Starts the WebAuthn login process by generating login options for the user.
+// @Description  Starts the WebAuthn login process. Without an email a discoverable login is started and the account is taken from the passkey the user picks.
 // @Tags         users
 // @Accept       json
 // @Produce      json
-// @Param        email query string true "User email address"
-// @Success      200  {object}  protocol.CredentialAssertion "Login options"
+// @Param        email query string false "User email address"
+// @Success      200  {object}  PasskeyAssertionResponse "Login options"
 // @Failure      400  {object}  ErrorResponse "Ungültige E-Mail-Adresse"
 // @Failure      404  {object}  ErrorResponse "Benutzer nicht gefunden"
 // @Failure      500  {object}  ErrorResponse "Interner Serverfehler"
 // @Router       /users/webauthn/login/options [get]
 func (c *UserController) beginLogin(w http.ResponseWriter, r *http.Request) {
 	email := r.URL.Query().Get("email")
-	if _, err := mail.ParseAddress(email); email == "" || err != nil {
+	if _, err := mail.ParseAddress(email); email != "" && err != nil {
 		c.Error(w, "ungültige E-Mail-Adresse", http.StatusBadRequest)
 		return
 	}
-	user, err := c.service.repo.GetUserByEmail(email)
-	if err != nil {
-		c.Error(w, "Benutzer nicht gefunden", http.StatusNotFound)
-		return
-	}
 
-	options, sessionData, err := c.service.webauth.BeginLogin(user)
+	options, sessionID, err := c.service.BeginPasskeyLogin(email)
 	if err != nil {
-		http.Error(w, "Login fehlgeschlagen", http.StatusInternalServerError)
+		if err == mongo.ErrNoDocuments || err == ERR_NO_PASSKEYS {
+			c.Error(w, "Benutzer nicht gefunden", http.StatusNotFound)
+		} else {
+			c.Error(w, "Login fehlgeschlagen", http.StatusInternalServerError)
+		}
 		return
 	}
 
-	user.SessionData = *sessionData
-	if err := c.service.repo.UpdateUser(user); err != nil {
-		log.Println("Failed to update user:", err)
-	}
-	if err := json.NewEncoder(w).Encode(options); err != nil {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(PasskeyAssertionResponse{CredentialAssertion: options, SessionID: sessionID}); err != nil {
 		log.Println("Failed to encode options:", err)
 	}
 }
@@ -278,63 +433,91 @@ func (c *UserController) beginLogin(w http.ResponseWriter, r *http.Request) {
 // @Tags         users
 // @Accept       json
 // @Produce      json
-// @Param        email query string true "User email address"
-// @Success      200  {object}  map[string]string "JWT token"
-// @Failure      400  {object}  ErrorResponse "Ungültige E-Mail-Adresse"
+// @Param        session query string true "Session id from the login options"
+// @Success      200  {object}  TokenResponse "Access and refresh token"
 // @Failure      401  {object}  ErrorResponse "Authentifizierung fehlgeschlagen"
-// @Failure      404  {object}  ErrorResponse "Benutzer nicht gefunden"
+// @Failure      429  {object}  ErrorResponse "Zu viele fehlgeschlagene Anmeldeversuche"
 // @Failure      500  {object}  ErrorResponse "Interner Serverfehler"
 // @Router       /users/webauthn/login [post]
 func (c *UserController) finishLogin(w http.ResponseWriter, r *http.Request) {
-	email := r.URL.Query().Get("email")
-	if _, err := mail.ParseAddress(email); email == "" || err != nil {
-		http.Error(w, "ungültige E-Mail-Adresse", http.StatusBadRequest)
-		return
-	}
-
-	user, err := c.service.repo.GetUserByEmail(email)
-	if err != nil {
-		http.Error(w, "Benutzer nicht gefunden", http.StatusNotFound)
-		return
-	}
-	sessionData := user.SessionData
-	_, err = c.service.webauth.FinishLogin(user, sessionData, r)
-	if err != nil {
-		http.Error(w, "Authentifizierung fehlgeschlagen", http.StatusUnauthorized)
-		return
-	}
-	token, err := c.EncodeUUID(user.ID, time.Duration(24*time.Hour))
+	user, err := c.service.FinishPasskeyLogin(r.URL.Query().Get("session"), server.ClientIP(r), r)
 	if err != nil {
-		c.Error(w, "Fehler beim Generieren des Tokens", http.StatusInternalServerError)
+		switch err.(type) {
+		case *LockedError:
+			c.writeLocked(w, err)
+		default:
+			if err != ERR_PASSKEY_LOGIN_FAILED && err != ERR_INVALID_WEBAUTHN_SESSION {
+				c.GetLogger().Err(err).Msg("Fehler beim Anmelden mit Passkey")
+			}
+			c.Error(w, "Authentifizierung fehlgeschlagen", http.StatusUnauthorized)
+		}
 		return
 	}
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(map[string]string{"token": token}); err != nil {
-		c.GetLogger().Err(err)
-	}
+	c.recordAudit(r, audit.Event{Type: audit.LoginSucceeded, UserID: user.ID, Details: map[string]string{"method": "passkey"}})
+	c.writeTokens(w, r, user)
 }
 
 // GetUsers godoc
-// @Summary      Get all users
-// @Description  Retrieves a list of all users.
+// @Summary      List users
+// @Description  Returns a page of the user directory. Every user is shown as the caller is allowed to see them, fields only visible to trip partners are left out.
+// @Description  The name search matches the start of the first name and of last names that are public. Sorting by email is only allowed for admins.
 // @Tags         users
 // @Accept       json
 // @Produce      json
-// @Success      200  {array}   []repo.User  "List of users"
+// @Param        Authorization header string false "User JWT token"
+// @Param        q         query  string  false  "Name prefix"
+// @Param        verified  query  bool    false  "Only verified or unverified users"
+// @Param        sort      query  string  false  "name, email, -name or -email"
+// @Param        limit     query  int     false  "Page size, at most 100"
+// @Param        cursor    query  string  false  "nextCursor of the previous page"
+// @Success      200  {object}  UserDirectoryResponse  "Page of users"
+// @Failure      400  {string}  string     "Ungültige Anfrage"
 // @Failure      500  {string}  string     "Server error"
 // @Router       /users [get]
 func (c *UserController) GetUsers(w http.ResponseWriter, r *http.Request) {
-	users, err := c.service.GetUsers()
+	params := r.URL.Query()
+	query := DirectoryQuery{
+		Query:  params.Get("q"),
+		Sort:   params.Get("sort"),
+		Cursor: params.Get("cursor"),
+	}
+	if value := params.Get("verified"); value != "" {
+		verified, err := strconv.ParseBool(value)
+		if err != nil {
+			c.Error(w, "Ungültiger Wert für verified", http.StatusBadRequest)
+			return
+		}
+		query.Verified = &verified
+	}
+	if value := params.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 {
+			c.Error(w, "Ungültiger Wert für limit", http.StatusBadRequest)
+			return
+		}
+		query.Limit = limit
+	}
+
+	viewer := viewerOf(r)
+	page, err := c.service.ListUsers(query, viewer.Admin)
 	if err != nil {
-		c.Error(w, "Fehler beim Laden der Benutzer", http.StatusInternalServerError)
+		switch err {
+		case ERR_INVALID_SORT:
+			c.Error(w, "Ungültige Sortierung", http.StatusBadRequest)
+		case ERR_INVALID_CURSOR:
+			c.Error(w, "Ungültiger Cursor", http.StatusBadRequest)
+		default:
+			c.Error(w, "Fehler beim Laden der Benutzer", http.StatusInternalServerError)
+		}
 		return
 	}
-	if users == nil {
-		users = []repo.User{}
+	response := UserDirectoryResponse{Users: make([]any, 0, len(page.Users)), NextCursor: page.NextCursor}
+	for _, user := range page.Users {
+		response.Users = append(response.Users, c.service.View(user, viewer, false))
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	err = json.NewEncoder(w).Encode(users)
+	err = json.NewEncoder(w).Encode(response)
 	if err != nil {
 		c.Error(w, "Fehler beim Kodieren der Antwort", http.StatusInternalServerError)
 	}
@@ -346,8 +529,9 @@ func (c *UserController) GetUsers(w http.ResponseWriter, r *http.Request) {
 // @Tags         users
 // @Accept       json
 // @Produce      json
+// @Param        Authorization header string false "User JWT token"
 // @Param        email  query  string  true  "User email address"
-// @Success      200  {object}  repo.User  "User data"
+// @Success      200  {object}  UserProfile  "User profile"
 // @Failure      400  {string}  string  "Invalid email address"
 // @Failure      404  {string}  string  "User not found"
 // @Failure      500  {string}  string  "Server error"
@@ -361,7 +545,7 @@ func (c *UserController) GetUserByEmail(w http.ResponseWriter, r *http.Request)
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	err = json.NewEncoder(w).Encode(user)
+	err = json.NewEncoder(w).Encode(c.service.View(user, viewerOf(r), true))
 	if err != nil {
 		http.Error(w, "Fehler beim Kodieren der Antwort", http.StatusInternalServerError)
 	}
@@ -369,13 +553,14 @@ func (c *UserController) GetUserByEmail(w http.ResponseWriter, r *http.Request)
 
 // CreateUser godoc
 // @Summary      Create a new user
-// @Description  Creates a new user with the provided JSON payload.
+// @Description  Creates a new user with the provided JSON payload and sends a link to verify the email address.
 // @Tags         users
 // @Accept       json
 // @Produce      json
 // @Param        user  body      repo.User  true  "User data"
 // @Success      200   {object}  map[string]string  "ID of the created user"
-// @Failure      400   {string}  string  "Invalid request payload"
+// @Failure      400   {string}  string  "Invalid request payload or password rejected by the policy"
+// @Failure      409   {string}  string  "Email already exists"
 // @Failure      500   {string}  string  "Server error"
 // @Router       /users [post]
 func (c *UserController) CreateUser(w http.ResponseWriter, r *http.Request) {
@@ -389,6 +574,9 @@ func (c *UserController) CreateUser(w http.ResponseWriter, r *http.Request) {
 	user.ID = uuid.New()
 	err = c.service.CreateUser(user)
 	if err != nil {
+		if c.writePasswordError(w, err) {
+			return
+		}
 		if err == ERR_EMAIL_ALREADY_EXISTS {
 			c.Error(w, err.Error(), http.StatusConflict)
 		} else {
@@ -396,6 +584,11 @@ func (c *UserController) CreateUser(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
+	user.Verified = false
+	// the user can request a new mail, so a failure here must not fail the signup
+	if err := c.sendVerification(user); err != nil {
+		c.GetLogger().Err(err).Msg("Fehler beim Senden der Bestätigungs-E-Mail")
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	err = json.NewEncoder(w).Encode(map[string]string{"id": user.ID.String()})
@@ -406,12 +599,13 @@ func (c *UserController) CreateUser(w http.ResponseWriter, r *http.Request) {
 
 // GetUser godoc
 // @Summary      Get user by ID
-// @Description  Retrieves a user by their unique ID provided as a path parameter. Password is omitted in the response.
+// @Description  Retrieves a user by their unique ID. Users get their own account, admins the admin view and everybody else the public profile with the fields the privacy settings allow.
 // @Tags         users
 // @Accept       json
 // @Produce      json
+// @Param        Authorization header string false "User JWT token"
 // @Param        id   path      string  true  "User ID (UUID)"
-// @Success      200  {object}  repo.User  "User data without password"
+// @Success      200  {object}  UserProfile  "User profile"
 // @Failure      400  {string}  string  "Invalid or missing ID"
 // @Failure      404  {string}  string  "User not found"
 // @Failure      500  {string}  string  "Server error"
@@ -437,11 +631,14 @@ func (c *UserController) GetUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// remove password from response
-	user.Password = ""
+	view := c.service.View(user, viewerOf(r), true)
+	if profile, ok := view.(UserProfile); ok {
+		profile.Rating = c.ratingSummary(user.ID)
+		view = profile
+	}
 
 	w.Header().Set("Content-Type", "application/json")
-	err = json.NewEncoder(w).Encode(user)
+	err = json.NewEncoder(w).Encode(view)
 	if err != nil {
 		c.Error(w, "Fehler beim Kodieren der Antwort", http.StatusInternalServerError)
 	}
@@ -449,7 +646,7 @@ func (c *UserController) GetUser(w http.ResponseWriter, r *http.Request) {
 
 // UpdateUser godoc
 // @Summary      Update user
-// @Description  Updates the user identified by the ID provided in the request header. The user data is passed as JSON in the request body.
+// @Description  Replaces the profile of the user identified by the ID provided in the request header. The password is not changed, a new email is only used once the verification mail sent to it has been confirmed.
 // @Tags         users
 // @Accept       json
 // @Produce      json
@@ -457,6 +654,7 @@ func (c *UserController) GetUser(w http.ResponseWriter, r *http.Request) {
 // @Param        user          body    repo.User  true  "User data to update"
 // @Success      200           {object} map[string]string  "Returns the updated user ID"
 // @Failure      400           {string} string  "Invalid or missing ID / Bad request"
+// @Failure      409           {string} string  "E-Mail-Adresse bereits vergeben"
 // @Failure      500           {string} string  "Server error updating user"
 // @Router       /users/{id} [put]
 func (c *UserController) UpdateUser(w http.ResponseWriter, r *http.Request) {
@@ -478,28 +676,121 @@ func (c *UserController) UpdateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = c.service.UpdateUser(uid, user)
+	emailChanged, err := c.service.UpdateUser(uid, user)
 	if err != nil {
-		c.Error(w, "Fehler beim Aktualisieren des Benutzers", http.StatusInternalServerError)
+		c.writeUpdateError(w, err)
 		return
 	}
+	if emailChanged {
+		c.sendEmailChangeVerification(uid)
+	}
 
 	w.Header().Set("Content-Type", "application/json")
-	err = json.NewEncoder(w).Encode(map[string]string{"id": user.ID.String()})
+	err = json.NewEncoder(w).Encode(map[string]string{"id": uid.String()})
+	if err != nil {
+		c.Error(w, "Fehler beim Kodieren der Antwort", http.StatusInternalServerError)
+	}
+}
+
+// PatchUser godoc
+// @Summary      Partially update user
+// @Description  Applies a JSON merge patch (RFC 7396) to the profile of the user. Only the fields in the patch are changed, null resets a field. The password, roles and second factors can not be changed here. A new email is only used once the verification mail sent to it has been confirmed.
+// @Tags         users
+// @Accept       json
+// @Produce      json
+// @Param        id     path    string  true  "User ID (UUID)"
+// @Param        patch  body    object  true  "Merge patch of the profile"
+// @Success      200    {object}  SelfView
+// @Failure      400    {string}  string  "Ungültige Änderung"
+// @Failure      403    {string}  string  "Keine Berechtigung"
+// @Failure      409    {string}  string  "E-Mail-Adresse bereits vergeben"
+// @Failure      415    {string}  string  "Nicht unterstützter Content-Type"
+// @Router       /users/{id} [patch]
+func (c *UserController) PatchUser(w http.ResponseWriter, r *http.Request) {
+	uid, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		c.Error(w, "Fehler beim Parsen der ID", http.StatusBadRequest)
+		return
+	}
+	if r.Header.Get(UserIdHeader) != uid.String() {
+		c.Error(w, "Keine Berechtigung", http.StatusForbidden)
+		return
+	}
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil || (mediaType != "application/merge-patch+json" && mediaType != "application/json") {
+			c.Error(w, "Nicht unterstützter Content-Type", http.StatusUnsupportedMediaType)
+			return
+		}
+	}
+	patch, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil {
+		c.Error(w, "Fehler beim Lesen der Anfrage", http.StatusBadRequest)
+		return
+	}
+
+	emailChanged, err := c.service.PatchUser(uid, patch)
+	if err != nil {
+		c.writeUpdateError(w, err)
+		return
+	}
+	if emailChanged {
+		c.sendEmailChangeVerification(uid)
+	}
+	user, err := c.service.GetUserByID(uid)
 	if err != nil {
+		c.Error(w, "Benutzer nicht gefunden", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(c.service.SelfView(user)); err != nil {
 		c.Error(w, "Fehler beim Kodieren der Antwort", http.StatusInternalServerError)
 	}
 }
 
+func (c *UserController) writeUpdateError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ERR_READ_ONLY_FIELD):
+		c.Error(w, "Feld kann hier nicht geändert werden: "+strings.TrimPrefix(err.Error(), ERR_READ_ONLY_FIELD.Error()+": "), http.StatusBadRequest)
+	case errors.Is(err, ERR_INVALID_PATCH):
+		c.Error(w, "Ungültige Änderung", http.StatusBadRequest)
+	case errors.Is(err, ERR_INVALID_VISIBILITY):
+		c.Error(w, "Ungültige Sichtbarkeit", http.StatusBadRequest)
+	case errors.Is(err, ERR_INVALID_EMAIL):
+		c.Error(w, "Ungültige E-Mail-Adresse", http.StatusBadRequest)
+	case errors.Is(err, ERR_EMAIL_ALREADY_EXISTS):
+		c.Error(w, "E-Mail-Adresse bereits vergeben", http.StatusConflict)
+	case errors.Is(err, mongo.ErrNoDocuments):
+		c.Error(w, "Benutzer nicht gefunden", http.StatusNotFound)
+	default:
+		c.Error(w, "Fehler beim Aktualisieren des Benutzers", http.StatusInternalServerError)
+	}
+}
+
+// sendEmailChangeVerification mails the link to confirm a new email. The
+// change itself is already saved, a failed mail can be resent by the user.
+func (c *UserController) sendEmailChangeVerification(userID uuid.UUID) {
+	user, err := c.service.GetUserByID(userID)
+	if err == nil {
+		err = c.sendVerification(user)
+	}
+	if err != nil {
+		c.GetLogger().Err(err).Msg("Fehler beim Senden der Bestätigungs-E-Mail")
+	}
+}
+
 // DeleteUser godoc
 // @Summary      Delete user
-// @Description  Deletes the user identified by the ID provided in the request header.
+// @Description  Deletes the user identified by the path ID. Users can only delete themselves, admins can delete anyone. The other services erase the data of the user in the background, see GET /users/{id}/erasure.
 // @Tags         users
 // @Accept       json
 // @Produce      json
-// @Param        UserIdHeader  header  string  true  "User ID (UUID)"
+// @Param        Authorization header string true "User JWT token"
+// @Param        id   path      string  true  "User ID (UUID)"
 // @Success      204  "User deleted successfully, no content"
 // @Failure      400  {string}  string  "Invalid or missing ID"
+// @Failure      403  {string}  string  "Keine Berechtigung"
 // @Failure      500  {string}  string  "Server error deleting user"
 // @Router       /users/{id} [delete]
 func (c *UserController) DeleteUser(w http.ResponseWriter, r *http.Request) {
@@ -508,32 +799,142 @@ func (c *UserController) DeleteUser(w http.ResponseWriter, r *http.Request) {
 		c.Error(w, "ID fehlt oder ungültig", http.StatusBadRequest)
 		return
 	}
-	uid, err := uuid.Parse(id)
+	callerID, err := uuid.Parse(id)
+	if err != nil {
+		c.Error(w, "Fehler beim Parsen der ID", http.StatusBadRequest)
+		return
+	}
+	uid, err := uuid.Parse(mux.Vars(r)["id"])
 	if err != nil {
 		c.Error(w, "Fehler beim Parsen der ID", http.StatusBadRequest)
 		return
 	}
+	if uid != callerID && !auth.HasRole(r, auth.RoleAdmin) {
+		c.Error(w, "Keine Berechtigung", http.StatusForbidden)
+		return
+	}
 
 	err = c.service.DeleteUser(uid)
 	if err != nil {
 		c.Error(w, "Fehler beim Löschen des Benutzers", http.StatusInternalServerError)
 		return
 	}
+	event := audit.Event{Type: audit.AccountDeleted, UserID: uid}
+	if callerID != uid {
+		event.ActorID = callerID
+	}
+	c.recordAudit(r, event)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetErasureStatus godoc
+// @Summary      Erasure status of a deleted user
+// @Description  Shows for every service whether it has erased the data of the deleted user. Users can see their own status, admins every status.
+// @Tags         users
+// @Produce      json
+// @Param        id   path      string  true  "User ID (UUID)"
+// @Success      200  {object}  ErasureStatusResponse
+// @Failure      403  {string}  string  "Keine Berechtigung"
+// @Failure      404  {string}  string  "Keine Löschung gefunden"
+// @Router       /users/{id}/erasure [get]
+func (c *UserController) GetErasureStatus(w http.ResponseWriter, r *http.Request) {
+	uid, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		c.Error(w, "Fehler beim Parsen der ID", http.StatusBadRequest)
+		return
+	}
+	if r.Header.Get(UserIdHeader) != uid.String() && !auth.HasRole(r, auth.RoleAdmin) {
+		c.Error(w, "Keine Berechtigung", http.StatusForbidden)
+		return
+	}
+
+	status, err := c.service.ErasureStatus(uid)
+	if err != nil {
+		c.Error(w, "Keine Löschung gefunden", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(ErasureStatusResponse{Erasure: status, Completed: status.Completed()}); err != nil {
+		c.Error(w, "Fehler beim Kodieren der Antwort", http.StatusInternalServerError)
+	}
+}
+
+// retryErasures periodically announces deletions again that are not finished.
+func (c *UserController) retryErasures() {
+	ticker := time.NewTicker(ErasureRetryDelay)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := c.service.RetryErasures(); err != nil {
+			c.GetLogger().Err(err).Msg("Fehler beim Wiederholen der Löschungen")
+		}
+	}
+}
+
+// cleanupExports periodically removes the archives of expired exports.
+func (c *UserController) cleanupExports() {
+	ticker := time.NewTicker(ExportCleanupInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := c.service.CleanupExports(); err != nil {
+			c.GetLogger().Err(err).Msg("Fehler beim Löschen abgelaufener Exporte")
+		}
+	}
+}
+
+// SetRoles godoc
+// @Summary      Set user roles
+// @Description  Replaces the roles of a user. Only admins may do this, the changes apply with the next token of the user.
+// @Tags         users
+// @Accept       json
+// @Param        Authorization header string true "Admin JWT token"
+// @Param        id    path  string           true  "User ID (UUID)"
+// @Param        body  body  SetRolesRequest  true  "Roles"
+// @Success      204  "Roles updated"
+// @Failure      400  {string}  string  "Ungültige Rolle"
+// @Failure      403  {string}  string  "Insufficient permissions"
+// @Failure      500  {string}  string  "Server error"
+// @Router       /users/{id}/roles [put]
+func (c *UserController) SetRoles(w http.ResponseWriter, r *http.Request) {
+	uid, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		c.Error(w, "Fehler beim Parsen der ID", http.StatusBadRequest)
+		return
+	}
+	var request SetRolesRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		c.Error(w, "Fehler beim Lesen der Anfrage", http.StatusBadRequest)
+		return
+	}
 
+	if err := c.service.SetRoles(uid, request.Roles); err != nil {
+		if err == ERR_INVALID_ROLE {
+			c.Error(w, "Ungültige Rolle", http.StatusBadRequest)
+		} else {
+			c.Error(w, "Fehler beim Aktualisieren des Benutzers", http.StatusInternalServerError)
+		}
+		return
+	}
+	adminID, _ := uuid.Parse(r.Header.Get(UserIdHeader))
+	c.recordAudit(r, audit.Event{Type: audit.RolesChanged, UserID: uid, ActorID: adminID, Details: map[string]string{"roles": strings.Join(request.Roles, ",")}})
 	w.WriteHeader(http.StatusNoContent)
 }
 
 // GetLoginToken godoc
 // @Summary      Get login token
-// @Description  Authenticates a user with email and password and returns a JWT token valid for 24 hours.
+// @Description  Authenticates a user with email and password and returns a short-lived JWT together with a refresh token.
+// @Description  If the user has two-factor authentication enabled an mfa token is returned instead, which has to be exchanged at /users/login/mfa.
 // @Tags         users
 // @Accept       json
 // @Produce      json
 // @Param        credentials  body  UserCredentials  true  "User credentials"
-// @Success      200  {object}  map[string]string  "JWT token"
+// @Success      200  {object}  TokenResponse  "Access and refresh token"
+// @Success      202  {object}  MFARequiredResponse  "Second factor required"
 // @Failure      400  {string}  string  "Fehler beim Lesen der Anfrage"
-// @Failure      401  {string}  string  "Falsches Passwort"
-// @Failure      500  {string}  string  "Fehler beim Generieren des Tokens oder Benutzer nicht gefunden"
+// @Failure      401  {string}  string  "E-Mail oder Passwort falsch"
+// @Failure      429  {string}  string  "Zu viele fehlgeschlagene Anmeldeversuche"
+// @Failure      500  {string}  string  "Fehler beim Generieren des Tokens"
 // @Router       /users/login [post]
 func (c *UserController) GetLoginToken(w http.ResponseWriter, r *http.Request) {
 	credentials := struct {
@@ -549,27 +950,1568 @@ func (c *UserController) GetLoginToken(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := c.service.repo.GetUserByEmail(credentials.Email)
+	user, err := c.service.Login(credentials.Email, credentials.Password, server.ClientIP(r))
+	if err != nil {
+		switch err.(type) {
+		case *LockedError:
+			c.writeLocked(w, err)
+		default:
+			if err != ERR_INVALID_CREDENTIALS {
+				c.GetLogger().Err(err).Msg("Fehler beim Anmelden")
+			}
+			// the same answer for unknown users and wrong passwords
+			c.Error(w, "E-Mail oder Passwort falsch", http.StatusUnauthorized)
+		}
+		return
+	}
+
+	c.writeLoginResult(w, r, user, map[string]string{"method": "password"})
+}
+
+// writeLoginResult answers a login with the tokens or, if the user has a
+// second factor, with an mfa token to exchange at /users/login/mfa. Completed
+// logins are recorded in the audit log with the details.
+func (c *UserController) writeLoginResult(w http.ResponseWriter, r *http.Request, user repo.User, details map[string]string) {
+	if user.TOTPEnabled {
+		mfaToken, err := c.EncodeClaims(jwt.Claims{UserID: user.ID, Purpose: PurposeMFA}, MFATokenTTL)
+		if err != nil {
+			c.Error(w, "Fehler beim Generieren des Tokens", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		if err := json.NewEncoder(w).Encode(MFARequiredResponse{MFARequired: true, MFAToken: mfaToken}); err != nil {
+			c.GetLogger().Err(err).Msg("Fehler beim Kodieren der Antwort")
+		}
+		return
+	}
+
+	c.recordAudit(r, audit.Event{Type: audit.LoginSucceeded, UserID: user.ID, Details: details})
+	c.writeTokens(w, r, user)
+}
+
+// FinishMFALogin godoc
+// @Summary      Complete login with second factor
+// @Description  Exchanges the mfa token of a password login and a TOTP or recovery code for an access and refresh token.
+// @Tags         users
+// @Accept       json
+// @Produce      json
+// @Param        body  body  MFALoginRequest  true  "Mfa token and code"
+// @Success      200  {object}  TokenResponse  "Access and refresh token"
+// @Failure      400  {string}  string  "Fehler beim Lesen der Anfrage"
+// @Failure      401  {string}  string  "Ungültiger Code"
+// @Failure      429  {string}  string  "Zu viele fehlgeschlagene Anmeldeversuche"
+// @Failure      500  {string}  string  "Fehler beim Generieren des Tokens"
+// @Router       /users/login/mfa [post]
+func (c *UserController) FinishMFALogin(w http.ResponseWriter, r *http.Request) {
+	var request MFALoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		c.Error(w, "Fehler beim Lesen der Anfrage", http.StatusBadRequest)
+		return
+	}
+	claims, err := c.decoder.DecodePurpose(request.MFAToken, PurposeMFA)
+	if err != nil {
+		c.Error(w, "Ungültiger oder abgelaufener Token", http.StatusUnauthorized)
+		return
+	}
+
+	user, err := c.service.VerifySecondFactor(claims.UserID, request.Code, server.ClientIP(r))
 	if err != nil {
-		c.Error(w, fmt.Sprintf("Nutzer nicht gefunden %v", err), http.StatusInternalServerError)
+		switch err.(type) {
+		case *LockedError:
+			c.writeLocked(w, err)
+		default:
+			c.Error(w, "Ungültiger Code", http.StatusUnauthorized)
+		}
+		return
+	}
+
+	// the mfa token can only be exchanged once
+	revocation := auth.Revocation{TokenID: claims.TokenID, ExpiresAt: claims.ExpiresAt}
+	c.Revoke(revocation.TokenID, revocation.ExpiresAt)
+	if err := auth.PublishRevocation(c.nats, revocation); err != nil {
+		c.GetLogger().Err(err).Msg("Fehler beim Veröffentlichen des Widerrufs")
+	}
+
+	c.recordAudit(r, audit.Event{Type: audit.LoginSucceeded, UserID: user.ID, Details: map[string]string{"method": "mfa"}})
+	c.writeTokens(w, r, user)
+}
+
+// writeLocked tells the client how long to wait before the next login attempt.
+func (c *UserController) writeLocked(w http.ResponseWriter, err error) {
+	if locked, ok := err.(*LockedError); ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(locked.RetryAfter.Seconds()))))
+	}
+	c.Error(w, "Zu viele fehlgeschlagene Anmeldeversuche", http.StatusTooManyRequests)
+}
+
+// RefreshToken godoc
+// @Summary      Refresh login token
+// @Description  Exchanges a refresh token for a new access token. The refresh token is rotated and can only be used once.
+// @Tags         users
+// @Accept       json
+// @Produce      json
+// @Param        body  body  RefreshTokenRequest  true  "Refresh token"
+// @Success      200  {object}  TokenResponse  "Access and refresh token"
+// @Failure      400  {string}  string  "Fehler beim Lesen der Anfrage"
+// @Failure      401  {string}  string  "Ungültiger Refresh-Token"
+// @Failure      500  {string}  string  "Fehler beim Generieren des Tokens"
+// @Router       /users/refresh [post]
+func (c *UserController) RefreshToken(w http.ResponseWriter, r *http.Request) {
+	var request RefreshTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.RefreshToken == "" {
+		c.Error(w, "Fehler beim Lesen der Anfrage", http.StatusBadRequest)
 		return
 	}
 
-	// Verify the password
-	if err := hasher.VerifyPassword(user.Password, credentials.Password); err != nil {
-		c.Error(w, fmt.Sprintf("Falsches Passwort [%v]", err), http.StatusUnauthorized)
+	userID, sessionID, refreshToken, err := c.service.RotateRefreshToken(request.RefreshToken, server.ClientIP(r))
+	if err != nil {
+		if err == ERR_INVALID_REFRESH_TOKEN {
+			c.Error(w, "Ungültiger Refresh-Token", http.StatusUnauthorized)
+		} else {
+			c.Error(w, "Fehler beim Generieren des Tokens", http.StatusInternalServerError)
+		}
 		return
 	}
 
-	token, err := c.EncodeUUID(user.ID, time.Duration(24*time.Hour))
+	user, err := c.service.GetUserByID(userID)
+	if err != nil {
+		c.Error(w, "Ungültiger Refresh-Token", http.StatusUnauthorized)
+		return
+	}
+	token, err := c.accessToken(user, sessionID)
 	if err != nil {
 		c.Error(w, "Fehler beim Generieren des Tokens", http.StatusInternalServerError)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	err = json.NewEncoder(w).Encode(map[string]string{"token": token})
+	err = json.NewEncoder(w).Encode(TokenResponse{Token: token, RefreshToken: refreshToken})
 	if err != nil {
 		c.Error(w, "Fehler beim Kodieren der Antwort", http.StatusInternalServerError)
 	}
 }
+
+// Logout godoc
+// @Summary      Logout
+// @Description  Ends the session of the current access token in all services and, if given, revokes the refresh token belonging to the login.
+// @Tags         users
+// @Accept       json
+// @Param        Authorization header string true "User JWT token"
+// @Param        body  body  RefreshTokenRequest  false  "Refresh token"
+// @Success      204  "Logged out"
+// @Failure      401  {string}  string  "Ungültiger Token"
+// @Failure      500  {string}  string  "Fehler beim Abmelden"
+// @Router       /users/logout [post]
+func (c *UserController) Logout(w http.ResponseWriter, r *http.Request) {
+	claims, err := c.decoder.DecodeClaims(r.Header.Get("Authorization"))
+	if err != nil {
+		c.Error(w, "Ungültiger Token", http.StatusUnauthorized)
+		return
+	}
+
+	if sessionID, err := uuid.Parse(claims.SessionID); err == nil {
+		if err := c.service.RevokeSession(claims.UserID, sessionID); err != nil && err != ERR_SESSION_NOT_FOUND {
+			c.Error(w, "Fehler beim Abmelden", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	var request RefreshTokenRequest
+	// the body is optional, tokens from before sessions were recorded only
+	// lose their access token without it
+	_ = json.NewDecoder(r.Body).Decode(&request)
+	if request.RefreshToken != "" {
+		if err := c.service.RevokeRefreshToken(claims.UserID, request.RefreshToken); err != nil && err != ERR_INVALID_REFRESH_TOKEN {
+			c.Error(w, "Fehler beim Abmelden", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	revocation := auth.Revocation{TokenID: claims.TokenID, ExpiresAt: claims.ExpiresAt}
+	c.Revoke(revocation.TokenID, revocation.ExpiresAt)
+	if err := auth.PublishRevocation(c.nats, revocation); err != nil {
+		c.Error(w, "Fehler beim Abmelden", http.StatusInternalServerError)
+		return
+	}
+	c.recordAudit(r, audit.Event{Type: audit.Logout, UserID: claims.UserID, Details: map[string]string{"session": claims.SessionID}})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// accessToken issues a short-lived JWT carrying the current state of the user
+// and the session it belongs to.
+func (c *UserController) accessToken(user repo.User, sessionID uuid.UUID) (string, error) {
+	return c.EncodeClaims(jwt.Claims{UserID: user.ID, Verified: user.Verified, Roles: user.Roles, SessionID: sessionID.String()}, AccessTokenTTL)
+}
+
+// recordAudit adds the address and device of the request to the event and
+// appends it to the audit log.
+func (c *UserController) recordAudit(r *http.Request, event audit.Event) {
+	event.IP = server.ClientIP(r)
+	event.UserAgent = r.UserAgent()
+	c.service.RecordAudit(event)
+}
+
+// writeTokens answers a successful login with a new session on the device of
+// the request and its access and refresh token.
+func (c *UserController) writeTokens(w http.ResponseWriter, r *http.Request, user repo.User) {
+	session, refreshToken, err := c.service.StartSession(user.ID, r.UserAgent(), server.ClientIP(r))
+	if err != nil {
+		c.Error(w, "Fehler beim Generieren des Tokens", http.StatusInternalServerError)
+		return
+	}
+	token, err := c.accessToken(user, session.ID)
+	if err != nil {
+		c.Error(w, "Fehler beim Generieren des Tokens", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(TokenResponse{Token: token, RefreshToken: refreshToken})
+	if err != nil {
+		c.Error(w, "Fehler beim Kodieren der Antwort", http.StatusInternalServerError)
+	}
+}
+
+// ForgotPassword godoc
+// @Summary      Request password reset
+// @Description  Sends a one-time link to reset the password. The response is the same whether the email exists or not.
+// @Tags         users
+// @Accept       json
+// @Param        body  body  ForgotPasswordRequest  true  "Email address"
+// @Success      202  "Reset mail sent if the account exists"
+// @Failure      400  {string}  string  "Fehler beim Lesen der Anfrage"
+// @Router       /users/password/forgot [post]
+func (c *UserController) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var request ForgotPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		c.Error(w, "Fehler beim Lesen der Anfrage", http.StatusBadRequest)
+		return
+	}
+
+	// errors only occur for existing accounts, so they are logged but never returned
+	if err := c.service.RequestPasswordReset(request.Email); err != nil {
+		c.GetLogger().Err(err).Msg("Fehler beim Anfordern des Passwort-Resets")
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// writePasswordError answers with the reason a new password was rejected by
+// the policy and reports whether err was one of them.
+func (c *UserController) writePasswordError(w http.ResponseWriter, err error) bool {
+	var message string
+	switch err {
+	case ERR_EMPTY_PASSWORD:
+		message = "Passwort darf nicht leer sein"
+	case ERR_PASSWORD_TOO_SHORT:
+		message = "Passwort ist zu kurz"
+	case ERR_PASSWORD_TOO_LONG:
+		message = "Passwort ist zu lang"
+	case ERR_PASSWORD_TOO_WEAK:
+		message = "Passwort ist zu leicht zu erraten"
+	case ERR_PASSWORD_BREACHED:
+		message = "Passwort ist aus einem Datenleck bekannt, bitte wähle ein anderes"
+	default:
+		return false
+	}
+	c.Error(w, message, http.StatusBadRequest)
+	return true
+}
+
+// ResetPassword godoc
+// @Summary      Reset password
+// @Description  Sets a new password with the token from the reset mail and logs the user out on all devices.
+// @Tags         users
+// @Accept       json
+// @Param        body  body  ResetPasswordRequest  true  "Reset token and new password"
+// @Success      204  "Password changed"
+// @Failure      400  {string}  string  "Ungültiger oder abgelaufener Link oder Passwort entspricht nicht den Anforderungen"
+// @Failure      500  {string}  string  "Server error"
+// @Router       /users/password/reset [post]
+func (c *UserController) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	var request ResetPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		c.Error(w, "Fehler beim Lesen der Anfrage", http.StatusBadRequest)
+		return
+	}
+
+	userID, err := c.service.ResetPassword(request.Token, request.Password)
+	if err != nil {
+		if c.writePasswordError(w, err) {
+			return
+		}
+		switch err {
+		case ERR_INVALID_RESET_TOKEN:
+			c.Error(w, "Ungültiger oder abgelaufener Link", http.StatusBadRequest)
+		default:
+			c.Error(w, "Fehler beim Zurücksetzen des Passworts", http.StatusInternalServerError)
+		}
+		return
+	}
+	c.recordAudit(r, audit.Event{Type: audit.PasswordReset, UserID: userID})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ChangePassword godoc
+// @Summary      Change password
+// @Description  Sets a new password after checking the current one. The user is logged out on all other devices and gets new tokens for the current one.
+// @Tags         users
+// @Accept       json
+// @Produce      json
+// @Param        body  body  ChangePasswordRequest  true  "Current and new password"
+// @Success      200  {object}  TokenResponse
+// @Failure      400  {string}  string  "Passwort entspricht nicht den Anforderungen"
+// @Failure      403  {string}  string  "Aktuelles Passwort falsch"
+// @Failure      429  {string}  string  "Zu viele Fehlversuche"
+// @Router       /users/password/change [post]
+func (c *UserController) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	uid, err := uuid.Parse(r.Header.Get(UserIdHeader))
+	if err != nil {
+		c.Error(w, "Fehler beim Parsen der ID", http.StatusBadRequest)
+		return
+	}
+	var request ChangePasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		c.Error(w, "Fehler beim Lesen der Anfrage", http.StatusBadRequest)
+		return
+	}
+
+	if err := c.service.ChangePassword(uid, request.CurrentPassword, request.NewPassword, server.ClientIP(r)); err != nil {
+		if _, ok := err.(*LockedError); ok {
+			c.writeLocked(w, err)
+			return
+		}
+		if c.writePasswordError(w, err) {
+			return
+		}
+		switch err {
+		case ERR_WRONG_PASSWORD:
+			c.Error(w, "Aktuelles Passwort falsch", http.StatusForbidden)
+		default:
+			c.Error(w, "Fehler beim Ändern des Passworts", http.StatusInternalServerError)
+		}
+		return
+	}
+	c.recordAudit(r, audit.Event{Type: audit.PasswordChanged, UserID: uid})
+
+	user, err := c.service.GetUserByID(uid)
+	if err != nil {
+		c.Error(w, "Benutzer nicht gefunden", http.StatusNotFound)
+		return
+	}
+	c.writeTokens(w, r, user)
+}
+
+// VerifyEmail godoc
+// @Summary      Verify email address
+// @Description  Confirms the email address of a user with the token from the verification mail.
+// @Tags         users
+// @Produce      plain
+// @Param        token  query  string  true  "Verification token"
+// @Success      200  {string}  string  "E-Mail-Adresse bestätigt"
+// @Failure      400  {string}  string  "Ungültiger oder abgelaufener Link"
+// @Failure      500  {string}  string  "Server error"
+// @Router       /users/verify [get]
+func (c *UserController) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	claims, err := c.decoder.DecodePurpose(r.URL.Query().Get("token"), PurposeVerification)
+	if err != nil {
+		c.Error(w, "Ungültiger oder abgelaufener Link", http.StatusBadRequest)
+		return
+	}
+
+	if err := c.service.VerifyEmail(claims.UserID, claims.Email); err != nil {
+		switch err {
+		case ERR_INVALID_VERIFICATION:
+			c.Error(w, "Ungültiger oder abgelaufener Link", http.StatusBadRequest)
+		case ERR_EMAIL_ALREADY_EXISTS:
+			c.Error(w, "E-Mail-Adresse bereits vergeben", http.StatusConflict)
+		default:
+			c.Error(w, "Fehler beim Bestätigen der E-Mail-Adresse", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if _, err := w.Write([]byte("E-Mail-Adresse bestätigt")); err != nil {
+		c.GetLogger().Err(err).Msg("Fehler beim Schreiben der Antwort")
+	}
+}
+
+// ResendVerification godoc
+// @Summary      Resend verification mail
+// @Description  Sends a new verification link to the email address of the authenticated user.
+// @Tags         users
+// @Param        Authorization header string true "User JWT token"
+// @Success      204  "Mail sent"
+// @Failure      400  {string}  string  "Invalid user ID"
+// @Failure      409  {string}  string  "E-Mail-Adresse bereits bestätigt"
+// @Failure      500  {string}  string  "Server error"
+// @Router       /users/verify/resend [post]
+func (c *UserController) ResendVerification(w http.ResponseWriter, r *http.Request) {
+	uid, err := uuid.Parse(r.Header.Get(UserIdHeader))
+	if err != nil {
+		c.Error(w, "Fehler beim Parsen der ID", http.StatusBadRequest)
+		return
+	}
+	user, err := c.service.GetUserByID(uid)
+	if err != nil {
+		c.Error(w, "Benutzer nicht gefunden", http.StatusNotFound)
+		return
+	}
+
+	if err := c.sendVerification(user); err != nil {
+		if err == ERR_ALREADY_VERIFIED {
+			c.Error(w, "E-Mail-Adresse bereits bestätigt", http.StatusConflict)
+		} else {
+			c.Error(w, "Fehler beim Senden der E-Mail", http.StatusInternalServerError)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// sendVerification signs a verification link for the current email of the user and mails it.
+func (c *UserController) sendVerification(user repo.User) error {
+	token, err := c.EncodeClaims(jwt.Claims{
+		UserID:  user.ID,
+		Purpose: PurposeVerification,
+		Email:   emailToVerify(user),
+	}, VerificationTokenTTL)
+	if err != nil {
+		return err
+	}
+	return c.service.SendVerificationMail(user, token)
+}
+
+// EnrollTOTP godoc
+// @Summary      Start TOTP enrollment
+// @Description  Creates a new TOTP secret for the authenticated user. It has to be confirmed with a code before it is used for logins.
+// @Tags         users
+// @Produce      json
+// @Param        Authorization header string true "User JWT token"
+// @Success      200  {object}  TOTPEnrollmentResponse  "Secret and otpauth URI"
+// @Failure      409  {string}  string  "Zwei-Faktor-Authentifizierung bereits aktiviert"
+// @Failure      500  {string}  string  "Server error"
+// @Router       /users/2fa/totp [post]
+func (c *UserController) EnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	uid, err := uuid.Parse(r.Header.Get(UserIdHeader))
+	if err != nil {
+		c.Error(w, "Fehler beim Parsen der ID", http.StatusBadRequest)
+		return
+	}
+
+	secret, uri, err := c.service.EnrollTOTP(uid)
+	if err != nil {
+		if err == ERR_TOTP_ALREADY_ENABLED {
+			c.Error(w, "Zwei-Faktor-Authentifizierung bereits aktiviert", http.StatusConflict)
+		} else {
+			c.Error(w, "Fehler beim Einrichten der Zwei-Faktor-Authentifizierung", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(TOTPEnrollmentResponse{Secret: secret, URI: uri}); err != nil {
+		c.Error(w, "Fehler beim Kodieren der Antwort", http.StatusInternalServerError)
+	}
+}
+
+// ConfirmTOTP godoc
+// @Summary      Confirm TOTP enrollment
+// @Description  Enables two-factor authentication with a code from the authenticator app and returns recovery codes, which are only shown once.
+// @Tags         users
+// @Accept       json
+// @Produce      json
+// @Param        Authorization header string true "User JWT token"
+// @Param        body  body  TOTPCodeRequest  true  "TOTP code"
+// @Success      200  {object}  RecoveryCodesResponse  "Recovery codes"
+// @Failure      400  {string}  string  "Ungültiger Code"
+// @Failure      409  {string}  string  "Zwei-Faktor-Authentifizierung bereits aktiviert"
+// @Failure      500  {string}  string  "Server error"
+// @Router       /users/2fa/totp/confirm [post]
+func (c *UserController) ConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+	uid, err := uuid.Parse(r.Header.Get(UserIdHeader))
+	if err != nil {
+		c.Error(w, "Fehler beim Parsen der ID", http.StatusBadRequest)
+		return
+	}
+	var request TOTPCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		c.Error(w, "Fehler beim Lesen der Anfrage", http.StatusBadRequest)
+		return
+	}
+
+	codes, err := c.service.ConfirmTOTP(uid, request.Code)
+	if err != nil {
+		switch err {
+		case ERR_INVALID_MFA_CODE, ERR_TOTP_NOT_ENROLLED:
+			c.Error(w, "Ungültiger Code", http.StatusBadRequest)
+		case ERR_TOTP_ALREADY_ENABLED:
+			c.Error(w, "Zwei-Faktor-Authentifizierung bereits aktiviert", http.StatusConflict)
+		default:
+			c.Error(w, "Fehler beim Einrichten der Zwei-Faktor-Authentifizierung", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	c.recordAudit(r, audit.Event{Type: audit.TOTPEnabled, UserID: uid})
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(RecoveryCodesResponse{RecoveryCodes: codes}); err != nil {
+		c.Error(w, "Fehler beim Kodieren der Antwort", http.StatusInternalServerError)
+	}
+}
+
+// DisableTOTP godoc
+// @Summary      Disable TOTP
+// @Description  Disables two-factor authentication after checking a current TOTP code or a recovery code.
+// @Tags         users
+// @Accept       json
+// @Param        Authorization header string true "User JWT token"
+// @Param        body  body  TOTPCodeRequest  true  "TOTP or recovery code"
+// @Success      204  "Two-factor authentication disabled"
+// @Failure      400  {string}  string  "Zwei-Faktor-Authentifizierung nicht aktiviert"
+// @Failure      401  {string}  string  "Ungültiger Code"
+// @Failure      429  {string}  string  "Zu viele fehlgeschlagene Anmeldeversuche"
+// @Failure      500  {string}  string  "Server error"
+// @Router       /users/2fa/totp [delete]
+func (c *UserController) DisableTOTP(w http.ResponseWriter, r *http.Request) {
+	uid, err := uuid.Parse(r.Header.Get(UserIdHeader))
+	if err != nil {
+		c.Error(w, "Fehler beim Parsen der ID", http.StatusBadRequest)
+		return
+	}
+	var request TOTPCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		c.Error(w, "Fehler beim Lesen der Anfrage", http.StatusBadRequest)
+		return
+	}
+
+	if err := c.service.DisableTOTP(uid, request.Code, server.ClientIP(r)); err != nil {
+		if _, ok := err.(*LockedError); ok {
+			c.writeLocked(w, err)
+			return
+		}
+		switch err {
+		case ERR_TOTP_NOT_ENABLED:
+			c.Error(w, "Zwei-Faktor-Authentifizierung nicht aktiviert", http.StatusBadRequest)
+		case ERR_INVALID_MFA_CODE:
+			c.Error(w, "Ungültiger Code", http.StatusUnauthorized)
+		default:
+			c.Error(w, "Fehler beim Deaktivieren der Zwei-Faktor-Authentifizierung", http.StatusInternalServerError)
+		}
+		return
+	}
+	c.recordAudit(r, audit.Event{Type: audit.TOTPDisabled, UserID: uid})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ListPasskeys godoc
+// @Summary      List passkeys
+// @Description  Lists the passkeys of the authenticated user with their usage and a warning if an authenticator may have been cloned.
+// @Tags         users
+// @Produce      json
+// @Param        Authorization header string true "User JWT token"
+// @Success      200  {array}   PasskeyInfo  "Passkeys"
+// @Failure      400  {string}  string  "Invalid user ID"
+// @Failure      404  {string}  string  "Benutzer nicht gefunden"
+// @Router       /users/webauthn/credentials [get]
+func (c *UserController) ListPasskeys(w http.ResponseWriter, r *http.Request) {
+	uid, err := uuid.Parse(r.Header.Get(UserIdHeader))
+	if err != nil {
+		c.Error(w, "Fehler beim Parsen der ID", http.StatusBadRequest)
+		return
+	}
+
+	passkeys, err := c.service.ListPasskeys(uid)
+	if err != nil {
+		c.Error(w, "Benutzer nicht gefunden", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(passkeys); err != nil {
+		c.Error(w, "Fehler beim Kodieren der Antwort", http.StatusInternalServerError)
+	}
+}
+
+// RenamePasskey godoc
+// @Summary      Rename passkey
+// @Description  Changes the name of a passkey of the authenticated user.
+// @Tags         users
+// @Accept       json
+// @Param        Authorization header string true "User JWT token"
+// @Param        credentialId  path  string             true  "Passkey ID"
+// @Param        body          body  RenamePasskeyRequest  true  "New name"
+// @Success      204  "Passkey renamed"
+// @Failure      400  {string}  string  "Ungültiger Name"
+// @Failure      404  {string}  string  "Passkey nicht gefunden"
+// @Failure      500  {string}  string  "Server error"
+// @Router       /users/webauthn/credentials/{credentialId} [put]
+func (c *UserController) RenamePasskey(w http.ResponseWriter, r *http.Request) {
+	uid, err := uuid.Parse(r.Header.Get(UserIdHeader))
+	if err != nil {
+		c.Error(w, "Fehler beim Parsen der ID", http.StatusBadRequest)
+		return
+	}
+	var request RenamePasskeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		c.Error(w, "Fehler beim Lesen der Anfrage", http.StatusBadRequest)
+		return
+	}
+
+	if err := c.service.RenamePasskey(uid, mux.Vars(r)["credentialId"], request.Name); err != nil {
+		switch err {
+		case ERR_INVALID_PASSKEY_NAME:
+			c.Error(w, "Ungültiger Name", http.StatusBadRequest)
+		case ERR_PASSKEY_NOT_FOUND:
+			c.Error(w, "Passkey nicht gefunden", http.StatusNotFound)
+		default:
+			c.Error(w, "Fehler beim Aktualisieren des Passkeys", http.StatusInternalServerError)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DeletePasskey godoc
+// @Summary      Delete passkey
+// @Description  Removes a passkey of the authenticated user, it can no longer be used to log in.
+// @Tags         users
+// @Param        Authorization header string true "User JWT token"
+// @Param        credentialId  path  string  true  "Passkey ID"
+// @Success      204  "Passkey deleted"
+// @Failure      404  {string}  string  "Passkey nicht gefunden"
+// @Failure      500  {string}  string  "Server error"
+// @Router       /users/webauthn/credentials/{credentialId} [delete]
+func (c *UserController) DeletePasskey(w http.ResponseWriter, r *http.Request) {
+	uid, err := uuid.Parse(r.Header.Get(UserIdHeader))
+	if err != nil {
+		c.Error(w, "Fehler beim Parsen der ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := c.service.DeletePasskey(uid, mux.Vars(r)["credentialId"]); err != nil {
+		if err == ERR_PASSKEY_NOT_FOUND {
+			c.Error(w, "Passkey nicht gefunden", http.StatusNotFound)
+		} else {
+			c.Error(w, "Fehler beim Löschen des Passkeys", http.StatusInternalServerError)
+		}
+		return
+	}
+	c.recordAudit(r, audit.Event{Type: audit.PasskeyDeleted, UserID: uid, Details: map[string]string{"credentialId": mux.Vars(r)["credentialId"]}})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetSelf godoc
+// @Summary      Get own account
+// @Description  Returns the account of the authenticated user including private fields and privacy settings.
+// @Tags         users
+// @Produce      json
+// @Param        Authorization header string true "User JWT token"
+// @Success      200  {object}  SelfView  "Own account"
+// @Failure      400  {string}  string  "Invalid user ID"
+// @Failure      404  {string}  string  "Benutzer nicht gefunden"
+// @Router       /users/self/profile [get]
+func (c *UserController) GetSelf(w http.ResponseWriter, r *http.Request) {
+	uid, err := uuid.Parse(r.Header.Get(UserIdHeader))
+	if err != nil {
+		c.Error(w, "Fehler beim Parsen der ID", http.StatusBadRequest)
+		return
+	}
+	user, err := c.service.GetUserByID(uid)
+	if err != nil {
+		c.Error(w, "Benutzer nicht gefunden", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(c.service.SelfView(user)); err != nil {
+		c.Error(w, "Fehler beim Kodieren der Antwort", http.StatusInternalServerError)
+	}
+}
+
+// SetPrivacy godoc
+// @Summary      Set privacy settings
+// @Description  Sets who can see the last name, email, phone number and age of the authenticated user: public, registered, partners (users with a confirmed trip together) or private.
+// @Tags         users
+// @Accept       json
+// @Param        Authorization header string true "User JWT token"
+// @Param        body  body  repo.PrivacySettings  true  "Privacy settings"
+// @Success      204  "Privacy settings updated"
+// @Failure      400  {string}  string  "Ungültige Sichtbarkeit"
+// @Failure      500  {string}  string  "Server error"
+// @Router       /users/self/privacy [put]
+func (c *UserController) SetPrivacy(w http.ResponseWriter, r *http.Request) {
+	uid, err := uuid.Parse(r.Header.Get(UserIdHeader))
+	if err != nil {
+		c.Error(w, "Fehler beim Parsen der ID", http.StatusBadRequest)
+		return
+	}
+	var privacy repo.PrivacySettings
+	if err := json.NewDecoder(r.Body).Decode(&privacy); err != nil {
+		c.Error(w, "Fehler beim Lesen der Anfrage", http.StatusBadRequest)
+		return
+	}
+
+	if err := c.service.SetPrivacy(uid, privacy); err != nil {
+		if err == ERR_INVALID_VISIBILITY {
+			c.Error(w, "Ungültige Sichtbarkeit", http.StatusBadRequest)
+		} else {
+			c.Error(w, "Fehler beim Aktualisieren des Benutzers", http.StatusInternalServerError)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// StartExport godoc
+// @Summary      Export own data
+// @Description  Starts collecting everything stored about the user from all services into a zip archive with one json file per service. Once finished an export.ready event is sent on user.<id>. At most 3 exports can be started within 24 hours.
+// @Tags         users
+// @Produce      json
+// @Success      202  {object}  repo.Export
+// @Failure      404  {string}  string  "Benutzer nicht gefunden"
+// @Failure      429  {string}  string  "Zu viele Exporte, Retry-After gibt die Wartezeit an"
+// @Router       /users/self/export [post]
+func (c *UserController) StartExport(w http.ResponseWriter, r *http.Request) {
+	uid, err := uuid.Parse(r.Header.Get(UserIdHeader))
+	if err != nil {
+		c.Error(w, "Fehler beim Parsen der ID", http.StatusBadRequest)
+		return
+	}
+
+	export, err := c.service.StartExport(uid)
+	if limit, ok := err.(*ExportLimitError); ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(limit.RetryAfter.Seconds()))))
+		c.Error(w, "Zu viele Exporte", http.StatusTooManyRequests)
+		return
+	}
+	if err != nil {
+		c.Error(w, "Benutzer nicht gefunden", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/user/self/export/"+export.ID.String())
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(export); err != nil {
+		c.GetLogger().Err(err).Msg("Fehler beim Kodieren der Antwort")
+	}
+}
+
+// GetExport godoc
+// @Summary      Status of a data export
+// @Tags         users
+// @Produce      json
+// @Param        exportId  path  string  true  "Export ID (UUID)"
+// @Success      200  {object}  repo.Export
+// @Failure      404  {string}  string  "Export nicht gefunden"
+// @Router       /users/self/export/{exportId} [get]
+func (c *UserController) GetExport(w http.ResponseWriter, r *http.Request) {
+	uid, exportID, ok := c.exportIDs(w, r)
+	if !ok {
+		return
+	}
+	export, err := c.service.GetExport(uid, exportID)
+	if err != nil {
+		c.Error(w, "Export nicht gefunden", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(export); err != nil {
+		c.Error(w, "Fehler beim Kodieren der Antwort", http.StatusInternalServerError)
+	}
+}
+
+// DownloadExport godoc
+// @Summary      Download a data export
+// @Tags         users
+// @Produce      application/zip
+// @Param        exportId  path  string  true  "Export ID (UUID)"
+// @Success      200  {file}    file
+// @Failure      404  {string}  string  "Export nicht gefunden"
+// @Failure      409  {string}  string  "Export noch nicht fertig"
+// @Router       /users/self/export/{exportId}/download [get]
+func (c *UserController) DownloadExport(w http.ResponseWriter, r *http.Request) {
+	uid, exportID, ok := c.exportIDs(w, r)
+	if !ok {
+		return
+	}
+	archive, err := c.service.ExportArchive(uid, exportID)
+	if err != nil {
+		if err == ERR_EXPORT_NOT_READY {
+			c.Error(w, "Export noch nicht fertig", http.StatusConflict)
+		} else {
+			c.Error(w, "Export nicht gefunden", http.StatusNotFound)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="mycargonaut-export-%s.zip"`, exportID))
+	if _, err := w.Write(archive); err != nil {
+		c.GetLogger().Err(err).Msg("Fehler beim Schreiben der Antwort")
+	}
+}
+
+func (c *UserController) exportIDs(w http.ResponseWriter, r *http.Request) (uuid.UUID, uuid.UUID, bool) {
+	uid, err := uuid.Parse(r.Header.Get(UserIdHeader))
+	if err != nil {
+		c.Error(w, "Fehler beim Parsen der ID", http.StatusBadRequest)
+		return uuid.Nil, uuid.Nil, false
+	}
+	exportID, err := uuid.Parse(mux.Vars(r)["exportId"])
+	if err != nil {
+		c.Error(w, "Export nicht gefunden", http.StatusNotFound)
+		return uuid.Nil, uuid.Nil, false
+	}
+	return uid, exportID, true
+}
+
+// viewerOf returns who is asking, set by OptionalJWT or EnsureJWT.
+func viewerOf(r *http.Request) Viewer {
+	uid, err := uuid.Parse(r.Header.Get(UserIdHeader))
+	if err != nil {
+		return Viewer{}
+	}
+	return Viewer{ID: uid, Admin: auth.HasRole(r, auth.RoleAdmin)}
+}
+
+// ratingSummary returns the number and average of the ratings of a user or
+// nil if the rating service is not available.
+func (c *UserController) ratingSummary(userID uuid.UUID) *RatingSummary {
+	ratings, err := c.ratingClient.GetRatingsByUserID(userID)
+	if err != nil {
+		c.GetLogger().Err(err).Msg("Fehler beim Laden der Bewertungen")
+		return nil
+	}
+	summary := &RatingSummary{Count: len(ratings)}
+	if len(ratings) > 0 {
+		sum := 0
+		for _, rating := range ratings {
+			sum += rating.Value
+		}
+		summary.Average = float64(sum) / float64(len(ratings))
+	}
+	return summary
+}
+
+// ListVehicles godoc
+// @Summary      List own vehicles
+// @Description  Returns the vehicles the authenticated user has registered, oldest first.
+// @Tags         vehicles
+// @Produce      json
+// @Param        Authorization header string true "User JWT token"
+// @Success      200  {array}   repo.Vehicle
+// @Failure      500  {string}  string  "Server error"
+// @Router       /users/vehicles [get]
+func (c *UserController) ListVehicles(w http.ResponseWriter, r *http.Request) {
+	uid, err := uuid.Parse(r.Header.Get(UserIdHeader))
+	if err != nil {
+		c.Error(w, "Fehler beim Parsen der ID", http.StatusBadRequest)
+		return
+	}
+
+	vehicles, err := c.service.ListVehicles(uid)
+	if err != nil {
+		c.Error(w, "Fehler beim Laden der Fahrzeuge", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(vehicles); err != nil {
+		c.Error(w, "Fehler beim Kodieren der Antwort", http.StatusInternalServerError)
+	}
+}
+
+// CreateVehicle godoc
+// @Summary      Register vehicle
+// @Description  Registers a vehicle of the authenticated user. Seats are the passenger seats, the trunk is given in centimeters and the payload in kilograms. Photos are uploaded to the media service under the returned photosId.
+// @Tags         vehicles
+// @Accept       json
+// @Produce      json
+// @Param        Authorization header string true "User JWT token"
+// @Param        body  body      repo.Vehicle  true  "Vehicle"
+// @Success      201   {object}  repo.Vehicle
+// @Failure      400   {string}  string  "Ungültiges Fahrzeug"
+// @Failure      409   {string}  string  "Kennzeichen bereits registriert"
+// @Failure      500   {string}  string  "Server error"
+// @Router       /users/vehicles [post]
+func (c *UserController) CreateVehicle(w http.ResponseWriter, r *http.Request) {
+	uid, err := uuid.Parse(r.Header.Get(UserIdHeader))
+	if err != nil {
+		c.Error(w, "Fehler beim Parsen der ID", http.StatusBadRequest)
+		return
+	}
+	var vehicle repo.Vehicle
+	if err := json.NewDecoder(r.Body).Decode(&vehicle); err != nil {
+		c.Error(w, "Fehler beim Lesen der Anfrage", http.StatusBadRequest)
+		return
+	}
+
+	vehicle, err = c.service.CreateVehicle(uid, vehicle)
+	if err != nil {
+		c.writeVehicleError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/user/vehicles/"+vehicle.ID.String())
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(vehicle); err != nil {
+		c.Error(w, "Fehler beim Kodieren der Antwort", http.StatusInternalServerError)
+	}
+}
+
+// GetVehicle godoc
+// @Summary      Get vehicle
+// @Description  Returns a vehicle. The plate is only shown to its owner.
+// @Tags         vehicles
+// @Produce      json
+// @Param        Authorization header string false "User JWT token"
+// @Param        vehicleId  path      string  true  "Vehicle ID (UUID)"
+// @Success      200        {object}  repo.Vehicle
+// @Failure      400        {string}  string  "Fehler beim Parsen der ID"
+// @Failure      404        {string}  string  "Fahrzeug nicht gefunden"
+// @Router       /users/vehicles/{vehicleId} [get]
+func (c *UserController) GetVehicle(w http.ResponseWriter, r *http.Request) {
+	vehicleID, err := uuid.Parse(mux.Vars(r)["vehicleId"])
+	if err != nil {
+		c.Error(w, "Fehler beim Parsen der ID", http.StatusBadRequest)
+		return
+	}
+	// anonymous callers get the nil id and never own the vehicle
+	callerID, _ := uuid.Parse(r.Header.Get(UserIdHeader))
+
+	vehicle, err := c.service.GetVehicle(callerID, vehicleID)
+	if err != nil {
+		c.Error(w, "Fahrzeug nicht gefunden", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(vehicle); err != nil {
+		c.Error(w, "Fehler beim Kodieren der Antwort", http.StatusInternalServerError)
+	}
+}
+
+// UpdateVehicle godoc
+// @Summary      Update vehicle
+// @Description  Replaces the details of a vehicle of the authenticated user. Offers created before keep their capacity.
+// @Tags         vehicles
+// @Accept       json
+// @Produce      json
+// @Param        Authorization header string true "User JWT token"
+// @Param        vehicleId  path      string        true  "Vehicle ID (UUID)"
+// @Param        body       body      repo.Vehicle  true  "Vehicle"
+// @Success      200        {object}  repo.Vehicle
+// @Failure      400        {string}  string  "Ungültiges Fahrzeug"
+// @Failure      404        {string}  string  "Fahrzeug nicht gefunden"
+// @Failure      409        {string}  string  "Kennzeichen bereits registriert"
+// @Failure      500        {string}  string  "Server error"
+// @Router       /users/vehicles/{vehicleId} [put]
+func (c *UserController) UpdateVehicle(w http.ResponseWriter, r *http.Request) {
+	uid, err := uuid.Parse(r.Header.Get(UserIdHeader))
+	if err != nil {
+		c.Error(w, "Fehler beim Parsen der ID", http.StatusBadRequest)
+		return
+	}
+	vehicleID, err := uuid.Parse(mux.Vars(r)["vehicleId"])
+	if err != nil {
+		c.Error(w, "Fehler beim Parsen der ID", http.StatusBadRequest)
+		return
+	}
+	var vehicle repo.Vehicle
+	if err := json.NewDecoder(r.Body).Decode(&vehicle); err != nil {
+		c.Error(w, "Fehler beim Lesen der Anfrage", http.StatusBadRequest)
+		return
+	}
+
+	vehicle, err = c.service.UpdateVehicle(uid, vehicleID, vehicle)
+	if err != nil {
+		c.writeVehicleError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(vehicle); err != nil {
+		c.Error(w, "Fehler beim Kodieren der Antwort", http.StatusInternalServerError)
+	}
+}
+
+// DeleteVehicle godoc
+// @Summary      Delete vehicle
+// @Description  Removes a vehicle of the authenticated user.
+// @Tags         vehicles
+// @Param        Authorization header string true "User JWT token"
+// @Param        vehicleId  path  string  true  "Vehicle ID (UUID)"
+// @Success      204  "Vehicle deleted"
+// @Failure      404  {string}  string  "Fahrzeug nicht gefunden"
+// @Failure      500  {string}  string  "Server error"
+// @Router       /users/vehicles/{vehicleId} [delete]
+func (c *UserController) DeleteVehicle(w http.ResponseWriter, r *http.Request) {
+	uid, err := uuid.Parse(r.Header.Get(UserIdHeader))
+	if err != nil {
+		c.Error(w, "Fehler beim Parsen der ID", http.StatusBadRequest)
+		return
+	}
+	vehicleID, err := uuid.Parse(mux.Vars(r)["vehicleId"])
+	if err != nil {
+		c.Error(w, "Fehler beim Parsen der ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := c.service.DeleteVehicle(uid, vehicleID); err != nil {
+		c.writeVehicleError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (c *UserController) writeVehicleError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ERR_INVALID_VEHICLE):
+		c.Error(w, "Ungültiges Fahrzeug: "+err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ERR_TOO_MANY_VEHICLES):
+		c.Error(w, "Zu viele Fahrzeuge", http.StatusBadRequest)
+	case errors.Is(err, ERR_DUPLICATE_PLATE):
+		c.Error(w, "Kennzeichen bereits registriert", http.StatusConflict)
+	case errors.Is(err, ERR_VEHICLE_NOT_FOUND):
+		c.Error(w, "Fahrzeug nicht gefunden", http.StatusNotFound)
+	default:
+		c.Error(w, "Fehler beim Speichern des Fahrzeugs", http.StatusInternalServerError)
+	}
+}
+
+// ListOIDCProviders godoc
+// @Summary      List identity providers
+// @Description  Returns the names of the identity providers users can log in with.
+// @Tags         users
+// @Produce      json
+// @Success      200  {array}  string
+// @Router       /users/oidc/providers [get]
+func (c *UserController) ListOIDCProviders(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(c.service.OIDCProviders()); err != nil {
+		c.Error(w, "Fehler beim Kodieren der Antwort", http.StatusInternalServerError)
+	}
+}
+
+// BeginOIDCLogin godoc
+// @Summary      Begin login with an identity provider
+// @Description  Returns the url of the provider the user has to be sent to. The provider redirects back to the frontend with a code and state, which are posted to /users/oidc/{provider}/callback.
+// @Description  The login is bound to the browser by a short-lived HttpOnly cookie, the callback has to be posted from the same browser.
+// @Tags         users
+// @Produce      json
+// @Param        provider  path  string  true  "Provider name"
+// @Success      200  {object}  OIDCLoginResponse
+// @Header       200  {string}  Set-Cookie  "oidc_state"
+// @Failure      404  {string}  string  "Unbekannter Anbieter"
+// @Failure      502  {string}  string  "Anbieter nicht erreichbar"
+// @Router       /users/oidc/{provider}/login [get]
+func (c *UserController) BeginOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	authURL, binding, err := c.service.BeginOIDCLogin(mux.Vars(r)["provider"])
+	if err != nil {
+		if err == ERR_UNKNOWN_PROVIDER {
+			c.Error(w, "Unbekannter Anbieter", http.StatusNotFound)
+		} else {
+			c.GetLogger().Err(err).Msg("Fehler beim Starten der Anmeldung beim Anbieter")
+			c.Error(w, "Anbieter nicht erreichbar", http.StatusBadGateway)
+		}
+		return
+	}
+
+	setOIDCStateCookie(w, binding, OIDCSessionTTL)
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(OIDCLoginResponse{AuthURL: authURL}); err != nil {
+		c.Error(w, "Fehler beim Kodieren der Antwort", http.StatusInternalServerError)
+	}
+}
+
+// OIDCStateCookie binds a login with an identity provider to the browser
+// that started it.
+const OIDCStateCookie = "oidc_state"
+
+// setOIDCStateCookie stores the binding of the login for maxAge, a negative
+// one removes it.
+func setOIDCStateCookie(w http.ResponseWriter, binding string, maxAge time.Duration) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     OIDCStateCookie,
+		Value:    binding,
+		Path:     "/",
+		MaxAge:   int(maxAge.Seconds()),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// FinishOIDCLogin godoc
+// @Summary      Finish login with an identity provider
+// @Description  Redeems the code the provider redirected back with. The external account is linked to the user with the same verified email, or a new verified user is created.
+// @Description  If the user has two-factor authentication enabled an mfa token is returned instead of the tokens.
+// @Tags         users
+// @Accept       json
+// @Produce      json
+// @Param        provider  path  string               true  "Provider name"
+// @Param        body      body  OIDCCallbackRequest  true  "State and code of the redirect"
+// @Success      200  {object}  TokenResponse  "Access and refresh token"
+// @Success      202  {object}  MFARequiredResponse  "Second factor required"
+// @Failure      400  {string}  string  "Fehler beim Lesen der Anfrage"
+// @Failure      401  {string}  string  "Authentifizierung fehlgeschlagen"
+// @Failure      403  {string}  string  "E-Mail-Adresse nicht bestätigt"
+// @Failure      404  {string}  string  "Unbekannter Anbieter"
+// @Failure      429  {string}  string  "Zu viele fehlgeschlagene Anmeldeversuche"
+// @Router       /users/oidc/{provider}/callback [post]
+func (c *UserController) FinishOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	var request OIDCCallbackRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		c.Error(w, "Fehler beim Lesen der Anfrage", http.StatusBadRequest)
+		return
+	}
+
+	var binding string
+	if cookie, err := r.Cookie(OIDCStateCookie); err == nil {
+		binding = cookie.Value
+	}
+	// the state can only be used once
+	setOIDCStateCookie(w, "", -1)
+	user, err := c.service.FinishOIDCLogin(mux.Vars(r)["provider"], request.State, binding, request.Code, server.ClientIP(r))
+	if err != nil {
+		switch err {
+		case ERR_UNKNOWN_PROVIDER:
+			c.Error(w, "Unbekannter Anbieter", http.StatusNotFound)
+		case ERR_OIDC_EMAIL_NOT_VERIFIED:
+			c.Error(w, "Die E-Mail-Adresse wurde vom Anbieter nicht bestätigt", http.StatusForbidden)
+		case ERR_OIDC_ACCOUNT_NOT_VERIFIED:
+			c.Error(w, "Bitte bestätige zuerst die E-Mail-Adresse deines bestehenden Kontos", http.StatusForbidden)
+		case ERR_INVALID_OIDC_SESSION, ERR_OIDC_LOGIN_FAILED:
+			c.Error(w, "Authentifizierung fehlgeschlagen", http.StatusUnauthorized)
+		default:
+			if locked, ok := err.(*LockedError); ok {
+				c.writeLocked(w, locked)
+				return
+			}
+			c.GetLogger().Err(err).Msg("Fehler beim Anmelden beim Anbieter")
+			c.Error(w, "Authentifizierung fehlgeschlagen", http.StatusUnauthorized)
+		}
+		return
+	}
+	c.writeLoginResult(w, r, user, map[string]string{"method": "oidc", "provider": mux.Vars(r)["provider"]})
+}
+
+// UnlinkIdentity godoc
+// @Summary      Unlink identity provider
+// @Description  Removes the link to the account at the provider, it can no longer be used to log in.
+// @Tags         users
+// @Param        Authorization header string true "User JWT token"
+// @Param        provider  path  string  true  "Provider name"
+// @Success      204  "Account unlinked"
+// @Failure      404  {string}  string  "Verknüpftes Konto nicht gefunden"
+// @Failure      500  {string}  string  "Server error"
+// @Router       /users/self/linked-accounts/{provider} [delete]
+func (c *UserController) UnlinkIdentity(w http.ResponseWriter, r *http.Request) {
+	uid, err := uuid.Parse(r.Header.Get(UserIdHeader))
+	if err != nil {
+		c.Error(w, "Fehler beim Parsen der ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := c.service.UnlinkIdentity(uid, mux.Vars(r)["provider"]); err != nil {
+		if err == ERR_IDENTITY_NOT_FOUND {
+			c.Error(w, "Verknüpftes Konto nicht gefunden", http.StatusNotFound)
+		} else {
+			c.Error(w, "Fehler beim Entfernen der Verknüpfung", http.StatusInternalServerError)
+		}
+		return
+	}
+	c.recordAudit(r, audit.Event{Type: audit.IdentityUnlinked, UserID: uid, Details: map[string]string{"provider": mux.Vars(r)["provider"]}})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// currentSession returns the session of the access token of the request, or
+// uuid.Nil for tokens issued before sessions were recorded.
+func (c *UserController) currentSession(r *http.Request) uuid.UUID {
+	claims, err := c.decoder.DecodeClaims(r.Header.Get("Authorization"))
+	if err != nil {
+		return uuid.Nil
+	}
+	sessionID, err := uuid.Parse(claims.SessionID)
+	if err != nil {
+		return uuid.Nil
+	}
+	return sessionID
+}
+
+// ListSessions godoc
+// @Summary      List sessions
+// @Description  Lists the devices the authenticated user is logged in on, most recently used first. The session of the request is marked as current.
+// @Tags         users
+// @Produce      json
+// @Param        Authorization header string true "User JWT token"
+// @Success      200  {array}   SessionInfo  "Sessions"
+// @Failure      400  {string}  string  "Invalid user ID"
+// @Failure      500  {string}  string  "Server error"
+// @Router       /users/self/sessions [get]
+func (c *UserController) ListSessions(w http.ResponseWriter, r *http.Request) {
+	uid, err := uuid.Parse(r.Header.Get(UserIdHeader))
+	if err != nil {
+		c.Error(w, "Fehler beim Parsen der ID", http.StatusBadRequest)
+		return
+	}
+
+	sessions, err := c.service.ListSessions(uid, c.currentSession(r))
+	if err != nil {
+		c.Error(w, "Fehler beim Laden der Sitzungen", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(sessions); err != nil {
+		c.Error(w, "Fehler beim Kodieren der Antwort", http.StatusInternalServerError)
+	}
+}
+
+// RevokeSession godoc
+// @Summary      Revoke session
+// @Description  Logs the authenticated user out on one device. Its refresh token stops working and its access tokens are rejected by all services.
+// @Tags         users
+// @Param        Authorization header string true "User JWT token"
+// @Param        sessionId  path  string  true  "Session ID"
+// @Success      204  "Session revoked"
+// @Failure      400  {string}  string  "Ungültige Sitzungs-ID"
+// @Failure      404  {string}  string  "Sitzung nicht gefunden"
+// @Failure      500  {string}  string  "Server error"
+// @Router       /users/self/sessions/{sessionId} [delete]
+func (c *UserController) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	uid, err := uuid.Parse(r.Header.Get(UserIdHeader))
+	if err != nil {
+		c.Error(w, "Fehler beim Parsen der ID", http.StatusBadRequest)
+		return
+	}
+	sessionID, err := uuid.Parse(mux.Vars(r)["sessionId"])
+	if err != nil {
+		c.Error(w, "Ungültige Sitzungs-ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := c.service.RevokeSession(uid, sessionID); err != nil {
+		if err == ERR_SESSION_NOT_FOUND {
+			c.Error(w, "Sitzung nicht gefunden", http.StatusNotFound)
+		} else {
+			c.Error(w, "Fehler beim Abmelden", http.StatusInternalServerError)
+		}
+		return
+	}
+	c.recordAudit(r, audit.Event{Type: audit.SessionRevoked, UserID: uid, Details: map[string]string{"session": sessionID.String()}})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RevokeOtherSessions godoc
+// @Summary      Revoke other sessions
+// @Description  Logs the authenticated user out on every device except the one of the request.
+// @Tags         users
+// @Param        Authorization header string true "User JWT token"
+// @Success      204  "Sessions revoked"
+// @Failure      400  {string}  string  "Invalid user ID"
+// @Failure      500  {string}  string  "Server error"
+// @Router       /users/self/sessions [delete]
+func (c *UserController) RevokeOtherSessions(w http.ResponseWriter, r *http.Request) {
+	uid, err := uuid.Parse(r.Header.Get(UserIdHeader))
+	if err != nil {
+		c.Error(w, "Fehler beim Parsen der ID", http.StatusBadRequest)
+		return
+	}
+
+	revoked, err := c.service.RevokeOtherSessions(uid, c.currentSession(r))
+	if err != nil {
+		c.Error(w, "Fehler beim Abmelden", http.StatusInternalServerError)
+		return
+	}
+	c.recordAudit(r, audit.Event{Type: audit.SessionRevoked, UserID: uid, Details: map[string]string{"count": strconv.Itoa(revoked)}})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ListSecurityEvents godoc
+// @Summary      List security events
+// @Description  Lists the security events of the authenticated user like logins, password changes and revoked sessions, newest first. The next page is requested with the createdAt of the last event as before.
+// @Tags         users
+// @Produce      json
+// @Param        Authorization header string true "User JWT token"
+// @Param        before  query  string  false  "Only events before this time (RFC 3339)"
+// @Param        limit   query  int     false  "Maximum number of events, default 50, at most 200"
+// @Success      200  {array}   audit.Event  "Security events"
+// @Failure      400  {string}  string  "Ungültige Anfrage"
+// @Failure      500  {string}  string  "Server error"
+// @Router       /users/self/security-events [get]
+func (c *UserController) ListSecurityEvents(w http.ResponseWriter, r *http.Request) {
+	uid, err := uuid.Parse(r.Header.Get(UserIdHeader))
+	if err != nil {
+		c.Error(w, "Fehler beim Parsen der ID", http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+	var before time.Time
+	if value := query.Get("before"); value != "" {
+		if before, err = time.Parse(time.RFC3339, value); err != nil {
+			c.Error(w, "Ungültiger Zeitpunkt", http.StatusBadRequest)
+			return
+		}
+	}
+	limit, err := auditLimit(query.Get("limit"))
+	if err != nil {
+		c.Error(w, "Ungültiges Limit", http.StatusBadRequest)
+		return
+	}
+
+	events, err := c.service.SecurityEvents(uid, before, limit)
+	if err != nil {
+		if err == ERR_INVALID_AUDIT_QUERY {
+			c.Error(w, "Ungültige Anfrage", http.StatusBadRequest)
+		} else {
+			c.Error(w, "Fehler beim Laden der Ereignisse", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(events); err != nil {
+		c.Error(w, "Fehler beim Kodieren der Antwort", http.StatusInternalServerError)
+	}
+}
+
+// QueryAudit godoc
+// @Summary      Query audit log
+// @Description  Searches the security events of all users, newest first. At least one of userId, ip or type is required. Admins only.
+// @Tags         users
+// @Produce      json
+// @Param        Authorization header string true "Admin JWT token"
+// @Param        userId  query  string  false  "Events of this user"
+// @Param        ip      query  string  false  "Events from this address"
+// @Param        type    query  string  false  "Events of this type, e.g. login.failed"
+// @Param        since   query  string  false  "Only events at or after this time (RFC 3339)"
+// @Param        until   query  string  false  "Only events before this time (RFC 3339)"
+// @Param        limit   query  int     false  "Maximum number of events, default 50, at most 200"
+// @Success      200  {array}   audit.Event  "Security events"
+// @Failure      400  {string}  string  "Ungültige Anfrage"
+// @Failure      401  {string}  string  "Unauthorized"
+// @Failure      403  {string}  string  "Forbidden"
+// @Failure      500  {string}  string  "Server error"
+// @Router       /users/audit [get]
+func (c *UserController) QueryAudit(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	query := repo.AuditQuery{IP: values.Get("ip"), Type: audit.Type(values.Get("type"))}
+	var err error
+	if value := values.Get("userId"); value != "" {
+		if query.UserID, err = uuid.Parse(value); err != nil {
+			c.Error(w, "Fehler beim Parsen der ID", http.StatusBadRequest)
+			return
+		}
+	}
+	for name, target := range map[string]*time.Time{"since": &query.Since, "until": &query.Until} {
+		if value := values.Get(name); value != "" {
+			if *target, err = time.Parse(time.RFC3339, value); err != nil {
+				c.Error(w, "Ungültiger Zeitpunkt", http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	if query.Limit, err = auditLimit(values.Get("limit")); err != nil {
+		c.Error(w, "Ungültiges Limit", http.StatusBadRequest)
+		return
+	}
+
+	events, err := c.service.QueryAudit(query)
+	if err != nil {
+		if err == ERR_INVALID_AUDIT_QUERY {
+			c.Error(w, "Ungültige Anfrage", http.StatusBadRequest)
+		} else {
+			c.Error(w, "Fehler beim Laden der Ereignisse", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(events); err != nil {
+		c.Error(w, "Fehler beim Kodieren der Antwort", http.StatusInternalServerError)
+	}
+}
+
+// auditLimit parses the optional limit of an audit query, 0 selects the
+// default.
+func auditLimit(value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+	return strconv.Atoi(value)
+}
+
+// ListBlocks godoc
+// @Summary      List blocked users
+// @Description  Lists the users the authenticated user blocked, oldest first.
+// @Tags         users
+// @Produce      json
+// @Param        Authorization header string true "User JWT token"
+// @Success      200  {array}   repo.Block  "Blocked users"
+// @Failure      400  {string}  string  "Invalid user ID"
+// @Failure      500  {string}  string  "Server error"
+// @Router       /users/self/blocks [get]
+func (c *UserController) ListBlocks(w http.ResponseWriter, r *http.Request) {
+	uid, err := uuid.Parse(r.Header.Get(UserIdHeader))
+	if err != nil {
+		c.Error(w, "Fehler beim Parsen der ID", http.StatusBadRequest)
+		return
+	}
+
+	blocks, err := c.service.ListBlocks(uid)
+	if err != nil {
+		c.Error(w, "Fehler beim Laden der blockierten Nutzer", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(blocks); err != nil {
+		c.Error(w, "Fehler beim Kodieren der Antwort", http.StatusInternalServerError)
+	}
+}
+
+// BlockUser godoc
+// @Summary      Block user
+// @Description  Blocks a user. Blocked users and the blocker can no longer chat with each other or book each other's offers, and their offers are hidden from one another.
+// @Tags         users
+// @Param        Authorization header string true "User JWT token"
+// @Param        userId  path  string  true  "ID of the user to block"
+// @Success      204  "User blocked"
+// @Failure      400  {string}  string  "Du kannst dich nicht selbst blockieren"
+// @Failure      404  {string}  string  "Benutzer nicht gefunden"
+// @Failure      500  {string}  string  "Server error"
+// @Router       /users/self/blocks/{userId} [put]
+func (c *UserController) BlockUser(w http.ResponseWriter, r *http.Request) {
+	uid, err := uuid.Parse(r.Header.Get(UserIdHeader))
+	if err != nil {
+		c.Error(w, "Fehler beim Parsen der ID", http.StatusBadRequest)
+		return
+	}
+	blockedID, err := uuid.Parse(mux.Vars(r)["userId"])
+	if err != nil {
+		c.Error(w, "Fehler beim Parsen der ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := c.service.BlockUser(uid, blockedID); err != nil {
+		switch err {
+		case ERR_BLOCK_SELF:
+			c.Error(w, "Du kannst dich nicht selbst blockieren", http.StatusBadRequest)
+		case ERR_USER_NOT_FOUND:
+			c.Error(w, "Benutzer nicht gefunden", http.StatusNotFound)
+		default:
+			c.Error(w, "Fehler beim Blockieren", http.StatusInternalServerError)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// UnblockUser godoc
+// @Summary      Unblock user
+// @Description  Lifts the block of a user.
+// @Tags         users
+// @Param        Authorization header string true "User JWT token"
+// @Param        userId  path  string  true  "ID of the blocked user"
+// @Success      204  "User unblocked"
+// @Failure      400  {string}  string  "Invalid user ID"
+// @Failure      500  {string}  string  "Server error"
+// @Router       /users/self/blocks/{userId} [delete]
+func (c *UserController) UnblockUser(w http.ResponseWriter, r *http.Request) {
+	uid, err := uuid.Parse(r.Header.Get(UserIdHeader))
+	if err != nil {
+		c.Error(w, "Fehler beim Parsen der ID", http.StatusBadRequest)
+		return
+	}
+	blockedID, err := uuid.Parse(mux.Vars(r)["userId"])
+	if err != nil {
+		c.Error(w, "Fehler beim Parsen der ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := c.service.UnblockUser(uid, blockedID); err != nil {
+		c.Error(w, "Fehler beim Aufheben der Blockierung", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetPreferences godoc
+// @Summary      Get notification preferences
+// @Description  Returns how the authenticated user wants to be notified per category (chat, booking, payment, tracking, marketing) and channel (in-app, email), and the quiet hours in which no emails are sent. Users who never chose get the defaults.
+// @Tags         users
+// @Produce      json
+// @Param        Authorization header string true "User JWT token"
+// @Success      200  {object}  notify.Preferences  "Notification preferences"
+// @Failure      400  {string}  string  "Invalid user ID"
+// @Failure      500  {string}  string  "Server error"
+// @Router       /users/self/notification-preferences [get]
+func (c *UserController) GetPreferences(w http.ResponseWriter, r *http.Request) {
+	uid, err := uuid.Parse(r.Header.Get(UserIdHeader))
+	if err != nil {
+		c.Error(w, "Fehler beim Parsen der ID", http.StatusBadRequest)
+		return
+	}
+
+	preferences, err := c.service.GetPreferences(uid)
+	if err != nil {
+		c.Error(w, "Fehler beim Laden der Benachrichtigungseinstellungen", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(preferences); err != nil {
+		c.Error(w, "Fehler beim Kodieren der Antwort", http.StatusInternalServerError)
+	}
+}
+
+// UpdatePreferences godoc
+// @Summary      Update notification preferences
+// @Description  Replaces the notification preferences of the authenticated user. Categories that are left out keep their defaults. Quiet hours are given as start and end (15:04) in an IANA time zone, e.g. Europe/Berlin, and may span midnight.
+// @Tags         users
+// @Accept       json
+// @Produce      json
+// @Param        Authorization header string true "User JWT token"
+// @Param        body  body  notify.Preferences  true  "Notification preferences"
+// @Success      200  {object}  notify.Preferences  "Saved notification preferences"
+// @Failure      400  {string}  string  "Ungültige Benachrichtigungseinstellungen"
+// @Failure      404  {string}  string  "Benutzer nicht gefunden"
+// @Failure      500  {string}  string  "Server error"
+// @Router       /users/self/notification-preferences [put]
+func (c *UserController) UpdatePreferences(w http.ResponseWriter, r *http.Request) {
+	uid, err := uuid.Parse(r.Header.Get(UserIdHeader))
+	if err != nil {
+		c.Error(w, "Fehler beim Parsen der ID", http.StatusBadRequest)
+		return
+	}
+	var request notify.Preferences
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		c.Error(w, "Fehler beim Lesen der Anfrage", http.StatusBadRequest)
+		return
+	}
+
+	preferences, err := c.service.UpdatePreferences(uid, request)
+	if err != nil {
+		switch {
+		case errors.Is(err, ERR_INVALID_PREFERENCES):
+			c.Error(w, "Ungültige Benachrichtigungseinstellungen", http.StatusBadRequest)
+		case errors.Is(err, ERR_USER_NOT_FOUND):
+			c.Error(w, "Benutzer nicht gefunden", http.StatusNotFound)
+		default:
+			c.Error(w, "Fehler beim Speichern der Benachrichtigungseinstellungen", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(preferences); err != nil {
+		c.Error(w, "Fehler beim Kodieren der Antwort", http.StatusInternalServerError)
+	}
+}
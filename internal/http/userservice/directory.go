@@ -0,0 +1,121 @@
+package userservice
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/http/userservice/repo"
+)
+
+const (
+	DefaultPageSize = 20
+	MaxPageSize     = 100
+)
+
+var (
+	ERR_INVALID_CURSOR = errors.New("invalid cursor")
+	ERR_INVALID_SORT   = errors.New("invalid sort")
+)
+
+// UserPage is one page of the user directory. NextCursor is empty on the last page.
+type UserPage struct {
+	Users      []repo.User
+	NextCursor string
+}
+
+// DirectoryQuery are the parameters of the user directory as sent by clients.
+type DirectoryQuery struct {
+	Query    string
+	Verified *bool
+	// Sort is "name" or "email", a leading "-" sorts descending.
+	Sort   string
+	Cursor string
+	Limit  int
+}
+
+// ListUsers returns a page of users. Sorting by email is reserved for admins,
+// the cursor would otherwise reveal email addresses.
+func (s *UserService) ListUsers(query DirectoryQuery, admin bool) (UserPage, error) {
+	sortBy, descending, err := parseSort(query.Sort, admin)
+	if err != nil {
+		return UserPage{}, err
+	}
+	limit := query.Limit
+	if limit <= 0 {
+		limit = DefaultPageSize
+	}
+	limit = min(limit, MaxPageSize)
+
+	var after *repo.UserCursor
+	if query.Cursor != "" {
+		cursor, err := decodeCursor(query.Cursor)
+		if err != nil {
+			return UserPage{}, err
+		}
+		after = &cursor
+	}
+
+	// one more user than requested tells whether there is another page
+	users, err := s.repo.FindUsers(repo.UserQuery{
+		NamePrefix: strings.TrimSpace(query.Query),
+		Verified:   query.Verified,
+		SortBy:     sortBy,
+		Descending: descending,
+		After:      after,
+		Limit:      limit + 1,
+	})
+	if err != nil {
+		return UserPage{}, err
+	}
+
+	page := UserPage{Users: users}
+	if len(users) > limit {
+		page.Users = users[:limit]
+		page.NextCursor, err = encodeCursor(repo.CursorOf(page.Users[limit-1], sortBy))
+		if err != nil {
+			return UserPage{}, err
+		}
+	}
+	if page.Users == nil {
+		page.Users = []repo.User{}
+	}
+	return page, nil
+}
+
+func parseSort(sort string, admin bool) (string, bool, error) {
+	descending := strings.HasPrefix(sort, "-")
+	switch strings.TrimPrefix(sort, "-") {
+	case "", "name":
+		return repo.SortByName, descending, nil
+	case "email":
+		if !admin {
+			return "", false, ERR_INVALID_SORT
+		}
+		return repo.SortByEmail, descending, nil
+	default:
+		return "", false, ERR_INVALID_SORT
+	}
+}
+
+// The cursor is opaque to clients.
+func encodeCursor(cursor repo.UserCursor) (string, error) {
+	data, err := json.Marshal(cursor)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodeCursor(value string) (repo.UserCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return repo.UserCursor{}, ERR_INVALID_CURSOR
+	}
+	var cursor repo.UserCursor
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return repo.UserCursor{}, ERR_INVALID_CURSOR
+	}
+	return cursor, nil
+}
@@ -0,0 +1,111 @@
+package userservice
+
+import (
+	"errors"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/erasure"
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/http/userservice/repo"
+	"github.com/google/uuid"
+)
+
+const (
+	// ErasureRetryDelay is how long a service gets to report before the
+	// deletion is announced again.
+	ErasureRetryDelay = time.Minute
+)
+
+var ERR_ERASURE_NOT_FOUND = errors.New("erasure not found")
+
+// DeleteUser removes the account with its tokens, exports, vehicles, blocks
+// and notification preferences and announces the deletion on erasure.DeletedSubject, so the other
+// services erase their data as well. How far they got is tracked in the
+// erasure of the user.
+func (s *UserService) DeleteUser(id uuid.UUID) error {
+	if _, err := s.repo.GetUserByID(id); err != nil {
+		return err
+	}
+	if err := s.RevokeAllSessions(id); err != nil {
+		return err
+	}
+	if err := s.repo.DeletePasswordResetsOfUser(id); err != nil {
+		return err
+	}
+	if err := s.repo.DeleteExportsOfUser(id); err != nil {
+		return err
+	}
+	if err := s.repo.DeleteVehiclesOfOwner(id); err != nil {
+		return err
+	}
+	if err := s.repo.DeleteBlocksOfUser(id); err != nil {
+		return err
+	}
+	if err := s.repo.DeletePreferences(id); err != nil {
+		return err
+	}
+	if err := s.repo.DeleteUser(id); err != nil {
+		return err
+	}
+
+	e := repo.Erasure{
+		UserID:    id,
+		DeletedAt: time.Now(),
+		Services:  make(map[string]repo.ErasureServiceState, len(erasure.Services)),
+	}
+	for _, service := range erasure.Services {
+		e.Services[service] = repo.ErasureServiceState{Status: erasure.StatusPending}
+	}
+	if err := s.repo.CreateErasure(e); err != nil {
+		return err
+	}
+	s.announceDeletion(e)
+	return nil
+}
+
+// ErasureStatus returns how far the data of a deleted user has been erased.
+func (s *UserService) ErasureStatus(userID uuid.UUID) (repo.Erasure, error) {
+	e, err := s.repo.GetErasure(userID)
+	if err != nil {
+		return repo.Erasure{}, ERR_ERASURE_NOT_FOUND
+	}
+	return e, nil
+}
+
+// RecordErasureReport stores the outcome a service reported for a deleted user.
+func (s *UserService) RecordErasureReport(report erasure.Report) error {
+	if !slices.Contains(erasure.Services, report.Service) {
+		return nil
+	}
+	return s.repo.UpdateErasureService(report.UserID, report.Service, repo.ErasureServiceState{
+		Status:    report.Status,
+		Error:     report.Error,
+		UpdatedAt: time.Now(),
+	})
+}
+
+// RetryErasures announces deletions again that some service has not finished
+// after ErasureRetryDelay, e.g. because it was down or failed.
+func (s *UserService) RetryErasures() error {
+	erasures, err := s.repo.GetIncompleteErasures()
+	if err != nil {
+		return err
+	}
+	for _, e := range erasures {
+		if time.Since(e.DeletedAt) >= ErasureRetryDelay {
+			s.announceDeletion(e)
+		}
+	}
+	return nil
+}
+
+func (s *UserService) announceDeletion(e repo.Erasure) {
+	if s.publisher == nil {
+		return
+	}
+	// a lost event is published again by RetryErasures
+	if err := erasure.Publish(s.publisher, erasure.UserDeleted{UserID: e.UserID, DeletedAt: e.DeletedAt}); err != nil {
+		log.Printf("Failed to announce deletion of user %s: %v", e.UserID, err)
+	}
+}
@@ -0,0 +1,240 @@
+package userservice
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/erasure"
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/http/userservice/repo"
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/notify"
+	"github.com/google/uuid"
+)
+
+const (
+	// ExportTTL is how long a finished export can be downloaded.
+	ExportTTL = 7 * 24 * time.Hour
+	// MaxExports is how many exports a user can start within ExportWindow.
+	MaxExports   = 3
+	ExportWindow = 24 * time.Hour
+	// ExportCleanupInterval is how often the archives of expired exports are
+	// removed.
+	ExportCleanupInterval = time.Hour
+)
+
+var (
+	ERR_EXPORT_NOT_FOUND = errors.New("export not found")
+	ERR_EXPORT_NOT_READY = errors.New("export not ready")
+)
+
+// ExportLimitError is returned if the user started MaxExports exports within
+// ExportWindow.
+type ExportLimitError struct {
+	RetryAfter time.Duration
+}
+
+func (e *ExportLimitError) Error() string {
+	return fmt.Sprintf("too many exports, retry after %s", e.RetryAfter.Round(time.Second))
+}
+
+// DataCollector asks another service for the data it keeps about a user,
+// it is implemented by *dataexport.Collector.
+type DataCollector interface {
+	Collect(service string, userID uuid.UUID) (json.RawMessage, error)
+}
+
+// ExportProfile is the content of profile.json in an export.
+type ExportProfile struct {
+	SelfView
+	Passkeys []PasskeyInfo  `json:"passkeys"`
+	Vehicles []repo.Vehicle `json:"vehicles"`
+	Blocks   []repo.Block   `json:"blockedUsers"`
+
+	NotificationPreferences notify.Preferences `json:"notificationPreferences"`
+}
+
+// ExportManifest is the content of manifest.json in an export. It lists the
+// services whose data could not be collected.
+type ExportManifest struct {
+	UserID    uuid.UUID         `json:"userId"`
+	CreatedAt time.Time         `json:"createdAt"`
+	Files     []string          `json:"files"`
+	Errors    map[string]string `json:"errors,omitempty"`
+}
+
+func (s *UserService) WithCollector(collector DataCollector) *UserService {
+	s.collector = collector
+	return s
+}
+
+// StartExport creates an export of all data stored about the user. Asking
+// the other services takes a while, so the archive is built in the background
+// and the user is notified on user.<id> once it can be downloaded. A user can
+// start MaxExports exports within ExportWindow.
+func (s *UserService) StartExport(userID uuid.UUID) (repo.Export, error) {
+	if _, err := s.repo.GetUserByID(userID); err != nil {
+		return repo.Export{}, err
+	}
+	now := time.Now()
+	if err := s.checkExportLimit(userID, now); err != nil {
+		return repo.Export{}, err
+	}
+	export := repo.Export{
+		ID:        uuid.New(),
+		UserID:    userID,
+		Status:    repo.ExportPending,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ExportTTL),
+	}
+	if err := s.repo.CreateExport(export); err != nil {
+		return repo.Export{}, err
+	}
+	go s.runExport(export)
+	return export, nil
+}
+
+func (s *UserService) checkExportLimit(userID uuid.UUID, now time.Time) error {
+	exports, err := s.repo.GetExportsOfUser(userID)
+	if err != nil {
+		return err
+	}
+	var recent []time.Time
+	for _, export := range exports {
+		if export.CreatedAt.After(now.Add(-ExportWindow)) {
+			recent = append(recent, export.CreatedAt)
+		}
+	}
+	if len(recent) < MaxExports {
+		return nil
+	}
+	// the oldest of the last MaxExports has to leave the window
+	slices.SortFunc(recent, func(a, b time.Time) int { return b.Compare(a) })
+	return &ExportLimitError{RetryAfter: recent[MaxExports-1].Add(ExportWindow).Sub(now)}
+}
+
+// CleanupExports removes the archives of expired exports.
+func (s *UserService) CleanupExports() error {
+	return s.repo.DeleteExpiredExportArchives(time.Now())
+}
+
+// GetExport returns an export of the user.
+func (s *UserService) GetExport(userID uuid.UUID, exportID uuid.UUID) (repo.Export, error) {
+	export, err := s.repo.GetExport(exportID)
+	// mongo removes expired documents only periodically
+	if err != nil || export.UserID != userID || export.ExpiresAt.Before(time.Now()) {
+		return repo.Export{}, ERR_EXPORT_NOT_FOUND
+	}
+	return export, nil
+}
+
+// ExportArchive returns the zip archive of a finished export.
+func (s *UserService) ExportArchive(userID uuid.UUID, exportID uuid.UUID) ([]byte, error) {
+	export, err := s.GetExport(userID, exportID)
+	if err != nil {
+		return nil, err
+	}
+	if export.Status != repo.ExportReady {
+		return nil, ERR_EXPORT_NOT_READY
+	}
+	return s.repo.GetExportArchive(export.ArchiveID)
+}
+
+func (s *UserService) runExport(export repo.Export) {
+	event := AccountEvent{Type: EventExportReady, ExportID: export.ID.String()}
+	archive, err := s.BuildExport(export.UserID)
+	if err == nil {
+		// the archive may exceed the size limit of a document
+		export.ArchiveID = uuid.New()
+		err = s.repo.SaveExportArchive(export, archive)
+	}
+	if err != nil {
+		log.Printf("Failed to export data of user %s: %v", export.UserID, err)
+		export.Status = repo.ExportFailed
+		export.Error = err.Error()
+		export.ArchiveID = uuid.Nil
+		event.Type = EventExportFailed
+	} else {
+		export.Status = repo.ExportReady
+	}
+	if err := s.repo.UpdateExport(export); err != nil {
+		log.Printf("Failed to save export of user %s: %v", export.UserID, err)
+		return
+	}
+	s.publishAccountEvent(export.UserID, event)
+}
+
+// BuildExport collects the data of the user from this and all other services
+// into a zip archive with one json file per service. Services that do not
+// answer are listed in manifest.json instead of failing the export.
+func (s *UserService) BuildExport(userID uuid.UUID) ([]byte, error) {
+	user, err := s.repo.GetUserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+	passkeys, err := s.ListPasskeys(userID)
+	if err != nil {
+		return nil, err
+	}
+	vehicles, err := s.ListVehicles(userID)
+	if err != nil {
+		return nil, err
+	}
+	blocks, err := s.ListBlocks(userID)
+	if err != nil {
+		return nil, err
+	}
+	preferences, err := s.GetPreferences(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	manifest := ExportManifest{UserID: userID, CreatedAt: time.Now(), Errors: map[string]string{}}
+	write := func(name string, data any) error {
+		file, err := archive.Create(name)
+		if err != nil {
+			return err
+		}
+		encoder := json.NewEncoder(file)
+		encoder.SetIndent("", "  ")
+		manifest.Files = append(manifest.Files, name)
+		return encoder.Encode(data)
+	}
+
+	if err := write("profile.json", ExportProfile{
+		SelfView:                s.SelfView(user),
+		Passkeys:                passkeys,
+		Vehicles:                vehicles,
+		Blocks:                  blocks,
+		NotificationPreferences: preferences,
+	}); err != nil {
+		return nil, err
+	}
+	for _, service := range erasure.Services {
+		if s.collector == nil {
+			manifest.Errors[service] = "not available"
+			continue
+		}
+		data, err := s.collector.Collect(service, userID)
+		if err != nil {
+			manifest.Errors[service] = err.Error()
+			continue
+		}
+		if err := write(service+".json", data); err != nil {
+			return nil, err
+		}
+	}
+	if err := write("manifest.json", manifest); err != nil {
+		return nil, err
+	}
+	if err := archive.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
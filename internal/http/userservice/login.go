@@ -0,0 +1,149 @@
+package userservice
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/audit"
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/hasher"
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/http/userservice/repo"
+	"github.com/google/uuid"
+)
+
+var ERR_INVALID_CREDENTIALS = errors.New("invalid credentials")
+
+// LockedError is returned while an account or address is not allowed to log in.
+type LockedError struct {
+	RetryAfter time.Duration
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("too many failed login attempts, retry after %s", e.RetryAfter.Round(time.Second))
+}
+
+// Publisher sends events to other services, it is implemented by *nats.Conn.
+type Publisher interface {
+	Publish(subject string, data []byte) error
+}
+
+const (
+	EventAccountLocked = "account.locked"
+	EventExportReady   = "export.ready"
+	EventExportFailed  = "export.failed"
+	// EventIdentityLinked is sent when an account at an identity provider
+	// was linked by its email, so the user notices unexpected links.
+	EventIdentityLinked = "identity.linked"
+)
+
+type AccountEvent struct {
+	Type        string    `json:"type"`
+	LockedUntil time.Time `json:"lockedUntil,omitempty"`
+	ExportID    string    `json:"exportId,omitempty"`
+	Provider    string    `json:"provider,omitempty"`
+}
+
+func (s *UserService) WithPublisher(publisher Publisher) *UserService {
+	s.publisher = publisher
+	return s
+}
+
+// Login checks the credentials of a password login.
+// Unknown users and wrong passwords both result in ERR_INVALID_CREDENTIALS.
+// Hashes made with weaker parameters than configured are replaced.
+func (s *UserService) Login(email, password, ip string) (repo.User, error) {
+	if err := s.CheckLoginAllowed(email, ip); err != nil {
+		return repo.User{}, err
+	}
+
+	user, err := s.repo.GetUserByEmail(email)
+	if err != nil {
+		_ = hasher.VerifyPassword(s.dummyHash, password)
+		s.RecordLoginFailure(email, ip, uuid.Nil)
+		return repo.User{}, ERR_INVALID_CREDENTIALS
+	}
+	if err := hasher.VerifyPassword(user.Password, password); err != nil {
+		s.RecordLoginFailure(email, ip, user.ID)
+		return repo.User{}, ERR_INVALID_CREDENTIALS
+	}
+	s.upgradePasswordHash(user, password)
+
+	// with a second factor the failures are only reset after the code was
+	// checked, otherwise knowing the password would allow unlimited guesses
+	if !user.TOTPEnabled {
+		s.RecordLoginSuccess(email)
+	}
+	return user, nil
+}
+
+// CheckLoginAllowed returns a LockedError if the account or the address has
+// to wait before the next login attempt.
+func (s *UserService) CheckLoginAllowed(email, ip string) error {
+	var wait time.Duration
+	if key := accountKey(email); key != "" {
+		wait = s.accountThrottle.Wait(key)
+	}
+	if ip != "" {
+		wait = max(wait, s.ipThrottle.Wait(ip))
+	}
+	if wait > 0 {
+		return &LockedError{RetryAfter: wait}
+	}
+	return nil
+}
+
+// RecordLoginFailure counts a failed login. If this locks an existing account
+// the user is notified on their NATS subject. The email is empty if the
+// account is not known, e.g. for a failed discoverable passkey login. Every
+// failure and lock is recorded in the audit log.
+func (s *UserService) RecordLoginFailure(email, ip string, userID uuid.UUID) {
+	if ip != "" {
+		s.ipThrottle.Fail(ip)
+	}
+	event := audit.Event{Type: audit.LoginFailed, UserID: userID, IP: ip}
+	if userID == uuid.Nil && email != "" {
+		event.Details = map[string]string{"email": email}
+	}
+	s.RecordAudit(event)
+
+	key := accountKey(email)
+	if key == "" {
+		return
+	}
+	locked, until := s.accountThrottle.Fail(key)
+	if !locked || userID == uuid.Nil {
+		return
+	}
+	s.RecordAudit(audit.Event{Type: audit.AccountLocked, UserID: userID, IP: ip, Details: map[string]string{"until": until.Format(time.RFC3339)}})
+	s.publishAccountEvent(userID, AccountEvent{Type: EventAccountLocked, LockedUntil: until})
+}
+
+// RecordLoginSuccess resets the failures of the account. The address is not
+// reset, otherwise one valid account would allow unlimited guesses on others.
+func (s *UserService) RecordLoginSuccess(email string) {
+	s.accountThrottle.Succeed(accountKey(email))
+}
+
+// publishAccountEvent notifies the user on user.<id>. These events concern the
+// security of the account and are sent regardless of the notification
+// preferences.
+func (s *UserService) publishAccountEvent(userID uuid.UUID, event AccountEvent) {
+	if s.publisher == nil {
+		return
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Println("Failed to encode account event:", err)
+		return
+	}
+	if err := s.publisher.Publish("user."+userID.String(), data); err != nil {
+		log.Println("Failed to publish account event:", err)
+	}
+}
+
+func accountKey(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
@@ -0,0 +1,183 @@
+package userservice
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/hasher"
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/http/userservice/repo"
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/totp"
+	"github.com/google/uuid"
+)
+
+const (
+	// PurposeMFA marks the token returned by a password login when a second
+	// factor is still missing.
+	PurposeMFA  = "mfa"
+	MFATokenTTL = 5 * time.Minute
+
+	TOTPIssuer        = "MyCargonaut"
+	recoveryCodeCount = 10
+)
+
+var (
+	ERR_TOTP_ALREADY_ENABLED = errors.New("totp already enabled")
+	ERR_TOTP_NOT_ENABLED     = errors.New("totp not enabled")
+	ERR_TOTP_NOT_ENROLLED    = errors.New("totp enrollment not started")
+	ERR_INVALID_MFA_CODE     = errors.New("invalid mfa code")
+)
+
+// EnrollTOTP creates a new secret for the user. It is only used for logins
+// after it has been confirmed with ConfirmTOTP.
+func (s *UserService) EnrollTOTP(userID uuid.UUID) (secret string, uri string, err error) {
+	user, err := s.repo.GetUserByID(userID)
+	if err != nil {
+		return "", "", err
+	}
+	if user.TOTPEnabled {
+		return "", "", ERR_TOTP_ALREADY_ENABLED
+	}
+
+	secret, err = totp.GenerateSecret()
+	if err != nil {
+		return "", "", err
+	}
+	user.TOTPSecret = secret
+	user.TOTPLastStep = 0
+	if err := s.repo.UpdateUserFields(user, "totpSecret", "totpLastStep"); err != nil {
+		return "", "", err
+	}
+	return secret, totp.URI(TOTPIssuer, user.Email, secret), nil
+}
+
+// ConfirmTOTP enables the enrolled secret once the user has proven to own it
+// and returns new recovery codes. The codes are only stored hashed and can not
+// be shown again.
+func (s *UserService) ConfirmTOTP(userID uuid.UUID, code string) ([]string, error) {
+	user, err := s.repo.GetUserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+	if user.TOTPEnabled {
+		return nil, ERR_TOTP_ALREADY_ENABLED
+	}
+	if user.TOTPSecret == "" {
+		return nil, ERR_TOTP_NOT_ENROLLED
+	}
+	step, ok := totp.Validate(user.TOTPSecret, code, time.Now())
+	if !ok {
+		return nil, ERR_INVALID_MFA_CODE
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	user.TOTPEnabled = true
+	user.TOTPLastStep = step
+	user.RecoveryCodes = hashes
+	if err := s.repo.UpdateUserFields(user, "totpEnabled", "totpLastStep", "recoveryCodes"); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// DisableTOTP removes the second factor after checking a current code or a
+// recovery code.
+func (s *UserService) DisableTOTP(userID uuid.UUID, code string, ip string) error {
+	user, err := s.repo.GetUserByID(userID)
+	if err != nil {
+		return err
+	}
+	if !user.TOTPEnabled {
+		return ERR_TOTP_NOT_ENABLED
+	}
+	if err := s.verifySecondFactor(&user, code, ip); err != nil {
+		return err
+	}
+
+	user.TOTPEnabled = false
+	user.TOTPSecret = ""
+	user.TOTPLastStep = 0
+	user.RecoveryCodes = nil
+	return s.repo.UpdateUserFields(user, "totpEnabled", "totpSecret", "totpLastStep", "recoveryCodes")
+}
+
+// VerifySecondFactor completes a password login of a user with two-factor
+// authentication. Wrong codes count as failed logins.
+func (s *UserService) VerifySecondFactor(userID uuid.UUID, code string, ip string) (repo.User, error) {
+	user, err := s.repo.GetUserByID(userID)
+	if err != nil {
+		return repo.User{}, ERR_INVALID_MFA_CODE
+	}
+	if !user.TOTPEnabled {
+		return repo.User{}, ERR_TOTP_NOT_ENABLED
+	}
+	if err := s.verifySecondFactor(&user, code, ip); err != nil {
+		return repo.User{}, err
+	}
+	return user, nil
+}
+
+// verifySecondFactor accepts a totp code that has not been used before or an
+// unused recovery code. The code is consumed atomically, so it can not be
+// replayed by concurrent requests.
+func (s *UserService) verifySecondFactor(user *repo.User, code string, ip string) error {
+	if err := s.CheckLoginAllowed(user.Email, ip); err != nil {
+		return err
+	}
+
+	err := ERR_INVALID_MFA_CODE
+	if step, ok := totp.Validate(user.TOTPSecret, code, time.Now()); ok && step > user.TOTPLastStep {
+		if err = s.repo.UseTOTPStep(user.ID, step); err == nil {
+			user.TOTPLastStep = step
+		}
+	} else if i := indexOfRecoveryCode(user.RecoveryCodes, code); i >= 0 {
+		if err = s.repo.UseRecoveryCode(user.ID, user.RecoveryCodes[i]); err == nil {
+			user.RecoveryCodes = slices.Delete(user.RecoveryCodes, i, i+1)
+		}
+	}
+	if errors.Is(err, ERR_INVALID_MFA_CODE) || errors.Is(err, repo.ERR_MFA_CODE_USED) {
+		s.RecordLoginFailure(user.Email, ip, user.ID)
+		return ERR_INVALID_MFA_CODE
+	}
+	if err != nil {
+		return err
+	}
+
+	s.RecordLoginSuccess(user.Email)
+	return nil
+}
+
+// generateRecoveryCodes returns readable codes like "abcde-fghij" and their hashes.
+func generateRecoveryCodes() (codes []string, hashes []string, err error) {
+	encoding := base32.StdEncoding.WithPadding(base32.NoPadding)
+	for range recoveryCodeCount {
+		buf := make([]byte, 7)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(encoding.EncodeToString(buf))[:10]
+		codes = append(codes, code[:5]+"-"+code[5:])
+		hashes = append(hashes, hasher.HashToken(code))
+	}
+	return codes, hashes, nil
+}
+
+func indexOfRecoveryCode(hashes []string, code string) int {
+	code = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	if code == "" {
+		return -1
+	}
+	hash := hasher.HashToken(code)
+	for i, h := range hashes {
+		if h == hash {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,251 @@
+package userservice
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/audit"
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/hasher"
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/http/userservice/repo"
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/middleware/auth"
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/oidc"
+	"github.com/google/uuid"
+)
+
+// OIDCSessionTTL is how long the user has to log in at the provider.
+const OIDCSessionTTL = 10 * time.Minute
+
+var (
+	ERR_UNKNOWN_PROVIDER          = errors.New("unknown identity provider")
+	ERR_INVALID_OIDC_SESSION      = errors.New("invalid or expired oidc session")
+	ERR_OIDC_LOGIN_FAILED         = errors.New("oidc login failed")
+	ERR_OIDC_EMAIL_NOT_VERIFIED   = errors.New("email not verified by the identity provider")
+	ERR_OIDC_ACCOUNT_NOT_VERIFIED = errors.New("account with this email is not verified")
+	ERR_IDENTITY_NOT_FOUND        = errors.New("linked account not found")
+)
+
+// newOIDCProviders configures the providers listed comma separated in
+// OIDC_PROVIDERS from OIDC_<NAME>_ISSUER, OIDC_<NAME>_CLIENT_ID,
+// OIDC_<NAME>_CLIENT_SECRET and optionally OIDC_<NAME>_SCOPES. The provider
+// redirects back to the login page of the frontend at
+// <base url>/login/oidc/<name>, which hands the code to FinishOIDCLogin.
+func newOIDCProviders(baseURL string) map[string]*oidc.Provider {
+	providers := make(map[string]*oidc.Provider)
+	for _, name := range strings.Split(os.Getenv("OIDC_PROVIDERS"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		prefix := "OIDC_" + strings.ToUpper(name) + "_"
+		config := oidc.Config{
+			Name:         name,
+			Issuer:       strings.TrimSpace(os.Getenv(prefix + "ISSUER")),
+			ClientID:     strings.TrimSpace(os.Getenv(prefix + "CLIENT_ID")),
+			ClientSecret: strings.TrimSpace(os.Getenv(prefix + "CLIENT_SECRET")),
+			Scopes:       strings.Fields(strings.ReplaceAll(os.Getenv(prefix+"SCOPES"), ",", " ")),
+		}
+		if config.Issuer == "" || config.ClientID == "" {
+			log.Printf("Skipping identity provider %s without issuer or client id", name)
+			continue
+		}
+		providers[name] = newOIDCProvider(baseURL, config)
+	}
+	return providers
+}
+
+func newOIDCProvider(baseURL string, config oidc.Config) *oidc.Provider {
+	if config.RedirectURL == "" {
+		config.RedirectURL = baseURL + "/login/oidc/" + config.Name
+	}
+	return oidc.NewProvider(config)
+}
+
+// WithOIDCProvider adds an identity provider users can log in with.
+func (s *UserService) WithOIDCProvider(config oidc.Config) *UserService {
+	if s.oidcProviders == nil {
+		s.oidcProviders = make(map[string]*oidc.Provider)
+	}
+	s.oidcProviders[config.Name] = newOIDCProvider(s.baseURL, config)
+	return s
+}
+
+// OIDCProviders returns the names of the configured identity providers.
+func (s *UserService) OIDCProviders() []string {
+	names := make([]string, 0, len(s.oidcProviders))
+	for name := range s.oidcProviders {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// BeginOIDCLogin returns the url the user logs in at with the provider. The
+// state in it identifies the login, the PKCE verifier and the nonce stay here.
+// The binding is kept by the browser that started the login and has to be
+// handed to FinishOIDCLogin, so a state can not be finished in another one.
+func (s *UserService) BeginOIDCLogin(providerName string) (authURL string, binding string, err error) {
+	provider, ok := s.oidcProviders[providerName]
+	if !ok {
+		return "", "", ERR_UNKNOWN_PROVIDER
+	}
+	state, err := hasher.GenerateToken()
+	if err != nil {
+		return "", "", err
+	}
+	nonce, err := hasher.GenerateToken()
+	if err != nil {
+		return "", "", err
+	}
+	verifier, err := oidc.NewVerifier()
+	if err != nil {
+		return "", "", err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	authURL, err = provider.AuthCodeURL(ctx, state, nonce, verifier)
+	if err != nil {
+		return "", "", err
+	}
+	binding = hasher.HashToken(state)
+	err = s.repo.CreateOIDCSession(repo.OIDCSession{
+		Hash:      binding,
+		Provider:  providerName,
+		Verifier:  verifier,
+		Nonce:     nonce,
+		ExpiresAt: time.Now().Add(OIDCSessionTTL),
+	})
+	if err != nil {
+		return "", "", err
+	}
+	return authURL, binding, nil
+}
+
+// FinishOIDCLogin redeems the code the provider redirected back with and
+// returns the user the external account belongs to. Unknown accounts are
+// linked to the user with the same email if the provider verified it, or a
+// new user is created. The binding BeginOIDCLogin returned has to match the
+// state. Failures count like failed password logins.
+func (s *UserService) FinishOIDCLogin(providerName, state, binding, code, ip string) (repo.User, error) {
+	if err := s.CheckLoginAllowed("", ip); err != nil {
+		return repo.User{}, err
+	}
+	provider, ok := s.oidcProviders[providerName]
+	if !ok {
+		return repo.User{}, ERR_UNKNOWN_PROVIDER
+	}
+	hash := hasher.HashToken(state)
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(binding)) != 1 {
+		s.RecordLoginFailure("", ip, uuid.Nil)
+		return repo.User{}, ERR_INVALID_OIDC_SESSION
+	}
+	session, err := s.repo.TakeOIDCSession(hash)
+	// mongo removes expired documents only periodically
+	if err != nil || state == "" || session.Provider != providerName || session.ExpiresAt.Before(time.Now()) {
+		s.RecordLoginFailure("", ip, uuid.Nil)
+		return repo.User{}, ERR_INVALID_OIDC_SESSION
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	claims, err := provider.Exchange(ctx, code, session.Verifier, session.Nonce)
+	if err != nil {
+		log.Printf("Failed to log in with %s: %v", providerName, err)
+		s.RecordLoginFailure("", ip, uuid.Nil)
+		return repo.User{}, ERR_OIDC_LOGIN_FAILED
+	}
+
+	user, err := s.userOfIdentity(providerName, claims, ip)
+	if err != nil {
+		return repo.User{}, err
+	}
+	// a locked account stays locked
+	if err := s.CheckLoginAllowed(user.Email, ""); err != nil {
+		return repo.User{}, err
+	}
+	if !user.TOTPEnabled {
+		s.RecordLoginSuccess(user.Email)
+	}
+	return user, nil
+}
+
+// userOfIdentity finds the user of an external account or links it. Linking
+// by email requires both sides to have verified the address, otherwise
+// whoever registered it first could take over the other account. Links are
+// recorded in the audit log with the address of the login.
+func (s *UserService) userOfIdentity(providerName string, claims oidc.Claims, ip string) (repo.User, error) {
+	if user, err := s.repo.GetUserByIdentity(providerName, claims.Subject); err == nil {
+		return user, nil
+	}
+	if !claims.EmailVerified || claims.Email == "" {
+		return repo.User{}, ERR_OIDC_EMAIL_NOT_VERIFIED
+	}
+	identity := repo.ExternalIdentity{
+		Provider: providerName,
+		Subject:  claims.Subject,
+		Email:    claims.Email,
+		LinkedAt: time.Now(),
+	}
+
+	user, err := s.repo.GetUserByEmail(claims.Email)
+	if err == nil {
+		if !user.Verified {
+			return repo.User{}, ERR_OIDC_ACCOUNT_NOT_VERIFIED
+		}
+		user.Identities = append(user.Identities, identity)
+		if err := s.repo.UpdateUserFields(user, "identities"); err != nil {
+			return repo.User{}, err
+		}
+		s.RecordAudit(audit.Event{Type: audit.IdentityLinked, UserID: user.ID, IP: ip, Details: map[string]string{"provider": providerName}})
+		s.publishAccountEvent(user.ID, AccountEvent{Type: EventIdentityLinked, Provider: providerName})
+		return user, nil
+	}
+
+	// the account can only be used with the provider until a password is set
+	// with the reset link
+	password, err := hasher.GenerateToken()
+	if err != nil {
+		return repo.User{}, err
+	}
+	hashedPassword, err := s.hashPassword(password)
+	if err != nil {
+		return repo.User{}, err
+	}
+	user = repo.User{
+		ID:         uuid.New(),
+		FirstName:  claims.GivenName,
+		LastName:   claims.FamilyName,
+		Email:      claims.Email,
+		Password:   hashedPassword,
+		Verified:   true,
+		Roles:      []string{auth.RoleUser},
+		Identities: []repo.ExternalIdentity{identity},
+	}
+	if err := s.repo.CreateUser(user); err != nil {
+		return repo.User{}, err
+	}
+	return user, nil
+}
+
+// UnlinkIdentity removes the link to the account at the provider, it can no
+// longer be used to log in.
+func (s *UserService) UnlinkIdentity(userID uuid.UUID, providerName string) error {
+	user, err := s.repo.GetUserByID(userID)
+	if err != nil {
+		return err
+	}
+	identities := slices.DeleteFunc(slices.Clone(user.Identities), func(identity repo.ExternalIdentity) bool {
+		return identity.Provider == providerName
+	})
+	if len(identities) == len(user.Identities) {
+		return ERR_IDENTITY_NOT_FOUND
+	}
+	user.Identities = identities
+	return s.repo.UpdateUserFields(user, "identities")
+}
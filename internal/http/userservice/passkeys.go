@@ -0,0 +1,177 @@
+package userservice
+
+import (
+	"encoding/base64"
+	"errors"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+)
+
+const maxPasskeyNameLength = 64
+
+var (
+	ERR_PASSKEY_NOT_FOUND    = errors.New("passkey not found")
+	ERR_INVALID_PASSKEY_NAME = errors.New("invalid passkey name")
+)
+
+// PasskeyInfo is what a user gets to see about one of their passkeys.
+type PasskeyInfo struct {
+	ID             string     `json:"id"`
+	Name           string     `json:"name"`
+	CreatedAt      *time.Time `json:"createdAt,omitempty"`
+	LastUsedAt     *time.Time `json:"lastUsedAt,omitempty"`
+	SignCount      uint32     `json:"signCount"`
+	CloneWarning   bool       `json:"cloneWarning"`
+	BackupEligible bool       `json:"backupEligible"`
+	Transports     []string   `json:"transports"`
+}
+
+// newWebAuthn configures the relying party from WEBAUTHN_RP_ID,
+// WEBAUTHN_RP_NAME and the comma separated WEBAUTHN_RP_ORIGINS. By default
+// the host and origin of the base url are used.
+func newWebAuthn(baseURL string) (*webauthn.WebAuthn, error) {
+	rpID := strings.TrimSpace(os.Getenv("WEBAUTHN_RP_ID"))
+	if rpID == "" {
+		if u, err := url.Parse(baseURL); err == nil && u.Hostname() != "" {
+			rpID = u.Hostname()
+		} else {
+			rpID = "localhost"
+		}
+	}
+	rpName := strings.TrimSpace(os.Getenv("WEBAUTHN_RP_NAME"))
+	if rpName == "" {
+		rpName = "MyCargonaut"
+	}
+	var origins []string
+	for _, origin := range strings.Split(os.Getenv("WEBAUTHN_RP_ORIGINS"), ",") {
+		if origin = strings.TrimSuffix(strings.TrimSpace(origin), "/"); origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+	if len(origins) == 0 {
+		origins = []string{baseURL}
+	}
+
+	return webauthn.New(&webauthn.Config{
+		RPID:          rpID,
+		RPDisplayName: rpName,
+		RPOrigins:     origins,
+	})
+}
+
+// ListPasskeys returns the passkeys registered by the user.
+func (s *UserService) ListPasskeys(userID uuid.UUID) ([]PasskeyInfo, error) {
+	user, err := s.repo.GetUserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	passkeys := make([]PasskeyInfo, 0, len(user.Credentials))
+	for _, cred := range user.Credentials {
+		meta := user.Passkey(cred.ID)
+		info := PasskeyInfo{
+			ID:             base64.RawURLEncoding.EncodeToString(cred.ID),
+			Name:           meta.Name,
+			SignCount:      cred.Authenticator.SignCount,
+			CloneWarning:   cred.Authenticator.CloneWarning,
+			BackupEligible: cred.Flags.BackupEligible,
+			Transports:     []string{},
+		}
+		if !meta.CreatedAt.IsZero() {
+			info.CreatedAt = &meta.CreatedAt
+		}
+		if !meta.LastUsedAt.IsZero() {
+			info.LastUsedAt = &meta.LastUsedAt
+		}
+		for _, transport := range cred.Transport {
+			info.Transports = append(info.Transports, string(transport))
+		}
+		passkeys = append(passkeys, info)
+	}
+	return passkeys, nil
+}
+
+// RenamePasskey changes the name the user gave a passkey.
+func (s *UserService) RenamePasskey(userID uuid.UUID, passkeyID string, name string) error {
+	name = strings.TrimSpace(name)
+	if err := validatePasskeyName(name); err != nil {
+		return err
+	}
+	credentialID, err := base64.RawURLEncoding.DecodeString(passkeyID)
+	if err != nil {
+		return ERR_PASSKEY_NOT_FOUND
+	}
+	user, err := s.repo.GetUserByID(userID)
+	if err != nil {
+		return err
+	}
+	if !hasCredential(user.Credentials, credentialID) {
+		return ERR_PASSKEY_NOT_FOUND
+	}
+
+	user.Passkey(credentialID).Name = name
+	return s.repo.UpdateUserFields(user, "passkeys")
+}
+
+// DeletePasskey removes a passkey, it can no longer be used to log in.
+func (s *UserService) DeletePasskey(userID uuid.UUID, passkeyID string) error {
+	credentialID, err := base64.RawURLEncoding.DecodeString(passkeyID)
+	if err != nil {
+		return ERR_PASSKEY_NOT_FOUND
+	}
+	user, err := s.repo.GetUserByID(userID)
+	if err != nil {
+		return err
+	}
+	if !user.RemoveCredential(credentialID) {
+		return ERR_PASSKEY_NOT_FOUND
+	}
+	return s.repo.UpdateUserFields(user, "credentials", "passkeys")
+}
+
+// RecordPasskeyLogin stores the sign counter and flags reported by the
+// authenticator during a login, so cloned authenticators can be detected.
+func (s *UserService) RecordPasskeyLogin(userID uuid.UUID, cred *webauthn.Credential) error {
+	user, err := s.repo.GetUserByID(userID)
+	if err != nil {
+		return err
+	}
+	for i := range user.Credentials {
+		if string(user.Credentials[i].ID) != string(cred.ID) {
+			continue
+		}
+		user.Credentials[i].Authenticator.SignCount = cred.Authenticator.SignCount
+		// once set the warning stays until the user removes the passkey
+		user.Credentials[i].Authenticator.CloneWarning = user.Credentials[i].Authenticator.CloneWarning || cred.Authenticator.CloneWarning
+		user.Credentials[i].Flags = cred.Flags
+		user.Passkey(cred.ID).LastUsedAt = time.Now()
+		if cred.Authenticator.CloneWarning {
+			log.Printf("Sign counter of a passkey of user %s went backwards, the authenticator may be cloned", userID)
+		}
+		return s.repo.UpdateUserFields(user, "credentials", "passkeys")
+	}
+	return ERR_PASSKEY_NOT_FOUND
+}
+
+func validatePasskeyName(name string) error {
+	if name == "" || utf8.RuneCountInString(name) > maxPasskeyNameLength {
+		return ERR_INVALID_PASSKEY_NAME
+	}
+	return nil
+}
+
+func hasCredential(credentials []webauthn.Credential, credentialID []byte) bool {
+	for _, cred := range credentials {
+		if string(cred.ID) == string(credentialID) {
+			return true
+		}
+	}
+	return false
+}
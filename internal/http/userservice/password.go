@@ -0,0 +1,97 @@
+package userservice
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/hasher"
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/http/userservice/repo"
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/mailer"
+	"github.com/google/uuid"
+)
+
+const PasswordResetTTL = time.Hour
+
+var (
+	ERR_INVALID_RESET_TOKEN = errors.New("invalid reset token")
+	ERR_EMPTY_PASSWORD      = errors.New("password must not be empty")
+)
+
+// RequestPasswordReset mails a one-time reset link to the user. Unknown emails
+// are silently ignored so the caller can not find out which accounts exist:
+// both take the same time, the link is stored and mailed in the background
+// and failures are only logged.
+func (s *UserService) RequestPasswordReset(email string) error {
+	user, lookupErr := s.repo.GetUserByEmail(email)
+	token, err := hasher.GenerateToken()
+	if err != nil {
+		return err
+	}
+	if lookupErr == nil {
+		go func() {
+			if err := s.sendPasswordReset(user, token); err != nil {
+				log.Printf("Failed to send password reset to user %s: %v", user.ID, err)
+			}
+		}()
+	}
+	return nil
+}
+
+func (s *UserService) sendPasswordReset(user repo.User, token string) error {
+	now := time.Now()
+	err := s.repo.CreatePasswordReset(repo.PasswordReset{
+		Hash:      hasher.HashToken(token),
+		UserID:    user.ID,
+		CreatedAt: now,
+		ExpiresAt: now.Add(PasswordResetTTL),
+	})
+	if err != nil {
+		return err
+	}
+
+	link := fmt.Sprintf("%s/password/reset?token=%s", s.baseURL, url.QueryEscape(token))
+	return s.mailer.Send(mailer.Message{
+		To:      user.Email,
+		Subject: "Passwort zurücksetzen",
+		Body: fmt.Sprintf(
+			"Hallo %s,\n\nüber den folgenden Link kannst du ein neues Passwort vergeben:\n\n%s\n\nDer Link ist %d Minuten gültig. Falls du das nicht angefordert hast, kannst du diese E-Mail ignorieren.\n",
+			user.FirstName, link, int(PasswordResetTTL.Minutes()),
+		),
+	})
+}
+
+// ResetPassword sets a new password with a token from RequestPasswordReset.
+// The token and all other pending resets are consumed and the user is logged
+// out everywhere. It returns the user whose password was reset. The new
+// password has to satisfy the policy.
+func (s *UserService) ResetPassword(token string, password string) (uuid.UUID, error) {
+	if err := s.CheckPassword(password); err != nil {
+		return uuid.Nil, err
+	}
+	// taking the token consumes it, so concurrent requests can not both use it
+	reset, err := s.repo.TakePasswordReset(hasher.HashToken(token))
+	if err != nil || reset.ExpiresAt.Before(time.Now()) {
+		return uuid.Nil, ERR_INVALID_RESET_TOKEN
+	}
+	user, err := s.repo.GetUserByID(reset.UserID)
+	if err != nil {
+		return uuid.Nil, ERR_INVALID_RESET_TOKEN
+	}
+
+	if err := s.repo.DeletePasswordResetsOfUser(user.ID); err != nil {
+		return uuid.Nil, err
+	}
+
+	hashedPassword, err := s.hashPassword(password)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	user.Password = hashedPassword
+	if err := s.repo.UpdateUserFields(user, "password"); err != nil {
+		return uuid.Nil, err
+	}
+	return user.ID, s.RevokeAllSessions(user.ID)
+}
@@ -0,0 +1,220 @@
+package userservice
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/breached"
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/hasher"
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/http/userservice/repo"
+)
+
+var (
+	ERR_PASSWORD_TOO_SHORT = errors.New("password is too short")
+	ERR_PASSWORD_TOO_LONG  = errors.New("password is too long")
+	ERR_PASSWORD_TOO_WEAK  = errors.New("password is too easy to guess")
+	ERR_PASSWORD_BREACHED  = errors.New("password is known from a data breach")
+)
+
+// PasswordPolicy decides which new passwords are accepted. Existing passwords
+// keep working when it gets stricter.
+type PasswordPolicy struct {
+	// MinLength is counted in characters.
+	MinLength int
+	// MaxLength is counted in bytes, bcrypt only uses the first 72.
+	MaxLength int
+	// MinEntropy is the estimated strength in bits, see EstimateEntropy.
+	MinEntropy float64
+	// Breached rejects passwords known from data breaches if set.
+	Breached *breached.List
+}
+
+var DefaultPasswordPolicy = PasswordPolicy{
+	MinLength:  8,
+	MaxLength:  72,
+	MinEntropy: 30,
+}
+
+// newPasswordPolicy reads PASSWORD_MIN_LENGTH, PASSWORD_MIN_ENTROPY and the
+// list of breached passwords in BREACHED_PASSWORDS_FILE, see breached.Load.
+func newPasswordPolicy() (PasswordPolicy, error) {
+	policy := DefaultPasswordPolicy
+	var err error
+	if policy.MinLength, err = envInt("PASSWORD_MIN_LENGTH", policy.MinLength); err != nil {
+		return policy, err
+	}
+	if value := strings.TrimSpace(os.Getenv("PASSWORD_MIN_ENTROPY")); value != "" {
+		if policy.MinEntropy, err = strconv.ParseFloat(value, 64); err != nil {
+			return policy, fmt.Errorf("PASSWORD_MIN_ENTROPY: %w", err)
+		}
+	}
+	if path := strings.TrimSpace(os.Getenv("BREACHED_PASSWORDS_FILE")); path != "" {
+		if policy.Breached, err = breached.Load(path); err != nil {
+			return policy, fmt.Errorf("BREACHED_PASSWORDS_FILE: %w", err)
+		}
+		log.Printf("Loaded %d breached password hashes", policy.Breached.Len())
+	}
+	return policy, nil
+}
+
+// newPasswordParams reads how new passwords are hashed: PASSWORD_HASH is
+// bcrypt or argon2id, BCRYPT_COST, ARGON2_MEMORY in KiB, ARGON2_TIME and
+// ARGON2_THREADS tune them. Stored hashes with weaker parameters are replaced
+// on the next login.
+func newPasswordParams() (hasher.Params, error) {
+	params := hasher.DefaultParams
+	if algorithm := strings.TrimSpace(os.Getenv("PASSWORD_HASH")); algorithm != "" {
+		params.Algorithm = strings.ToLower(algorithm)
+	}
+	if params.Algorithm != hasher.Bcrypt && params.Algorithm != hasher.Argon2id {
+		return params, fmt.Errorf("PASSWORD_HASH: %w: %s", hasher.ErrUnknownAlgorithm, params.Algorithm)
+	}
+	var err error
+	if params.BcryptCost, err = envInt("BCRYPT_COST", params.BcryptCost); err != nil {
+		return params, err
+	}
+	values := []struct {
+		name   string
+		target *uint32
+	}{
+		{"ARGON2_MEMORY", &params.Argon2Memory},
+		{"ARGON2_TIME", &params.Argon2Time},
+	}
+	for _, value := range values {
+		parsed, err := envInt(value.name, int(*value.target))
+		if err != nil || parsed < 1 {
+			return params, fmt.Errorf("%s: invalid value", value.name)
+		}
+		*value.target = uint32(parsed)
+	}
+	threads, err := envInt("ARGON2_THREADS", int(params.Argon2Threads))
+	if err != nil || threads < 1 || threads > math.MaxUint8 {
+		return params, errors.New("ARGON2_THREADS: invalid value")
+	}
+	params.Argon2Threads = uint8(threads)
+	return params, nil
+}
+
+func envInt(name string, fallback int) (int, error) {
+	value := strings.TrimSpace(os.Getenv(name))
+	if value == "" {
+		return fallback, nil
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", name, err)
+	}
+	return parsed, nil
+}
+
+// WithPasswordPolicy replaces the policy read from the environment.
+func (s *UserService) WithPasswordPolicy(policy PasswordPolicy) *UserService {
+	s.passwordPolicy = policy
+	return s
+}
+
+// WithPasswordHashing replaces the hash parameters read from the environment.
+func (s *UserService) WithPasswordHashing(params hasher.Params) *UserService {
+	s.passwordParams = params
+	dummyHash, err := params.Hash("dummy password")
+	if err != nil {
+		panic("failed to hash dummy password: " + err.Error())
+	}
+	s.dummyHash = dummyHash
+	return s
+}
+
+// CheckPassword returns why a new password is not accepted by the policy.
+func (s *UserService) CheckPassword(password string) error {
+	return s.passwordPolicy.Check(password)
+}
+
+// Check returns why the password is not accepted, the cheap checks first.
+func (p PasswordPolicy) Check(password string) error {
+	switch {
+	case password == "":
+		return ERR_EMPTY_PASSWORD
+	case utf8.RuneCountInString(password) < p.MinLength:
+		return ERR_PASSWORD_TOO_SHORT
+	case p.MaxLength > 0 && len(password) > p.MaxLength:
+		return ERR_PASSWORD_TOO_LONG
+	case EstimateEntropy(password) < p.MinEntropy:
+		return ERR_PASSWORD_TOO_WEAK
+	case p.Breached != nil && p.Breached.Contains(password):
+		return ERR_PASSWORD_BREACHED
+	}
+	return nil
+}
+
+// EstimateEntropy estimates the strength of a password in bits from the
+// character classes it uses and its length. Characters that repeat or continue
+// the previous one, like in aaaa or 1234, add nothing. It is only meant to
+// catch trivial passwords, common ones are left to the breached list.
+func EstimateEntropy(password string) float64 {
+	var lower, upper, digit, symbol, other bool
+	length := 0
+	previous := rune(-10)
+	for _, r := range password {
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= '0' && r <= '9':
+			digit = true
+		case r < utf8.RuneSelf && (unicode.IsPunct(r) || unicode.IsSymbol(r) || r == ' '):
+			symbol = true
+		default:
+			other = true
+		}
+		if diff := r - previous; diff < -1 || diff > 1 {
+			length++
+		}
+		previous = r
+	}
+
+	pool := 0
+	for _, class := range []struct {
+		used bool
+		size int
+	}{{lower, 26}, {upper, 26}, {digit, 10}, {symbol, 33}, {other, 100}} {
+		if class.used {
+			pool += class.size
+		}
+	}
+	if pool == 0 {
+		return 0
+	}
+	return float64(length) * math.Log2(float64(pool))
+}
+
+// hashPassword hashes a new password with the configured parameters.
+func (s *UserService) hashPassword(password string) (string, error) {
+	return s.passwordParams.Hash(password)
+}
+
+// upgradePasswordHash replaces the stored hash after a successful login if it
+// was made with weaker parameters than configured now. The hash is only
+// replaced if it was not changed since it was verified. A failure is only
+// logged, the old hash keeps working.
+func (s *UserService) upgradePasswordHash(user repo.User, password string) {
+	if !s.passwordParams.NeedsRehash(user.Password) {
+		return
+	}
+	hashedPassword, err := s.hashPassword(password)
+	if err != nil {
+		log.Printf("Failed to rehash password of user %s: %v", user.ID, err)
+		return
+	}
+	err = s.repo.ReplacePasswordHash(user.ID, user.Password, hashedPassword)
+	if err != nil && !errors.Is(err, repo.ERR_PASSWORD_CHANGED) {
+		log.Printf("Failed to store rehashed password of user %s: %v", user.ID, err)
+	}
+}
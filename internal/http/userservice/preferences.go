@@ -0,0 +1,57 @@
+package userservice
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/notify"
+	"github.com/google/uuid"
+)
+
+var ERR_INVALID_PREFERENCES = errors.New("invalid notification preferences")
+
+// GetPreferences returns how the user wants to be notified, the defaults if
+// the user never chose.
+func (s *UserService) GetPreferences(userID uuid.UUID) (notify.Preferences, error) {
+	preferences, err := s.repo.GetPreferences(userID)
+	if err != nil {
+		return notify.Preferences{}, err
+	}
+	if preferences == nil {
+		return notify.Defaults(userID), nil
+	}
+	return preferences.WithDefaults(), nil
+}
+
+// UpdatePreferences replaces the preferences of the user. Missing categories
+// keep their defaults. The services sending notifications are told about the
+// change on notify.ChangedSubject.
+func (s *UserService) UpdatePreferences(userID uuid.UUID, preferences notify.Preferences) (notify.Preferences, error) {
+	if err := preferences.Validate(); err != nil {
+		return notify.Preferences{}, fmt.Errorf("%w: %v", ERR_INVALID_PREFERENCES, err)
+	}
+	if _, err := s.repo.GetUserByID(userID); err != nil {
+		return notify.Preferences{}, ERR_USER_NOT_FOUND
+	}
+	preferences.UserID = userID
+	preferences.UpdatedAt = time.Now()
+	preferences = preferences.WithDefaults()
+	if err := s.repo.SavePreferences(preferences); err != nil {
+		return notify.Preferences{}, err
+	}
+	s.publishPreferences(preferences)
+	return preferences, nil
+}
+
+// publishPreferences announces the change, a lost event only delays it until
+// the cached preferences expire in the other services.
+func (s *UserService) publishPreferences(preferences notify.Preferences) {
+	if s.publisher == nil {
+		return
+	}
+	if err := notify.Publish(s.publisher, preferences); err != nil {
+		log.Printf("Failed to announce notification preferences of %s: %v", preferences.UserID, err)
+	}
+}
@@ -0,0 +1,235 @@
+package userservice
+
+import (
+	"errors"
+	"log"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	repoangebot "github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/http/angebotservice/service/repo_angebot"
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/http/userservice/repo"
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/offerclient"
+	"github.com/google/uuid"
+)
+
+var ERR_INVALID_VISIBILITY = errors.New("invalid visibility")
+
+// Viewer is the user requesting a profile. ID is uuid.Nil for anonymous requests.
+type Viewer struct {
+	ID    uuid.UUID
+	Admin bool
+}
+
+type RatingSummary struct {
+	Count   int     `json:"count"`
+	Average float64 `json:"average"`
+}
+
+// UserProfile is how a user is shown to others. Optional fields are only set
+// if the privacy settings of the user allow the viewer to see them.
+type UserProfile struct {
+	ID             uuid.UUID      `json:"id"`
+	FirstName      string         `json:"firstName"`
+	LastName       string         `json:"lastName"`
+	ProfilePicture string         `json:"profilePicture"`
+	Age            *int           `json:"age,omitempty"`
+	Email          string         `json:"email,omitempty"`
+	PhoneNumber    string         `json:"phoneNumber,omitempty"`
+	EmailVerified  bool           `json:"emailVerified"`
+	Rating         *RatingSummary `json:"rating,omitempty"`
+}
+
+// SelfView is how users see their own account.
+type SelfView struct {
+	ID             uuid.UUID               `json:"id"`
+	FirstName      string                  `json:"firstName"`
+	LastName       string                  `json:"lastName"`
+	Email          string                  `json:"email"`
+	PendingEmail   string                  `json:"pendingEmail,omitempty"`
+	PhoneNumber    string                  `json:"phoneNumber"`
+	BirthDate      time.Time               `json:"birthDate"`
+	ProfilePicture string                  `json:"profilePicture"`
+	Verified       bool                    `json:"verified"`
+	Roles          []string                `json:"roles"`
+	TOTPEnabled    bool                    `json:"totpEnabled"`
+	Privacy        repo.PrivacySettings    `json:"privacy"`
+	LinkedAccounts []repo.ExternalIdentity `json:"linkedAccounts"`
+}
+
+// AdminView is how administrators see an account.
+type AdminView struct {
+	SelfView
+	PasskeyCount      int `json:"passkeyCount"`
+	RecoveryCodesLeft int `json:"recoveryCodesLeft"`
+}
+
+// PartnerChecker finds out whether two users share a confirmed trip.
+type PartnerChecker interface {
+	ArePartners(a, b uuid.UUID) (bool, error)
+}
+
+// offerPartners asks the offer service for trips both users take part in.
+type offerPartners struct {
+	client *offerclient.OfferClient
+}
+
+func newOfferPartners(url string) *offerPartners {
+	return &offerPartners{client: offerclient.NewOfferClient(url)}
+}
+
+// ArePartners reports whether one user created or drives an offer the other
+// has paid for, or both paid for the same offer.
+func (p *offerPartners) ArePartners(a, b uuid.UUID) (bool, error) {
+	offers, err := p.client.GetOffersByFilter(repoangebot.Filter{User: a, IncludePassed: true})
+	if err != nil {
+		return false, err
+	}
+	for _, offer := range offers {
+		// passengers only count once they paid for their space
+		participants := append(offer.PaidSpaces.Users(), offer.Creator, offer.Driver)
+		if slices.Contains(participants, a) && slices.Contains(participants, b) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *UserService) WithPartnerChecker(partners PartnerChecker) *UserService {
+	s.partners = partners
+	return s
+}
+
+// SetPrivacy replaces the privacy settings of the user.
+func (s *UserService) SetPrivacy(userID uuid.UUID, privacy repo.PrivacySettings) error {
+	for _, visibility := range []repo.Visibility{privacy.LastName, privacy.Email, privacy.PhoneNumber, privacy.Age} {
+		if visibility != "" && !visibility.IsValid() {
+			return ERR_INVALID_VISIBILITY
+		}
+	}
+	user, err := s.repo.GetUserByID(userID)
+	if err != nil {
+		return err
+	}
+	user.Privacy = privacy
+	return s.repo.UpdateUserFields(user, "privacy")
+}
+
+// View returns the representation of the user the viewer is allowed to see.
+// checkPartners decides whether partner-only fields are looked up, which
+// needs a request to the offer service and is skipped for lists.
+func (s *UserService) View(user repo.User, viewer Viewer, checkPartners bool) any {
+	switch {
+	case viewer.ID == user.ID:
+		return s.SelfView(user)
+	case viewer.Admin:
+		return s.AdminView(user)
+	default:
+		return s.Profile(user, viewer, checkPartners)
+	}
+}
+
+func (s *UserService) SelfView(user repo.User) SelfView {
+	roles := user.Roles
+	if roles == nil {
+		roles = []string{}
+	}
+	linkedAccounts := user.Identities
+	if linkedAccounts == nil {
+		linkedAccounts = []repo.ExternalIdentity{}
+	}
+	return SelfView{
+		ID:             user.ID,
+		FirstName:      user.FirstName,
+		LastName:       user.LastName,
+		Email:          user.Email,
+		PendingEmail:   user.PendingEmail,
+		PhoneNumber:    user.PhoneNumber,
+		BirthDate:      user.BirthDate,
+		ProfilePicture: user.ProfilePicture,
+		Verified:       user.Verified,
+		Roles:          roles,
+		TOTPEnabled:    user.TOTPEnabled,
+		Privacy:        user.Privacy.WithDefaults(),
+		LinkedAccounts: linkedAccounts,
+	}
+}
+
+func (s *UserService) AdminView(user repo.User) AdminView {
+	return AdminView{
+		SelfView:          s.SelfView(user),
+		PasskeyCount:      len(user.Credentials),
+		RecoveryCodesLeft: len(user.RecoveryCodes),
+	}
+}
+
+// Profile applies the privacy settings of the user for the viewer.
+func (s *UserService) Profile(user repo.User, viewer Viewer, checkPartners bool) UserProfile {
+	privacy := user.Privacy.WithDefaults()
+
+	// whether the viewer is a partner is only looked up once it matters
+	var partner *bool
+	visible := func(visibility repo.Visibility) bool {
+		switch visibility {
+		case repo.VisibilityPublic:
+			return true
+		case repo.VisibilityRegistered:
+			return viewer.ID != uuid.Nil
+		case repo.VisibilityPartners:
+			if viewer.ID == uuid.Nil || !checkPartners || s.partners == nil {
+				return false
+			}
+			if partner == nil {
+				ok, err := s.partners.ArePartners(user.ID, viewer.ID)
+				if err != nil {
+					log.Println("Failed to check trip partners:", err)
+				}
+				partner = &ok
+			}
+			return *partner
+		default:
+			return false
+		}
+	}
+
+	profile := UserProfile{
+		ID:             user.ID,
+		FirstName:      user.FirstName,
+		LastName:       abbreviate(user.LastName),
+		ProfilePicture: user.ProfilePicture,
+		EmailVerified:  user.Verified,
+	}
+	if visible(privacy.LastName) {
+		profile.LastName = user.LastName
+	}
+	if !user.BirthDate.IsZero() && visible(privacy.Age) {
+		age := ageAt(user.BirthDate, time.Now())
+		profile.Age = &age
+	}
+	if visible(privacy.Email) {
+		profile.Email = user.Email
+	}
+	if visible(privacy.PhoneNumber) {
+		profile.PhoneNumber = user.PhoneNumber
+	}
+	return profile
+}
+
+// abbreviate shortens a name to its first letter, "Mustermann" becomes "M.".
+func abbreviate(name string) string {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return ""
+	}
+	r, _ := utf8.DecodeRuneInString(name)
+	return string(r) + "."
+}
+
+func ageAt(birthDate time.Time, now time.Time) int {
+	age := now.Year() - birthDate.Year()
+	if now.Month() < birthDate.Month() || (now.Month() == birthDate.Month() && now.Day() < birthDate.Day()) {
+		age--
+	}
+	return age
+}
@@ -0,0 +1,84 @@
+package repo
+
+import (
+	"context"
+	"time"
+
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/audit"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const CollectionAuditLog = "audit_log"
+
+// AuditQuery selects events of the audit log, zero values match everything.
+// Since is inclusive, Until exclusive so the oldest event of a page can be
+// used as Until of the next one.
+type AuditQuery struct {
+	UserID uuid.UUID
+	IP     string
+	Type   audit.Type
+	Since  time.Time
+	Until  time.Time
+	Limit  int
+}
+
+// createAuditIndexes supports the queries by user and by address, newest
+// first.
+func createAuditIndexes(collection *mongo.Collection) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "userId", Value: 1}, {Key: "createdAt", Value: -1}}},
+		{Keys: bson.D{{Key: "ip", Value: 1}, {Key: "createdAt", Value: -1}}},
+	})
+	return err
+}
+
+// CreateAuditEvent appends an event to the audit log. Events are never
+// changed, only removed by mongo once they expire.
+func (r *MongoRepo) CreateAuditEvent(event audit.Event) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := r.auditCollection.InsertOne(ctx, event)
+	return err
+}
+
+// FindAuditEvents returns the matching events, newest first.
+func (r *MongoRepo) FindAuditEvents(query AuditQuery) ([]audit.Event, error) {
+	filter := bson.M{}
+	if query.UserID != uuid.Nil {
+		filter["userId"] = query.UserID
+	}
+	if query.IP != "" {
+		filter["ip"] = query.IP
+	}
+	if query.Type != "" {
+		filter["type"] = query.Type
+	}
+	createdAt := bson.M{}
+	if !query.Since.IsZero() {
+		createdAt["$gte"] = query.Since
+	}
+	if !query.Until.IsZero() {
+		createdAt["$lt"] = query.Until
+	}
+	if len(createdAt) > 0 {
+		filter["createdAt"] = createdAt
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	opts := options.Find().SetSort(bson.M{"createdAt": -1}).SetLimit(int64(query.Limit))
+	cursor, err := r.auditCollection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	events := []audit.Event{}
+	if err := cursor.All(ctx, &events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
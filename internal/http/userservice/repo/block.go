@@ -0,0 +1,78 @@
+package repo
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const CollectionBlocks = "blocks"
+
+// Block keeps the blocked user away from the blocker.
+type Block struct {
+	BlockerID uuid.UUID `bson:"blockerId" json:"-"`
+	BlockedID uuid.UUID `bson:"blockedId" json:"userId"`
+	CreatedAt time.Time `bson:"createdAt" json:"createdAt"`
+}
+
+// createBlockIndex makes a user block another user at most once.
+func createBlockIndex(collection *mongo.Collection) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "blockerId", Value: 1}, {Key: "blockedId", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	return err
+}
+
+// CreateBlock stores the block, blocking a user again keeps the first one.
+func (r *MongoRepo) CreateBlock(block Block) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	filter := bson.M{"blockerId": block.BlockerID, "blockedId": block.BlockedID}
+	_, err := r.blockCollection.UpdateOne(ctx, filter, bson.M{"$setOnInsert": block}, options.Update().SetUpsert(true))
+	return err
+}
+
+func (r *MongoRepo) DeleteBlock(blockerID, blockedID uuid.UUID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := r.blockCollection.DeleteOne(ctx, bson.M{"blockerId": blockerID, "blockedId": blockedID})
+	return err
+}
+
+// GetBlocksOfUser returns the users the blocker blocked, oldest first.
+func (r *MongoRepo) GetBlocksOfUser(blockerID uuid.UUID) ([]Block, error) {
+	return r.findBlocks(bson.M{"blockerId": blockerID})
+}
+
+func (r *MongoRepo) GetBlocks() ([]Block, error) {
+	return r.findBlocks(bson.M{})
+}
+
+func (r *MongoRepo) findBlocks(filter bson.M) ([]Block, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	cursor, err := r.blockCollection.Find(ctx, filter, options.Find().SetSort(bson.M{"createdAt": 1}))
+	if err != nil {
+		return nil, err
+	}
+	blocks := []Block{}
+	if err := cursor.All(ctx, &blocks); err != nil {
+		return nil, err
+	}
+	return blocks, nil
+}
+
+// DeleteBlocksOfUser removes the blocks of the user and those against the user.
+func (r *MongoRepo) DeleteBlocksOfUser(userID uuid.UUID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := r.blockCollection.DeleteMany(ctx, bson.M{"$or": []bson.M{{"blockerId": userID}, {"blockedId": userID}}})
+	return err
+}
@@ -0,0 +1,144 @@
+package repo
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Fields the user directory can be sorted by.
+const (
+	SortByName  = "sortName"
+	SortByEmail = "email"
+)
+
+// UserQuery selects a page of the user directory. Results are ordered by
+// SortBy and the id, After continues behind the last user of a page.
+type UserQuery struct {
+	// NamePrefix matches the start of the first name, or of the last name if
+	// the user shows it publicly.
+	NamePrefix string
+	Verified   *bool
+	SortBy     string
+	Descending bool
+	After      *UserCursor
+	Limit      int
+}
+
+// UserCursor is the position of a user in the sort order.
+type UserCursor struct {
+	Value string    `json:"v"`
+	ID    uuid.UUID `json:"id"`
+}
+
+// CursorOf returns the position of the user for the given sort field.
+func CursorOf(user User, sortBy string) UserCursor {
+	if sortBy == SortByEmail {
+		return UserCursor{Value: user.Email, ID: user.ID}
+	}
+	return UserCursor{Value: user.SortName, ID: user.ID}
+}
+
+// withSearchKeys derives the fields the directory searches and sorts by.
+// Last names are only searchable if they are public, otherwise the search
+// would reveal what the privacy settings hide.
+func (u User) withSearchKeys() User {
+	u.SortName = strings.ToLower(strings.TrimSpace(u.FirstName))
+	u.NameKeys = []string{u.SortName}
+	if u.Privacy.WithDefaults().LastName == VisibilityPublic {
+		u.NameKeys = append(u.NameKeys, strings.ToLower(strings.TrimSpace(u.LastName)))
+	}
+	return u
+}
+
+// createDirectoryIndexes creates the indexes used by FindUsers and the lookup by email.
+func createDirectoryIndexes(collection *mongo.Collection) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "sortName", Value: 1}, {Key: "_id", Value: 1}}},
+		{Keys: bson.D{{Key: "verified", Value: 1}, {Key: "sortName", Value: 1}, {Key: "_id", Value: 1}}},
+		{Keys: bson.D{{Key: "email", Value: 1}, {Key: "_id", Value: 1}}},
+		{Keys: bson.D{{Key: "nameKeys", Value: 1}}},
+	})
+	return err
+}
+
+// backfillSearchKeys sets the search fields of users stored before they existed.
+func backfillSearchKeys(collection *mongo.Collection) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	cursor, err := collection.Find(ctx, bson.M{"sortName": bson.M{"$exists": false}})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var user User
+		if err := cursor.Decode(&user); err != nil {
+			return err
+		}
+		user = user.withSearchKeys()
+		_, err := collection.UpdateOne(ctx, bson.M{"_id": user.ID}, bson.M{"$set": bson.M{
+			"sortName": user.SortName,
+			"nameKeys": user.NameKeys,
+		}})
+		if err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+func (r *MongoRepo) FindUsers(query UserQuery) ([]User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	sortBy := query.SortBy
+	if sortBy == "" {
+		sortBy = SortByName
+	}
+	filter := bson.A{}
+	if query.NamePrefix != "" {
+		prefix := "^" + regexp.QuoteMeta(strings.ToLower(query.NamePrefix))
+		filter = append(filter, bson.M{"nameKeys": bson.M{"$regex": prefix}})
+	}
+	if query.Verified != nil {
+		filter = append(filter, bson.M{"verified": *query.Verified})
+	}
+	direction := 1
+	compare := "$gt"
+	if query.Descending {
+		direction = -1
+		compare = "$lt"
+	}
+	if query.After != nil {
+		filter = append(filter, bson.M{"$or": bson.A{
+			bson.M{sortBy: bson.M{compare: query.After.Value}},
+			bson.M{sortBy: query.After.Value, "_id": bson.M{compare: query.After.ID}},
+		}})
+	}
+	where := bson.M{}
+	if len(filter) > 0 {
+		where["$and"] = filter
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: sortBy, Value: direction}, {Key: "_id", Value: direction}}).
+		SetLimit(int64(query.Limit))
+	cursor, err := r.userCollection.Find(ctx, where, opts)
+	if err != nil {
+		return []User{}, err
+	}
+	var users []User
+	if err = cursor.All(ctx, &users); err != nil {
+		return []User{}, err
+	}
+	return users, nil
+}
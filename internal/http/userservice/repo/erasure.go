@@ -0,0 +1,86 @@
+package repo
+
+import (
+	"context"
+	"time"
+
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/erasure"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const CollectionErasures = "erasures"
+
+// Erasure tracks how far the data of a deleted user has been removed from the
+// other services.
+type Erasure struct {
+	UserID    uuid.UUID                      `bson:"_id"       json:"userId"`
+	DeletedAt time.Time                      `bson:"deletedAt" json:"deletedAt"`
+	Services  map[string]ErasureServiceState `bson:"services"  json:"services"`
+}
+
+type ErasureServiceState struct {
+	Status    erasure.Status `bson:"status"              json:"status"`
+	Error     string         `bson:"error,omitempty"     json:"error,omitempty"`
+	UpdatedAt time.Time      `bson:"updatedAt,omitempty" json:"updatedAt,omitempty"`
+}
+
+// Completed reports whether every service has erased the data.
+func (e Erasure) Completed() bool {
+	for _, state := range e.Services {
+		if state.Status != erasure.StatusDone {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *MongoRepo) CreateErasure(e Erasure) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := r.erasureCollection.ReplaceOne(ctx, bson.M{"_id": e.UserID}, e, options.Replace().SetUpsert(true))
+	return err
+}
+
+func (r *MongoRepo) GetErasure(userID uuid.UUID) (Erasure, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var e Erasure
+	if err := r.erasureCollection.FindOne(ctx, bson.M{"_id": userID}).Decode(&e); err != nil {
+		return Erasure{}, err
+	}
+	return e, nil
+}
+
+// UpdateErasureService stores the state reported by a service. Services that
+// already finished stay done even if a repeated event fails later.
+func (r *MongoRepo) UpdateErasureService(userID uuid.UUID, service string, state ErasureServiceState) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	field := "services." + service
+	_, err := r.erasureCollection.UpdateOne(ctx,
+		bson.M{"_id": userID, field + ".status": bson.M{"$ne": erasure.StatusDone}},
+		bson.M{"$set": bson.M{field: state}},
+	)
+	return err
+}
+
+// GetIncompleteErasures returns the erasures some service has not finished.
+func (r *MongoRepo) GetIncompleteErasures() ([]Erasure, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var conditions bson.A
+	for _, service := range erasure.Services {
+		conditions = append(conditions, bson.M{"services." + service + ".status": bson.M{"$ne": erasure.StatusDone}})
+	}
+	cursor, err := r.erasureCollection.Find(ctx, bson.M{"$or": conditions})
+	if err != nil {
+		return nil, err
+	}
+	var erasures []Erasure
+	if err := cursor.All(ctx, &erasures); err != nil {
+		return nil, err
+	}
+	return erasures, nil
+}
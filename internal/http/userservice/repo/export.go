@@ -0,0 +1,139 @@
+package repo
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const CollectionExports = "exports"
+
+type ExportStatus string
+
+const (
+	ExportPending ExportStatus = "pending"
+	ExportReady   ExportStatus = "ready"
+	ExportFailed  ExportStatus = "failed"
+)
+
+// BucketExportArchives is the GridFS bucket the archives are stored in, they
+// may exceed the size limit of a document.
+const BucketExportArchives = "exportArchives"
+
+// Export is a data export requested by a user. The archive is kept until the
+// export expires.
+type Export struct {
+	ID     uuid.UUID    `bson:"_id"             json:"id"`
+	UserID uuid.UUID    `bson:"userId"          json:"-"`
+	Status ExportStatus `bson:"status"          json:"status"`
+	Error  string       `bson:"error,omitempty" json:"error,omitempty"`
+	// ArchiveID is the file of the archive in BucketExportArchives.
+	ArchiveID uuid.UUID `bson:"archiveId" json:"-"`
+	CreatedAt time.Time `bson:"createdAt" json:"createdAt"`
+	ExpiresAt time.Time `bson:"expiresAt" json:"expiresAt"`
+}
+
+// archiveMetadata is stored with the file of an archive, so it can be found
+// once the user is deleted or the export expired.
+type archiveMetadata struct {
+	UserID    uuid.UUID `bson:"userId"`
+	ExpiresAt time.Time `bson:"expiresAt"`
+}
+
+func (r *MongoRepo) CreateExport(export Export) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := r.exportCollection.InsertOne(ctx, export)
+	return err
+}
+
+func (r *MongoRepo) UpdateExport(export Export) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := r.exportCollection.ReplaceOne(ctx, bson.M{"_id": export.ID}, export)
+	return err
+}
+
+func (r *MongoRepo) GetExport(id uuid.UUID) (Export, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var export Export
+	if err := r.exportCollection.FindOne(ctx, bson.M{"_id": id}).Decode(&export); err != nil {
+		return Export{}, err
+	}
+	return export, nil
+}
+
+// GetExportsOfUser returns the exports of the user that did not expire yet.
+func (r *MongoRepo) GetExportsOfUser(userID uuid.UUID) ([]Export, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	cursor, err := r.exportCollection.Find(ctx, bson.M{"userId": userID})
+	if err != nil {
+		return nil, err
+	}
+	exports := []Export{}
+	if err := cursor.All(ctx, &exports); err != nil {
+		return nil, err
+	}
+	return exports, nil
+}
+
+// SaveExportArchive stores the archive of the export under its ArchiveID.
+func (r *MongoRepo) SaveExportArchive(export Export, archive []byte) error {
+	metadata := archiveMetadata{UserID: export.UserID, ExpiresAt: export.ExpiresAt}
+	return r.archives.UploadFromStreamWithID(
+		export.ArchiveID, export.ID.String()+".zip", bytes.NewReader(archive),
+		options.GridFSUpload().SetMetadata(metadata),
+	)
+}
+
+func (r *MongoRepo) GetExportArchive(archiveID uuid.UUID) ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := r.archives.DownloadToStream(archiveID, &buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// DeleteExpiredExportArchives removes the archives whose export expired,
+// mongo only removes the export documents.
+func (r *MongoRepo) DeleteExpiredExportArchives(now time.Time) error {
+	return r.deleteArchives(bson.M{"metadata.expiresAt": bson.M{"$lte": now}})
+}
+
+func (r *MongoRepo) DeleteExportsOfUser(userID uuid.UUID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := r.exportCollection.DeleteMany(ctx, bson.M{"userId": userID}); err != nil {
+		return err
+	}
+	return r.deleteArchives(bson.M{"metadata.userId": userID})
+}
+
+func (r *MongoRepo) deleteArchives(filter bson.M) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	cursor, err := r.archives.FindContext(ctx, filter)
+	if err != nil {
+		return err
+	}
+	var files []struct {
+		ID uuid.UUID `bson:"_id"`
+	}
+	if err := cursor.All(ctx, &files); err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err := r.archives.DeleteContext(ctx, file.ID); err != nil && !errors.Is(err, gridfs.ErrFileNotFound) {
+			return err
+		}
+	}
+	return nil
+}
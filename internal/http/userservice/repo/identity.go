@@ -0,0 +1,69 @@
+package repo
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const CollectionOIDCSessions = "oidc_sessions"
+
+// ExternalIdentity is an account at an OpenID provider the user can log in with.
+type ExternalIdentity struct {
+	Provider string    `bson:"provider" json:"provider"`
+	Subject  string    `bson:"subject"  json:"-"`
+	Email    string    `bson:"email"    json:"email"`
+	LinkedAt time.Time `bson:"linkedAt" json:"linkedAt"`
+}
+
+// OIDCSession is a running login at an OpenID provider, stored by the hash of
+// the state handed out with the authorization url.
+type OIDCSession struct {
+	Hash      string    `bson:"_id"`
+	Provider  string    `bson:"provider"`
+	Verifier  string    `bson:"verifier"`
+	Nonce     string    `bson:"nonce"`
+	ExpiresAt time.Time `bson:"expiresAt"`
+}
+
+// createIdentityIndex finds users by their external accounts at login.
+func createIdentityIndex(collection *mongo.Collection) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "identities.provider", Value: 1}, {Key: "identities.subject", Value: 1}},
+	})
+	return err
+}
+
+func (r *MongoRepo) GetUserByIdentity(provider, subject string) (User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var user User
+	filter := bson.M{"identities": bson.M{"$elemMatch": bson.M{"provider": provider, "subject": subject}}}
+	if err := r.userCollection.FindOne(ctx, filter).Decode(&user); err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+func (r *MongoRepo) CreateOIDCSession(session OIDCSession) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := r.oidcCollection.InsertOne(ctx, session)
+	return err
+}
+
+// TakeOIDCSession returns and deletes a session, so every state can only be
+// used once.
+func (r *MongoRepo) TakeOIDCSession(hash string) (OIDCSession, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var session OIDCSession
+	if err := r.oidcCollection.FindOneAndDelete(ctx, bson.M{"_id": hash}).Decode(&session); err != nil {
+		return OIDCSession{}, err
+	}
+	return session, nil
+}
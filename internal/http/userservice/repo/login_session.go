@@ -0,0 +1,82 @@
+package repo
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const CollectionLoginSessions = "login_sessions"
+
+// LoginSession is a device the user is logged in on. Its id is the family of
+// the refresh tokens of the login and is carried by every access token.
+type LoginSession struct {
+	ID         uuid.UUID `bson:"_id"        json:"id"`
+	UserID     uuid.UUID `bson:"userId"     json:"-"`
+	UserAgent  string    `bson:"userAgent"  json:"userAgent"`
+	Device     string    `bson:"device"     json:"device"`
+	IP         string    `bson:"ip"         json:"ip"`
+	CreatedAt  time.Time `bson:"createdAt"  json:"createdAt"`
+	LastSeenAt time.Time `bson:"lastSeenAt" json:"lastSeenAt"`
+	ExpiresAt  time.Time `bson:"expiresAt"  json:"expiresAt"`
+}
+
+func (r *MongoRepo) CreateLoginSession(session LoginSession) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := r.loginSessionCollection.InsertOne(ctx, session)
+	return err
+}
+
+func (r *MongoRepo) GetLoginSession(id uuid.UUID) (LoginSession, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var session LoginSession
+	if err := r.loginSessionCollection.FindOne(ctx, bson.M{"_id": id}).Decode(&session); err != nil {
+		return LoginSession{}, err
+	}
+	return session, nil
+}
+
+// TouchLoginSession records that the session was used again from the address.
+func (r *MongoRepo) TouchLoginSession(id uuid.UUID, ip string, lastSeenAt time.Time, expiresAt time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := r.loginSessionCollection.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{
+		"ip":         ip,
+		"lastSeenAt": lastSeenAt,
+		"expiresAt":  expiresAt,
+	}})
+	return err
+}
+
+func (r *MongoRepo) GetLoginSessionsOfUser(userID uuid.UUID) ([]LoginSession, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	cursor, err := r.loginSessionCollection.Find(ctx, bson.M{"userId": userID}, options.Find().SetSort(bson.M{"lastSeenAt": -1}))
+	if err != nil {
+		return nil, err
+	}
+	sessions := []LoginSession{}
+	if err := cursor.All(ctx, &sessions); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+func (r *MongoRepo) DeleteLoginSession(id uuid.UUID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := r.loginSessionCollection.DeleteOne(ctx, bson.M{"_id": id})
+	return err
+}
+
+func (r *MongoRepo) DeleteLoginSessionsOfUser(userID uuid.UUID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := r.loginSessionCollection.DeleteMany(ctx, bson.M{"userId": userID})
+	return err
+}
@@ -1,22 +1,54 @@
 package repo
 
 import (
+	"bytes"
 	"errors"
+	"maps"
+	"slices"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/audit"
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/erasure"
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/notify"
 	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
 )
 
 // MockRepo is a thread-safe in-memory implementation of Repo
 type MockRepo struct {
-	mu    sync.RWMutex
-	users map[uuid.UUID]User
+	mu       sync.RWMutex
+	users    map[uuid.UUID]User
+	tokens   map[string]RefreshToken
+	resets   map[string]PasswordReset
+	sessions map[string]WebAuthnSession
+	erasures map[uuid.UUID]Erasure
+	exports  map[uuid.UUID]Export
+	archives map[uuid.UUID]mockArchive
+	vehicles map[uuid.UUID]Vehicle
+	oidc     map[string]OIDCSession
+	logins   map[uuid.UUID]LoginSession
+	blocks   []Block
+	audit    []audit.Event
+	prefs    map[uuid.UUID]notify.Preferences
 }
 
 // NewMockRepo initializes a new MockRepo
 func NewMockRepo() *MockRepo {
 	return &MockRepo{
-		users: make(map[uuid.UUID]User),
+		users:    make(map[uuid.UUID]User),
+		tokens:   make(map[string]RefreshToken),
+		resets:   make(map[string]PasswordReset),
+		sessions: make(map[string]WebAuthnSession),
+		erasures: make(map[uuid.UUID]Erasure),
+		exports:  make(map[uuid.UUID]Export),
+		archives: make(map[uuid.UUID]mockArchive),
+		vehicles: make(map[uuid.UUID]Vehicle),
+		oidc:     make(map[string]OIDCSession),
+		logins:   make(map[uuid.UUID]LoginSession),
+		prefs:    make(map[uuid.UUID]notify.Preferences),
 	}
 }
 
@@ -27,7 +59,7 @@ func (m *MockRepo) CreateUser(user User) error {
 	if _, exists := m.users[user.ID]; exists {
 		return errors.New("user already exists")
 	}
-	m.users[user.ID] = user
+	m.users[user.ID] = user.withSearchKeys()
 	return nil
 }
 
@@ -49,7 +81,82 @@ func (m *MockRepo) UpdateUser(user User) error {
 	if _, exists := m.users[user.ID]; !exists {
 		return errors.New("user not found")
 	}
-	m.users[user.ID] = user
+	m.users[user.ID] = user.withSearchKeys()
+	return nil
+}
+
+func (m *MockRepo) UpdateUserFields(user User, fields ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, exists := m.users[user.ID]
+	if !exists {
+		return errors.New("user not found")
+	}
+	set, err := userFields(user, fields)
+	if err != nil {
+		return err
+	}
+	data, err := bson.Marshal(stored)
+	if err != nil {
+		return err
+	}
+	var merged bson.M
+	if err := bson.Unmarshal(data, &merged); err != nil {
+		return err
+	}
+	maps.Copy(merged, set)
+	if data, err = bson.Marshal(merged); err != nil {
+		return err
+	}
+	var updated User
+	if err := bson.Unmarshal(data, &updated); err != nil {
+		return err
+	}
+	m.users[user.ID] = updated
+	return nil
+}
+
+func (m *MockRepo) ReplacePasswordHash(userID uuid.UUID, oldHash string, newHash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, exists := m.users[userID]
+	if !exists || user.Password != oldHash {
+		return ERR_PASSWORD_CHANGED
+	}
+	user.Password = newHash
+	m.users[userID] = user
+	return nil
+}
+
+func (m *MockRepo) UseTOTPStep(userID uuid.UUID, step int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, exists := m.users[userID]
+	if !exists || user.TOTPLastStep >= step {
+		return ERR_MFA_CODE_USED
+	}
+	user.TOTPLastStep = step
+	m.users[userID] = user
+	return nil
+}
+
+func (m *MockRepo) UseRecoveryCode(userID uuid.UUID, hash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, exists := m.users[userID]
+	if !exists {
+		return ERR_MFA_CODE_USED
+	}
+	i := slices.Index(user.RecoveryCodes, hash)
+	if i < 0 {
+		return ERR_MFA_CODE_USED
+	}
+	user.RecoveryCodes = slices.Delete(slices.Clone(user.RecoveryCodes), i, i+1)
+	m.users[userID] = user
 	return nil
 }
 
@@ -80,9 +187,620 @@ func (m *MockRepo) GetUserByEmail(email string) (User, error) {
 	defer m.mu.RUnlock()
 
 	for _, user := range m.users {
-		if user.Email == email {
+		if strings.EqualFold(user.Email, email) {
 			return user, nil
 		}
 	}
 	return User{}, errors.New("user not found")
 }
+
+func (m *MockRepo) CreateRefreshToken(token RefreshToken) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.tokens[token.Hash]; exists {
+		return errors.New("token already exists")
+	}
+	m.tokens[token.Hash] = token
+	return nil
+}
+
+func (m *MockRepo) GetRefreshToken(hash string) (RefreshToken, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	token, exists := m.tokens[hash]
+	if !exists {
+		return RefreshToken{}, errors.New("token not found")
+	}
+	return token, nil
+}
+
+func (m *MockRepo) MarkRefreshTokenUsed(hash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	token, exists := m.tokens[hash]
+	if !exists || token.Used {
+		return ERR_REFRESH_TOKEN_USED
+	}
+	token.Used = true
+	m.tokens[hash] = token
+	return nil
+}
+
+func (m *MockRepo) DeleteRefreshTokenFamily(family uuid.UUID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for hash, token := range m.tokens {
+		if token.Family == family {
+			delete(m.tokens, hash)
+		}
+	}
+	return nil
+}
+
+func (m *MockRepo) DeleteRefreshTokensOfUser(userID uuid.UUID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for hash, token := range m.tokens {
+		if token.UserID == userID {
+			delete(m.tokens, hash)
+		}
+	}
+	return nil
+}
+
+func (m *MockRepo) CreatePasswordReset(reset PasswordReset) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.resets[reset.Hash] = reset
+	return nil
+}
+
+func (m *MockRepo) TakePasswordReset(hash string) (PasswordReset, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	reset, exists := m.resets[hash]
+	if !exists {
+		return PasswordReset{}, errors.New("reset not found")
+	}
+	delete(m.resets, hash)
+	return reset, nil
+}
+
+func (m *MockRepo) DeletePasswordResetsOfUser(userID uuid.UUID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for hash, reset := range m.resets {
+		if reset.UserID == userID {
+			delete(m.resets, hash)
+		}
+	}
+	return nil
+}
+
+func (m *MockRepo) CreateWebAuthnSession(session WebAuthnSession) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.sessions[session.Hash]; exists {
+		return errors.New("session already exists")
+	}
+	m.sessions[session.Hash] = session
+	return nil
+}
+
+func (m *MockRepo) TakeWebAuthnSession(hash string) (WebAuthnSession, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session, exists := m.sessions[hash]
+	if !exists {
+		return WebAuthnSession{}, errors.New("session not found")
+	}
+	delete(m.sessions, hash)
+	return session, nil
+}
+
+func (m *MockRepo) FindUsers(query UserQuery) ([]User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	sortBy := query.SortBy
+	if sortBy == "" {
+		sortBy = SortByName
+	}
+	// compare orders two positions like the mongo sort does
+	compare := func(a, b UserCursor) int {
+		if c := strings.Compare(a.Value, b.Value); c != 0 {
+			return c
+		}
+		return bytes.Compare(a.ID[:], b.ID[:])
+	}
+	prefix := strings.ToLower(query.NamePrefix)
+
+	var users []User
+	for _, user := range m.users {
+		user = user.withSearchKeys()
+		if prefix != "" && !hasPrefix(user.NameKeys, prefix) {
+			continue
+		}
+		if query.Verified != nil && user.Verified != *query.Verified {
+			continue
+		}
+		if query.After != nil {
+			c := compare(CursorOf(user, sortBy), *query.After)
+			if (!query.Descending && c <= 0) || (query.Descending && c >= 0) {
+				continue
+			}
+		}
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		c := compare(CursorOf(users[i], sortBy), CursorOf(users[j], sortBy))
+		if query.Descending {
+			return c > 0
+		}
+		return c < 0
+	})
+	if query.Limit > 0 && len(users) > query.Limit {
+		users = users[:query.Limit]
+	}
+	return users, nil
+}
+
+func hasPrefix(keys []string, prefix string) bool {
+	for _, key := range keys {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *MockRepo) CreateErasure(e Erasure) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	services := make(map[string]ErasureServiceState, len(e.Services))
+	for service, state := range e.Services {
+		services[service] = state
+	}
+	e.Services = services
+	m.erasures[e.UserID] = e
+	return nil
+}
+
+func (m *MockRepo) GetErasure(userID uuid.UUID) (Erasure, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	e, exists := m.erasures[userID]
+	if !exists {
+		return Erasure{}, errors.New("erasure not found")
+	}
+	services := make(map[string]ErasureServiceState, len(e.Services))
+	for service, state := range e.Services {
+		services[service] = state
+	}
+	e.Services = services
+	return e, nil
+}
+
+func (m *MockRepo) UpdateErasureService(userID uuid.UUID, service string, state ErasureServiceState) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, exists := m.erasures[userID]
+	if !exists || e.Services[service].Status == erasure.StatusDone {
+		return nil
+	}
+	e.Services[service] = state
+	return nil
+}
+
+func (m *MockRepo) GetIncompleteErasures() ([]Erasure, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var erasures []Erasure
+	for _, e := range m.erasures {
+		if !e.Completed() {
+			erasures = append(erasures, e)
+		}
+	}
+	return erasures, nil
+}
+
+func (m *MockRepo) CreateExport(export Export) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.exports[export.ID]; exists {
+		return errors.New("export already exists")
+	}
+	m.exports[export.ID] = export
+	return nil
+}
+
+func (m *MockRepo) UpdateExport(export Export) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.exports[export.ID]; !exists {
+		return errors.New("export not found")
+	}
+	m.exports[export.ID] = export
+	return nil
+}
+
+func (m *MockRepo) GetExport(id uuid.UUID) (Export, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	export, exists := m.exports[id]
+	if !exists {
+		return Export{}, errors.New("export not found")
+	}
+	return export, nil
+}
+
+func (m *MockRepo) GetExportsOfUser(userID uuid.UUID) ([]Export, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	exports := []Export{}
+	for _, export := range m.exports {
+		if export.UserID == userID {
+			exports = append(exports, export)
+		}
+	}
+	return exports, nil
+}
+
+type mockArchive struct {
+	archiveMetadata
+	data []byte
+}
+
+func (m *MockRepo) SaveExportArchive(export Export, archive []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.archives[export.ArchiveID] = mockArchive{
+		archiveMetadata: archiveMetadata{UserID: export.UserID, ExpiresAt: export.ExpiresAt},
+		data:            bytes.Clone(archive),
+	}
+	return nil
+}
+
+func (m *MockRepo) GetExportArchive(archiveID uuid.UUID) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	archive, exists := m.archives[archiveID]
+	if !exists {
+		return nil, errors.New("archive not found")
+	}
+	return archive.data, nil
+}
+
+func (m *MockRepo) DeleteExpiredExportArchives(now time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	maps.DeleteFunc(m.archives, func(_ uuid.UUID, archive mockArchive) bool {
+		return !archive.ExpiresAt.After(now)
+	})
+	return nil
+}
+
+func (m *MockRepo) DeleteExportsOfUser(userID uuid.UUID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	maps.DeleteFunc(m.exports, func(_ uuid.UUID, export Export) bool {
+		return export.UserID == userID
+	})
+	maps.DeleteFunc(m.archives, func(_ uuid.UUID, archive mockArchive) bool {
+		return archive.UserID == userID
+	})
+	return nil
+}
+
+func (m *MockRepo) CreateVehicle(vehicle Vehicle) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.vehicles[vehicle.ID]; exists {
+		return errors.New("vehicle already exists")
+	}
+	m.vehicles[vehicle.ID] = vehicle
+	return nil
+}
+
+func (m *MockRepo) GetVehicle(id uuid.UUID) (Vehicle, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	vehicle, exists := m.vehicles[id]
+	if !exists {
+		return Vehicle{}, errors.New("vehicle not found")
+	}
+	return vehicle, nil
+}
+
+func (m *MockRepo) GetVehiclesOfOwner(ownerID uuid.UUID) ([]Vehicle, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	vehicles := []Vehicle{}
+	for _, vehicle := range m.vehicles {
+		if vehicle.OwnerID == ownerID {
+			vehicles = append(vehicles, vehicle)
+		}
+	}
+	sort.Slice(vehicles, func(i, j int) bool {
+		return vehicles[i].CreatedAt.Before(vehicles[j].CreatedAt)
+	})
+	return vehicles, nil
+}
+
+func (m *MockRepo) UpdateVehicle(vehicle Vehicle) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.vehicles[vehicle.ID]; !exists {
+		return errors.New("vehicle not found")
+	}
+	m.vehicles[vehicle.ID] = vehicle
+	return nil
+}
+
+func (m *MockRepo) DeleteVehicle(id uuid.UUID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.vehicles, id)
+	return nil
+}
+
+func (m *MockRepo) DeleteVehiclesOfOwner(ownerID uuid.UUID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, vehicle := range m.vehicles {
+		if vehicle.OwnerID == ownerID {
+			delete(m.vehicles, id)
+		}
+	}
+	return nil
+}
+
+func (m *MockRepo) GetUserByIdentity(provider, subject string) (User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, user := range m.users {
+		for _, identity := range user.Identities {
+			if identity.Provider == provider && identity.Subject == subject {
+				return user, nil
+			}
+		}
+	}
+	return User{}, errors.New("user not found")
+}
+
+func (m *MockRepo) CreateOIDCSession(session OIDCSession) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.oidc[session.Hash]; exists {
+		return errors.New("session already exists")
+	}
+	m.oidc[session.Hash] = session
+	return nil
+}
+
+func (m *MockRepo) TakeOIDCSession(hash string) (OIDCSession, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session, exists := m.oidc[hash]
+	if !exists {
+		return OIDCSession{}, errors.New("session not found")
+	}
+	delete(m.oidc, hash)
+	return session, nil
+}
+
+func (m *MockRepo) CreateLoginSession(session LoginSession) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.logins[session.ID]; exists {
+		return errors.New("session already exists")
+	}
+	m.logins[session.ID] = session
+	return nil
+}
+
+func (m *MockRepo) GetLoginSession(id uuid.UUID) (LoginSession, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	session, exists := m.logins[id]
+	if !exists {
+		return LoginSession{}, errors.New("session not found")
+	}
+	return session, nil
+}
+
+func (m *MockRepo) TouchLoginSession(id uuid.UUID, ip string, lastSeenAt time.Time, expiresAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session, exists := m.logins[id]
+	if !exists {
+		return nil
+	}
+	session.IP = ip
+	session.LastSeenAt = lastSeenAt
+	session.ExpiresAt = expiresAt
+	m.logins[id] = session
+	return nil
+}
+
+func (m *MockRepo) GetLoginSessionsOfUser(userID uuid.UUID) ([]LoginSession, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	sessions := []LoginSession{}
+	for _, session := range m.logins {
+		if session.UserID == userID {
+			sessions = append(sessions, session)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastSeenAt.After(sessions[j].LastSeenAt)
+	})
+	return sessions, nil
+}
+
+func (m *MockRepo) DeleteLoginSession(id uuid.UUID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.logins, id)
+	return nil
+}
+
+func (m *MockRepo) DeleteLoginSessionsOfUser(userID uuid.UUID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, session := range m.logins {
+		if session.UserID == userID {
+			delete(m.logins, id)
+		}
+	}
+	return nil
+}
+
+func (m *MockRepo) CreateBlock(block Block) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, existing := range m.blocks {
+		if existing.BlockerID == block.BlockerID && existing.BlockedID == block.BlockedID {
+			return nil
+		}
+	}
+	m.blocks = append(m.blocks, block)
+	return nil
+}
+
+func (m *MockRepo) DeleteBlock(blockerID, blockedID uuid.UUID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.blocks = slices.DeleteFunc(m.blocks, func(block Block) bool {
+		return block.BlockerID == blockerID && block.BlockedID == blockedID
+	})
+	return nil
+}
+
+func (m *MockRepo) GetBlocksOfUser(blockerID uuid.UUID) ([]Block, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	blocks := []Block{}
+	for _, block := range m.blocks {
+		if block.BlockerID == blockerID {
+			blocks = append(blocks, block)
+		}
+	}
+	return blocks, nil
+}
+
+func (m *MockRepo) GetBlocks() ([]Block, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return slices.Clone(m.blocks), nil
+}
+
+func (m *MockRepo) DeleteBlocksOfUser(userID uuid.UUID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.blocks = slices.DeleteFunc(m.blocks, func(block Block) bool {
+		return block.BlockerID == userID || block.BlockedID == userID
+	})
+	return nil
+}
+
+func (m *MockRepo) CreateAuditEvent(event audit.Event) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.audit = append(m.audit, event)
+	return nil
+}
+
+func (m *MockRepo) FindAuditEvents(query AuditQuery) ([]audit.Event, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	events := []audit.Event{}
+	// newest first
+	for i := len(m.audit) - 1; i >= 0; i-- {
+		event := m.audit[i]
+		switch {
+		case query.UserID != uuid.Nil && event.UserID != query.UserID,
+			query.IP != "" && event.IP != query.IP,
+			query.Type != "" && event.Type != query.Type,
+			!query.Since.IsZero() && event.CreatedAt.Before(query.Since),
+			!query.Until.IsZero() && !event.CreatedAt.Before(query.Until):
+			continue
+		}
+		events = append(events, event)
+		if query.Limit > 0 && len(events) == query.Limit {
+			break
+		}
+	}
+	return events, nil
+}
+
+func (m *MockRepo) GetPreferences(userID uuid.UUID) (*notify.Preferences, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	preferences, ok := m.prefs[userID]
+	if !ok {
+		return nil, nil
+	}
+	return &preferences, nil
+}
+
+func (m *MockRepo) SavePreferences(preferences notify.Preferences) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.prefs[preferences.UserID] = preferences
+	return nil
+}
+
+func (m *MockRepo) DeletePreferences(userID uuid.UUID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.prefs, userID)
+	return nil
+}
@@ -3,12 +3,14 @@ package repo
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"time"
 
 	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/google/uuid"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
@@ -18,11 +20,22 @@ type User struct {
 	FirstName      string                `bson:"firstName"      json:"firstName"`
 	LastName       string                `bson:"lastName"       json:"lastName"`
 	Email          string                `bson:"email"          json:"email"`
+	PendingEmail   string                `bson:"pendingEmail"   json:"-"`
 	Password       string                `bson:"password"       json:"-"`
 	PhoneNumber    string                `bson:"phoneNumber"    json:"phoneNumber"`
 	ProfilePicture string                `bson:"profilePicture" json:"profilePicture"`
-	SessionData    webauthn.SessionData  `bson:"sessionData"    json:"sessionData"`
+	Verified       bool                  `bson:"verified"       json:"verified"`
+	Roles          []string              `bson:"roles"          json:"roles"`
+	Privacy        PrivacySettings       `bson:"privacy"        json:"privacy"`
+	TOTPEnabled    bool                  `bson:"totpEnabled"    json:"totpEnabled"`
+	TOTPSecret     string                `bson:"totpSecret"     json:"-"`
+	TOTPLastStep   int64                 `bson:"totpLastStep"   json:"-"`
+	RecoveryCodes  []string              `bson:"recoveryCodes"  json:"-"`
 	Credentials    []webauthn.Credential `bson:"credentials"   json:"credentials"`
+	Passkeys       []Passkey             `bson:"passkeys"       json:"-"`
+	SortName       string                `bson:"sortName"       json:"-"`
+	NameKeys       []string              `bson:"nameKeys"       json:"-"`
+	Identities     []ExternalIdentity    `bson:"identities"     json:"-"`
 }
 
 func (u User) WebAuthnID() []byte {
@@ -41,10 +54,6 @@ func (u User) WebAuthnCredentials() []webauthn.Credential {
 	return u.Credentials
 }
 
-func (u *User) AddCredential(cred *webauthn.Credential) {
-	u.Credentials = append(u.Credentials, *cred)
-}
-
 func (u *User) UnmarshalJSON(data []byte) error {
 	type Alias User // alias ohne json:"-"
 	aux := &struct {
@@ -61,7 +70,21 @@ func (u *User) UnmarshalJSON(data []byte) error {
 }
 
 type MongoRepo struct {
-	userCollection *mongo.Collection
+	userCollection    *mongo.Collection
+	tokenCollection   *mongo.Collection
+	resetCollection   *mongo.Collection
+	sessionCollection *mongo.Collection
+	erasureCollection *mongo.Collection
+	exportCollection  *mongo.Collection
+	vehicleCollection *mongo.Collection
+	oidcCollection    *mongo.Collection
+
+	loginSessionCollection *mongo.Collection
+	blockCollection        *mongo.Collection
+	auditCollection        *mongo.Collection
+	preferenceCollection   *mongo.Collection
+
+	archives *gridfs.Bucket
 }
 
 const (
@@ -89,15 +112,70 @@ func NewMongoRepo(mongoUri string) (*MongoRepo, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &MongoRepo{
-		userCollection: client.Database(DBName).Collection(CollectionUser),
-	}, nil
+	db := client.Database(DBName)
+	repo := &MongoRepo{
+		userCollection:    db.Collection(CollectionUser),
+		tokenCollection:   db.Collection(CollectionRefreshTokens),
+		resetCollection:   db.Collection(CollectionPasswordResets),
+		sessionCollection: db.Collection(CollectionWebAuthnSessions),
+		erasureCollection: db.Collection(CollectionErasures),
+		exportCollection:  db.Collection(CollectionExports),
+		vehicleCollection: db.Collection(CollectionVehicles),
+		oidcCollection:    db.Collection(CollectionOIDCSessions),
+
+		loginSessionCollection: db.Collection(CollectionLoginSessions),
+		blockCollection:        db.Collection(CollectionBlocks),
+		auditCollection:        db.Collection(CollectionAuditLog),
+		preferenceCollection:   db.Collection(CollectionPreferences),
+	}
+	if repo.archives, err = gridfs.NewBucket(db, options.GridFSBucket().SetName(BucketExportArchives)); err != nil {
+		return nil, err
+	}
+
+	// remove tokens once they are expired
+	for _, collection := range []*mongo.Collection{repo.tokenCollection, repo.resetCollection, repo.sessionCollection, repo.exportCollection, repo.oidcCollection, repo.loginSessionCollection, repo.auditCollection} {
+		if err := createExpiryIndex(collection, "expiresAt"); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := createDirectoryIndexes(repo.userCollection); err != nil {
+		return nil, err
+	}
+	if err := createIdentityIndex(repo.userCollection); err != nil {
+		return nil, err
+	}
+	if err := createEmailIndex(repo.userCollection); err != nil {
+		return nil, err
+	}
+	if err := createBlockIndex(repo.blockCollection); err != nil {
+		return nil, err
+	}
+	if err := createAuditIndexes(repo.auditCollection); err != nil {
+		return nil, err
+	}
+	if err := backfillSearchKeys(repo.userCollection); err != nil {
+		return nil, err
+	}
+
+	return repo, nil
+}
+
+// createExpiryIndex lets mongo delete documents as soon as the time in field has passed.
+func createExpiryIndex(collection *mongo.Collection, field string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.M{field: 1},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	return err
 }
 
 func (r *MongoRepo) CreateUser(user User) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	_, err := r.userCollection.InsertOne(ctx, user)
+	_, err := r.userCollection.InsertOne(ctx, user.withSearchKeys())
 	return err
 }
 
@@ -115,10 +193,108 @@ func (r *MongoRepo) GetUserByID(id uuid.UUID) (User, error) {
 func (r *MongoRepo) UpdateUser(user User) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	_, err := r.userCollection.UpdateOne(ctx, bson.M{"_id": user.ID}, bson.M{"$set": user})
+	_, err := r.userCollection.UpdateOne(ctx, bson.M{"_id": user.ID}, bson.M{"$set": user.withSearchKeys()})
+	return err
+}
+
+// UpdateUserFields sets only the fields of the user named by their bson keys,
+// so concurrent changes of the other fields are kept.
+func (r *MongoRepo) UpdateUserFields(user User, fields ...string) error {
+	set, err := userFields(user, fields)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = r.userCollection.UpdateOne(ctx, bson.M{"_id": user.ID}, bson.M{"$set": set})
 	return err
 }
 
+// ERR_PASSWORD_CHANGED is returned if the password hash was replaced in the
+// meantime.
+var ERR_PASSWORD_CHANGED = errors.New("password changed in the meantime")
+
+// ReplacePasswordHash sets the new hash only if the stored one is still the
+// old hash, so a password changed concurrently is not overwritten.
+func (r *MongoRepo) ReplacePasswordHash(userID uuid.UUID, oldHash string, newHash string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	result, err := r.userCollection.UpdateOne(ctx,
+		bson.M{"_id": userID, "password": oldHash},
+		bson.M{"$set": bson.M{"password": newHash}},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ERR_PASSWORD_CHANGED
+	}
+	return nil
+}
+
+// ERR_MFA_CODE_USED is returned if a totp step or recovery code was used
+// already, possibly by a concurrent request.
+var ERR_MFA_CODE_USED = errors.New("mfa code already used")
+
+// UseTOTPStep stores the step of an accepted totp code unless the same or a
+// later step was used already, only one of concurrent requests succeeds.
+func (r *MongoRepo) UseTOTPStep(userID uuid.UUID, step int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	result, err := r.userCollection.UpdateOne(ctx,
+		bson.M{"_id": userID, "totpLastStep": bson.M{"$lt": step}},
+		bson.M{"$set": bson.M{"totpLastStep": step}},
+	)
+	if err != nil {
+		return err
+	}
+	if result.ModifiedCount == 0 {
+		return ERR_MFA_CODE_USED
+	}
+	return nil
+}
+
+// UseRecoveryCode removes the hashed recovery code, only one of concurrent
+// requests with the same code succeeds.
+func (r *MongoRepo) UseRecoveryCode(userID uuid.UUID, hash string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	result, err := r.userCollection.UpdateOne(ctx,
+		bson.M{"_id": userID, "recoveryCodes": hash},
+		bson.M{"$pull": bson.M{"recoveryCodes": hash}},
+	)
+	if err != nil {
+		return err
+	}
+	if result.ModifiedCount == 0 {
+		return ERR_MFA_CODE_USED
+	}
+	return nil
+}
+
+// userFields returns the fields of the user to set, the search keys are
+// included if the fields they derive from are.
+func userFields(user User, fields []string) (bson.M, error) {
+	data, err := bson.Marshal(user.withSearchKeys())
+	if err != nil {
+		return nil, err
+	}
+	var all bson.M
+	if err := bson.Unmarshal(data, &all); err != nil {
+		return nil, err
+	}
+	set := bson.M{}
+	for _, field := range fields {
+		switch field {
+		case "firstName", "lastName", "privacy":
+			set["sortName"] = all["sortName"]
+			set["nameKeys"] = all["nameKeys"]
+		}
+		set[field] = all[field]
+	}
+	return set, nil
+}
+
 func (r *MongoRepo) DeleteUser(id uuid.UUID) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
@@ -126,11 +302,27 @@ func (r *MongoRepo) DeleteUser(id uuid.UUID) error {
 	return err
 }
 
+// emailCollation compares emails ignoring case, identity providers send them
+// in lower case while users registered them as they typed them.
+var emailCollation = &options.Collation{Locale: "en", Strength: 2}
+
+// createEmailIndex supports looking up users by email ignoring case.
+func createEmailIndex(collection *mongo.Collection) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.M{"email": 1},
+		Options: options.Index().SetCollation(emailCollation),
+	})
+	return err
+}
+
+// GetUserByEmail finds the user with the email ignoring case.
 func (r *MongoRepo) GetUserByEmail(email string) (User, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 	var user User
-	err := r.userCollection.FindOne(ctx, bson.M{"email": email}).Decode(&user)
+	err := r.userCollection.FindOne(ctx, bson.M{"email": email}, options.FindOne().SetCollation(emailCollation)).Decode(&user)
 	if err != nil {
 		return User{}, err
 	}
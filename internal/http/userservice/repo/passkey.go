@@ -0,0 +1,63 @@
+package repo
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// Passkey holds what we know about a webauthn credential beyond the
+// credential itself. It is matched to User.Credentials by the credential id.
+type Passkey struct {
+	CredentialID []byte    `bson:"credentialId"`
+	Name         string    `bson:"name"`
+	CreatedAt    time.Time `bson:"createdAt"`
+	LastUsedAt   time.Time `bson:"lastUsedAt"`
+}
+
+func (u *User) AddCredential(cred *webauthn.Credential) {
+	u.Credentials = append(u.Credentials, *cred)
+	u.Passkeys = append(u.Passkeys, Passkey{
+		CredentialID: cred.ID,
+		Name:         fmt.Sprintf("Passkey %d", len(u.Credentials)),
+		CreatedAt:    time.Now(),
+	})
+}
+
+// Passkey returns the metadata of a credential for modification. Credentials
+// registered before metadata was stored get a new entry.
+func (u *User) Passkey(credentialID []byte) *Passkey {
+	for i := range u.Passkeys {
+		if bytes.Equal(u.Passkeys[i].CredentialID, credentialID) {
+			return &u.Passkeys[i]
+		}
+	}
+	u.Passkeys = append(u.Passkeys, Passkey{CredentialID: credentialID, Name: "Passkey"})
+	return &u.Passkeys[len(u.Passkeys)-1]
+}
+
+// RemoveCredential deletes a credential and its metadata. It returns false if
+// the user has no such credential.
+func (u *User) RemoveCredential(credentialID []byte) bool {
+	found := false
+	credentials := u.Credentials[:0]
+	for _, cred := range u.Credentials {
+		if bytes.Equal(cred.ID, credentialID) {
+			found = true
+			continue
+		}
+		credentials = append(credentials, cred)
+	}
+	u.Credentials = credentials
+
+	passkeys := u.Passkeys[:0]
+	for _, passkey := range u.Passkeys {
+		if !bytes.Equal(passkey.CredentialID, credentialID) {
+			passkeys = append(passkeys, passkey)
+		}
+	}
+	u.Passkeys = passkeys
+	return found
+}
@@ -0,0 +1,47 @@
+package repo
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const CollectionPasswordResets = "password_resets"
+
+// PasswordReset is a pending request to reset a password, stored by the hash
+// of the token that was mailed to the user.
+type PasswordReset struct {
+	Hash      string    `bson:"_id"`
+	UserID    uuid.UUID `bson:"userId"`
+	CreatedAt time.Time `bson:"createdAt"`
+	ExpiresAt time.Time `bson:"expiresAt"`
+}
+
+func (r *MongoRepo) CreatePasswordReset(reset PasswordReset) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := r.resetCollection.InsertOne(ctx, reset)
+	return err
+}
+
+// TakePasswordReset returns and deletes the reset in one step, so it can only
+// be taken once.
+func (r *MongoRepo) TakePasswordReset(hash string) (PasswordReset, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var reset PasswordReset
+	err := r.resetCollection.FindOneAndDelete(ctx, bson.M{"_id": hash}).Decode(&reset)
+	if err != nil {
+		return PasswordReset{}, err
+	}
+	return reset, nil
+}
+
+func (r *MongoRepo) DeletePasswordResetsOfUser(userID uuid.UUID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := r.resetCollection.DeleteMany(ctx, bson.M{"userId": userID})
+	return err
+}
@@ -0,0 +1,45 @@
+package repo
+
+import (
+	"context"
+	"time"
+
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/notify"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const CollectionPreferences = "notification_preferences"
+
+// GetPreferences returns the notification preferences of the user or nil if
+// the user never saved any.
+func (r *MongoRepo) GetPreferences(userID uuid.UUID) (*notify.Preferences, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var preferences notify.Preferences
+	err := r.preferenceCollection.FindOne(ctx, bson.M{"_id": userID}).Decode(&preferences)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &preferences, nil
+}
+
+// SavePreferences replaces the notification preferences of the user.
+func (r *MongoRepo) SavePreferences(preferences notify.Preferences) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := r.preferenceCollection.ReplaceOne(ctx, bson.M{"_id": preferences.UserID}, preferences, options.Replace().SetUpsert(true))
+	return err
+}
+
+func (r *MongoRepo) DeletePreferences(userID uuid.UUID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := r.preferenceCollection.DeleteOne(ctx, bson.M{"_id": userID})
+	return err
+}
@@ -0,0 +1,56 @@
+package repo
+
+// Visibility controls who can see a field of a user's profile.
+type Visibility string
+
+const (
+	VisibilityPublic Visibility = "public"
+	// VisibilityRegistered shows the field to every logged in user.
+	VisibilityRegistered Visibility = "registered"
+	// VisibilityPartners shows the field to users who share a confirmed trip
+	// with the user.
+	VisibilityPartners Visibility = "partners"
+	VisibilityPrivate  Visibility = "private"
+)
+
+func (v Visibility) IsValid() bool {
+	switch v {
+	case VisibilityPublic, VisibilityRegistered, VisibilityPartners, VisibilityPrivate:
+		return true
+	}
+	return false
+}
+
+// PrivacySettings decide which profile fields other users can see. Empty
+// values fall back to DefaultPrivacySettings.
+type PrivacySettings struct {
+	// LastName is shown abbreviated to its first letter to everybody else.
+	LastName    Visibility `bson:"lastName,omitempty"    json:"lastName"`
+	Email       Visibility `bson:"email,omitempty"       json:"email"`
+	PhoneNumber Visibility `bson:"phoneNumber,omitempty" json:"phoneNumber"`
+	Age         Visibility `bson:"age,omitempty"         json:"age"`
+}
+
+var DefaultPrivacySettings = PrivacySettings{
+	LastName:    VisibilityPartners,
+	Email:       VisibilityPartners,
+	PhoneNumber: VisibilityPartners,
+	Age:         VisibilityPublic,
+}
+
+// WithDefaults fills unset fields with the default settings.
+func (p PrivacySettings) WithDefaults() PrivacySettings {
+	if p.LastName == "" {
+		p.LastName = DefaultPrivacySettings.LastName
+	}
+	if p.Email == "" {
+		p.Email = DefaultPrivacySettings.Email
+	}
+	if p.PhoneNumber == "" {
+		p.PhoneNumber = DefaultPrivacySettings.PhoneNumber
+	}
+	if p.Age == "" {
+		p.Age = DefaultPrivacySettings.Age
+	}
+	return p
+}
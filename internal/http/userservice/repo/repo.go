@@ -1,12 +1,81 @@
 package repo
 
-import "github.com/google/uuid"
+import (
+	"time"
+
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/audit"
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/notify"
+	"github.com/google/uuid"
+)
 
 type Repo interface {
 	CreateUser(user User) error
 	GetUserByID(id uuid.UUID) (User, error)
 	UpdateUser(user User) error
+	UpdateUserFields(user User, fields ...string) error
+	ReplacePasswordHash(userID uuid.UUID, oldHash string, newHash string) error
+	UseTOTPStep(userID uuid.UUID, step int64) error
+	UseRecoveryCode(userID uuid.UUID, hash string) error
 	DeleteUser(id uuid.UUID) error
 	GetUsers() ([]User, error)
+	FindUsers(query UserQuery) ([]User, error)
 	GetUserByEmail(email string) (User, error)
+	GetUserByIdentity(provider, subject string) (User, error)
+
+	CreateRefreshToken(token RefreshToken) error
+	GetRefreshToken(hash string) (RefreshToken, error)
+	MarkRefreshTokenUsed(hash string) error
+	DeleteRefreshTokenFamily(family uuid.UUID) error
+	DeleteRefreshTokensOfUser(userID uuid.UUID) error
+
+	CreateLoginSession(session LoginSession) error
+	GetLoginSession(id uuid.UUID) (LoginSession, error)
+	TouchLoginSession(id uuid.UUID, ip string, lastSeenAt time.Time, expiresAt time.Time) error
+	GetLoginSessionsOfUser(userID uuid.UUID) ([]LoginSession, error)
+	DeleteLoginSession(id uuid.UUID) error
+	DeleteLoginSessionsOfUser(userID uuid.UUID) error
+
+	CreatePasswordReset(reset PasswordReset) error
+	TakePasswordReset(hash string) (PasswordReset, error)
+	DeletePasswordResetsOfUser(userID uuid.UUID) error
+
+	CreateWebAuthnSession(session WebAuthnSession) error
+	TakeWebAuthnSession(hash string) (WebAuthnSession, error)
+
+	CreateOIDCSession(session OIDCSession) error
+	TakeOIDCSession(hash string) (OIDCSession, error)
+
+	CreateErasure(erasure Erasure) error
+	GetErasure(userID uuid.UUID) (Erasure, error)
+	UpdateErasureService(userID uuid.UUID, service string, state ErasureServiceState) error
+	GetIncompleteErasures() ([]Erasure, error)
+
+	CreateExport(export Export) error
+	UpdateExport(export Export) error
+	GetExport(id uuid.UUID) (Export, error)
+	GetExportsOfUser(userID uuid.UUID) ([]Export, error)
+	SaveExportArchive(export Export, archive []byte) error
+	GetExportArchive(archiveID uuid.UUID) ([]byte, error)
+	DeleteExpiredExportArchives(now time.Time) error
+	DeleteExportsOfUser(userID uuid.UUID) error
+
+	CreateVehicle(vehicle Vehicle) error
+	GetVehicle(id uuid.UUID) (Vehicle, error)
+	GetVehiclesOfOwner(ownerID uuid.UUID) ([]Vehicle, error)
+	UpdateVehicle(vehicle Vehicle) error
+	DeleteVehicle(id uuid.UUID) error
+	DeleteVehiclesOfOwner(ownerID uuid.UUID) error
+
+	CreateBlock(block Block) error
+	DeleteBlock(blockerID, blockedID uuid.UUID) error
+	GetBlocksOfUser(blockerID uuid.UUID) ([]Block, error)
+	GetBlocks() ([]Block, error)
+	DeleteBlocksOfUser(userID uuid.UUID) error
+
+	CreateAuditEvent(event audit.Event) error
+	FindAuditEvents(query AuditQuery) ([]audit.Event, error)
+
+	GetPreferences(userID uuid.UUID) (*notify.Preferences, error)
+	SavePreferences(preferences notify.Preferences) error
+	DeletePreferences(userID uuid.UUID) error
 }
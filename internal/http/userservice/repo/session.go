@@ -0,0 +1,42 @@
+package repo
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const CollectionWebAuthnSessions = "webauthn_sessions"
+
+// WebAuthnSession is the challenge of a running passkey registration or login,
+// stored by the hash of the session id handed out to the client. UserID is
+// empty for discoverable logins where the user is not known in advance.
+type WebAuthnSession struct {
+	Hash      string               `bson:"_id"`
+	UserID    uuid.UUID            `bson:"userId"`
+	Data      webauthn.SessionData `bson:"data"`
+	ExpiresAt time.Time            `bson:"expiresAt"`
+}
+
+func (r *MongoRepo) CreateWebAuthnSession(session WebAuthnSession) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := r.sessionCollection.InsertOne(ctx, session)
+	return err
+}
+
+// TakeWebAuthnSession returns and deletes a session, so every challenge can
+// only be answered once.
+func (r *MongoRepo) TakeWebAuthnSession(hash string) (WebAuthnSession, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var session WebAuthnSession
+	err := r.sessionCollection.FindOneAndDelete(ctx, bson.M{"_id": hash}).Decode(&session)
+	if err != nil {
+		return WebAuthnSession{}, err
+	}
+	return session, nil
+}
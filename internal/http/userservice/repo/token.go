@@ -0,0 +1,73 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const CollectionRefreshTokens = "refresh_tokens"
+
+// RefreshToken is stored by the hash of the token handed out to the client.
+// All tokens created by rotating the same login share a family, so the whole
+// chain can be revoked once a rotated token is reused.
+type RefreshToken struct {
+	Hash      string    `bson:"_id"       json:"-"`
+	UserID    uuid.UUID `bson:"userId"    json:"userId"`
+	Family    uuid.UUID `bson:"family"    json:"family"`
+	Used      bool      `bson:"used"      json:"used"`
+	CreatedAt time.Time `bson:"createdAt" json:"createdAt"`
+	ExpiresAt time.Time `bson:"expiresAt" json:"expiresAt"`
+}
+
+func (r *MongoRepo) CreateRefreshToken(token RefreshToken) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := r.tokenCollection.InsertOne(ctx, token)
+	return err
+}
+
+func (r *MongoRepo) GetRefreshToken(hash string) (RefreshToken, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var token RefreshToken
+	err := r.tokenCollection.FindOne(ctx, bson.M{"_id": hash}).Decode(&token)
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	return token, nil
+}
+
+// ERR_REFRESH_TOKEN_USED is returned if the token was used already, possibly
+// by a concurrent request.
+var ERR_REFRESH_TOKEN_USED = errors.New("refresh token already used")
+
+// MarkRefreshTokenUsed marks the token as used unless it is already, only
+// one of concurrent requests with the same token succeeds.
+func (r *MongoRepo) MarkRefreshTokenUsed(hash string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := r.tokenCollection.FindOneAndUpdate(ctx, bson.M{"_id": hash, "used": false}, bson.M{"$set": bson.M{"used": true}}).Err()
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return ERR_REFRESH_TOKEN_USED
+	}
+	return err
+}
+
+func (r *MongoRepo) DeleteRefreshTokenFamily(family uuid.UUID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := r.tokenCollection.DeleteMany(ctx, bson.M{"family": family})
+	return err
+}
+
+func (r *MongoRepo) DeleteRefreshTokensOfUser(userID uuid.UUID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := r.tokenCollection.DeleteMany(ctx, bson.M{"userId": userID})
+	return err
+}
@@ -0,0 +1,94 @@
+package repo
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const CollectionVehicles = "vehicles"
+
+// Dimensions of a trunk in centimeters.
+type Dimensions struct {
+	Width  float64 `bson:"width"  json:"width"`
+	Height float64 `bson:"height" json:"height"`
+	Depth  float64 `bson:"depth"  json:"depth"`
+}
+
+// Vehicle is a car a driver offers trips with. Seats are the seats available
+// for passengers, the driver is not counted.
+type Vehicle struct {
+	ID         uuid.UUID  `bson:"_id"        json:"id"`
+	OwnerID    uuid.UUID  `bson:"ownerId"    json:"ownerId"`
+	Make       string     `bson:"make"       json:"make"`
+	Model      string     `bson:"model"      json:"model"`
+	Plate      string     `bson:"plate"      json:"plate,omitempty"`
+	Seats      int        `bson:"seats"      json:"seats"`
+	Trunk      Dimensions `bson:"trunk"      json:"trunk"`
+	MaxPayload int        `bson:"maxPayload" json:"maxPayload"`
+	Features   []string   `bson:"features"   json:"features"`
+	// PhotosID is the compound id the photos are uploaded to in the media service.
+	PhotosID  string    `bson:"photosId"  json:"photosId"`
+	CreatedAt time.Time `bson:"createdAt" json:"createdAt"`
+}
+
+// Public hides the plate, which only the owner gets to see.
+func (v Vehicle) Public() Vehicle {
+	v.Plate = ""
+	return v
+}
+
+func (r *MongoRepo) CreateVehicle(vehicle Vehicle) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := r.vehicleCollection.InsertOne(ctx, vehicle)
+	return err
+}
+
+func (r *MongoRepo) GetVehicle(id uuid.UUID) (Vehicle, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var vehicle Vehicle
+	if err := r.vehicleCollection.FindOne(ctx, bson.M{"_id": id}).Decode(&vehicle); err != nil {
+		return Vehicle{}, err
+	}
+	return vehicle, nil
+}
+
+func (r *MongoRepo) GetVehiclesOfOwner(ownerID uuid.UUID) ([]Vehicle, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	cursor, err := r.vehicleCollection.Find(ctx, bson.M{"ownerId": ownerID}, options.Find().SetSort(bson.M{"createdAt": 1}))
+	if err != nil {
+		return nil, err
+	}
+	vehicles := []Vehicle{}
+	if err := cursor.All(ctx, &vehicles); err != nil {
+		return nil, err
+	}
+	return vehicles, nil
+}
+
+func (r *MongoRepo) UpdateVehicle(vehicle Vehicle) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := r.vehicleCollection.ReplaceOne(ctx, bson.M{"_id": vehicle.ID}, vehicle)
+	return err
+}
+
+func (r *MongoRepo) DeleteVehicle(id uuid.UUID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := r.vehicleCollection.DeleteOne(ctx, bson.M{"_id": id})
+	return err
+}
+
+func (r *MongoRepo) DeleteVehiclesOfOwner(ownerID uuid.UUID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := r.vehicleCollection.DeleteMany(ctx, bson.M{"ownerId": ownerID})
+	return err
+}
@@ -0,0 +1,165 @@
+package userservice
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/http/userservice/repo"
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/middleware/auth"
+	"github.com/google/uuid"
+)
+
+var ERR_SESSION_NOT_FOUND = errors.New("session not found")
+
+// SessionInfo is a login of the user as shown in the session list. LastSeenAt
+// is updated whenever the access token is refreshed.
+type SessionInfo struct {
+	repo.LoginSession
+	Current bool `json:"current"`
+}
+
+// ListSessions returns the devices the user is logged in on, most recently
+// used first. current is the session of the request.
+func (s *UserService) ListSessions(userID uuid.UUID, current uuid.UUID) ([]SessionInfo, error) {
+	sessions, err := s.repo.GetLoginSessionsOfUser(userID)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]SessionInfo, 0, len(sessions))
+	now := time.Now()
+	for _, session := range sessions {
+		// mongo removes expired documents only periodically
+		if session.ExpiresAt.Before(now) {
+			continue
+		}
+		result = append(result, SessionInfo{LoginSession: session, Current: session.ID == current})
+	}
+	return result, nil
+}
+
+// RevokeSession logs the user out on one device.
+func (s *UserService) RevokeSession(userID uuid.UUID, sessionID uuid.UUID) error {
+	session, err := s.repo.GetLoginSession(sessionID)
+	if err != nil || session.UserID != userID {
+		return ERR_SESSION_NOT_FOUND
+	}
+	return s.revokeSessions(sessionID)
+}
+
+// RevokeOtherSessions logs the user out on every device but the current one
+// and returns how many sessions were ended.
+func (s *UserService) RevokeOtherSessions(userID uuid.UUID, current uuid.UUID) (int, error) {
+	sessions, err := s.repo.GetLoginSessionsOfUser(userID)
+	if err != nil {
+		return 0, err
+	}
+	var ids []uuid.UUID
+	for _, session := range sessions {
+		if session.ID != current {
+			ids = append(ids, session.ID)
+		}
+	}
+	return len(ids), s.revokeSessions(ids...)
+}
+
+// RevokeAllSessions logs the user out of every device.
+func (s *UserService) RevokeAllSessions(userID uuid.UUID) error {
+	sessions, err := s.repo.GetLoginSessionsOfUser(userID)
+	if err != nil {
+		return err
+	}
+	ids := make([]uuid.UUID, 0, len(sessions))
+	for _, session := range sessions {
+		ids = append(ids, session.ID)
+	}
+	if err := s.revokeSessions(ids...); err != nil {
+		return err
+	}
+	// refresh tokens of logins from before sessions were recorded
+	if err := s.repo.DeleteRefreshTokensOfUser(userID); err != nil {
+		return err
+	}
+	return s.repo.DeleteLoginSessionsOfUser(userID)
+}
+
+// revokeSessions deletes the refresh tokens and records of the sessions and
+// announces them on auth.RevocationSubject, so every service rejects their
+// access tokens until those have expired.
+func (s *UserService) revokeSessions(ids ...uuid.UUID) error {
+	for _, id := range ids {
+		if err := s.repo.DeleteRefreshTokenFamily(id); err != nil {
+			return err
+		}
+		if err := s.repo.DeleteLoginSession(id); err != nil {
+			return err
+		}
+		if s.publisher == nil {
+			continue
+		}
+		revocation := auth.Revocation{SessionID: id.String(), ExpiresAt: time.Now().Add(AccessTokenTTL)}
+		if err := auth.PublishRevocation(s.publisher, revocation); err != nil {
+			log.Printf("Failed to announce revoked session %s: %v", id, err)
+		}
+	}
+	return nil
+}
+
+// touchSession records that the session of the refresh token was used. Logins
+// from before sessions were recorded get a session on their first refresh.
+func (s *UserService) touchSession(token repo.RefreshToken, ip string) error {
+	now := time.Now()
+	if _, err := s.repo.GetLoginSession(token.Family); err != nil {
+		return s.repo.CreateLoginSession(repo.LoginSession{
+			ID:         token.Family,
+			UserID:     token.UserID,
+			Device:     deviceName(""),
+			IP:         ip,
+			CreatedAt:  token.CreatedAt,
+			LastSeenAt: now,
+			ExpiresAt:  now.Add(RefreshTokenTTL),
+		})
+	}
+	return s.repo.TouchLoginSession(token.Family, ip, now, now.Add(RefreshTokenTTL))
+}
+
+// deviceName turns a user agent into a short label like "Firefox on Windows".
+func deviceName(userAgent string) string {
+	ua := strings.ToLower(userAgent)
+	browser := "Unknown browser"
+	for _, candidate := range []struct{ token, name string }{
+		// order matters, e.g. Edge and Opera also claim to be Chrome
+		{"edg/", "Edge"},
+		{"opr/", "Opera"},
+		{"firefox/", "Firefox"},
+		{"chrome/", "Chrome"},
+		{"safari/", "Safari"},
+		{"okhttp", "Android app"},
+		{"cfnetwork", "iOS app"},
+		{"curl/", "curl"},
+	} {
+		if strings.Contains(ua, candidate.token) {
+			browser = candidate.name
+			break
+		}
+	}
+	system := ""
+	for _, candidate := range []struct{ token, name string }{
+		{"android", "Android"},
+		{"iphone", "iOS"},
+		{"ipad", "iPadOS"},
+		{"windows", "Windows"},
+		{"mac os x", "macOS"},
+		{"linux", "Linux"},
+	} {
+		if strings.Contains(ua, candidate.token) {
+			system = candidate.name
+			break
+		}
+	}
+	if system == "" {
+		return browser
+	}
+	return browser + " on " + system
+}
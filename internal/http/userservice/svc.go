@@ -4,10 +4,15 @@ import (
 	"errors"
 	"log"
 	"os"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/hasher"
 	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/http/userservice/repo"
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/mailer"
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/middleware/auth"
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/oidc"
 	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/google/uuid"
 	"github.com/joho/godotenv"
@@ -16,6 +21,20 @@ import (
 type UserService struct {
 	repo    repo.Repo
 	webauth *webauthn.WebAuthn
+	mailer  mailer.Mailer
+	baseURL string
+
+	accountThrottle *LoginThrottle
+	ipThrottle      *LoginThrottle
+	publisher       Publisher
+	partners        PartnerChecker
+	collector       DataCollector
+	oidcProviders   map[string]*oidc.Provider
+	passwordPolicy  PasswordPolicy
+	passwordParams  hasher.Params
+	// dummyHash is compared against when the user does not exist, so unknown
+	// accounts take as long to reject as wrong passwords.
+	dummyHash string
 }
 
 func NewUserService(repo repo.Repo) *UserService {
@@ -30,25 +49,60 @@ func NewUserService(repo repo.Repo) *UserService {
 	BASE_URL = strings.TrimSuffix(BASE_URL, "/")
 	BASE_URL = strings.ReplaceAll(BASE_URL, "\n", "")
 
-	wauth, err := webauthn.New(
-		&webauthn.Config{
-			RPID:          "localhost",
-			RPDisplayName: "Example",
-			RPOrigins:     []string{BASE_URL},
-		},
-	)
+	wauth, err := newWebAuthn(BASE_URL)
 	if err != nil {
 		panic("failed to create webauthn instance: " + err.Error())
 	}
+	policy, err := newPasswordPolicy()
+	if err != nil {
+		panic("failed to load password policy: " + err.Error())
+	}
+	params, err := newPasswordParams()
+	if err != nil {
+		panic("failed to configure password hashing: " + err.Error())
+	}
 
-	return &UserService{
+	s := &UserService{
 		repo:    repo,
 		webauth: wauth,
+		mailer:  newMailer(),
+		baseURL: BASE_URL,
+
+		oidcProviders:   newOIDCProviders(BASE_URL),
+		partners:        newOfferPartners(os.Getenv("ANGEBOT_SERVICE")),
+		accountThrottle: NewLoginThrottle(3, 10, 15*time.Minute),
+		ipThrottle:      NewLoginThrottle(20, 100, 15*time.Minute),
+		passwordPolicy:  policy,
 	}
+	return s.WithPasswordHashing(params)
+}
+
+// newMailer chooses the mailer from the environment: SMTP if a host is set,
+// otherwise files in MAIL_DIR and as a last resort memory only.
+func newMailer() mailer.Mailer {
+	if host := os.Getenv("SMTP_HOST"); host != "" {
+		return mailer.NewSMTPMailer(
+			host,
+			os.Getenv("SMTP_PORT"),
+			os.Getenv("SMTP_USER"),
+			os.Getenv("SMTP_PASSWORD"),
+			os.Getenv("MAIL_FROM"),
+		)
+	}
+	if dir := os.Getenv("MAIL_DIR"); dir != "" {
+		return mailer.NewFileMailer(dir)
+	}
+	log.Println("No mailer configured, mails are only kept in memory")
+	return mailer.NewMemoryMailer()
+}
+
+func (s *UserService) WithMailer(m mailer.Mailer) *UserService {
+	s.mailer = m
+	return s
 }
 
 func (s *UserService) SaveUser(user repo.User) error {
-	hashedPassword, err := hasher.HashPassword(user.Password)
+	hashedPassword, err := s.hashPassword(user.Password)
 	if err != nil {
 		return err
 	}
@@ -60,29 +114,54 @@ func (s *UserService) GetUserByID(id uuid.UUID) (repo.User, error) {
 	return s.repo.GetUserByID(id)
 }
 
-func (s *UserService) UpdateUser(userid uuid.UUID, user repo.User) error {
-	user.ID = userid
-	hashedPassword, err := hasher.HashPassword(user.Password)
+// UpdateUser replaces the profile of the user. The password, the roles, the
+// second factors and linked accounts have their own endpoints and are kept. A changed email
+// is only used once it has been confirmed, emailChanged reports that a
+// verification mail has to be sent to it.
+func (s *UserService) UpdateUser(userid uuid.UUID, user repo.User) (emailChanged bool, err error) {
+	existing, err := s.repo.GetUserByID(userid)
 	if err != nil {
-		return err
+		return false, err
 	}
-	user.Password = hashedPassword
-	return s.repo.UpdateUser(user)
-}
+	user.ID = userid
+	// the privacy settings decide which names are searchable
+	user.Privacy = existing.Privacy
 
-func (s *UserService) DeleteUser(id uuid.UUID) error {
-	return s.repo.DeleteUser(id)
+	email := user.Email
+	user.Email = existing.Email
+	user.PendingEmail = existing.PendingEmail
+	if email != "" {
+		emailChanged, err = s.requestEmailChange(&user, email)
+		if err != nil {
+			return false, err
+		}
+	}
+	return emailChanged, s.repo.UpdateUserFields(user, profileFields...)
 }
 
+// profileFields are the fields UpdateUser replaces.
+var profileFields = []string{"firstName", "lastName", "birthDate", "phoneNumber", "profilePicture", "pendingEmail"}
+
 var ERR_EMAIL_ALREADY_EXISTS = errors.New("email already exists")
 
+// CreateUser registers a new user. The password has to satisfy the policy.
 func (s *UserService) CreateUser(user repo.User) error {
+	if err := s.CheckPassword(user.Password); err != nil {
+		return err
+	}
 	temp, _ := s.repo.GetUserByEmail(user.Email)
 	if temp.ID != uuid.Nil {
 		return ERR_EMAIL_ALREADY_EXISTS
 	}
+	user.Verified = false
+	user.PendingEmail = ""
+	user.Roles = []string{auth.RoleUser}
+	user.TOTPEnabled = false
+	user.TOTPSecret = ""
+	user.RecoveryCodes = nil
+	user.Identities = nil
 
-	hashedPassword, err := hasher.HashPassword(user.Password)
+	hashedPassword, err := s.hashPassword(user.Password)
 	if err != nil {
 		return err
 	}
@@ -90,16 +169,22 @@ func (s *UserService) CreateUser(user repo.User) error {
 	return s.repo.CreateUser(user)
 }
 
-func (s *UserService) GetUsers() ([]repo.User, error) {
-	users, err := s.repo.GetUsers()
+var ERR_INVALID_ROLE = errors.New("invalid role")
+
+// SetRoles replaces the roles of a user. Every user keeps the user role.
+func (s *UserService) SetRoles(id uuid.UUID, roles []string) error {
+	user, err := s.repo.GetUserByID(id)
 	if err != nil {
-		return []repo.User{}, err
-	}
-	if users == nil {
-		return []repo.User{}, nil
+		return err
 	}
-	for i := range len(users) {
-		users[i].Password = ""
+	user.Roles = []string{auth.RoleUser}
+	for _, role := range roles {
+		if !auth.IsValidRole(role) {
+			return ERR_INVALID_ROLE
+		}
+		if !slices.Contains(user.Roles, role) {
+			user.Roles = append(user.Roles, role)
+		}
 	}
-	return users, nil
+	return s.repo.UpdateUserFields(user, "roles")
 }
@@ -1,19 +1,44 @@
 package userservice
 
 import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"os"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/audit"
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/blocking"
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/breached"
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/erasure"
 	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/hasher"
 	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/http/userservice/repo"
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/mailer"
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/middleware/auth"
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/notify"
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/oidc"
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/oidc/oidctest"
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/totp"
+	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/google/uuid"
 )
 
-var svc *UserService
+var (
+	svc   *UserService
+	mails *mailer.MemoryMailer
+)
 
 func TestMain(m *testing.M) {
 	repo := repo.NewMockRepo()
-	svc = NewUserService(repo)
+	mails = mailer.NewMemoryMailer()
+	svc = NewUserService(repo).WithMailer(mails)
 	os.Exit(m.Run())
 }
 
@@ -97,30 +122,231 @@ func TestUserService_UpdateUser(t *testing.T) {
 		t.Errorf("passwords should match but verification failed: %v", err)
 	}
 
-	newPassword := "new password"
-	user.Password = newPassword
+	// passwords are only changed through ChangePassword
+	user.FirstName = "Erika"
+	user.Password = "new password"
 
-	err = svc.UpdateUser(user.ID, user)
+	emailChanged, err := svc.UpdateUser(user.ID, user)
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
 	}
+	if emailChanged {
+		t.Errorf("email should not have changed")
+	}
 
 	got, err = svc.GetUserByID(id)
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
 	}
 
-	if got.ID != id {
-		t.Errorf("unexpected ID: %v", got.ID)
+	if got.FirstName != "Erika" {
+		t.Errorf("unexpected first name: %v", got.FirstName)
 	}
 
-	if got.Password == user.Password {
-		t.Errorf("passwords should be hashed: %v", got.Password)
+	if err := hasher.VerifyPassword(got.Password, password); err != nil {
+		t.Errorf("password should be kept but verification failed: %v", err)
+	}
+}
+
+func TestUserService_PatchUser(t *testing.T) {
+	id := uuid.New()
+	email := uuid.New().String() + "@example.com"
+	password := "some password"
+	if err := svc.CreateUser(repo.User{ID: id, Email: email, Password: password, FirstName: "Max", LastName: "Mustermann", PhoneNumber: "0123"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
 	}
 
-	if err := hasher.VerifyPassword(got.Password, newPassword); err != nil {
-		t.Errorf("passwords should match but verification failed: %v", err)
+	emailChanged, err := svc.PatchUser(id, []byte(`{"firstName": "Moritz", "phoneNumber": null, "privacy": {"age": "private"}}`))
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if emailChanged {
+		t.Errorf("email should not have changed")
+	}
+	got, _ := svc.GetUserByID(id)
+	if got.FirstName != "Moritz" || got.LastName != "Mustermann" || got.PhoneNumber != "" {
+		t.Errorf("unexpected user after patch: %+v", got)
+	}
+	if got.Privacy.Age != repo.VisibilityPrivate || got.Privacy.WithDefaults().Email != repo.VisibilityPartners {
+		t.Errorf("unexpected privacy after patch: %+v", got.Privacy)
+	}
+	if err := hasher.VerifyPassword(got.Password, password); err != nil {
+		t.Errorf("password should be kept but verification failed: %v", err)
+	}
+
+	for patch, want := range map[string]error{
+		`{"password": "new password"}`: ERR_READ_ONLY_FIELD,
+		`{"roles": ["admin"]}`:         ERR_READ_ONLY_FIELD,
+		`{"unknown": 1}`:               ERR_INVALID_PATCH,
+		`{"firstName": 1}`:             ERR_INVALID_PATCH,
+		`["firstName"]`:                ERR_INVALID_PATCH,
+		`{"email": null}`:              ERR_INVALID_EMAIL,
+		`{"email": "not an email"}`:    ERR_INVALID_EMAIL,
+		`{"privacy": {"age": "all"}}`:  ERR_INVALID_VISIBILITY,
+	} {
+		if _, err := svc.PatchUser(id, []byte(patch)); !errors.Is(err, want) {
+			t.Errorf("patch %s: expected %v but got %v", patch, want, err)
+		}
+	}
+	if got, _ := svc.GetUserByID(id); got.FirstName != "Moritz" || len(got.Roles) != 1 {
+		t.Errorf("rejected patches should not change the user: %+v", got)
+	}
+}
+
+// staleRepo reads the user as it was before concurrent changes.
+type staleRepo struct {
+	repo.Repo
+	user repo.User
+}
+
+func (r staleRepo) GetUserByID(id uuid.UUID) (repo.User, error) {
+	return r.user, nil
+}
+
+func TestUserService_PatchUser_Concurrent(t *testing.T) {
+	users := repo.NewMockRepo()
+	id := uuid.New()
+	if err := NewUserService(users).CreateUser(repo.User{ID: id, Email: uuid.New().String() + "@example.com", Password: "some password"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	before, _ := users.GetUserByID(id)
+	if err := NewUserService(users).SetRoles(id, []string{auth.RoleModerator}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	stale := NewUserService(staleRepo{Repo: users, user: before})
+	if _, err := stale.PatchUser(id, []byte(`{"firstName": "Moritz"}`)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := stale.UpdateUser(id, repo.User{FirstName: "Max", LastName: "Mustermann"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got, _ := users.GetUserByID(id)
+	if got.FirstName != "Max" || got.LastName != "Mustermann" || !slices.Contains(got.Roles, auth.RoleModerator) {
+		t.Errorf("expected the profile to change and the roles to be kept: %+v", got)
+	}
+	if len(got.NameKeys) != 1 || got.NameKeys[0] != "max" {
+		t.Errorf("expected the search keys to follow the name: %v", got.NameKeys)
+	}
+}
+
+func TestUserService_VerifyEmail_Concurrent(t *testing.T) {
+	users := repo.NewMockRepo()
+	id := uuid.New()
+	email := uuid.New().String() + "@example.com"
+	if err := NewUserService(users).CreateUser(repo.User{ID: id, Email: email, Password: "some password"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	before, _ := users.GetUserByID(id)
+	if err := NewUserService(users).SetRoles(id, []string{auth.RoleModerator}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	stale := NewUserService(staleRepo{Repo: users, user: before})
+	if err := stale.VerifyEmail(id, email); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got, _ := users.GetUserByID(id)
+	if !got.Verified || !slices.Contains(got.Roles, auth.RoleModerator) {
+		t.Errorf("expected the email to be verified and the roles to be kept: %+v", got)
+	}
+}
+
+func TestUserService_ChangeEmail(t *testing.T) {
+	id := uuid.New()
+	email := uuid.New().String() + "@example.com"
+	if err := svc.CreateUser(repo.User{ID: id, Email: email, Password: "some password"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := svc.VerifyEmail(id, email); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	taken := uuid.New().String() + "@example.com"
+	if err := svc.CreateUser(repo.User{ID: uuid.New(), Email: taken, Password: "some password"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := svc.PatchUser(id, []byte(`{"email": "`+taken+`"}`)); err != ERR_EMAIL_ALREADY_EXISTS {
+		t.Errorf("expected email already exists but got: %v", err)
+	}
+
+	newEmail := uuid.New().String() + "@example.com"
+	emailChanged, err := svc.PatchUser(id, []byte(`{"email": "`+newEmail+`"}`))
+	if err != nil || !emailChanged {
+		t.Fatalf("expected email change but got: %v, %v", emailChanged, err)
+	}
+	got, _ := svc.GetUserByID(id)
+	if got.Email != email || !got.Verified || got.PendingEmail != newEmail {
+		t.Errorf("new email should be pending until confirmed: %+v", got)
+	}
+
+	if err := svc.SendVerificationMail(got, "some-token"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if len(mails.Messages(newEmail)) != 1 {
+		t.Errorf("expected verification mail to the new email but got %d", len(mails.Messages(newEmail)))
+	}
+
+	if err := svc.VerifyEmail(id, newEmail); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	got, _ = svc.GetUserByID(id)
+	if got.Email != newEmail || !got.Verified || got.PendingEmail != "" {
+		t.Errorf("new email should be confirmed: %+v", got)
 	}
+	if len(mails.Messages(email)) != 1 {
+		t.Errorf("expected notice to the previous email but got %d", len(mails.Messages(email)))
+	}
+	// links for the old address no longer work
+	if err := svc.VerifyEmail(id, email); err != ERR_INVALID_VERIFICATION {
+		t.Errorf("expected invalid verification but got: %v", err)
+	}
+}
+
+func TestUserService_ChangePassword(t *testing.T) {
+	id := uuid.New()
+	email := uuid.New().String() + "@example.com"
+	password := "some password"
+	if err := svc.CreateUser(repo.User{ID: id, Email: email, Password: password}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, token, err := svc.StartSession(id, "", "192.0.2.1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := svc.ChangePassword(id, "wrong password", "new password", "192.0.2.40"); err != ERR_WRONG_PASSWORD {
+		t.Errorf("expected wrong password but got: %v", err)
+	}
+	if err := svc.ChangePassword(id, password, "", "192.0.2.40"); err != ERR_EMPTY_PASSWORD {
+		t.Errorf("expected empty password but got: %v", err)
+	}
+	if err := svc.ChangePassword(id, password, "new password", "192.0.2.40"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	got, _ := svc.GetUserByID(id)
+	if err := hasher.VerifyPassword(got.Password, "new password"); err != nil {
+		t.Errorf("new password should be set but verification failed: %v", err)
+	}
+	if _, _, _, err := svc.RotateRefreshToken(token, "192.0.2.1"); err != ERR_INVALID_REFRESH_TOKEN {
+		t.Errorf("refresh tokens should be revoked but got: %v", err)
+	}
+
+	// the password is changed even if the mail is not sent
+	failing := NewUserService(repo.NewMockRepo()).WithMailer(failingMailer{})
+	if err := failing.CreateUser(repo.User{ID: id, Email: email, Password: password}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := failing.ChangePassword(id, password, "new password", "192.0.2.40"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+type failingMailer struct{}
+
+func (failingMailer) Send(mailer.Message) error {
+	return errors.New("mail server unavailable")
 }
 
 func TestUserService_DeleteUser(t *testing.T) {
@@ -148,3 +374,1399 @@ func TestUserService_DeleteUser(t *testing.T) {
 		t.Errorf("expected error but got none")
 	}
 }
+
+func TestUserService_Vehicles(t *testing.T) {
+	owner, other := uuid.New(), uuid.New()
+	for _, id := range []uuid.UUID{owner, other} {
+		if err := svc.CreateUser(repo.User{ID: id, Email: id.String() + "@example.com", Password: "some password"}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	if _, err := svc.CreateVehicle(owner, repo.Vehicle{Make: "VW", Seats: 4}); !errors.Is(err, ERR_INVALID_VEHICLE) {
+		t.Errorf("expected invalid vehicle without model but got: %v", err)
+	}
+	if _, err := svc.CreateVehicle(owner, repo.Vehicle{Make: "VW", Model: "Golf", Seats: 12}); !errors.Is(err, ERR_INVALID_VEHICLE) {
+		t.Errorf("expected invalid vehicle with too many seats but got: %v", err)
+	}
+
+	vehicle, err := svc.CreateVehicle(owner, repo.Vehicle{
+		Make:       " VW ",
+		Model:      "Golf",
+		Plate:      "gi  ab 123",
+		Seats:      4,
+		Trunk:      repo.Dimensions{Width: 100, Height: 50, Depth: 80},
+		MaxPayload: 400,
+		Features:   []string{"Klimaanlage", " "},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if vehicle.OwnerID != owner || vehicle.PhotosID == "" || vehicle.Make != "VW" || vehicle.Plate != "GI AB 123" || len(vehicle.Features) != 1 {
+		t.Errorf("vehicle should be normalized: %+v", vehicle)
+	}
+	if _, err := svc.CreateVehicle(owner, repo.Vehicle{Make: "Opel", Model: "Astra", Plate: "GI AB 123"}); err != ERR_DUPLICATE_PLATE {
+		t.Errorf("expected duplicate plate but got: %v", err)
+	}
+
+	got, err := svc.GetVehicle(other, vehicle.ID)
+	if err != nil || got.Plate != "" || got.Seats != 4 {
+		t.Errorf("others should not see the plate: %+v, %v", got, err)
+	}
+	if got, _ := svc.GetVehicle(owner, vehicle.ID); got.Plate != vehicle.Plate {
+		t.Errorf("owner should see the plate: %+v", got)
+	}
+
+	if _, err := svc.UpdateVehicle(other, vehicle.ID, repo.Vehicle{Make: "VW", Model: "Polo"}); err != ERR_VEHICLE_NOT_FOUND {
+		t.Errorf("expected vehicle not found for other user but got: %v", err)
+	}
+	updated, err := svc.UpdateVehicle(owner, vehicle.ID, repo.Vehicle{Make: "VW", Model: "Polo", Plate: vehicle.Plate, Seats: 3})
+	if err != nil || updated.Model != "Polo" || updated.PhotosID != vehicle.PhotosID || !updated.CreatedAt.Equal(vehicle.CreatedAt) {
+		t.Errorf("unexpected update: %+v, %v", updated, err)
+	}
+
+	if err := svc.DeleteVehicle(other, vehicle.ID); err != ERR_VEHICLE_NOT_FOUND {
+		t.Errorf("expected vehicle not found for other user but got: %v", err)
+	}
+	if err := svc.DeleteUser(owner); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if vehicles, _ := svc.ListVehicles(owner); len(vehicles) != 0 {
+		t.Errorf("vehicles of deleted user should be removed: %+v", vehicles)
+	}
+}
+
+func TestUserService_Erasure(t *testing.T) {
+	users := repo.NewMockRepo()
+	publisher := &recordingPublisher{}
+	service := NewUserService(users).WithMailer(mailer.NewMemoryMailer()).WithPublisher(publisher)
+
+	id := uuid.New()
+	if err := service.CreateUser(repo.User{ID: id, Email: uuid.New().String() + "@example.com", Password: "some password"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, token, err := service.StartSession(id, "", "192.0.2.1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := service.ErasureStatus(id); err != ERR_ERASURE_NOT_FOUND {
+		t.Errorf("expected no erasure but got: %v", err)
+	}
+
+	if err := service.DeleteUser(id); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// the session of the user is revoked before the deletion is announced
+	if !slices.Equal(publisher.Subjects(), []string{auth.RevocationSubject, erasure.DeletedSubject}) {
+		t.Errorf("expected deletion to be announced but got %v", publisher.Subjects())
+	}
+	if _, _, _, err := service.RotateRefreshToken(token, "192.0.2.1"); err != ERR_INVALID_REFRESH_TOKEN {
+		t.Errorf("refresh tokens should be deleted but got: %v", err)
+	}
+
+	status, err := service.ErasureStatus(id)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(status.Services) != len(erasure.Services) || status.Completed() {
+		t.Errorf("all services should be pending: %+v", status)
+	}
+
+	for i, name := range erasure.Services {
+		report := erasure.Report{UserID: id, Service: name, Status: erasure.StatusDone}
+		if i == 0 {
+			report.Status = erasure.StatusFailed
+			report.Error = "mongo unavailable"
+		}
+		if err := service.RecordErasureReport(report); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+	status, _ = service.ErasureStatus(id)
+	if status.Completed() || status.Services[erasure.Services[0]].Error != "mongo unavailable" {
+		t.Errorf("failed service should keep the erasure incomplete: %+v", status)
+	}
+
+	// only erasures older than the retry delay are announced again
+	if err := service.RetryErasures(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if len(publisher.Subjects()) != 2 {
+		t.Errorf("recent erasure should not be retried yet but got %v", publisher.Subjects())
+	}
+	status.DeletedAt = status.DeletedAt.Add(-ErasureRetryDelay)
+	if err := users.CreateErasure(status); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := service.RetryErasures(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if len(publisher.Subjects()) != 3 {
+		t.Errorf("expected deletion to be announced again but got %v", publisher.Subjects())
+	}
+
+	// a repeated failure does not undo finished services
+	if err := service.RecordErasureReport(erasure.Report{UserID: id, Service: erasure.Services[1], Status: erasure.StatusFailed}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := service.RecordErasureReport(erasure.Report{UserID: id, Service: erasure.Services[0], Status: erasure.StatusDone}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if status, _ := service.ErasureStatus(id); !status.Completed() {
+		t.Errorf("erasure should be completed: %+v", status)
+	}
+}
+
+type fakeCollector struct {
+	data map[string]string
+}
+
+func (c *fakeCollector) Collect(service string, userID uuid.UUID) (json.RawMessage, error) {
+	data, ok := c.data[service]
+	if !ok {
+		return nil, fmt.Errorf("%s timed out", service)
+	}
+	return json.RawMessage(data), nil
+}
+
+func TestUserService_Export(t *testing.T) {
+	publisher := &recordingPublisher{}
+	service := NewUserService(repo.NewMockRepo()).
+		WithMailer(mailer.NewMemoryMailer()).
+		WithPublisher(publisher).
+		WithCollector(&fakeCollector{data: map[string]string{
+			erasure.ServiceOffers:  `{"created": []}`,
+			erasure.ServiceRatings: `{"given": [], "received": []}`,
+		}})
+
+	id := uuid.New()
+	if err := service.CreateUser(repo.User{ID: id, Email: uuid.New().String() + "@example.com", Password: "some password", FirstName: "Max"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	export, err := service.StartExport(id)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := service.GetExport(uuid.New(), export.ID); err != ERR_EXPORT_NOT_FOUND {
+		t.Errorf("exports of other users should not be found but got: %v", err)
+	}
+	// the user is notified once the export is finished
+	for deadline := time.Now().Add(5 * time.Second); len(publisher.Subjects()) == 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if subjects := publisher.Subjects(); len(subjects) != 1 || subjects[0] != "user."+id.String() {
+		t.Fatalf("expected notification on user subject but got %v", subjects)
+	}
+	export, _ = service.GetExport(id, export.ID)
+	if export.Status != repo.ExportReady {
+		t.Fatalf("export should be ready but is %s: %s", export.Status, export.Error)
+	}
+
+	data, err := service.ExportArchive(id, export.ID)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("export should be a zip archive: %v", err)
+	}
+	files := map[string][]byte{}
+	for _, file := range archive.File {
+		f, err := file.Open()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		files[file.Name], _ = io.ReadAll(f)
+		f.Close()
+	}
+	for _, name := range []string{"profile.json", "angebot.json", "rating.json", "manifest.json"} {
+		if _, ok := files[name]; !ok {
+			t.Errorf("expected %s in export", name)
+		}
+	}
+
+	var profile ExportProfile
+	if err := json.Unmarshal(files["profile.json"], &profile); err != nil || profile.ID != id || profile.FirstName != "Max" {
+		t.Errorf("unexpected profile %s: %v", files["profile.json"], err)
+	}
+	if strings.Contains(string(files["profile.json"]), "password") {
+		t.Errorf("export should not contain the password hash")
+	}
+	var manifest ExportManifest
+	if err := json.Unmarshal(files["manifest.json"], &manifest); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if manifest.Errors[erasure.ServiceChat] == "" || manifest.Errors[erasure.ServiceOffers] != "" {
+		t.Errorf("manifest should list the services that did not answer: %v", manifest.Errors)
+	}
+
+	// exports are removed with the account
+	if err := service.DeleteUser(id); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := service.GetExport(id, export.ID); err != ERR_EXPORT_NOT_FOUND {
+		t.Errorf("export should be deleted but got: %v", err)
+	}
+}
+
+func TestUserService_ExportLimit(t *testing.T) {
+	service := NewUserService(repo.NewMockRepo()).
+		WithMailer(mailer.NewMemoryMailer()).
+		WithCollector(&fakeCollector{})
+
+	id := uuid.New()
+	if err := service.CreateUser(repo.User{ID: id, Email: uuid.New().String() + "@example.com", Password: "some password"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i := 0; i < MaxExports; i++ {
+		if _, err := service.StartExport(id); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	_, err := service.StartExport(id)
+	limit, ok := err.(*ExportLimitError)
+	if !ok {
+		t.Fatalf("expected export limit but got: %v", err)
+	}
+	if limit.RetryAfter <= 0 || limit.RetryAfter > ExportWindow {
+		t.Errorf("unexpected retry after %s", limit.RetryAfter)
+	}
+}
+
+func TestUserService_OIDCLogin(t *testing.T) {
+	idp := oidctest.New("cargonaut")
+	defer idp.Close()
+	svc.WithOIDCProvider(oidc.Config{Name: "fake", Issuer: idp.Issuer(), ClientID: "cargonaut", RedirectURL: "http://localhost/login/oidc/fake"})
+	if !slices.Contains(svc.OIDCProviders(), "fake") {
+		t.Fatalf("provider should be listed: %v", svc.OIDCProviders())
+	}
+	if _, _, err := svc.BeginOIDCLogin("unknown"); err != ERR_UNKNOWN_PROVIDER {
+		t.Errorf("expected unknown provider but got: %v", err)
+	}
+
+	ip := "oidc-" + uuid.NewString()
+	login := func(user oidctest.User) (repo.User, string, error) {
+		idp.SetUser(user)
+		authURL, binding, err := svc.BeginOIDCLogin("fake")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		code, state, err := idp.Authorize(authURL)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		got, err := svc.FinishOIDCLogin("fake", state, binding, code, ip)
+		return got, state, err
+	}
+
+	// unknown account with a verified email creates a verified user
+	external := oidctest.User{Subject: uuid.NewString(), Email: uuid.NewString() + "@example.com", EmailVerified: true, GivenName: "Erika", FamilyName: "Mustermann"}
+	created, state, err := login(external)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !created.Verified || created.Email != external.Email || created.FirstName != "Erika" || len(created.Identities) != 1 {
+		t.Errorf("unexpected user: %+v", created)
+	}
+	if _, err := svc.FinishOIDCLogin("fake", state, hasher.HashToken(state), "", ip); err != ERR_INVALID_OIDC_SESSION {
+		t.Errorf("state should only be usable once but got: %v", err)
+	}
+	again, _, err := login(external)
+	if err != nil || again.ID != created.ID {
+		t.Errorf("same account should log in the same user: %v, %v", again.ID, err)
+	}
+
+	// codes are bound to the PKCE verifier of the login they were issued for
+	idp.SetUser(external)
+	first, _, _ := svc.BeginOIDCLogin("fake")
+	second, secondBinding, _ := svc.BeginOIDCLogin("fake")
+	code, _, _ := idp.Authorize(first)
+	_, secondState, _ := idp.Authorize(second)
+	if _, err := svc.FinishOIDCLogin("fake", secondState, secondBinding, code, ip); err != ERR_OIDC_LOGIN_FAILED {
+		t.Errorf("expected failed login for a code of another login but got: %v", err)
+	}
+
+	// a state can only be finished by the browser that started the login
+	third, _, _ := svc.BeginOIDCLogin("fake")
+	_, ownBinding, _ := svc.BeginOIDCLogin("fake")
+	code, thirdState, _ := idp.Authorize(third)
+	for _, binding := range []string{"", ownBinding} {
+		if _, err := svc.FinishOIDCLogin("fake", thirdState, binding, code, ip); err != ERR_INVALID_OIDC_SESSION {
+			t.Errorf("expected invalid session for a state of another browser but got: %v", err)
+		}
+	}
+
+	if _, _, err := login(oidctest.User{Subject: uuid.NewString(), Email: uuid.NewString() + "@example.com"}); err != ERR_OIDC_EMAIL_NOT_VERIFIED {
+		t.Errorf("expected email not verified but got: %v", err)
+	}
+
+	// accounts are only linked by email if the local address is verified,
+	// providers send it in lower case
+	email := "Erika." + uuid.NewString() + "@Example.com"
+	local := repo.User{ID: uuid.New(), Email: email, Password: "some password"}
+	if err := svc.CreateUser(local); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := svc.CreateUser(repo.User{ID: uuid.New(), Email: strings.ToLower(email), Password: "some password"}); err == nil {
+		t.Errorf("expected the email to be taken regardless of case")
+	}
+	linked := oidctest.User{Subject: uuid.NewString(), Email: email, EmailVerified: true}
+	if _, _, err := login(linked); err != ERR_OIDC_ACCOUNT_NOT_VERIFIED {
+		t.Errorf("expected account not verified but got: %v", err)
+	}
+	if err := svc.VerifyEmail(local.ID, email); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got, _, err := login(linked)
+	if err != nil || got.ID != local.ID {
+		t.Fatalf("account should be linked to the existing user: %+v, %v", got, err)
+	}
+	if view := svc.SelfView(got); len(view.LinkedAccounts) != 1 || view.LinkedAccounts[0].Provider != "fake" {
+		t.Errorf("linked account should be shown: %+v", view.LinkedAccounts)
+	}
+
+	if err := svc.UnlinkIdentity(local.ID, "fake"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := svc.UnlinkIdentity(local.ID, "fake"); err != ERR_IDENTITY_NOT_FOUND {
+		t.Errorf("expected identity not found but got: %v", err)
+	}
+}
+
+func TestUserService_RotateRefreshToken(t *testing.T) {
+	id := uuid.New()
+
+	session, token, err := svc.StartSession(id, "", "192.0.2.1")
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	userID, sessionID, rotated, err := svc.RotateRefreshToken(token, "192.0.2.1")
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if userID != id || sessionID != session.ID {
+		t.Errorf("unexpected IDs: %v %v", userID, sessionID)
+	}
+	if rotated == token {
+		t.Errorf("refresh token should be rotated")
+	}
+
+	// reusing the old token revokes the whole family
+	if _, _, _, err := svc.RotateRefreshToken(token, "192.0.2.1"); err != ERR_INVALID_REFRESH_TOKEN {
+		t.Errorf("expected invalid refresh token but got: %v", err)
+	}
+	if _, _, _, err := svc.RotateRefreshToken(rotated, "192.0.2.1"); err != ERR_INVALID_REFRESH_TOKEN {
+		t.Errorf("expected rotated token to be revoked but got: %v", err)
+	}
+}
+
+// staleTokens reads refresh tokens as they were before a concurrent request.
+type staleTokens struct {
+	repo.Repo
+	token repo.RefreshToken
+}
+
+func (r staleTokens) GetRefreshToken(hash string) (repo.RefreshToken, error) {
+	return r.token, nil
+}
+
+func TestUserService_RotateRefreshToken_Concurrent(t *testing.T) {
+	_, token, err := svc.StartSession(uuid.New(), "", "192.0.2.1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	before, err := svc.repo.GetRefreshToken(hasher.HashToken(token))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, _, rotated, err := svc.RotateRefreshToken(token, "192.0.2.1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the second request read the token before the first one marked it used
+	stale := NewUserService(staleTokens{Repo: svc.repo, token: before})
+	if _, _, _, err := stale.RotateRefreshToken(token, "192.0.2.1"); err != ERR_INVALID_REFRESH_TOKEN {
+		t.Errorf("expected invalid refresh token but got: %v", err)
+	}
+	if _, _, _, err := svc.RotateRefreshToken(rotated, "192.0.2.1"); err != ERR_INVALID_REFRESH_TOKEN {
+		t.Errorf("expected the family to be revoked but got: %v", err)
+	}
+}
+
+func TestUserService_RevokeRefreshToken(t *testing.T) {
+	id := uuid.New()
+
+	_, token, err := svc.StartSession(id, "", "192.0.2.1")
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if err := svc.RevokeRefreshToken(uuid.New(), token); err != ERR_INVALID_REFRESH_TOKEN {
+		t.Errorf("expected foreign user to be rejected but got: %v", err)
+	}
+	if err := svc.RevokeRefreshToken(id, token); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, _, _, err := svc.RotateRefreshToken(token, "192.0.2.1"); err != ERR_INVALID_REFRESH_TOKEN {
+		t.Errorf("expected invalid refresh token but got: %v", err)
+	}
+}
+
+func TestUserService_Sessions(t *testing.T) {
+	publisher := &recordingPublisher{}
+	service := NewUserService(repo.NewMockRepo()).WithMailer(mailer.NewMemoryMailer()).WithPublisher(publisher)
+	id := uuid.New()
+
+	firefox := "Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:128.0) Gecko/20100101 Firefox/128.0"
+	laptop, laptopToken, err := service.StartSession(id, firefox, "192.0.2.1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if laptop.Device != "Firefox on Windows" {
+		t.Errorf("unexpected device: %s", laptop.Device)
+	}
+	phone, phoneToken, err := service.StartSession(id, "okhttp/4.12.0", "192.0.2.2")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	tablet, _, err := service.StartSession(id, "", "192.0.2.3")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, _, _, err := service.RotateRefreshToken(laptopToken, "198.51.100.7"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	sessions, err := service.ListSessions(id, laptop.ID)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(sessions) != 3 || sessions[0].ID != laptop.ID || !sessions[0].Current || sessions[1].Current {
+		t.Fatalf("expected the refreshed session first and current: %+v", sessions)
+	}
+	if sessions[0].IP != "198.51.100.7" {
+		t.Errorf("expected the ip of the refresh but got %s", sessions[0].IP)
+	}
+
+	if err := service.RevokeSession(uuid.New(), phone.ID); err != ERR_SESSION_NOT_FOUND {
+		t.Errorf("expected foreign user to be rejected but got: %v", err)
+	}
+	if err := service.RevokeSession(id, phone.ID); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, _, _, err := service.RotateRefreshToken(phoneToken, "192.0.2.2"); err != ERR_INVALID_REFRESH_TOKEN {
+		t.Errorf("refresh token of the revoked session should be invalid but got: %v", err)
+	}
+	if subjects := publisher.Subjects(); len(subjects) != 1 || subjects[0] != auth.RevocationSubject {
+		t.Errorf("expected the revocation to be published but got %v", subjects)
+	}
+
+	revoked, err := service.RevokeOtherSessions(id, laptop.ID)
+	if err != nil || revoked != 1 {
+		t.Fatalf("expected one revoked session but got %d: %v", revoked, err)
+	}
+	sessions, _ = service.ListSessions(id, laptop.ID)
+	if len(sessions) != 1 || sessions[0].ID != laptop.ID {
+		t.Errorf("only the current session should be left: %+v", sessions)
+	}
+	if err := service.RevokeSession(id, tablet.ID); err != ERR_SESSION_NOT_FOUND {
+		t.Errorf("expected revoked session to be gone but got: %v", err)
+	}
+}
+
+func TestUserService_Blocks(t *testing.T) {
+	publisher := &recordingPublisher{}
+	service := NewUserService(repo.NewMockRepo()).WithMailer(mailer.NewMemoryMailer()).WithPublisher(publisher)
+	blocker, blocked := uuid.New(), uuid.New()
+	for _, id := range []uuid.UUID{blocker, blocked} {
+		if err := service.CreateUser(repo.User{ID: id, Email: uuid.New().String() + "@example.com", Password: "some password"}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	if err := service.BlockUser(blocker, blocker); err != ERR_BLOCK_SELF {
+		t.Errorf("expected self block to be rejected but got: %v", err)
+	}
+	if err := service.BlockUser(blocker, uuid.New()); err != ERR_USER_NOT_FOUND {
+		t.Errorf("expected unknown user but got: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := service.BlockUser(blocker, blocked); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	blocks, err := service.ListBlocks(blocker)
+	if err != nil || len(blocks) != 1 || blocks[0].BlockedID != blocked {
+		t.Fatalf("expected one block but got %+v: %v", blocks, err)
+	}
+	all, _ := service.AllBlocks()
+	if len(all) != 1 || all[0].BlockerID != blocker || all[0].BlockedID != blocked {
+		t.Errorf("unexpected blocks: %+v", all)
+	}
+	if subjects := publisher.Subjects(); len(subjects) != 2 || subjects[0] != blocking.ChangedSubject {
+		t.Errorf("expected the blocks to be announced but got %v", subjects)
+	}
+
+	if err := service.UnblockUser(blocker, blocked); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if blocks, _ := service.ListBlocks(blocker); len(blocks) != 0 {
+		t.Errorf("block should be lifted: %+v", blocks)
+	}
+
+	// blocks against a deleted user are removed with the account
+	if err := service.BlockUser(blocker, blocked); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := service.DeleteUser(blocked); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if blocks, _ := service.ListBlocks(blocker); len(blocks) != 0 {
+		t.Errorf("blocks of the deleted user should be removed: %+v", blocks)
+	}
+}
+
+func TestUserService_Audit(t *testing.T) {
+	service := NewUserService(repo.NewMockRepo()).WithMailer(mailer.NewMemoryMailer())
+	id, other := uuid.New(), uuid.New()
+	start := time.Now().Add(-time.Hour)
+	for i := 0; i < 5; i++ {
+		service.RecordAudit(audit.Event{Type: audit.LoginSucceeded, UserID: id, IP: "10.0.0.1", CreatedAt: start.Add(time.Duration(i) * time.Minute)})
+	}
+	service.RecordAudit(audit.Event{Type: audit.PasswordChanged, UserID: other, IP: "10.0.0.2", CreatedAt: start})
+
+	page, err := service.SecurityEvents(id, time.Time{}, 3)
+	if err != nil || len(page) != 3 {
+		t.Fatalf("expected three events but got %d: %v", len(page), err)
+	}
+	if !page[0].CreatedAt.After(page[2].CreatedAt) {
+		t.Errorf("expected the newest event first: %+v", page)
+	}
+	if page[0].ID == uuid.Nil || page[0].Service != auditServiceName {
+		t.Errorf("expected the defaults to be filled in: %+v", page[0])
+	}
+	rest, err := service.SecurityEvents(id, page[2].CreatedAt, 3)
+	if err != nil || len(rest) != 2 {
+		t.Fatalf("expected the two remaining events but got %d: %v", len(rest), err)
+	}
+
+	if events, _ := service.QueryAudit(repo.AuditQuery{IP: "10.0.0.2"}); len(events) != 1 || events[0].UserID != other {
+		t.Errorf("unexpected events by address: %+v", events)
+	}
+	if events, _ := service.QueryAudit(repo.AuditQuery{Type: audit.PasswordChanged}); len(events) != 1 {
+		t.Errorf("unexpected events by type: %+v", events)
+	}
+	if _, err := service.QueryAudit(repo.AuditQuery{Since: start}); err != ERR_INVALID_AUDIT_QUERY {
+		t.Errorf("expected a query without user, address or type to be rejected but got: %v", err)
+	}
+	if _, err := service.QueryAudit(repo.AuditQuery{UserID: id, Limit: maxAuditLimit + 1}); err != ERR_INVALID_AUDIT_QUERY {
+		t.Errorf("expected a too large limit to be rejected but got: %v", err)
+	}
+
+	// failed logins are recorded, with the email only if the account is unknown
+	if _, err := service.Login("unknown@example.com", "secret password", "10.0.0.3"); err != ERR_INVALID_CREDENTIALS {
+		t.Fatalf("expected invalid credentials but got: %v", err)
+	}
+	events, _ := service.QueryAudit(repo.AuditQuery{IP: "10.0.0.3"})
+	if len(events) != 1 || events[0].Type != audit.LoginFailed || events[0].Details["email"] != "unknown@example.com" {
+		t.Errorf("expected the failed login to be recorded: %+v", events)
+	}
+}
+
+func TestUserService_Preferences(t *testing.T) {
+	publisher := &recordingPublisher{}
+	service := NewUserService(repo.NewMockRepo()).WithMailer(mailer.NewMemoryMailer()).WithPublisher(publisher)
+	id := uuid.New()
+	if err := service.CreateUser(repo.User{ID: id, Email: uuid.New().String() + "@example.com", Password: "some password"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	preferences, err := service.GetPreferences(id)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !preferences.Categories[notify.Booking].Email || preferences.Categories[notify.Marketing].Email {
+		t.Errorf("expected the defaults but got %+v", preferences.Categories)
+	}
+
+	invalid := notify.Preferences{QuietHours: &notify.QuietHours{Start: "22:00", End: "07:00", TimeZone: "Nowhere"}}
+	if _, err := service.UpdatePreferences(id, invalid); !errors.Is(err, ERR_INVALID_PREFERENCES) {
+		t.Errorf("expected invalid preferences but got: %v", err)
+	}
+	if _, err := service.UpdatePreferences(uuid.New(), notify.Preferences{}); err != ERR_USER_NOT_FOUND {
+		t.Errorf("expected unknown user but got: %v", err)
+	}
+
+	update := notify.Preferences{
+		Categories: map[notify.Category]notify.Channels{notify.Chat: {InApp: false, Email: true}},
+		QuietHours: &notify.QuietHours{Start: "22:00", End: "07:00", TimeZone: "Europe/Berlin"},
+	}
+	if _, err := service.UpdatePreferences(id, update); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	preferences, _ = service.GetPreferences(id)
+	if preferences.Categories[notify.Chat].InApp || !preferences.Categories[notify.Chat].Email {
+		t.Errorf("expected the chosen channels for chat: %+v", preferences.Categories)
+	}
+	if !preferences.Categories[notify.Tracking].InApp || preferences.QuietHours == nil {
+		t.Errorf("expected the defaults for the other categories and the quiet hours: %+v", preferences)
+	}
+	if subjects := publisher.Subjects(); len(subjects) != 1 || subjects[0] != notify.ChangedSubject {
+		t.Errorf("expected the change to be announced but got %v", subjects)
+	}
+
+	// the preferences are removed with the account
+	if err := service.DeleteUser(id); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if preferences, _ := service.GetPreferences(id); preferences.QuietHours != nil {
+		t.Errorf("expected the preferences to be deleted: %+v", preferences)
+	}
+}
+
+func TestUserService_VerifyEmail(t *testing.T) {
+	id := uuid.New()
+	email := uuid.New().String() + "@example.com"
+
+	user := repo.User{
+		Email:    email,
+		ID:       id,
+		Password: "some password",
+		Verified: true,
+	}
+
+	err := svc.CreateUser(user)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	got, err := svc.GetUserByID(id)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if got.Verified {
+		t.Errorf("new users should not be verified")
+	}
+
+	if err := svc.SendVerificationMail(got, "some-token"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if len(mails.Messages(email)) != 1 {
+		t.Errorf("expected one verification mail but got %d", len(mails.Messages(email)))
+	}
+
+	if err := svc.VerifyEmail(id, "other@example.com"); err != ERR_INVALID_VERIFICATION {
+		t.Errorf("expected invalid verification but got: %v", err)
+	}
+	if err := svc.VerifyEmail(id, email); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	got, err = svc.GetUserByID(id)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if !got.Verified {
+		t.Errorf("user should be verified")
+	}
+	if err := svc.SendVerificationMail(got, "some-token"); err != ERR_ALREADY_VERIFIED {
+		t.Errorf("expected already verified but got: %v", err)
+	}
+}
+
+func TestUserService_ResetPassword(t *testing.T) {
+	id := uuid.New()
+	email := uuid.New().String() + "@example.com"
+
+	user := repo.User{
+		Email:    email,
+		ID:       id,
+		Password: "some password",
+	}
+
+	err := svc.CreateUser(user)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	_, refreshToken, err := svc.StartSession(id, "", "192.0.2.1")
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// unknown emails must not be distinguishable
+	if err := svc.RequestPasswordReset("unknown-" + email); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if err := svc.RequestPasswordReset(email); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	// the link is mailed in the background
+	for deadline := time.Now().Add(5 * time.Second); len(mails.Messages(email)) == 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	messages := mails.Messages(email)
+	if len(messages) != 1 {
+		t.Fatalf("expected one reset mail but got %d", len(messages))
+	}
+	_, token, _ := strings.Cut(messages[0].Body, "token=")
+	token, _, _ = strings.Cut(token, "\n")
+
+	if _, err := svc.ResetPassword("invalid", "new password"); err != ERR_INVALID_RESET_TOKEN {
+		t.Errorf("expected invalid reset token but got: %v", err)
+	}
+	// concurrent requests can not both use the token
+	results := make(chan error, 2)
+	for _, password := range []string{"new password", "other password"} {
+		go func() {
+			_, err := svc.ResetPassword(token, password)
+			results <- err
+		}()
+	}
+	var succeeded int
+	for range 2 {
+		switch err := <-results; err {
+		case nil:
+			succeeded++
+		case ERR_INVALID_RESET_TOKEN:
+		default:
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+	if succeeded != 1 {
+		t.Fatalf("reset token should be single use but was used %d times", succeeded)
+	}
+	if _, err := svc.ResetPassword(token, "third password"); err != ERR_INVALID_RESET_TOKEN {
+		t.Errorf("reset token should be single use but got: %v", err)
+	}
+
+	got, err := svc.GetUserByID(id)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if hasher.VerifyPassword(got.Password, "new password") != nil && hasher.VerifyPassword(got.Password, "other password") != nil {
+		t.Errorf("password should be one of the new ones")
+	}
+	if _, _, _, err := svc.RotateRefreshToken(refreshToken, "192.0.2.1"); err != ERR_INVALID_REFRESH_TOKEN {
+		t.Errorf("existing sessions should be revoked but got: %v", err)
+	}
+}
+
+func TestUserService_SetRoles(t *testing.T) {
+	id := uuid.New()
+
+	user := repo.User{
+		Email:    uuid.New().String() + "@example.com",
+		ID:       id,
+		Password: "some password",
+		Roles:    []string{auth.RoleAdmin},
+	}
+
+	err := svc.CreateUser(user)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	got, err := svc.GetUserByID(id)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if len(got.Roles) != 1 || got.Roles[0] != auth.RoleUser {
+		t.Errorf("new users should only have the user role: %v", got.Roles)
+	}
+
+	privacy := repo.PrivacySettings{Email: repo.VisibilityPublic, Age: repo.VisibilityPrivate}
+	if err := svc.SetPrivacy(id, privacy); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := svc.SetRoles(id, []string{"superuser"}); err != ERR_INVALID_ROLE {
+		t.Errorf("expected invalid role but got: %v", err)
+	}
+	if err := svc.SetRoles(id, []string{auth.RoleModerator}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	got, err = svc.GetUserByID(id)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if len(got.Roles) != 2 || got.Roles[1] != auth.RoleModerator {
+		t.Errorf("unexpected roles: %v", got.Roles)
+	}
+	if got.Privacy != privacy {
+		t.Errorf("changing roles should keep the privacy settings: %+v", got.Privacy)
+	}
+}
+
+type recordingPublisher struct {
+	mu       sync.Mutex
+	subjects []string
+}
+
+func (p *recordingPublisher) Publish(subject string, data []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.subjects = append(p.subjects, subject)
+	return nil
+}
+
+func (p *recordingPublisher) Subjects() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return slices.Clone(p.subjects)
+}
+
+func TestLoginThrottle(t *testing.T) {
+	now := time.Now()
+	throttle := NewLoginThrottle(2, 5, 15*time.Minute)
+	throttle.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if locked, _ := throttle.Fail("key"); locked {
+			t.Fatalf("should not lock after %d failures", i+1)
+		}
+		if wait := throttle.Wait("key"); wait != 0 {
+			t.Errorf("free attempts should not wait but got %v", wait)
+		}
+	}
+
+	throttle.Fail("key")
+	if wait := throttle.Wait("key"); wait != 2*time.Second {
+		t.Errorf("expected 2s backoff but got %v", wait)
+	}
+	throttle.Fail("key")
+	if wait := throttle.Wait("key"); wait != 4*time.Second {
+		t.Errorf("expected 4s backoff but got %v", wait)
+	}
+	if wait := throttle.Wait("other"); wait != 0 {
+		t.Errorf("other keys should not be affected but got %v", wait)
+	}
+
+	locked, until := throttle.Fail("key")
+	if !locked || !until.Equal(now.Add(15*time.Minute)) {
+		t.Errorf("expected lock until %v but got %v %v", now.Add(15*time.Minute), locked, until)
+	}
+
+	now = now.Add(16 * time.Minute)
+	if wait := throttle.Wait("key"); wait != 0 {
+		t.Errorf("lock should have expired but got %v", wait)
+	}
+
+	throttle.Fail("key")
+	throttle.Fail("key")
+	throttle.Fail("key")
+	throttle.Succeed("key")
+	if wait := throttle.Wait("key"); wait != 0 {
+		t.Errorf("success should reset the key but got %v", wait)
+	}
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	// sha1 of "correct horse battery staple"
+	list, err := breached.Read(strings.NewReader("ABF7AAD6438836DBE526AA231ABDE2D0EEF74D42:1\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	policy := DefaultPasswordPolicy
+	policy.Breached = list
+
+	tests := []struct {
+		password string
+		want     error
+	}{
+		{"", ERR_EMPTY_PASSWORD},
+		{"Ab1!", ERR_PASSWORD_TOO_SHORT},
+		{strings.Repeat("a1B!", 19), ERR_PASSWORD_TOO_LONG},
+		{"aaaaaaaaaaaa", ERR_PASSWORD_TOO_WEAK},
+		{"123456789012", ERR_PASSWORD_TOO_WEAK},
+		{"abcdefghijkl", ERR_PASSWORD_TOO_WEAK},
+		{"correct horse battery staple", ERR_PASSWORD_BREACHED},
+		{"some password", nil},
+		{"Grüße aus Köln", nil},
+	}
+	for _, tc := range tests {
+		if err := policy.Check(tc.password); err != tc.want {
+			t.Errorf("%q: expected %v but got %v", tc.password, tc.want, err)
+		}
+	}
+}
+
+func TestUserService_PasswordRehash(t *testing.T) {
+	cheap := hasher.DefaultParams
+	cheap.BcryptCost = 4
+	service := NewUserService(repo.NewMockRepo()).WithMailer(mailer.NewMemoryMailer()).WithPasswordHashing(cheap)
+	id := uuid.New()
+	email := "rehash@example.com"
+	if err := service.CreateUser(repo.User{ID: id, Email: email, Password: "secret password"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := service.CreateUser(repo.User{ID: uuid.New(), Email: "weak@example.com", Password: "12345678"}); err != ERR_PASSWORD_TOO_WEAK {
+		t.Errorf("expected weak password to be rejected but got: %v", err)
+	}
+
+	// raising the parameters replaces the hash on the next login
+	argon2Params := cheap
+	argon2Params.Algorithm = hasher.Argon2id
+	argon2Params.Argon2Memory = 1024
+	argon2Params.Argon2Time = 1
+	service.WithPasswordHashing(argon2Params)
+	if _, err := service.Login(email, "secret password", "10.0.0.1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	user, _ := service.GetUserByID(id)
+	if !strings.HasPrefix(user.Password, "$argon2id$") {
+		t.Fatalf("expected the hash to be migrated to argon2id but got %s", user.Password)
+	}
+	if _, err := service.Login(email, "secret password", "10.0.0.1"); err != nil {
+		t.Errorf("expected the migrated hash to work but got: %v", err)
+	}
+	if again, _ := service.GetUserByID(id); again.Password != user.Password {
+		t.Errorf("expected an up to date hash to be kept")
+	}
+	if _, err := service.Login(email, "wrong password", "10.0.0.1"); err != ERR_INVALID_CREDENTIALS {
+		t.Errorf("expected invalid credentials but got: %v", err)
+	}
+
+	// a login that verified the old password must not revert a change
+	service.WithPasswordHashing(cheap)
+	stale, _ := service.GetUserByID(id)
+	changed := stale
+	changed.Password = "changed hash"
+	if err := service.repo.UpdateUserFields(changed, "password"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	service.upgradePasswordHash(stale, "secret password")
+	if got, _ := service.GetUserByID(id); got.Password != "changed hash" {
+		t.Errorf("expected the changed password to be kept but got %s", got.Password)
+	}
+}
+
+func TestUserService_Login(t *testing.T) {
+	publisher := &recordingPublisher{}
+	service := NewUserService(repo.NewMockRepo()).WithMailer(mailer.NewMemoryMailer()).WithPublisher(publisher)
+	now := time.Now()
+	service.accountThrottle.now = func() time.Time { return now }
+	service.ipThrottle.now = func() time.Time { return now }
+
+	id := uuid.New()
+	email := "login@example.com"
+	if err := service.CreateUser(repo.User{ID: id, Email: email, Password: "secret password"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := service.Login(email, "secret password", "10.0.0.1"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := service.Login("unknown@example.com", "secret password", "10.0.0.1"); err != ERR_INVALID_CREDENTIALS {
+		t.Errorf("expected invalid credentials but got: %v", err)
+	}
+
+	// skip the backoff between attempts, only the lock is of interest here
+	var err error
+	for i := 0; i < 10; i++ {
+		_, err = service.Login(email, "wrong", "10.0.0.2")
+		now = now.Add(5 * time.Minute)
+	}
+	now = now.Add(-5 * time.Minute)
+	if err != ERR_INVALID_CREDENTIALS {
+		t.Errorf("expected invalid credentials but got: %v", err)
+	}
+	if len(publisher.Subjects()) != 1 || publisher.Subjects()[0] != "user."+id.String() {
+		t.Errorf("expected lock event for the user but got %v", publisher.Subjects())
+	}
+
+	_, err = service.Login(email, "secret password", "10.0.0.3")
+	locked, ok := err.(*LockedError)
+	if !ok || locked.RetryAfter <= 0 {
+		t.Fatalf("expected locked account but got: %v", err)
+	}
+
+	now = now.Add(16 * time.Minute)
+	if _, err := service.Login(email, "secret password", "10.0.0.3"); err != nil {
+		t.Errorf("lock should have expired but got: %v", err)
+	}
+}
+
+func TestUserService_TOTP(t *testing.T) {
+	service := NewUserService(repo.NewMockRepo()).WithMailer(mailer.NewMemoryMailer())
+	id := uuid.New()
+	email := "totp@example.com"
+	if err := service.CreateUser(repo.User{ID: id, Email: email, Password: "secret password"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := service.ConfirmTOTP(id, "123456"); err != ERR_TOTP_NOT_ENROLLED {
+		t.Errorf("expected not enrolled but got: %v", err)
+	}
+	secret, uri, err := service.EnrollTOTP(id)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(uri, secret) {
+		t.Errorf("uri should contain the secret: %s", uri)
+	}
+	if user, _ := service.Login(email, "secret password", "10.0.0.1"); user.TOTPEnabled {
+		t.Errorf("totp should only be enabled after confirmation")
+	}
+
+	code, _ := totp.Code(secret, time.Now())
+	if _, err := service.ConfirmTOTP(id, "abcdef"); err != ERR_INVALID_MFA_CODE {
+		t.Errorf("expected invalid code but got: %v", err)
+	}
+	recoveryCodes, err := service.ConfirmTOTP(id, code)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(recoveryCodes) != recoveryCodeCount {
+		t.Errorf("expected %d recovery codes but got %d", recoveryCodeCount, len(recoveryCodes))
+	}
+
+	user, err := service.Login(email, "secret password", "10.0.0.1")
+	if err != nil || !user.TOTPEnabled {
+		t.Fatalf("expected login to require a second factor: %v", err)
+	}
+	// the code used for the confirmation can not be replayed
+	if _, err := service.VerifySecondFactor(id, code, "10.0.0.1"); err != ERR_INVALID_MFA_CODE {
+		t.Errorf("expected replayed code to be rejected but got: %v", err)
+	}
+	if _, err := service.VerifySecondFactor(id, strings.ToUpper(recoveryCodes[0]), "10.0.0.1"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := service.VerifySecondFactor(id, recoveryCodes[0], "10.0.0.1"); err != ERR_INVALID_MFA_CODE {
+		t.Errorf("recovery codes should be single use but got: %v", err)
+	}
+
+	if err := service.DisableTOTP(id, recoveryCodes[1], "10.0.0.1"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	got, _ := service.GetUserByID(id)
+	if got.TOTPEnabled || got.TOTPSecret != "" || len(got.RecoveryCodes) != 0 {
+		t.Errorf("totp should be removed: %+v", got)
+	}
+}
+
+func TestUserService_TOTP_Concurrent(t *testing.T) {
+	users := repo.NewMockRepo()
+	service := NewUserService(users).WithMailer(mailer.NewMemoryMailer())
+	id := uuid.New()
+	if err := service.CreateUser(repo.User{ID: id, Email: "totp-race@example.com", Password: "secret password"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	secret, _, err := service.EnrollTOTP(id)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	now := time.Now()
+	code, _ := totp.Code(secret, now.Add(-30*time.Second))
+	recoveryCodes, err := service.ConfirmTOTP(id, code)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// both requests read the user before either consumed the code
+	before, _ := users.GetUserByID(id)
+	stale := NewUserService(staleRepo{Repo: users, user: before})
+	code, _ = totp.Code(secret, now)
+	if _, err := stale.VerifySecondFactor(id, code, "10.0.0.1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := stale.VerifySecondFactor(id, code, "10.0.0.1"); err != ERR_INVALID_MFA_CODE {
+		t.Errorf("expected replayed totp code to be rejected but got: %v", err)
+	}
+	if _, err := stale.VerifySecondFactor(id, recoveryCodes[0], "10.0.0.1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := stale.VerifySecondFactor(id, recoveryCodes[0], "10.0.0.1"); err != ERR_INVALID_MFA_CODE {
+		t.Errorf("expected replayed recovery code to be rejected but got: %v", err)
+	}
+	if got, _ := users.GetUserByID(id); len(got.RecoveryCodes) != recoveryCodeCount-1 {
+		t.Errorf("expected one recovery code to be used: %d left", len(got.RecoveryCodes))
+	}
+}
+
+func TestUserService_Passkeys(t *testing.T) {
+	id := uuid.New()
+	user := repo.User{ID: id, Email: uuid.New().String() + "@example.com", Password: "some password"}
+	if err := svc.CreateUser(user); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	user, _ = svc.GetUserByID(id)
+	user.AddCredential(&webauthn.Credential{ID: []byte("credential"), Authenticator: webauthn.Authenticator{SignCount: 1}})
+	if err := svc.repo.UpdateUser(user); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	passkeys, err := svc.ListPasskeys(id)
+	if err != nil || len(passkeys) != 1 {
+		t.Fatalf("expected one passkey but got %v %v", passkeys, err)
+	}
+	passkeyID := passkeys[0].ID
+	if passkeys[0].CreatedAt == nil || passkeys[0].LastUsedAt != nil {
+		t.Errorf("unexpected timestamps: %+v", passkeys[0])
+	}
+
+	if err := svc.RenamePasskey(id, passkeyID, " "); err != ERR_INVALID_PASSKEY_NAME {
+		t.Errorf("expected invalid name but got: %v", err)
+	}
+	if err := svc.RenamePasskey(id, "unknown", "Laptop"); err != ERR_PASSKEY_NOT_FOUND {
+		t.Errorf("expected not found but got: %v", err)
+	}
+	if err := svc.RenamePasskey(id, passkeyID, "Laptop"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	err = svc.RecordPasskeyLogin(id, &webauthn.Credential{ID: []byte("credential"), Authenticator: webauthn.Authenticator{SignCount: 5}})
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	passkeys, _ = svc.ListPasskeys(id)
+	if passkeys[0].Name != "Laptop" || passkeys[0].SignCount != 5 || passkeys[0].LastUsedAt == nil {
+		t.Errorf("passkey was not updated: %+v", passkeys[0])
+	}
+
+	err = svc.RecordPasskeyLogin(id, &webauthn.Credential{ID: []byte("credential"), Authenticator: webauthn.Authenticator{SignCount: 2, CloneWarning: true}})
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	passkeys, _ = svc.ListPasskeys(id)
+	if !passkeys[0].CloneWarning {
+		t.Errorf("expected clone warning: %+v", passkeys[0])
+	}
+
+	if err := svc.DeletePasskey(id, passkeyID); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := svc.DeletePasskey(id, passkeyID); err != ERR_PASSKEY_NOT_FOUND {
+		t.Errorf("expected not found but got: %v", err)
+	}
+	got, _ := svc.GetUserByID(id)
+	if len(got.Credentials) != 0 || len(got.Passkeys) != 0 {
+		t.Errorf("passkey should be removed: %+v", got)
+	}
+}
+
+func TestNewWebAuthn(t *testing.T) {
+	wauth, err := newWebAuthn("https://mycargonaut.example")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if wauth.Config.RPID != "mycargonaut.example" || wauth.Config.RPOrigins[0] != "https://mycargonaut.example" {
+		t.Errorf("expected relying party from base url but got %+v", wauth.Config)
+	}
+
+	t.Setenv("WEBAUTHN_RP_ID", "example.org")
+	t.Setenv("WEBAUTHN_RP_NAME", "Test")
+	t.Setenv("WEBAUTHN_RP_ORIGINS", "https://example.org, https://app.example.org/")
+	wauth, err = newWebAuthn("https://mycargonaut.example")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if wauth.Config.RPID != "example.org" || wauth.Config.RPDisplayName != "Test" || len(wauth.Config.RPOrigins) != 2 || wauth.Config.RPOrigins[1] != "https://app.example.org" {
+		t.Errorf("expected relying party from environment but got %+v", wauth.Config)
+	}
+}
+
+func TestUserService_WebAuthnSessions(t *testing.T) {
+	id := uuid.New()
+	email := uuid.New().String() + "@example.com"
+	if err := svc.CreateUser(repo.User{ID: id, Email: email, Password: "some password"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, _, err := svc.BeginPasskeyLogin(email); err != ERR_NO_PASSKEYS {
+		t.Errorf("expected no passkeys but got: %v", err)
+	}
+
+	// concurrent discoverable logins get their own challenges
+	first, firstSession, err := svc.BeginPasskeyLogin("")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	second, secondSession, err := svc.BeginPasskeyLogin("")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if firstSession == secondSession || first.Response.Challenge.String() == second.Response.Challenge.String() {
+		t.Errorf("expected separate sessions")
+	}
+	if len(first.Response.AllowedCredentials) != 0 {
+		t.Errorf("discoverable logins must not restrict the credentials")
+	}
+
+	session, err := svc.takeWebAuthnSession(firstSession)
+	if err != nil || session.UserID != uuid.Nil {
+		t.Errorf("expected discoverable session but got %+v %v", session, err)
+	}
+	if _, err := svc.takeWebAuthnSession(firstSession); err != ERR_INVALID_WEBAUTHN_SESSION {
+		t.Errorf("sessions should be single use but got: %v", err)
+	}
+	if _, err := svc.FinishPasskeyLogin("unknown", "", nil); err != ERR_INVALID_WEBAUTHN_SESSION {
+		t.Errorf("expected invalid session but got: %v", err)
+	}
+
+	// registration sessions belong to the user that started them
+	_, registrationSession, err := svc.BeginPasskeyRegistration(id)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := svc.FinishPasskeyRegistration(uuid.New(), registrationSession, "", nil); err != ERR_INVALID_WEBAUTHN_SESSION {
+		t.Errorf("expected invalid session but got: %v", err)
+	}
+
+	err = svc.repo.CreateWebAuthnSession(repo.WebAuthnSession{
+		Hash:      hasher.HashToken("expired"),
+		ExpiresAt: time.Now().Add(-time.Minute),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := svc.takeWebAuthnSession("expired"); err != ERR_INVALID_WEBAUTHN_SESSION {
+		t.Errorf("expired sessions should be rejected but got: %v", err)
+	}
+}
+
+type fakePartners map[uuid.UUID]uuid.UUID
+
+func (p fakePartners) ArePartners(a, b uuid.UUID) (bool, error) {
+	return p[a] == b || p[b] == a, nil
+}
+
+func TestUserService_View(t *testing.T) {
+	owner := uuid.New()
+	partner := uuid.New()
+	stranger := uuid.New()
+	service := NewUserService(repo.NewMockRepo()).WithMailer(mailer.NewMemoryMailer()).WithPartnerChecker(fakePartners{owner: partner})
+
+	user := repo.User{
+		ID:          owner,
+		FirstName:   "Max",
+		LastName:    "Mustermann",
+		Email:       "max@example.com",
+		PhoneNumber: "0123",
+		BirthDate:   time.Now().AddDate(-30, 0, -1),
+		Password:    "secret password",
+	}
+	if err := service.CreateUser(user); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	user, _ = service.GetUserByID(owner)
+
+	anonymous := service.View(user, Viewer{}, true).(UserProfile)
+	if anonymous.LastName != "M." || anonymous.Email != "" || anonymous.PhoneNumber != "" {
+		t.Errorf("anonymous viewers should only see public fields: %+v", anonymous)
+	}
+	if anonymous.Age == nil || *anonymous.Age != 30 {
+		t.Errorf("expected age 30 but got %v", anonymous.Age)
+	}
+
+	if profile := service.View(user, Viewer{ID: stranger}, true).(UserProfile); profile.Email != "" {
+		t.Errorf("strangers should not see partner fields: %+v", profile)
+	}
+	profile := service.View(user, Viewer{ID: partner}, true).(UserProfile)
+	if profile.LastName != "Mustermann" || profile.Email != user.Email || profile.PhoneNumber != user.PhoneNumber {
+		t.Errorf("partners should see partner fields: %+v", profile)
+	}
+	if profile := service.View(user, Viewer{ID: partner}, false).(UserProfile); profile.Email != "" {
+		t.Errorf("partner fields should be hidden without the partner check: %+v", profile)
+	}
+
+	if _, ok := service.View(user, Viewer{ID: owner}, true).(SelfView); !ok {
+		t.Errorf("users should get their own account")
+	}
+	if _, ok := service.View(user, Viewer{ID: stranger, Admin: true}, true).(AdminView); !ok {
+		t.Errorf("admins should get the admin view")
+	}
+
+	if err := service.SetPrivacy(owner, repo.PrivacySettings{Email: "everybody"}); err != ERR_INVALID_VISIBILITY {
+		t.Errorf("expected invalid visibility but got: %v", err)
+	}
+	err := service.SetPrivacy(owner, repo.PrivacySettings{Email: repo.VisibilityRegistered, Age: repo.VisibilityPrivate})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	user, _ = service.GetUserByID(owner)
+	profile = service.View(user, Viewer{ID: stranger}, true).(UserProfile)
+	if profile.Email != user.Email || profile.Age != nil || profile.PhoneNumber != "" {
+		t.Errorf("privacy settings were not applied: %+v", profile)
+	}
+	if self := service.SelfView(user); self.Privacy.PhoneNumber != repo.VisibilityPartners {
+		t.Errorf("unset settings should fall back to the defaults: %+v", self.Privacy)
+	}
+}
+
+func TestUserService_ListUsers(t *testing.T) {
+	service := NewUserService(repo.NewMockRepo()).WithMailer(mailer.NewMemoryMailer())
+	names := []string{"Anna", "bernd", "Berta", "Carl", "Dora"}
+	for i, name := range names {
+		user := repo.User{ID: uuid.New(), FirstName: name, LastName: "Hidden", Email: fmt.Sprintf("%d@example.com", i), Password: "secret password"}
+		if err := service.CreateUser(user); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if name == "Carl" {
+			user, _ = service.GetUserByID(user.ID)
+			if err := service.VerifyEmail(user.ID, user.Email); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if err := service.SetPrivacy(user.ID, repo.PrivacySettings{LastName: repo.VisibilityPublic}); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+	}
+
+	var got []string
+	cursor := ""
+	for pages := 0; ; pages++ {
+		page, err := service.ListUsers(DirectoryQuery{Limit: 2, Cursor: cursor}, false)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		for _, user := range page.Users {
+			got = append(got, user.FirstName)
+		}
+		if page.NextCursor == "" {
+			if pages != 2 {
+				t.Errorf("expected 3 pages but got %d", pages+1)
+			}
+			break
+		}
+		cursor = page.NextCursor
+	}
+	if strings.Join(got, ",") != "Anna,bernd,Berta,Carl,Dora" {
+		t.Errorf("unexpected order: %v", got)
+	}
+
+	page, _ := service.ListUsers(DirectoryQuery{Sort: "-name", Limit: 1}, false)
+	if len(page.Users) != 1 || page.Users[0].FirstName != "Dora" {
+		t.Errorf("expected Dora first when sorting descending: %v", page.Users)
+	}
+
+	page, _ = service.ListUsers(DirectoryQuery{Query: "BE"}, false)
+	if len(page.Users) != 2 {
+		t.Errorf("expected two users starting with be: %v", page.Users)
+	}
+	// only the last name made public can be searched
+	page, _ = service.ListUsers(DirectoryQuery{Query: "hid"}, false)
+	if len(page.Users) != 1 || page.Users[0].FirstName != "Carl" {
+		t.Errorf("expected only the public last name to match: %v", page.Users)
+	}
+	verified := true
+	page, _ = service.ListUsers(DirectoryQuery{Verified: &verified}, false)
+	if len(page.Users) != 1 || page.Users[0].FirstName != "Carl" {
+		t.Errorf("expected only verified users: %v", page.Users)
+	}
+
+	if _, err := service.ListUsers(DirectoryQuery{Sort: "email"}, false); err != ERR_INVALID_SORT {
+		t.Errorf("sorting by email should be reserved for admins but got: %v", err)
+	}
+	page, err := service.ListUsers(DirectoryQuery{Sort: "-email", Limit: 1}, true)
+	if err != nil || page.Users[0].Email != "4@example.com" {
+		t.Errorf("unexpected result sorting by email: %v %v", page.Users, err)
+	}
+	if _, err := service.ListUsers(DirectoryQuery{Cursor: "invalid"}, false); err != ERR_INVALID_CURSOR {
+		t.Errorf("expected invalid cursor but got: %v", err)
+	}
+}
@@ -0,0 +1,101 @@
+package userservice
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// LoginThrottle counts failed logins per key (an account or an ip address).
+// After a few free attempts every further failure doubles the time until the
+// next attempt is allowed, and too many failures lock the key for a while.
+type LoginThrottle struct {
+	mu       sync.Mutex
+	attempts map[string]*loginAttempts
+	now      func() time.Time
+
+	freeAttempts int
+	lockAfter    int
+	lockDuration time.Duration
+}
+
+type loginAttempts struct {
+	failures     int
+	lastFailure  time.Time
+	blockedUntil time.Time
+}
+
+const (
+	maxLoginBackoff = 5 * time.Minute
+	// failures are forgotten when nothing happened for this long
+	loginAttemptWindow = 24 * time.Hour
+)
+
+func NewLoginThrottle(freeAttempts, lockAfter int, lockDuration time.Duration) *LoginThrottle {
+	return &LoginThrottle{
+		attempts:     make(map[string]*loginAttempts),
+		now:          time.Now,
+		freeAttempts: freeAttempts,
+		lockAfter:    lockAfter,
+		lockDuration: lockDuration,
+	}
+}
+
+// Wait returns how long the key has to wait before the next attempt.
+func (t *LoginThrottle) Wait(key string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	attempts, ok := t.attempts[key]
+	if !ok {
+		return 0
+	}
+	if wait := attempts.blockedUntil.Sub(t.now()); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// Fail records a failed attempt. It returns true if the key got locked by it.
+func (t *LoginThrottle) Fail(key string) (bool, time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	t.prune(now)
+
+	attempts, ok := t.attempts[key]
+	if !ok {
+		attempts = &loginAttempts{}
+		t.attempts[key] = attempts
+	}
+	attempts.failures++
+	attempts.lastFailure = now
+
+	if attempts.failures >= t.lockAfter {
+		attempts.failures = 0
+		attempts.blockedUntil = now.Add(t.lockDuration)
+		return true, attempts.blockedUntil
+	}
+	if attempts.failures > t.freeAttempts {
+		backoff := time.Duration(math.Pow(2, float64(attempts.failures-t.freeAttempts))) * time.Second
+		attempts.blockedUntil = now.Add(min(backoff, maxLoginBackoff))
+	}
+	return false, time.Time{}
+}
+
+// Succeed forgets all failures of the key.
+func (t *LoginThrottle) Succeed(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.attempts, key)
+}
+
+func (t *LoginThrottle) prune(now time.Time) {
+	for key, attempts := range t.attempts {
+		if now.Sub(attempts.lastFailure) > loginAttemptWindow && now.After(attempts.blockedUntil) {
+			delete(t.attempts, key)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package userservice
+
+import (
+	"errors"
+	"time"
+
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/hasher"
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/http/userservice/repo"
+	"github.com/google/uuid"
+)
+
+const (
+	AccessTokenTTL  = 15 * time.Minute
+	RefreshTokenTTL = 30 * 24 * time.Hour
+)
+
+var ERR_INVALID_REFRESH_TOKEN = errors.New("invalid refresh token")
+
+// StartSession records a fresh login on a device and starts its refresh
+// token family, which shares the id of the session.
+func (s *UserService) StartSession(userID uuid.UUID, userAgent string, ip string) (repo.LoginSession, string, error) {
+	now := time.Now()
+	session := repo.LoginSession{
+		ID:         uuid.New(),
+		UserID:     userID,
+		UserAgent:  userAgent,
+		Device:     deviceName(userAgent),
+		IP:         ip,
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(RefreshTokenTTL),
+	}
+	if err := s.repo.CreateLoginSession(session); err != nil {
+		return repo.LoginSession{}, "", err
+	}
+	token, err := s.createRefreshToken(userID, session.ID)
+	if err != nil {
+		return repo.LoginSession{}, "", err
+	}
+	return session, token, nil
+}
+
+// RotateRefreshToken exchanges a refresh token for a new one of the same family
+// and returns the user and session it belongs to. Presenting a token that was
+// already rotated revokes the whole session, since it means the token has
+// leaked.
+func (s *UserService) RotateRefreshToken(token string, ip string) (uuid.UUID, uuid.UUID, string, error) {
+	hash := hasher.HashToken(token)
+	stored, err := s.repo.GetRefreshToken(hash)
+	if err != nil {
+		return uuid.Nil, uuid.Nil, "", ERR_INVALID_REFRESH_TOKEN
+	}
+	if stored.ExpiresAt.Before(time.Now()) {
+		return uuid.Nil, uuid.Nil, "", ERR_INVALID_REFRESH_TOKEN
+	}
+
+	// a concurrent request may have used the token since it was read
+	err = s.repo.MarkRefreshTokenUsed(hash)
+	if stored.Used || errors.Is(err, repo.ERR_REFRESH_TOKEN_USED) {
+		if err := s.revokeSessions(stored.Family); err != nil {
+			return uuid.Nil, uuid.Nil, "", err
+		}
+		return uuid.Nil, uuid.Nil, "", ERR_INVALID_REFRESH_TOKEN
+	}
+	if err != nil {
+		return uuid.Nil, uuid.Nil, "", err
+	}
+	next, err := s.createRefreshToken(stored.UserID, stored.Family)
+	if err != nil {
+		return uuid.Nil, uuid.Nil, "", err
+	}
+	if err := s.touchSession(stored, ip); err != nil {
+		return uuid.Nil, uuid.Nil, "", err
+	}
+	return stored.UserID, stored.Family, next, nil
+}
+
+// RevokeRefreshToken ends the login the refresh token belongs to.
+func (s *UserService) RevokeRefreshToken(userID uuid.UUID, token string) error {
+	stored, err := s.repo.GetRefreshToken(hasher.HashToken(token))
+	if err != nil || stored.UserID != userID {
+		return ERR_INVALID_REFRESH_TOKEN
+	}
+	return s.revokeSessions(stored.Family)
+}
+
+func (s *UserService) createRefreshToken(userID, family uuid.UUID) (string, error) {
+	token, err := hasher.GenerateToken()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	err = s.repo.CreateRefreshToken(repo.RefreshToken{
+		Hash:      hasher.HashToken(token),
+		UserID:    userID,
+		Family:    family,
+		CreatedAt: now,
+		ExpiresAt: now.Add(RefreshTokenTTL),
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
@@ -0,0 +1,220 @@
+package userservice
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/hasher"
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/http/userservice/repo"
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/mailer"
+	"github.com/google/uuid"
+)
+
+var (
+	ERR_INVALID_PATCH   = errors.New("invalid merge patch")
+	ERR_READ_ONLY_FIELD = errors.New("field can not be changed")
+	ERR_INVALID_EMAIL   = errors.New("invalid email")
+	ERR_WRONG_PASSWORD  = errors.New("wrong password")
+)
+
+// readOnlyFields are part of the user representation but have their own
+// endpoints or can not be changed by the user at all.
+var readOnlyFields = []string{
+	"id", "password", "verified", "emailVerified", "roles", "totpEnabled",
+	"credentials", "pendingEmail", "rating", "age", "linkedAccounts",
+}
+
+// PatchUser applies a JSON merge patch (RFC 7396) to the profile of the user.
+// Only the fields in the patch are changed, null resets a field. A new email
+// is only used once it has been confirmed, emailChanged reports that a
+// verification mail has to be sent to it.
+func (s *UserService) PatchUser(userID uuid.UUID, patch []byte) (emailChanged bool, err error) {
+	// any other json value would replace the whole user
+	if trimmed := bytes.TrimSpace(patch); len(trimmed) == 0 || trimmed[0] != '{' {
+		return false, ERR_INVALID_PATCH
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(patch, &fields); err != nil {
+		return false, ERR_INVALID_PATCH
+	}
+
+	user, err := s.repo.GetUserByID(userID)
+	if err != nil {
+		return false, err
+	}
+	// only the patched fields are written, concurrent changes of the others
+	// are kept
+	changed := make([]string, 0, len(fields))
+	for key, value := range fields {
+		changed = append(changed, key)
+		switch key {
+		case "firstName":
+			err = patchString(&user.FirstName, value)
+		case "lastName":
+			err = patchString(&user.LastName, value)
+		case "phoneNumber":
+			err = patchString(&user.PhoneNumber, value)
+		case "profilePicture":
+			err = patchString(&user.ProfilePicture, value)
+		case "birthDate":
+			var birthDate *time.Time
+			if err = json.Unmarshal(value, &birthDate); err == nil {
+				user.BirthDate = time.Time{}
+				if birthDate != nil {
+					user.BirthDate = *birthDate
+				}
+			}
+		case "privacy":
+			err = patchPrivacy(&user.Privacy, value)
+		case "email":
+			var email *string
+			if err = json.Unmarshal(value, &email); err != nil || email == nil {
+				return false, ERR_INVALID_EMAIL
+			}
+			emailChanged, err = s.requestEmailChange(&user, *email)
+			if err != nil {
+				return false, err
+			}
+			changed[len(changed)-1] = "pendingEmail"
+		default:
+			for _, field := range readOnlyFields {
+				if key == field {
+					return false, fmt.Errorf("%w: %s", ERR_READ_ONLY_FIELD, key)
+				}
+			}
+			return false, fmt.Errorf("%w: unknown field %s", ERR_INVALID_PATCH, key)
+		}
+		if err != nil {
+			if errors.Is(err, ERR_INVALID_VISIBILITY) {
+				return false, err
+			}
+			return false, fmt.Errorf("%w: %s", ERR_INVALID_PATCH, key)
+		}
+	}
+	return emailChanged, s.repo.UpdateUserFields(user, changed...)
+}
+
+// ChangePassword sets a new password after checking the current one. Wrong
+// passwords count as failed logins and the new one has to satisfy the policy.
+// All refresh tokens are revoked, the caller has to issue new ones for the
+// current device. The password is changed even if the notification mail can
+// not be sent.
+func (s *UserService) ChangePassword(userID uuid.UUID, current string, password string, ip string) error {
+	if err := s.CheckPassword(password); err != nil {
+		return err
+	}
+	user, err := s.repo.GetUserByID(userID)
+	if err != nil {
+		return err
+	}
+	if err := s.CheckLoginAllowed(user.Email, ip); err != nil {
+		return err
+	}
+	if hasher.VerifyPassword(user.Password, current) != nil {
+		s.RecordLoginFailure(user.Email, ip, user.ID)
+		return ERR_WRONG_PASSWORD
+	}
+
+	hashedPassword, err := s.hashPassword(password)
+	if err != nil {
+		return err
+	}
+	user.Password = hashedPassword
+	if err := s.repo.UpdateUserFields(user, "password"); err != nil {
+		return err
+	}
+	if err := s.RevokeAllSessions(user.ID); err != nil {
+		return err
+	}
+	err = s.mailer.Send(mailer.Message{
+		To:      user.Email,
+		Subject: "Dein Passwort wurde geändert",
+		Body: fmt.Sprintf(
+			"Hallo %s,\n\ndas Passwort deines Kontos wurde soeben geändert und du wurdest auf allen anderen Geräten abgemeldet. Falls du das nicht warst, setze dein Passwort über \"Passwort vergessen\" zurück.\n",
+			user.FirstName,
+		),
+	})
+	if err != nil {
+		log.Printf("Failed to send password change mail to user %s: %v", user.ID, err)
+	}
+	return nil
+}
+
+// requestEmailChange stores the new email as pending until it is confirmed
+// with VerifyEmail. Switching back to the current email drops the pending one.
+func (s *UserService) requestEmailChange(user *repo.User, email string) (bool, error) {
+	email = strings.TrimSpace(email)
+	if email == user.Email {
+		user.PendingEmail = ""
+		return false, nil
+	}
+	if address, err := mail.ParseAddress(email); err != nil || address.Address != email {
+		return false, ERR_INVALID_EMAIL
+	}
+	if other, err := s.repo.GetUserByEmail(email); err == nil && other.ID != user.ID {
+		return false, ERR_EMAIL_ALREADY_EXISTS
+	}
+	user.PendingEmail = email
+	return true, nil
+}
+
+// emailToVerify is the address the next verification link is meant for.
+func emailToVerify(user repo.User) string {
+	if user.PendingEmail != "" {
+		return user.PendingEmail
+	}
+	return user.Email
+}
+
+func patchString(field *string, value json.RawMessage) error {
+	var s *string
+	if err := json.Unmarshal(value, &s); err != nil {
+		return err
+	}
+	*field = ""
+	if s != nil {
+		*field = strings.TrimSpace(*s)
+	}
+	return nil
+}
+
+// patchPrivacy merges a nested patch into the privacy settings, null resets a
+// setting to its default.
+func patchPrivacy(privacy *repo.PrivacySettings, value json.RawMessage) error {
+	var fields map[string]*repo.Visibility
+	if err := json.Unmarshal(value, &fields); err != nil {
+		return err
+	}
+	if fields == nil {
+		*privacy = repo.PrivacySettings{}
+		return nil
+	}
+	for key, visibility := range fields {
+		var v repo.Visibility
+		if visibility != nil {
+			if !visibility.IsValid() {
+				return ERR_INVALID_VISIBILITY
+			}
+			v = *visibility
+		}
+		switch key {
+		case "lastName":
+			privacy.LastName = v
+		case "email":
+			privacy.Email = v
+		case "phoneNumber":
+			privacy.PhoneNumber = v
+		case "age":
+			privacy.Age = v
+		default:
+			return fmt.Errorf("unknown privacy field %s", key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package userservice
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/http/userservice/repo"
+	"github.com/google/uuid"
+)
+
+const (
+	// maxVehicleSeats is the most passenger seats a car offered for trips may have.
+	maxVehicleSeats = 8
+	maxVehicles     = 10
+)
+
+var (
+	ERR_VEHICLE_NOT_FOUND = errors.New("vehicle not found")
+	ERR_INVALID_VEHICLE   = errors.New("invalid vehicle")
+	ERR_DUPLICATE_PLATE   = errors.New("plate already registered")
+	ERR_TOO_MANY_VEHICLES = errors.New("too many vehicles")
+)
+
+// CreateVehicle registers a vehicle for the user. The id, the owner and the
+// media id for its photos are assigned here.
+func (s *UserService) CreateVehicle(ownerID uuid.UUID, vehicle repo.Vehicle) (repo.Vehicle, error) {
+	if _, err := s.repo.GetUserByID(ownerID); err != nil {
+		return repo.Vehicle{}, err
+	}
+	vehicles, err := s.repo.GetVehiclesOfOwner(ownerID)
+	if err != nil {
+		return repo.Vehicle{}, err
+	}
+	if len(vehicles) >= maxVehicles {
+		return repo.Vehicle{}, ERR_TOO_MANY_VEHICLES
+	}
+
+	vehicle.ID = uuid.New()
+	vehicle.OwnerID = ownerID
+	vehicle.PhotosID = uuid.NewString()
+	vehicle.CreatedAt = time.Now()
+	if err := validateVehicle(&vehicle, vehicles); err != nil {
+		return repo.Vehicle{}, err
+	}
+	if err := s.repo.CreateVehicle(vehicle); err != nil {
+		return repo.Vehicle{}, err
+	}
+	return vehicle, nil
+}
+
+// ListVehicles returns the vehicles of the user, oldest first.
+func (s *UserService) ListVehicles(ownerID uuid.UUID) ([]repo.Vehicle, error) {
+	return s.repo.GetVehiclesOfOwner(ownerID)
+}
+
+// GetVehicle returns a vehicle. Only the owner sees the plate.
+func (s *UserService) GetVehicle(callerID uuid.UUID, vehicleID uuid.UUID) (repo.Vehicle, error) {
+	vehicle, err := s.repo.GetVehicle(vehicleID)
+	if err != nil {
+		return repo.Vehicle{}, ERR_VEHICLE_NOT_FOUND
+	}
+	if vehicle.OwnerID != callerID {
+		return vehicle.Public(), nil
+	}
+	return vehicle, nil
+}
+
+// UpdateVehicle replaces the details of a vehicle of the user. The id, owner,
+// photos and creation time are kept.
+func (s *UserService) UpdateVehicle(ownerID uuid.UUID, vehicleID uuid.UUID, vehicle repo.Vehicle) (repo.Vehicle, error) {
+	stored, err := s.repo.GetVehicle(vehicleID)
+	if err != nil || stored.OwnerID != ownerID {
+		return repo.Vehicle{}, ERR_VEHICLE_NOT_FOUND
+	}
+	vehicles, err := s.repo.GetVehiclesOfOwner(ownerID)
+	if err != nil {
+		return repo.Vehicle{}, err
+	}
+
+	vehicle.ID = stored.ID
+	vehicle.OwnerID = stored.OwnerID
+	vehicle.PhotosID = stored.PhotosID
+	vehicle.CreatedAt = stored.CreatedAt
+	if err := validateVehicle(&vehicle, vehicles); err != nil {
+		return repo.Vehicle{}, err
+	}
+	if err := s.repo.UpdateVehicle(vehicle); err != nil {
+		return repo.Vehicle{}, err
+	}
+	return vehicle, nil
+}
+
+// DeleteVehicle removes a vehicle of the user. Offers that were created with
+// it keep the capacity they got from it.
+func (s *UserService) DeleteVehicle(ownerID uuid.UUID, vehicleID uuid.UUID) error {
+	vehicle, err := s.repo.GetVehicle(vehicleID)
+	if err != nil || vehicle.OwnerID != ownerID {
+		return ERR_VEHICLE_NOT_FOUND
+	}
+	return s.repo.DeleteVehicle(vehicleID)
+}
+
+// validateVehicle normalizes the vehicle and checks it against the other
+// vehicles of the owner, an owner can register a plate only once. Other users
+// may register the same plate, e.g. for a shared car.
+func validateVehicle(vehicle *repo.Vehicle, others []repo.Vehicle) error {
+	vehicle.Make = strings.TrimSpace(vehicle.Make)
+	vehicle.Model = strings.TrimSpace(vehicle.Model)
+	vehicle.Plate = strings.ToUpper(strings.Join(strings.Fields(vehicle.Plate), " "))
+
+	switch {
+	case vehicle.Make == "":
+		return fmt.Errorf("%w: make", ERR_INVALID_VEHICLE)
+	case vehicle.Model == "":
+		return fmt.Errorf("%w: model", ERR_INVALID_VEHICLE)
+	case vehicle.Seats < 0 || vehicle.Seats > maxVehicleSeats:
+		return fmt.Errorf("%w: seats", ERR_INVALID_VEHICLE)
+	case vehicle.Trunk.Width < 0 || vehicle.Trunk.Height < 0 || vehicle.Trunk.Depth < 0:
+		return fmt.Errorf("%w: trunk", ERR_INVALID_VEHICLE)
+	case vehicle.MaxPayload < 0:
+		return fmt.Errorf("%w: maxPayload", ERR_INVALID_VEHICLE)
+	}
+
+	features := make([]string, 0, len(vehicle.Features))
+	for _, feature := range vehicle.Features {
+		if feature = strings.TrimSpace(feature); feature != "" {
+			features = append(features, feature)
+		}
+	}
+	vehicle.Features = features
+
+	if vehicle.Plate == "" {
+		return nil
+	}
+	for _, other := range others {
+		if other.ID != vehicle.ID && other.Plate == vehicle.Plate {
+			return ERR_DUPLICATE_PLATE
+		}
+	}
+	return nil
+}
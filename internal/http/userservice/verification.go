@@ -0,0 +1,83 @@
+package userservice
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/http/userservice/repo"
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/mailer"
+	"github.com/google/uuid"
+)
+
+const (
+	PurposeVerification  = "verify"
+	VerificationTokenTTL = 24 * time.Hour
+)
+
+var (
+	ERR_INVALID_VERIFICATION = errors.New("invalid verification token")
+	ERR_ALREADY_VERIFIED     = errors.New("email already verified")
+)
+
+// SendVerificationMail mails the link to confirm the users email address, or
+// the new address if the user is changing it.
+func (s *UserService) SendVerificationMail(user repo.User, token string) error {
+	if user.Verified && user.PendingEmail == "" {
+		return ERR_ALREADY_VERIFIED
+	}
+	link := fmt.Sprintf("%s/api/user/verify?token=%s", s.baseURL, url.QueryEscape(token))
+	return s.mailer.Send(mailer.Message{
+		To:      emailToVerify(user),
+		Subject: "Bitte bestätige deine E-Mail-Adresse",
+		Body: fmt.Sprintf(
+			"Hallo %s,\n\nbitte bestätige deine E-Mail-Adresse über den folgenden Link:\n\n%s\n\nDer Link ist %d Stunden gültig.\n",
+			user.FirstName, link, int(VerificationTokenTTL.Hours()),
+		),
+	})
+}
+
+// VerifyEmail marks the email of the user as confirmed. The email must be the
+// one the verification token was issued for, so links sent to a previous
+// address can not confirm a new one. Confirming a pending email replaces the
+// current one, the old address is told about the change.
+func (s *UserService) VerifyEmail(userID uuid.UUID, email string) error {
+	user, err := s.repo.GetUserByID(userID)
+	if err != nil {
+		return ERR_INVALID_VERIFICATION
+	}
+	if user.PendingEmail != "" && user.PendingEmail == email {
+		return s.confirmEmailChange(user)
+	}
+	if user.Email != email {
+		return ERR_INVALID_VERIFICATION
+	}
+	if user.Verified {
+		return nil
+	}
+	user.Verified = true
+	return s.repo.UpdateUserFields(user, "verified")
+}
+
+func (s *UserService) confirmEmailChange(user repo.User) error {
+	// the address may have been taken since the change was requested
+	if other, err := s.repo.GetUserByEmail(user.PendingEmail); err == nil && other.ID != user.ID {
+		return ERR_EMAIL_ALREADY_EXISTS
+	}
+	previous := user.Email
+	user.Email = user.PendingEmail
+	user.PendingEmail = ""
+	user.Verified = true
+	if err := s.repo.UpdateUserFields(user, "email", "pendingEmail", "verified"); err != nil {
+		return err
+	}
+	return s.mailer.Send(mailer.Message{
+		To:      previous,
+		Subject: "Deine E-Mail-Adresse wurde geändert",
+		Body: fmt.Sprintf(
+			"Hallo %s,\n\ndie E-Mail-Adresse deines Kontos wurde zu %s geändert. Falls du das nicht warst, wende dich bitte an den Support.\n",
+			user.FirstName, user.Email,
+		),
+	})
+}
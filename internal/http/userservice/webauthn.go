@@ -0,0 +1,186 @@
+package userservice
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/hasher"
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/http/userservice/repo"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+)
+
+const WebAuthnSessionTTL = 5 * time.Minute
+
+var (
+	ERR_INVALID_WEBAUTHN_SESSION = errors.New("invalid webauthn session")
+	ERR_PASSKEY_LOGIN_FAILED     = errors.New("passkey login failed")
+	ERR_NO_PASSKEYS              = errors.New("user has no passkeys")
+)
+
+// BeginPasskeyRegistration starts registering a new passkey for the user. The
+// returned session id has to be passed to FinishPasskeyRegistration.
+func (s *UserService) BeginPasskeyRegistration(userID uuid.UUID) (*protocol.CredentialCreation, string, error) {
+	user, err := s.repo.GetUserByID(userID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	exclusions := make([]protocol.CredentialDescriptor, 0, len(user.Credentials))
+	for _, cred := range user.Credentials {
+		exclusions = append(exclusions, cred.Descriptor())
+	}
+	// passkeys should be discoverable so they can be used without entering an email
+	options, data, err := s.webauth.BeginRegistration(user,
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementPreferred),
+		webauthn.WithExclusions(exclusions),
+	)
+	if err != nil {
+		return nil, "", err
+	}
+	sessionID, err := s.createWebAuthnSession(user.ID, data)
+	if err != nil {
+		return nil, "", err
+	}
+	return options, sessionID, nil
+}
+
+// FinishPasskeyRegistration checks the response of the authenticator and adds
+// the new passkey to the user.
+func (s *UserService) FinishPasskeyRegistration(userID uuid.UUID, sessionID string, name string, r *http.Request) error {
+	session, err := s.takeWebAuthnSession(sessionID)
+	if err != nil || session.UserID != userID {
+		return ERR_INVALID_WEBAUTHN_SESSION
+	}
+	user, err := s.repo.GetUserByID(userID)
+	if err != nil {
+		return err
+	}
+
+	cred, err := s.webauth.FinishRegistration(user, session.Data, r)
+	if err != nil {
+		return err
+	}
+	user.AddCredential(cred)
+	if name = strings.TrimSpace(name); validatePasskeyName(name) == nil {
+		user.Passkey(cred.ID).Name = name
+	}
+	return s.repo.UpdateUserFields(user, "credentials", "passkeys")
+}
+
+// BeginPasskeyLogin starts a passkey login. Without an email the login is
+// discoverable and the account is taken from the passkey the user picks.
+func (s *UserService) BeginPasskeyLogin(email string) (*protocol.CredentialAssertion, string, error) {
+	if email == "" {
+		options, data, err := s.webauth.BeginDiscoverableLogin()
+		if err != nil {
+			return nil, "", err
+		}
+		sessionID, err := s.createWebAuthnSession(uuid.Nil, data)
+		if err != nil {
+			return nil, "", err
+		}
+		return options, sessionID, nil
+	}
+
+	user, err := s.repo.GetUserByEmail(email)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(user.Credentials) == 0 {
+		return nil, "", ERR_NO_PASSKEYS
+	}
+	options, data, err := s.webauth.BeginLogin(user)
+	if err != nil {
+		return nil, "", err
+	}
+	sessionID, err := s.createWebAuthnSession(user.ID, data)
+	if err != nil {
+		return nil, "", err
+	}
+	return options, sessionID, nil
+}
+
+// FinishPasskeyLogin checks the assertion for a session of BeginPasskeyLogin
+// and returns the user that logged in. Failures count like failed password
+// logins.
+func (s *UserService) FinishPasskeyLogin(sessionID string, ip string, r *http.Request) (repo.User, error) {
+	if err := s.CheckLoginAllowed("", ip); err != nil {
+		return repo.User{}, err
+	}
+	session, err := s.takeWebAuthnSession(sessionID)
+	if err != nil {
+		s.RecordLoginFailure("", ip, uuid.Nil)
+		return repo.User{}, ERR_INVALID_WEBAUTHN_SESSION
+	}
+
+	var user repo.User
+	var cred *webauthn.Credential
+	if session.UserID != uuid.Nil {
+		user, err = s.repo.GetUserByID(session.UserID)
+		if err != nil {
+			return repo.User{}, ERR_PASSKEY_LOGIN_FAILED
+		}
+		if err := s.CheckLoginAllowed(user.Email, ""); err != nil {
+			return repo.User{}, err
+		}
+		cred, err = s.webauth.FinishLogin(user, session.Data, r)
+	} else {
+		cred, err = s.webauth.FinishDiscoverableLogin(func(rawID, userHandle []byte) (webauthn.User, error) {
+			id, err := uuid.FromBytes(userHandle)
+			if err != nil {
+				return nil, err
+			}
+			user, err = s.repo.GetUserByID(id)
+			return user, err
+		}, session.Data, r)
+		if err == nil {
+			// the account is only known now, a locked account stays locked
+			if err := s.CheckLoginAllowed(user.Email, ""); err != nil {
+				return repo.User{}, err
+			}
+		}
+	}
+	if err != nil {
+		s.RecordLoginFailure(user.Email, ip, user.ID)
+		return repo.User{}, ERR_PASSKEY_LOGIN_FAILED
+	}
+
+	s.RecordLoginSuccess(user.Email)
+	if err := s.RecordPasskeyLogin(user.ID, cred); err != nil {
+		return repo.User{}, err
+	}
+	return s.repo.GetUserByID(user.ID)
+}
+
+func (s *UserService) createWebAuthnSession(userID uuid.UUID, data *webauthn.SessionData) (string, error) {
+	sessionID, err := hasher.GenerateToken()
+	if err != nil {
+		return "", err
+	}
+	err = s.repo.CreateWebAuthnSession(repo.WebAuthnSession{
+		Hash:      hasher.HashToken(sessionID),
+		UserID:    userID,
+		Data:      *data,
+		ExpiresAt: time.Now().Add(WebAuthnSessionTTL),
+	})
+	if err != nil {
+		return "", err
+	}
+	return sessionID, nil
+}
+
+func (s *UserService) takeWebAuthnSession(sessionID string) (repo.WebAuthnSession, error) {
+	if sessionID == "" {
+		return repo.WebAuthnSession{}, ERR_INVALID_WEBAUTHN_SESSION
+	}
+	session, err := s.repo.TakeWebAuthnSession(hasher.HashToken(sessionID))
+	// mongo removes expired documents only periodically
+	if err != nil || session.ExpiresAt.Before(time.Now()) {
+		return repo.WebAuthnSession{}, ERR_INVALID_WEBAUTHN_SESSION
+	}
+	return session, nil
+}
@@ -3,30 +3,89 @@ package jwt
 import (
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/golang-jwt/jwt"
 	"github.com/google/uuid"
 )
 
 var (
-	ErrInvalidToken  = errors.New("invalid token")
-	ErrInvalidClaims = errors.New("invalid claims")
-	ErrInvalidUUID   = errors.New("invalid uuid")
+	ErrInvalidToken   = errors.New("invalid token")
+	ErrInvalidClaims  = errors.New("invalid claims")
+	ErrInvalidUUID    = errors.New("invalid uuid")
+	ErrRevokedToken   = errors.New("revoked token")
+	ErrInvalidPurpose = errors.New("invalid purpose")
 )
 
 type Decodable interface {
 	DecodeUUID(tokenString string) (uuid.UUID, error)
+	DecodeClaims(tokenString string) (Claims, error)
+}
+
+// Claims are the values carried by a token issued by Encoder.
+type Claims struct {
+	UserID    uuid.UUID
+	TokenID   string
+	ExpiresAt time.Time
+	Verified  bool
+	Roles     []string
+	// Purpose is set for single-use tokens like email verification links,
+	// which must never be accepted as access tokens.
+	Purpose string
+	Email   string
+	// SessionID identifies the login the token was issued for, revoking it
+	// rejects every access token of that login.
+	SessionID string
 }
 
 type Decoder struct {
-	key []byte
+	key      []byte
+	denylist *Denylist
 }
 
 func NewDecoder(key []byte) *Decoder {
 	return &Decoder{key: key}
 }
 
+// WithDenylist makes the decoder reject tokens whose id has been revoked.
+func (d *Decoder) WithDenylist(denylist *Denylist) *Decoder {
+	d.denylist = denylist
+	return d
+}
+
 func (d *Decoder) DecodeUUID(tokenString string) (uuid.UUID, error) {
+	claims, err := d.DecodeClaims(tokenString)
+	if err != nil {
+		return uuid.UUID{}, err
+	}
+	return claims.UserID, nil
+}
+
+// DecodeClaims decodes an access token.
+func (d *Decoder) DecodeClaims(tokenString string) (Claims, error) {
+	claims, err := d.decode(tokenString)
+	if err != nil {
+		return Claims{}, err
+	}
+	if claims.Purpose != "" {
+		return Claims{}, ErrInvalidPurpose
+	}
+	return claims, nil
+}
+
+// DecodePurpose decodes a token that was issued for the given purpose only.
+func (d *Decoder) DecodePurpose(tokenString string, purpose string) (Claims, error) {
+	claims, err := d.decode(tokenString)
+	if err != nil {
+		return Claims{}, err
+	}
+	if purpose == "" || claims.Purpose != purpose {
+		return Claims{}, ErrInvalidPurpose
+	}
+	return claims, nil
+}
+
+func (d *Decoder) decode(tokenString string) (Claims, error) {
 	// Token parsen
 	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
 		// Sicherstellen, dass der Signatur-Algorithmus stimmt
@@ -38,24 +97,59 @@ func (d *Decoder) DecodeUUID(tokenString string) (uuid.UUID, error) {
 
 	// Wenn Parsen fehlgeschlagen ist oder Token ungültig ist
 	if err != nil || !token.Valid {
-		return uuid.UUID{}, ErrInvalidToken
+		return Claims{}, ErrInvalidToken
 	}
 
 	// Claims extrahieren
-	claims, ok := token.Claims.(jwt.MapClaims)
+	mapClaims, ok := token.Claims.(jwt.MapClaims)
 	if !ok {
-		return uuid.UUID{}, ErrInvalidClaims
+		return Claims{}, ErrInvalidClaims
 	}
 
-	id, ok := claims["uuid"].(string)
+	id, ok := mapClaims["uuid"].(string)
 	if !ok {
-		return uuid.UUID{}, ErrInvalidClaims
+		return Claims{}, ErrInvalidClaims
 	}
 
 	uid, err := uuid.Parse(id)
 	if err != nil {
-		return uuid.UUID{}, ErrInvalidUUID
+		return Claims{}, ErrInvalidUUID
+	}
+
+	claims := Claims{UserID: uid}
+	if jti, ok := mapClaims["jti"].(string); ok {
+		claims.TokenID = jti
+	}
+	if exp, ok := mapClaims["exp"].(float64); ok {
+		claims.ExpiresAt = time.Unix(int64(exp), 0)
+	}
+	if verified, ok := mapClaims["verified"].(bool); ok {
+		claims.Verified = verified
+	}
+	if roles, ok := mapClaims["roles"].([]interface{}); ok {
+		for _, role := range roles {
+			if role, ok := role.(string); ok {
+				claims.Roles = append(claims.Roles, role)
+			}
+		}
+	}
+	if purpose, ok := mapClaims["purpose"].(string); ok {
+		claims.Purpose = purpose
+	}
+	if email, ok := mapClaims["email"].(string); ok {
+		claims.Email = email
+	}
+	if sid, ok := mapClaims["sid"].(string); ok {
+		claims.SessionID = sid
+	}
+
+	// Widerrufene Tokens ablehnen
+	if d.denylist != nil && claims.TokenID != "" && d.denylist.Contains(claims.TokenID) {
+		return Claims{}, ErrRevokedToken
+	}
+	if d.denylist != nil && claims.SessionID != "" && d.denylist.Contains(claims.SessionID) {
+		return Claims{}, ErrRevokedToken
 	}
 
-	return uid, nil
+	return claims, nil
 }
@@ -0,0 +1,41 @@
+package jwt
+
+import (
+	"sync"
+	"time"
+)
+
+// Denylist holds the ids of revoked tokens and sessions until their tokens
+// would have expired anyway.
+type Denylist struct {
+	mu      sync.RWMutex
+	entries map[string]time.Time
+}
+
+func NewDenylist() *Denylist {
+	return &Denylist{
+		entries: make(map[string]time.Time),
+	}
+}
+
+func (d *Denylist) Add(tokenID string, expiresAt time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// drop entries of tokens that are expired by now
+	now := time.Now()
+	for id, exp := range d.entries {
+		if exp.Before(now) {
+			delete(d.entries, id)
+		}
+	}
+	d.entries[tokenID] = expiresAt
+}
+
+func (d *Denylist) Contains(tokenID string) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	_, ok := d.entries[tokenID]
+	return ok
+}
@@ -18,10 +18,32 @@ func NewEncoder(key []byte) *Encoder {
 }
 
 func (e *Encoder) EncodeUUID(id uuid.UUID, ttl time.Duration) (string, error) {
+	return e.EncodeClaims(Claims{UserID: id}, ttl)
+}
+
+// EncodeClaims signs the given claims. TokenID and ExpiresAt are ignored,
+// every token gets a new id and expires after ttl.
+func (e *Encoder) EncodeClaims(c Claims, ttl time.Duration) (string, error) {
 	claims := jwt.MapClaims{
-		"uuid": id.String(),
+		"uuid": c.UserID.String(),
+		"jti":  uuid.New().String(),
 		"exp":  time.Now().Add(ttl).Unix(),
 	}
+	if c.Verified {
+		claims["verified"] = true
+	}
+	if len(c.Roles) > 0 {
+		claims["roles"] = c.Roles
+	}
+	if c.Purpose != "" {
+		claims["purpose"] = c.Purpose
+	}
+	if c.Email != "" {
+		claims["email"] = c.Email
+	}
+	if c.SessionID != "" {
+		claims["sid"] = c.SessionID
+	}
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 
 	return token.SignedString(e.key)
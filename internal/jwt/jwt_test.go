@@ -77,3 +77,97 @@ func TestDecodeExpiredToken(t *testing.T) {
 		t.Errorf("Expected error decoding expired token")
 	}
 }
+
+func TestDecodeRevokedToken(t *testing.T) {
+	id := uuid.New()
+	token, err := NewEncoder([]byte("some secret")).EncodeUUID(id, time.Hour)
+	if err != nil {
+		t.Errorf("Failed to encode token: %v", err)
+	}
+	denylist := NewDenylist()
+	decoder := NewDecoder([]byte("some secret")).WithDenylist(denylist)
+
+	claims, err := decoder.DecodeClaims(token)
+	if err != nil {
+		t.Errorf("Failed to decode token: %v", err)
+	}
+	if claims.TokenID == "" {
+		t.Errorf("Token id is empty")
+	}
+
+	denylist.Add(claims.TokenID, claims.ExpiresAt)
+	_, err = decoder.DecodeUUID(token)
+	if err != ErrRevokedToken {
+		t.Errorf("Expected revoked token error, got %v", err)
+	}
+}
+
+func TestDecodeRevokedSession(t *testing.T) {
+	sessionID := uuid.NewString()
+	encoder := NewEncoder([]byte("some secret"))
+	token, err := encoder.EncodeClaims(Claims{UserID: uuid.New(), SessionID: sessionID}, time.Hour)
+	if err != nil {
+		t.Errorf("Failed to encode token: %v", err)
+	}
+	other, err := encoder.EncodeClaims(Claims{UserID: uuid.New(), SessionID: uuid.NewString()}, time.Hour)
+	if err != nil {
+		t.Errorf("Failed to encode token: %v", err)
+	}
+	denylist := NewDenylist()
+	decoder := NewDecoder([]byte("some secret")).WithDenylist(denylist)
+
+	claims, err := decoder.DecodeClaims(token)
+	if err != nil || claims.SessionID != sessionID {
+		t.Errorf("Expected session id %s, got %q (%v)", sessionID, claims.SessionID, err)
+	}
+
+	denylist.Add(sessionID, time.Now().Add(time.Hour))
+	if _, err := decoder.DecodeClaims(token); err != ErrRevokedToken {
+		t.Errorf("Expected revoked token error, got %v", err)
+	}
+	if _, err := decoder.DecodeClaims(other); err != nil {
+		t.Errorf("Tokens of other sessions should stay valid, got %v", err)
+	}
+}
+
+func TestDecodePurpose(t *testing.T) {
+	id := uuid.New()
+	encoder := NewEncoder([]byte("some secret"))
+	decoder := NewDecoder([]byte("some secret"))
+
+	token, err := encoder.EncodeClaims(Claims{UserID: id, Purpose: "verify", Email: "a@example.com"}, time.Hour)
+	if err != nil {
+		t.Errorf("Failed to encode token: %v", err)
+	}
+
+	claims, err := decoder.DecodePurpose(token, "verify")
+	if err != nil {
+		t.Errorf("Failed to decode token: %v", err)
+	}
+	if claims.UserID != id || claims.Email != "a@example.com" {
+		t.Errorf("Decoded claims do not match original claims")
+	}
+
+	if _, err := decoder.DecodePurpose(token, "reset"); err != ErrInvalidPurpose {
+		t.Errorf("Expected invalid purpose error, got %v", err)
+	}
+	// tokens with a purpose must not be usable as access tokens
+	if _, err := decoder.DecodeUUID(token); err != ErrInvalidPurpose {
+		t.Errorf("Expected invalid purpose error, got %v", err)
+	}
+}
+
+func TestDecodeRoles(t *testing.T) {
+	id := uuid.New()
+	token, err := NewEncoder([]byte("some secret")).EncodeClaims(Claims{UserID: id, Roles: []string{"user", "admin"}}, time.Hour)
+	if err != nil {
+		t.Errorf("Failed to encode token: %v", err)
+	}
+	claims, err := NewDecoder([]byte("some secret")).DecodeClaims(token)
+	if err != nil {
+		t.Errorf("Failed to decode token: %v", err)
+	}
+	if len(claims.Roles) != 2 || claims.Roles[0] != "user" || claims.Roles[1] != "admin" {
+		t.Errorf("Decoded roles do not match original roles: %v", claims.Roles)
+	}
+}
@@ -4,9 +4,22 @@ import "github.com/google/uuid"
 
 // mockDecoder implements jwt.Decodable for testing
 type MockDecoder struct {
-	DecodeFunc func(token string) (uuid.UUID, error)
+	DecodeFunc       func(token string) (uuid.UUID, error)
+	DecodeClaimsFunc func(token string) (Claims, error)
 }
 
 func (m *MockDecoder) DecodeUUID(token string) (uuid.UUID, error) {
 	return m.DecodeFunc(token)
 }
+
+// DecodeClaims falls back to DecodeFunc when no DecodeClaimsFunc is set
+func (m *MockDecoder) DecodeClaims(token string) (Claims, error) {
+	if m.DecodeClaimsFunc != nil {
+		return m.DecodeClaimsFunc(token)
+	}
+	id, err := m.DecodeFunc(token)
+	if err != nil {
+		return Claims{}, err
+	}
+	return Claims{UserID: id}, nil
+}
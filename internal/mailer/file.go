@@ -0,0 +1,29 @@
+package mailer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// FileMailer writes every mail as a file into a directory,
+// which is handy for local development without a mail server.
+type FileMailer struct {
+	dir string
+}
+
+func NewFileMailer(dir string) *FileMailer {
+	return &FileMailer{dir: dir}
+}
+
+func (m *FileMailer) Send(msg Message) error {
+	if err := os.MkdirAll(m.dir, 0o755); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%s.eml", time.Now().Format("20060102-150405"), uuid.New())
+	content := fmt.Sprintf("To: %s\r\nSubject: %s\r\n\r\n%s", msg.To, msg.Subject, msg.Body)
+	return os.WriteFile(filepath.Join(m.dir, name), []byte(content), 0o644)
+}
@@ -0,0 +1,13 @@
+package mailer
+
+// Message is a plain text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers emails to users.
+type Mailer interface {
+	Send(msg Message) error
+}
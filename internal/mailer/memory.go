@@ -0,0 +1,35 @@
+package mailer
+
+import "sync"
+
+// MemoryMailer keeps all mails in memory, it is meant for tests.
+type MemoryMailer struct {
+	mu       sync.RWMutex
+	messages []Message
+}
+
+func NewMemoryMailer() *MemoryMailer {
+	return &MemoryMailer{}
+}
+
+func (m *MemoryMailer) Send(msg Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.messages = append(m.messages, msg)
+	return nil
+}
+
+// Messages returns all mails sent to the given address.
+func (m *MemoryMailer) Messages(to string) []Message {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var result []Message
+	for _, msg := range m.messages {
+		if msg.To == to {
+			result = append(result, msg)
+		}
+	}
+	return result
+}
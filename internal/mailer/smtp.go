@@ -0,0 +1,42 @@
+package mailer
+
+import (
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+)
+
+// SMTPMailer sends mails through an SMTP server.
+type SMTPMailer struct {
+	addr string
+	auth smtp.Auth
+	from string
+}
+
+// NewSMTPMailer creates a mailer for the given server. If username is empty
+// the server is used without authentication.
+func NewSMTPMailer(host, port, username, password, from string) *SMTPMailer {
+	var auth smtp.Auth
+	if username != "" {
+		auth = smtp.PlainAuth("", username, password, host)
+	}
+	return &SMTPMailer{
+		addr: net.JoinHostPort(host, port),
+		auth: auth,
+		from: from,
+	}
+}
+
+func (m *SMTPMailer) Send(msg Message) error {
+	var body strings.Builder
+	fmt.Fprintf(&body, "From: %s\r\n", m.from)
+	fmt.Fprintf(&body, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&body, "Subject: %s\r\n", msg.Subject)
+	body.WriteString("MIME-Version: 1.0\r\n")
+	body.WriteString("Content-Type: text/plain; charset=\"utf-8\"\r\n")
+	body.WriteString("\r\n")
+	body.WriteString(msg.Body)
+
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{msg.To}, []byte(body.String()))
+}
@@ -0,0 +1,47 @@
+package auth
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/audit"
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/jwt"
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/server"
+	"github.com/google/uuid"
+)
+
+// WithAudit sends rejected tokens and requests without the required role to
+// the audit log, recorded as coming from the given service.
+func (m *AuthMiddleware) WithAudit(conn audit.Publisher, service string) *AuthMiddleware {
+	m.audit = conn
+	m.service = service
+	return m
+}
+
+// auditRejectedToken records tokens that were valid once but must not be used,
+// expired and malformed tokens are too common to be worth recording.
+func (m *AuthMiddleware) auditRejectedToken(r *http.Request, err error) {
+	if !errors.Is(err, jwt.ErrRevokedToken) && !errors.Is(err, jwt.ErrInvalidPurpose) {
+		return
+	}
+	m.record(r, audit.Event{Type: audit.TokenRejected, Details: map[string]string{"reason": err.Error()}})
+}
+
+func (m *AuthMiddleware) record(r *http.Request, event audit.Event) {
+	if m.audit == nil {
+		return
+	}
+	event.ID = uuid.New()
+	event.IP = server.ClientIP(r)
+	event.UserAgent = r.UserAgent()
+	event.Service = m.service
+	if event.Details == nil {
+		event.Details = map[string]string{}
+	}
+	event.Details["method"] = r.Method
+	event.Details["path"] = r.URL.Path
+	if err := audit.Publish(m.audit, event); err != nil {
+		log.Println("Failed to publish audit event:", err)
+	}
+}
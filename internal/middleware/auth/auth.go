@@ -1,22 +1,40 @@
 package auth
 
 import (
+	"errors"
 	"net/http"
+	"strings"
 
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/audit"
 	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/jwt"
 )
 
+const (
+	UserIdHeader    = "UserId"
+	UserRolesHeader = "UserRoles"
+)
+
 type AuthMiddleware struct {
 	// Add fields here
-	decoder jwt.Decodable
+	decoder  jwt.Decodable
+	denylist *jwt.Denylist
+	audit    audit.Publisher
+	service  string
 }
 
 func NewAuthMiddleware(secret []byte) *AuthMiddleware {
+	denylist := jwt.NewDenylist()
 	return &AuthMiddleware{
-		decoder: jwt.NewDecoder(secret),
+		decoder:  jwt.NewDecoder(secret).WithDenylist(denylist),
+		denylist: denylist,
 	}
 }
 
+// Denylist returns the revoked token ids consulted by EnsureJWT.
+func (m *AuthMiddleware) Denylist() *jwt.Denylist {
+	return m.denylist
+}
+
 func (m *AuthMiddleware) EnsureJWT(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		token := r.Header.Get("Authorization")
@@ -25,19 +43,71 @@ func (m *AuthMiddleware) EnsureJWT(next http.HandlerFunc) http.HandlerFunc {
 			return
 		}
 
-		userID, err := m.decoder.DecodeUUID(token)
+		claims, err := m.decoder.DecodeClaims(token)
 		if err != nil {
-			switch err {
-			case jwt.ErrInvalidToken:
+			m.auditRejectedToken(r, err)
+			switch {
+			case errors.Is(err, jwt.ErrInvalidToken):
 				http.Error(w, "Invalid token", http.StatusUnauthorized)
-			case jwt.ErrInvalidClaims:
+			case errors.Is(err, jwt.ErrInvalidClaims):
 				http.Error(w, "Token is expired", http.StatusUnauthorized)
+			case errors.Is(err, jwt.ErrRevokedToken):
+				http.Error(w, "Token has been revoked", http.StatusUnauthorized)
+			case errors.Is(err, jwt.ErrInvalidPurpose):
+				http.Error(w, "Token can not be used for authentication", http.StatusUnauthorized)
 			default:
 				http.Error(w, "Unknown error", http.StatusInternalServerError)
 			}
 			return
 		}
-		r.Header.Add("UserId", userID.String())
+		setIdentity(r, claims)
 		next.ServeHTTP(w, r)
 	})
 }
+
+// EnsureVerified works like EnsureJWT but additionally requires the user to
+// have confirmed their email address.
+func (m *AuthMiddleware) EnsureVerified(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := r.Header.Get("Authorization")
+		if token == "" {
+			http.Error(w, "Authorization header is missing", http.StatusUnauthorized)
+			return
+		}
+
+		claims, err := m.decoder.DecodeClaims(token)
+		if err != nil {
+			m.auditRejectedToken(r, err)
+			http.Error(w, "Invalid token", http.StatusUnauthorized)
+			return
+		}
+		if !claims.Verified {
+			http.Error(w, "Email address is not verified", http.StatusForbidden)
+			return
+		}
+		setIdentity(r, claims)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// OptionalJWT sets the identity headers if the request carries a valid token.
+// Requests without or with an invalid token are passed on as anonymous.
+func (m *AuthMiddleware) OptionalJWT(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Del(UserIdHeader)
+		r.Header.Del(UserRolesHeader)
+		if token := r.Header.Get("Authorization"); token != "" {
+			if claims, err := m.decoder.DecodeClaims(token); err == nil {
+				setIdentity(r, claims)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// setIdentity passes the authenticated user on to the handler. The headers are
+// overwritten so a client can not smuggle in its own values.
+func setIdentity(r *http.Request, claims jwt.Claims) {
+	r.Header.Set(UserIdHeader, claims.UserID.String())
+	r.Header.Set(UserRolesHeader, strings.Join(claims.Roles, ","))
+}
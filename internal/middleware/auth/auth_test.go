@@ -1,10 +1,14 @@
 package auth
 
 import (
+	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/audit"
 	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/jwt"
 	"github.com/google/uuid"
 )
@@ -49,6 +53,33 @@ func TestEnsureJWT(t *testing.T) {
 			wantStatus:     http.StatusUnauthorized,
 			wantUserHeader: false,
 		},
+		{
+			name:       "Revoked Token",
+			authHeader: "revoked-token",
+			mockDecodeFunc: func(token string) (uuid.UUID, error) {
+				return uuid.Nil, jwt.ErrRevokedToken
+			},
+			wantStatus:     http.StatusUnauthorized,
+			wantUserHeader: false,
+		},
+		{
+			name:       "Purpose Token",
+			authHeader: "verification-token",
+			mockDecodeFunc: func(token string) (uuid.UUID, error) {
+				return uuid.Nil, jwt.ErrInvalidPurpose
+			},
+			wantStatus:     http.StatusUnauthorized,
+			wantUserHeader: false,
+		},
+		{
+			name:       "Wrapped Invalid Token",
+			authHeader: "wrapped-token",
+			mockDecodeFunc: func(token string) (uuid.UUID, error) {
+				return uuid.Nil, fmt.Errorf("decoding: %w", jwt.ErrInvalidToken)
+			},
+			wantStatus:     http.StatusUnauthorized,
+			wantUserHeader: false,
+		},
 		{
 			name:       "Valid Token",
 			authHeader: "valid-token",
@@ -94,3 +125,219 @@ func TestEnsureJWT(t *testing.T) {
 		})
 	}
 }
+
+func TestEnsureJWT_RevokedSession(t *testing.T) {
+	secret := []byte("secret")
+	mw := NewAuthMiddleware(secret)
+	sessionID := uuid.NewString()
+	token, err := jwt.NewEncoder(secret).EncodeClaims(jwt.Claims{UserID: uuid.New(), SessionID: sessionID}, time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to encode token: %v", err)
+	}
+	handler := mw.EnsureJWT(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	request := func() int {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", token)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := request(); code != http.StatusOK {
+		t.Errorf("expected status %d, got %d", http.StatusOK, code)
+	}
+	mw.Revoke(sessionID, time.Now().Add(time.Hour))
+	if code := request(); code != http.StatusUnauthorized {
+		t.Errorf("expected status %d after revoking the session, got %d", http.StatusUnauthorized, code)
+	}
+}
+
+func TestEnsureVerified(t *testing.T) {
+	tests := []struct {
+		name       string
+		claims     jwt.Claims
+		err        error
+		wantStatus int
+	}{
+		{
+			name:       "Invalid Token",
+			err:        jwt.ErrInvalidToken,
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "Unverified User",
+			claims:     jwt.Claims{UserID: uuid.New()},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "Verified User",
+			claims:     jwt.Claims{UserID: uuid.New(), Verified: true},
+			wantStatus: http.StatusOK,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			mw := NewAuthMiddleware([]byte("secret"))
+			injectDecoder(mw, &jwt.MockDecoder{DecodeClaimsFunc: func(token string) (jwt.Claims, error) {
+				return tc.claims, tc.err
+			}})
+
+			testHandler := mw.EnsureVerified(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("UserId") != tc.claims.UserID.String() {
+					t.Error("UserId header not set")
+				}
+				w.WriteHeader(http.StatusOK)
+			})
+
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set("Authorization", "token")
+			rec := httptest.NewRecorder()
+
+			testHandler.ServeHTTP(rec, req)
+
+			if rec.Code != tc.wantStatus {
+				t.Errorf("expected status %d, got %d", tc.wantStatus, rec.Code)
+			}
+		})
+	}
+}
+
+func TestRequireRole(t *testing.T) {
+	tests := []struct {
+		name       string
+		roles      []string
+		required   []string
+		wantStatus int
+	}{
+		{
+			name:       "Missing Role",
+			roles:      []string{RoleUser},
+			required:   []string{RoleModerator},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "Matching Role",
+			roles:      []string{RoleUser, RoleModerator},
+			required:   []string{RoleModerator},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "Admin",
+			roles:      []string{RoleAdmin},
+			required:   []string{RoleModerator},
+			wantStatus: http.StatusOK,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			publisher := &auditPublisher{}
+			mw := NewAuthMiddleware([]byte("secret")).WithAudit(publisher, "test")
+			injectDecoder(mw, &jwt.MockDecoder{DecodeClaimsFunc: func(token string) (jwt.Claims, error) {
+				return jwt.Claims{UserID: uuid.New(), Roles: tc.roles}, nil
+			}})
+
+			testHandler := mw.RequireRole(tc.required...)(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})
+
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set("Authorization", "token")
+			// roles sent by the client must be ignored
+			req.Header.Set(UserRolesHeader, RoleAdmin)
+			rec := httptest.NewRecorder()
+
+			testHandler.ServeHTTP(rec, req)
+
+			if rec.Code != tc.wantStatus {
+				t.Errorf("expected status %d, got %d", tc.wantStatus, rec.Code)
+			}
+			if tc.wantStatus != http.StatusForbidden {
+				if len(publisher.events) != 0 {
+					t.Errorf("expected no audit event but got %+v", publisher.events)
+				}
+				return
+			}
+			if len(publisher.events) != 1 || publisher.events[0].Type != audit.AccessDenied || publisher.events[0].Service != "test" {
+				t.Errorf("expected the denied access to be audited but got %+v", publisher.events)
+			}
+		})
+	}
+}
+
+// auditPublisher keeps the audit events sent by the middleware.
+type auditPublisher struct {
+	events []audit.Event
+}
+
+func (p *auditPublisher) Publish(subject string, data []byte) error {
+	var event audit.Event
+	if err := json.Unmarshal(data, &event); err != nil {
+		return err
+	}
+	p.events = append(p.events, event)
+	return nil
+}
+
+func TestOptionalJWT(t *testing.T) {
+	userID := uuid.New()
+	tests := []struct {
+		name     string
+		token    string
+		err      error
+		wantUser string
+	}{
+		{
+			name:     "Anonymous",
+			wantUser: "",
+		},
+		{
+			name:     "Invalid Token",
+			token:    "token",
+			err:      jwt.ErrInvalidToken,
+			wantUser: "",
+		},
+		{
+			name:     "Valid Token",
+			token:    "token",
+			wantUser: userID.String(),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			mw := NewAuthMiddleware([]byte("secret"))
+			injectDecoder(mw, &jwt.MockDecoder{DecodeClaimsFunc: func(token string) (jwt.Claims, error) {
+				return jwt.Claims{UserID: userID, Roles: []string{RoleAdmin}}, tc.err
+			}})
+
+			testHandler := mw.OptionalJWT(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get(UserIdHeader) != tc.wantUser {
+					t.Errorf("expected user %q, got %q", tc.wantUser, r.Header.Get(UserIdHeader))
+				}
+				if tc.wantUser == "" && HasRole(r, RoleAdmin) {
+					t.Error("anonymous requests must not have roles")
+				}
+				w.WriteHeader(http.StatusOK)
+			})
+
+			req := httptest.NewRequest("GET", "/", nil)
+			// headers sent by the client must be ignored
+			req.Header.Set(UserIdHeader, uuid.New().String())
+			req.Header.Set(UserRolesHeader, RoleAdmin)
+			if tc.token != "" {
+				req.Header.Set("Authorization", tc.token)
+			}
+			rec := httptest.NewRecorder()
+
+			testHandler.ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusOK {
+				t.Errorf("expected status %d, got %d", http.StatusOK, rec.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package auth
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// RevocationSubject is the NATS subject on which revoked token ids are shared
+// between the services.
+const RevocationSubject = "auth.revoked"
+
+// Revocation rejects a single token or, with a session id, every token of a
+// login until ExpiresAt.
+type Revocation struct {
+	TokenID   string    `json:"jti,omitempty"`
+	SessionID string    `json:"sid,omitempty"`
+	ExpiresAt time.Time `json:"exp"`
+}
+
+// Publisher sends messages to other services, it is implemented by *nats.Conn.
+type Publisher interface {
+	Publish(subject string, data []byte) error
+}
+
+// Revoke rejects the token or session with the given id until expiresAt.
+func (m *AuthMiddleware) Revoke(tokenID string, expiresAt time.Time) {
+	m.denylist.Add(tokenID, expiresAt)
+}
+
+// SubscribeRevocations keeps the denylist in sync with revocations published
+// by other services.
+func (m *AuthMiddleware) SubscribeRevocations(conn *nats.Conn) error {
+	_, err := conn.Subscribe(RevocationSubject, func(msg *nats.Msg) {
+		var revocation Revocation
+		if err := json.Unmarshal(msg.Data, &revocation); err != nil {
+			log.Println("Failed to decode revocation:", err)
+			return
+		}
+		if revocation.TokenID != "" {
+			m.Revoke(revocation.TokenID, revocation.ExpiresAt)
+		}
+		if revocation.SessionID != "" {
+			m.Revoke(revocation.SessionID, revocation.ExpiresAt)
+		}
+	})
+	return err
+}
+
+// PublishRevocation announces a revoked token to all subscribed services.
+func PublishRevocation(conn Publisher, revocation Revocation) error {
+	data, err := json.Marshal(revocation)
+	if err != nil {
+		return err
+	}
+	return conn.Publish(RevocationSubject, data)
+}
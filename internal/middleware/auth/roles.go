@@ -0,0 +1,57 @@
+package auth
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/audit"
+	"github.com/google/uuid"
+)
+
+const (
+	RoleUser      = "user"
+	RoleDriver    = "driver"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+var Roles = []string{RoleUser, RoleDriver, RoleModerator, RoleAdmin}
+
+func IsValidRole(role string) bool {
+	return slices.Contains(Roles, role)
+}
+
+// RequireRole only lets users through that have at least one of the given roles.
+// Admins are allowed everything and every authenticated user has the user role.
+func (m *AuthMiddleware) RequireRole(roles ...string) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return m.EnsureJWT(func(w http.ResponseWriter, r *http.Request) {
+			if !HasRole(r, roles...) {
+				userID, _ := uuid.Parse(r.Header.Get(UserIdHeader))
+				m.record(r, audit.Event{
+					Type:    audit.AccessDenied,
+					UserID:  userID,
+					Details: map[string]string{"required": strings.Join(roles, ",")},
+				})
+				http.Error(w, "Insufficient permissions", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// HasRole reports whether the user authenticated by EnsureJWT has one of the given roles.
+func HasRole(r *http.Request, roles ...string) bool {
+	granted := strings.Split(r.Header.Get(UserRolesHeader), ",")
+	if slices.Contains(granted, RoleAdmin) {
+		return true
+	}
+	for _, role := range roles {
+		if role == RoleUser || slices.Contains(granted, role) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,296 @@
+// Package notify describes how users want to hear about what happens on the
+// platform. The user service keeps the preferences, services that notify a
+// user on user.<id> or by email look them up first.
+package notify
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"time"
+	// quiet hours are evaluated in the time zone of the user
+	_ "time/tzdata"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// ChangedSubject carries the Preferences of a user whenever they change.
+	ChangedSubject = "user.preferences.changed"
+	// LookupSubject is requested with a user ID, it is answered with a Reply.
+	LookupSubject = "user.preferences"
+)
+
+// CacheTTL is how long a Lookup keeps preferences it requested. Changes are
+// applied right away, the TTL only covers lost change events.
+const CacheTTL = 5 * time.Minute
+
+type Category string
+
+const (
+	Chat      Category = "chat"
+	Booking   Category = "booking"
+	Payment   Category = "payment"
+	Tracking  Category = "tracking"
+	Marketing Category = "marketing"
+)
+
+var Categories = []Category{Chat, Booking, Payment, Tracking, Marketing}
+
+type Channel string
+
+const (
+	// InApp messages are sent over the WebSocket of the gateway.
+	InApp Channel = "inApp"
+	Email Channel = "email"
+)
+
+var (
+	ErrUnknownCategory   = errors.New("unknown category")
+	ErrInvalidQuietHours = errors.New("invalid quiet hours")
+)
+
+// Channels selects the channels of a category.
+type Channels struct {
+	InApp bool `bson:"inApp" json:"inApp"`
+	Email bool `bson:"email" json:"email"`
+}
+
+// QuietHours suppress emails between Start and End, given as 15:04 in the
+// time zone of the user. Emails are not sent later, they are dropped. An End
+// before Start spans midnight.
+type QuietHours struct {
+	Start    string `bson:"start"    json:"start"`
+	End      string `bson:"end"      json:"end"`
+	TimeZone string `bson:"timeZone" json:"timeZone"`
+}
+
+type Preferences struct {
+	UserID     uuid.UUID             `bson:"_id"                  json:"-"`
+	Categories map[Category]Channels `bson:"categories"           json:"categories"`
+	QuietHours *QuietHours           `bson:"quietHours,omitempty" json:"quietHours,omitempty"`
+	UpdatedAt  time.Time             `bson:"updatedAt"            json:"updatedAt"`
+}
+
+// Defaults are used until a user saved preferences: everything in the app,
+// emails only for bookings and payments and no marketing at all.
+func Defaults(userID uuid.UUID) Preferences {
+	return Preferences{
+		UserID: userID,
+		Categories: map[Category]Channels{
+			Chat:      {InApp: true},
+			Booking:   {InApp: true, Email: true},
+			Payment:   {InApp: true, Email: true},
+			Tracking:  {InApp: true},
+			Marketing: {},
+		},
+	}
+}
+
+// Subject is where in-app messages for the user are published.
+func Subject(userID uuid.UUID) string {
+	return "user." + userID.String()
+}
+
+// Validate checks the categories and quiet hours.
+func (p Preferences) Validate() error {
+	for category := range p.Categories {
+		if !slices.Contains(Categories, category) {
+			return fmt.Errorf("%w: %s", ErrUnknownCategory, category)
+		}
+	}
+	if p.QuietHours != nil {
+		if _, _, _, err := p.QuietHours.parse(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WithDefaults fills in the categories that are missing.
+func (p Preferences) WithDefaults() Preferences {
+	categories := Defaults(p.UserID).Categories
+	for category, channels := range p.Categories {
+		categories[category] = channels
+	}
+	p.Categories = categories
+	return p
+}
+
+// Allows reports whether the user wants to be notified about the category on
+// the channel at the given time.
+func (p Preferences) Allows(category Category, channel Channel, now time.Time) bool {
+	channels, ok := p.Categories[category]
+	if !ok {
+		channels = Defaults(p.UserID).Categories[category]
+	}
+	switch channel {
+	case InApp:
+		return channels.InApp
+	case Email:
+		return channels.Email && (p.QuietHours == nil || !p.QuietHours.Contains(now))
+	}
+	return false
+}
+
+// Contains reports whether the time is within the quiet hours. Invalid quiet
+// hours contain nothing.
+func (q QuietHours) Contains(now time.Time) bool {
+	start, end, location, err := q.parse()
+	if err != nil || start == end {
+		return false
+	}
+	local := now.In(location)
+	minute := local.Hour()*60 + local.Minute()
+	if start < end {
+		return minute >= start && minute < end
+	}
+	return minute >= start || minute < end
+}
+
+// parse returns start and end as minutes of the day.
+func (q QuietHours) parse() (int, int, *time.Location, error) {
+	start, err := time.Parse("15:04", q.Start)
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("%w: start %q", ErrInvalidQuietHours, q.Start)
+	}
+	end, err := time.Parse("15:04", q.End)
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("%w: end %q", ErrInvalidQuietHours, q.End)
+	}
+	location, err := time.LoadLocation(q.TimeZone)
+	if err != nil || q.TimeZone == "" {
+		return 0, 0, nil, fmt.Errorf("%w: time zone %q", ErrInvalidQuietHours, q.TimeZone)
+	}
+	return start.Hour()*60 + start.Minute(), end.Hour()*60 + end.Minute(), location, nil
+}
+
+type Reply struct {
+	Preferences Preferences `json:"preferences"`
+	Error       string      `json:"error,omitempty"`
+}
+
+// message is the wire format, the user ID is not part of the JSON of
+// Preferences.
+type message struct {
+	UserID uuid.UUID `json:"userId"`
+	Preferences
+}
+
+// Publisher sends events, it is implemented by *nats.Conn.
+type Publisher interface {
+	Publish(subject string, data []byte) error
+}
+
+// Publish announces the changed preferences of a user.
+func Publish(conn Publisher, preferences Preferences) error {
+	data, err := json.Marshal(message{UserID: preferences.UserID, Preferences: preferences})
+	if err != nil {
+		return err
+	}
+	return conn.Publish(ChangedSubject, data)
+}
+
+// Respond answers lookups with the preferences returned by get.
+func Respond(conn *nats.Conn, get func(uuid.UUID) (Preferences, error)) (*nats.Subscription, error) {
+	return conn.Subscribe(LookupSubject, func(msg *nats.Msg) {
+		var reply Reply
+		userID, err := uuid.ParseBytes(msg.Data)
+		if err == nil {
+			reply.Preferences, err = get(userID)
+		}
+		if err != nil {
+			log.Println("Failed to look up notification preferences:", err)
+			reply.Error = err.Error()
+		}
+
+		data, err := json.Marshal(reply)
+		if err != nil {
+			log.Println("Failed to encode notification preferences:", err)
+			return
+		}
+		if err := msg.Respond(data); err != nil {
+			log.Println("Failed to send notification preferences:", err)
+		}
+	})
+}
+
+// Lookup asks the user service for preferences and caches them.
+type Lookup struct {
+	conn    *nats.Conn
+	timeout time.Duration
+
+	mu    sync.Mutex
+	cache map[uuid.UUID]cached
+}
+
+type cached struct {
+	preferences Preferences
+	expiresAt   time.Time
+}
+
+// NewLookup subscribes to changes so cached preferences are replaced as soon
+// as the user saves new ones.
+func NewLookup(conn *nats.Conn, timeout time.Duration) (*Lookup, error) {
+	l := &Lookup{conn: conn, timeout: timeout, cache: make(map[uuid.UUID]cached)}
+	_, err := conn.Subscribe(ChangedSubject, func(msg *nats.Msg) {
+		var changed message
+		if err := json.Unmarshal(msg.Data, &changed); err != nil || changed.UserID == uuid.Nil {
+			log.Println("Failed to decode notification preferences:", err)
+			return
+		}
+		changed.Preferences.UserID = changed.UserID
+		l.store(changed.Preferences)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Get returns the preferences of the user. If the user service does not
+// answer the defaults are used, so notifications are not lost.
+func (l *Lookup) Get(userID uuid.UUID) Preferences {
+	l.mu.Lock()
+	entry, ok := l.cache[userID]
+	l.mu.Unlock()
+	if ok && time.Now().Before(entry.expiresAt) {
+		return entry.preferences
+	}
+
+	msg, err := l.conn.Request(LookupSubject, []byte(userID.String()), l.timeout)
+	if err != nil {
+		log.Printf("Failed to look up notification preferences of %s: %v", userID, err)
+		return Defaults(userID)
+	}
+	var reply Reply
+	if err := json.Unmarshal(msg.Data, &reply); err != nil || reply.Error != "" {
+		log.Printf("Failed to look up notification preferences of %s: %v %s", userID, err, reply.Error)
+		return Defaults(userID)
+	}
+	reply.Preferences.UserID = userID
+	l.store(reply.Preferences)
+	return reply.Preferences
+}
+
+// Allows reports whether the user wants to be notified about the category on
+// the channel now.
+func (l *Lookup) Allows(userID uuid.UUID, category Category, channel Channel) bool {
+	return l.Get(userID).Allows(category, channel, time.Now())
+}
+
+func (l *Lookup) store(preferences Preferences) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for userID, entry := range l.cache {
+		if now.After(entry.expiresAt) {
+			delete(l.cache, userID)
+		}
+	}
+	l.cache[preferences.UserID] = cached{preferences: preferences, expiresAt: now.Add(CacheTTL)}
+}
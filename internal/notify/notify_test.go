@@ -0,0 +1,98 @@
+package notify
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestQuietHours_Contains(t *testing.T) {
+	night := QuietHours{Start: "22:00", End: "07:00", TimeZone: "Europe/Berlin"}
+	lunch := QuietHours{Start: "12:00", End: "13:30", TimeZone: "UTC"}
+
+	tests := []struct {
+		name  string
+		quiet QuietHours
+		now   time.Time
+		want  bool
+	}{
+		{"before midnight", night, time.Date(2026, 1, 10, 21, 30, 0, 0, time.UTC), true},
+		{"after midnight", night, time.Date(2026, 1, 10, 5, 59, 0, 0, time.UTC), true},
+		{"end is exclusive", night, time.Date(2026, 1, 10, 6, 0, 0, 0, time.UTC), false},
+		{"daytime", night, time.Date(2026, 1, 10, 12, 0, 0, 0, time.UTC), false},
+		{"summer time", night, time.Date(2026, 7, 10, 20, 0, 0, 0, time.UTC), true},
+		{"within the day", lunch, time.Date(2026, 1, 10, 13, 0, 0, 0, time.UTC), true},
+		{"outside the day", lunch, time.Date(2026, 1, 10, 14, 0, 0, 0, time.UTC), false},
+		{"invalid", QuietHours{Start: "22:00", End: "07:00"}, time.Date(2026, 1, 10, 23, 0, 0, 0, time.UTC), false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.quiet.Contains(tc.now); got != tc.want {
+				t.Errorf("expected %v but got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestPreferences_Allows(t *testing.T) {
+	preferences := Preferences{
+		UserID: uuid.New(),
+		Categories: map[Category]Channels{
+			Chat:    {InApp: false, Email: true},
+			Booking: {InApp: true, Email: true},
+		},
+		QuietHours: &QuietHours{Start: "22:00", End: "07:00", TimeZone: "UTC"},
+	}
+	day := time.Date(2026, 1, 10, 12, 0, 0, 0, time.UTC)
+	night := time.Date(2026, 1, 10, 23, 0, 0, 0, time.UTC)
+
+	if preferences.Allows(Chat, InApp, day) || !preferences.Allows(Chat, Email, day) {
+		t.Errorf("expected the chosen channels of chat")
+	}
+	if !preferences.Allows(Booking, Email, day) || preferences.Allows(Booking, Email, night) {
+		t.Errorf("expected emails to be held back during quiet hours")
+	}
+	if !preferences.Allows(Booking, InApp, night) {
+		t.Errorf("expected in-app messages during quiet hours")
+	}
+	// missing categories fall back to the defaults
+	if !preferences.Allows(Tracking, InApp, day) || preferences.Allows(Marketing, Email, day) {
+		t.Errorf("expected the defaults for missing categories")
+	}
+}
+
+func TestPreferences_Validate(t *testing.T) {
+	valid := Defaults(uuid.New())
+	valid.QuietHours = &QuietHours{Start: "22:00", End: "07:00", TimeZone: "Europe/Berlin"}
+	if err := valid.Validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	unknown := Preferences{Categories: map[Category]Channels{"spam": {}}}
+	if err := unknown.Validate(); !errors.Is(err, ErrUnknownCategory) {
+		t.Errorf("expected unknown category but got: %v", err)
+	}
+	for _, quiet := range []QuietHours{
+		{Start: "25:00", End: "07:00", TimeZone: "UTC"},
+		{Start: "22:00", End: "7", TimeZone: "UTC"},
+		{Start: "22:00", End: "07:00", TimeZone: "Mars/Olympus"},
+		{Start: "22:00", End: "07:00"},
+	} {
+		invalid := Preferences{QuietHours: &quiet}
+		if err := invalid.Validate(); !errors.Is(err, ErrInvalidQuietHours) {
+			t.Errorf("%+v: expected invalid quiet hours but got: %v", quiet, err)
+		}
+	}
+}
+
+func TestPreferences_WithDefaults(t *testing.T) {
+	preferences := Preferences{Categories: map[Category]Channels{Marketing: {Email: true}}}.WithDefaults()
+	if len(preferences.Categories) != len(Categories) {
+		t.Errorf("expected all categories but got %v", preferences.Categories)
+	}
+	if !preferences.Categories[Marketing].Email || !preferences.Categories[Chat].InApp {
+		t.Errorf("expected the chosen channels and the defaults: %v", preferences.Categories)
+	}
+}
@@ -0,0 +1,84 @@
+package oidc
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+)
+
+// JWK is a public signing key as published by a provider.
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// RSAJWK returns the jwk of an rsa public key.
+func RSAJWK(kid string, key *rsa.PublicKey) JWK {
+	return JWK{
+		Kty: "RSA",
+		Kid: kid,
+		Use: "sig",
+		Alg: "RS256",
+		N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+func parseJWK(raw json.RawMessage) (string, any, error) {
+	var jwk JWK
+	if err := json.Unmarshal(raw, &jwk); err != nil {
+		return "", nil, err
+	}
+	if jwk.Use != "" && jwk.Use != "sig" {
+		return "", nil, errors.New("no signing key")
+	}
+	decode := func(value string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(value)
+		if err != nil || len(b) == 0 {
+			return nil, errors.New("invalid key parameter")
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decode(jwk.N)
+		if err != nil {
+			return "", nil, err
+		}
+		e, err := decode(jwk.E)
+		if err != nil || !e.IsInt64() {
+			return "", nil, errors.New("invalid exponent")
+		}
+		return jwk.Kid, &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if jwk.Crv != "P-256" {
+			return "", nil, errors.New("unsupported curve")
+		}
+		x, err := decode(jwk.X)
+		if err != nil {
+			return "", nil, err
+		}
+		y, err := decode(jwk.Y)
+		if err != nil {
+			return "", nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+		if !key.Curve.IsOnCurve(x, y) {
+			return "", nil, errors.New("invalid point")
+		}
+		return jwk.Kid, key, nil
+	}
+	return "", nil, errors.New("unsupported key type")
+}
@@ -0,0 +1,277 @@
+// Package oidc implements the relying party side of the OpenID Connect
+// authorization code flow with PKCE.
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var (
+	ErrDiscovery      = errors.New("oidc discovery failed")
+	ErrExchange       = errors.New("oidc code exchange failed")
+	ErrInvalidIDToken = errors.New("invalid id token")
+)
+
+// Config describes a provider. The endpoints are discovered from the issuer.
+type Config struct {
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+}
+
+// Claims are the claims of an id token used to identify the user.
+type Claims struct {
+	Subject       string `json:"sub"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	GivenName     string `json:"given_name"`
+	FamilyName    string `json:"family_name"`
+	Picture       string `json:"picture"`
+	Nonce         string `json:"nonce"`
+}
+
+type idTokenClaims struct {
+	jwt.RegisteredClaims
+	Email         string `json:"email"`
+	EmailVerified any    `json:"email_verified"`
+	GivenName     string `json:"given_name"`
+	FamilyName    string `json:"family_name"`
+	Picture       string `json:"picture"`
+	Nonce         string `json:"nonce"`
+}
+
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Provider talks to one OpenID provider. The discovery document and the keys
+// are fetched on first use and cached.
+type Provider struct {
+	config Config
+	client *http.Client
+
+	mu        sync.Mutex
+	endpoints *discovery
+	keys      map[string]any
+}
+
+func NewProvider(config Config) *Provider {
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{"openid", "email", "profile"}
+	}
+	config.Issuer = strings.TrimSuffix(config.Issuer, "/")
+	return &Provider{config: config, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (p *Provider) Name() string {
+	return p.config.Name
+}
+
+// NewVerifier returns a random PKCE code verifier.
+func NewVerifier() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Challenge returns the S256 code challenge of a verifier.
+func Challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// AuthCodeURL returns the url the user is sent to for logging in at the
+// provider.
+func (p *Provider) AuthCodeURL(ctx context.Context, state, nonce, verifier string) (string, error) {
+	endpoints, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.config.ClientID},
+		"redirect_uri":          {p.config.RedirectURL},
+		"scope":                 {strings.Join(p.config.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {Challenge(verifier)},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(endpoints.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return endpoints.AuthorizationEndpoint + separator + query.Encode(), nil
+}
+
+// Exchange redeems the authorization code and returns the verified claims of
+// the id token. The nonce has to be the one sent with AuthCodeURL.
+func (p *Provider) Exchange(ctx context.Context, code, verifier, nonce string) (Claims, error) {
+	endpoints, err := p.discover(ctx)
+	if err != nil {
+		return Claims{}, err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.config.RedirectURL},
+		"client_id":     {p.config.ClientID},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoints.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return Claims{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.config.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return Claims{}, fmt.Errorf("%w: %v", ErrExchange, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return Claims{}, fmt.Errorf("%w: status code %d", ErrExchange, resp.StatusCode)
+	}
+	var token struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil || token.IDToken == "" {
+		return Claims{}, fmt.Errorf("%w: no id token", ErrExchange)
+	}
+	return p.Verify(ctx, token.IDToken, nonce)
+}
+
+// Verify checks the signature, issuer, audience, expiry and nonce of an id
+// token.
+func (p *Provider) Verify(ctx context.Context, rawIDToken, nonce string) (Claims, error) {
+	endpoints, err := p.discover(ctx)
+	if err != nil {
+		return Claims{}, err
+	}
+	var claims idTokenClaims
+	_, err = jwt.ParseWithClaims(rawIDToken, &claims, func(token *jwt.Token) (any, error) {
+		kid, _ := token.Header["kid"].(string)
+		return p.key(ctx, kid)
+	},
+		jwt.WithValidMethods([]string{"RS256", "ES256"}),
+		jwt.WithIssuer(endpoints.Issuer),
+		jwt.WithAudience(p.config.ClientID),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return Claims{}, fmt.Errorf("%w: %v", ErrInvalidIDToken, err)
+	}
+	if claims.Subject == "" || claims.Nonce != nonce {
+		return Claims{}, ErrInvalidIDToken
+	}
+
+	// some providers send the flag as a string
+	verified := false
+	switch value := claims.EmailVerified.(type) {
+	case bool:
+		verified = value
+	case string:
+		verified = value == "true"
+	}
+	return Claims{
+		Subject:       claims.Subject,
+		Email:         strings.ToLower(strings.TrimSpace(claims.Email)),
+		EmailVerified: verified,
+		GivenName:     claims.GivenName,
+		FamilyName:    claims.FamilyName,
+		Picture:       claims.Picture,
+		Nonce:         claims.Nonce,
+	}, nil
+}
+
+func (p *Provider) discover(ctx context.Context) (*discovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.endpoints != nil {
+		return p.endpoints, nil
+	}
+
+	var endpoints discovery
+	if err := p.getJSON(ctx, p.config.Issuer+"/.well-known/openid-configuration", &endpoints); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDiscovery, err)
+	}
+	if strings.TrimSuffix(endpoints.Issuer, "/") != p.config.Issuer {
+		return nil, fmt.Errorf("%w: issuer %q does not match", ErrDiscovery, endpoints.Issuer)
+	}
+	if endpoints.AuthorizationEndpoint == "" || endpoints.TokenEndpoint == "" || endpoints.JWKSURI == "" {
+		return nil, fmt.Errorf("%w: endpoints missing", ErrDiscovery)
+	}
+	p.endpoints = &endpoints
+	return p.endpoints, nil
+}
+
+// key returns the signing key with the id, the keys are fetched again if it
+// is unknown because the provider may have rotated them.
+func (p *Provider) key(ctx context.Context, kid string) (any, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+
+	var set struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+	if err := p.getJSON(ctx, p.endpoints.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]any, len(set.Keys))
+	for _, raw := range set.Keys {
+		id, key, err := parseJWK(raw)
+		if err != nil {
+			continue
+		}
+		keys[id] = key
+	}
+	p.keys = keys
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown key %q", kid)
+}
+
+func (p *Provider) getJSON(ctx context.Context, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("status code %d", resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,226 @@
+// Package oidctest provides an in-process OpenID provider for tests. It
+// logs in a configurable user without asking and implements just enough of
+// the authorization code flow with PKCE for the relying party in package oidc.
+package oidctest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/Konzepte-moderner-Softwareentwicklung/Backend/internal/oidc"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const keyID = "test-key"
+
+// User is the account that is logged in at the provider.
+type User struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	GivenName     string
+	FamilyName    string
+}
+
+type grant struct {
+	user        User
+	clientID    string
+	redirectURI string
+	challenge   string
+	nonce       string
+}
+
+type IdP struct {
+	*httptest.Server
+	ClientID string
+
+	key   *rsa.PrivateKey
+	mu    sync.Mutex
+	user  User
+	codes map[string]grant
+}
+
+// New starts a provider that accepts the client id. Close it when done.
+func New(clientID string) *IdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	idp := &IdP{ClientID: clientID, key: key, codes: make(map[string]grant)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", idp.handleDiscovery)
+	mux.HandleFunc("/authorize", idp.handleAuthorize)
+	mux.HandleFunc("/token", idp.handleToken)
+	mux.HandleFunc("/jwks", idp.handleJWKS)
+	idp.Server = httptest.NewServer(mux)
+	return idp
+}
+
+// Issuer is the issuer url to configure the relying party with.
+func (idp *IdP) Issuer() string {
+	return idp.URL
+}
+
+// SetUser changes the account that is logged in at the provider.
+func (idp *IdP) SetUser(user User) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.user = user
+}
+
+// Authorize opens an authorization url like a browser would and returns the
+// code and state of the redirect back to the relying party.
+func (idp *IdP) Authorize(authURL string) (code string, state string, err error) {
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(authURL)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		return "", "", fmt.Errorf("authorization failed with status code %d", resp.StatusCode)
+	}
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		return "", "", err
+	}
+	return location.Query().Get("code"), location.Query().Get("state"), nil
+}
+
+func (idp *IdP) handleDiscovery(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"issuer":                                idp.URL,
+		"authorization_endpoint":                idp.URL + "/authorize",
+		"token_endpoint":                        idp.URL + "/token",
+		"jwks_uri":                              idp.URL + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+	})
+}
+
+func (idp *IdP) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"keys": []oidc.JWK{oidc.RSAJWK(keyID, &idp.key.PublicKey)},
+	})
+}
+
+func (idp *IdP) handleAuthorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	redirectURI, err := url.Parse(query.Get("redirect_uri"))
+	switch {
+	case err != nil || !redirectURI.IsAbs():
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	case query.Get("client_id") != idp.ClientID:
+		http.Error(w, "unknown client", http.StatusBadRequest)
+		return
+	case query.Get("response_type") != "code" || query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "":
+		http.Error(w, "authorization code flow with S256 required", http.StatusBadRequest)
+		return
+	}
+
+	code := randomString()
+	idp.mu.Lock()
+	idp.codes[code] = grant{
+		user:        idp.user,
+		clientID:    idp.ClientID,
+		redirectURI: redirectURI.String(),
+		challenge:   query.Get("code_challenge"),
+		nonce:       query.Get("nonce"),
+	}
+	idp.mu.Unlock()
+
+	values := redirectURI.Query()
+	values.Set("code", code)
+	values.Set("state", query.Get("state"))
+	redirectURI.RawQuery = values.Encode()
+	http.Redirect(w, r, redirectURI.String(), http.StatusFound)
+}
+
+func (idp *IdP) handleToken(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil || r.PostForm.Get("grant_type") != "authorization_code" {
+		tokenError(w, "unsupported_grant_type")
+		return
+	}
+	code := r.PostForm.Get("code")
+	idp.mu.Lock()
+	grant, ok := idp.codes[code]
+	// codes can only be redeemed once
+	delete(idp.codes, code)
+	idp.mu.Unlock()
+
+	clientID := r.PostForm.Get("client_id")
+	if user, _, ok := r.BasicAuth(); ok {
+		clientID, _ = url.QueryUnescape(user)
+	}
+	switch {
+	case !ok, grant.redirectURI != r.PostForm.Get("redirect_uri"), grant.clientID != clientID:
+		tokenError(w, "invalid_grant")
+		return
+	case oidc.Challenge(r.PostForm.Get("code_verifier")) != grant.challenge:
+		tokenError(w, "invalid_grant")
+		return
+	}
+
+	idToken, err := idp.idToken(grant)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"access_token": randomString(),
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     idToken,
+	})
+}
+
+func (idp *IdP) idToken(grant grant) (string, error) {
+	if grant.user.Subject == "" {
+		return "", errors.New("no user logged in")
+	}
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":            idp.URL,
+		"sub":            grant.user.Subject,
+		"aud":            grant.clientID,
+		"iat":            now.Unix(),
+		"exp":            now.Add(5 * time.Minute).Unix(),
+		"nonce":          grant.nonce,
+		"email":          grant.user.Email,
+		"email_verified": grant.user.EmailVerified,
+		"given_name":     grant.user.GivenName,
+		"family_name":    grant.user.FamilyName,
+	})
+	token.Header["kid"] = keyID
+	return token.SignedString(idp.key)
+}
+
+func tokenError(w http.ResponseWriter, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": code})
+}
+
+func randomString() string {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
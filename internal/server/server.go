@@ -2,6 +2,7 @@ package server
 
 import (
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"time"
@@ -123,6 +124,19 @@ func GetScheme(r *http.Request) string {
 	return "http"
 }
 
+// ClientIP returns the address of the client. nginx passes it on as X-Real-IP,
+// which it always overwrites, so unlike X-Forwarded-For it can not be spoofed.
+func ClientIP(r *http.Request) string {
+	if ip := r.Header.Get("X-Real-IP"); ip != "" {
+		return ip
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
 func (s *Server) ListenAndServe() {
 	s.log.Print("Server started on port ", s.port)
 	s.log.Error().AnErr("startup", http.ListenAndServe(fmt.Sprintf(":%d", s.port), s.Router))
@@ -0,0 +1,100 @@
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Parameters of RFC 6238 as expected by common authenticator apps.
+const (
+	Period = 30 * time.Second
+	Digits = 6
+	// Skew is the number of periods a code may be early or late.
+	Skew = 1
+
+	secretBytes = 20
+)
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateSecret returns a new random base32 encoded secret.
+func GenerateSecret() (string, error) {
+	buf := make([]byte, secretBytes)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return encoding.EncodeToString(buf), nil
+}
+
+// URI returns the otpauth:// URI which authenticator apps read from a QR code.
+func URI(issuer, account, secret string) string {
+	label := url.PathEscape(issuer + ":" + account)
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(Digits))
+	query.Set("period", fmt.Sprint(int(Period.Seconds())))
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+// Step returns the time step a point in time belongs to.
+func Step(t time.Time) int64 {
+	return t.Unix() / int64(Period.Seconds())
+}
+
+// Code returns the code for the given time.
+func Code(secret string, t time.Time) (string, error) {
+	return codeForStep(secret, Step(t))
+}
+
+// Validate checks a code against the steps around t. It returns the matching
+// step so callers can reject a code that has already been used.
+func Validate(secret, code string, t time.Time) (int64, bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != Digits {
+		return 0, false
+	}
+	now := Step(t)
+	for step := now - Skew; step <= now+Skew; step++ {
+		expected, err := codeForStep(secret, step)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+func codeForStep(secret string, step int64) (string, error) {
+	key, err := encoding.DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+	if err != nil {
+		return "", err
+	}
+
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	// dynamic truncation, RFC 4226 section 5.3
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < Digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", Digits, value%mod), nil
+}
@@ -0,0 +1,68 @@
+package totp
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+)
+
+// test vectors from RFC 6238 appendix B, truncated to six digits
+func TestCode(t *testing.T) {
+	secret := base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+	cases := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, c := range cases {
+		got, err := Code(secret, time.Unix(c.unix, 0))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got != c.code {
+			t.Errorf("expected %s at %d but got %s", c.code, c.unix, got)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	now := time.Now()
+	code, err := Code(secret, now)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	step, ok := Validate(secret, code, now)
+	if !ok || step != Step(now) {
+		t.Errorf("expected code to be valid for step %d but got %d %v", Step(now), step, ok)
+	}
+	if _, ok := Validate(secret, code, now.Add(Period)); !ok {
+		t.Errorf("code of the previous period should be accepted")
+	}
+	if _, ok := Validate(secret, code, now.Add(3*Period)); ok {
+		t.Errorf("old codes should be rejected")
+	}
+	if _, ok := Validate(secret, "12345", now); ok {
+		t.Errorf("codes with the wrong length should be rejected")
+	}
+}
+
+func TestURI(t *testing.T) {
+	uri := URI("MyCargonaut", "max@example.com", "ABC")
+	if !strings.HasPrefix(uri, "otpauth://totp/MyCargonaut:max@example.com?") {
+		t.Errorf("unexpected uri: %s", uri)
+	}
+	if !strings.Contains(uri, "secret=ABC") || !strings.Contains(uri, "issuer=MyCargonaut") {
+		t.Errorf("uri is missing parameters: %s", uri)
+	}
+}
@@ -0,0 +1,67 @@
+package userclient
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+var ErrVehicleNotFound = errors.New("vehicle not found")
+
+// Dimensions of a trunk in centimeters.
+type Dimensions struct {
+	Width  float64 `json:"width"`
+	Height float64 `json:"height"`
+	Depth  float64 `json:"depth"`
+}
+
+// Vehicle is the public view of a vehicle registered in the user service.
+// Seats are the seats available for passengers.
+type Vehicle struct {
+	ID         uuid.UUID  `json:"id"`
+	OwnerID    uuid.UUID  `json:"ownerId"`
+	Make       string     `json:"make"`
+	Model      string     `json:"model"`
+	Seats      int        `json:"seats"`
+	Trunk      Dimensions `json:"trunk"`
+	MaxPayload int        `json:"maxPayload"`
+	Features   []string   `json:"features"`
+}
+
+type UserClient string
+
+func NewUserClient(url string) *UserClient {
+	client := UserClient(url)
+	return &client
+}
+
+// GetVehicle returns the public view of a vehicle, without its plate.
+func (c *UserClient) GetVehicle(vehicleID uuid.UUID) (*Vehicle, error) {
+	req, err := http.NewRequest(http.MethodGet, string(*c)+"/vehicles/"+vehicleID.String(), bytes.NewBuffer(nil))
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrVehicleNotFound
+	}
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("failed to get vehicle, status code: %d", resp.StatusCode)
+	}
+
+	var vehicle Vehicle
+	if err := json.NewDecoder(resp.Body).Decode(&vehicle); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	return &vehicle, nil
+}